@@ -0,0 +1,1120 @@
+package cmd
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// AAREntry is a file in an aar.
+type AAREntry struct {
+	Name string
+	Size int64 // uncompressed size in bytes
+}
+
+// AARChange is a file present in two aars with different contents.
+type AARChange struct {
+	Name    string
+	OldSize int64
+	NewSize int64
+}
+
+// AARDiff lists the entries that differ between two aars, sorted by name.
+type AARDiff struct {
+	Added   []AAREntry
+	Removed []AAREntry
+	Changed []AARChange
+}
+
+// Empty reports whether the two aars have identical entries.
+func (d *AARDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// String formats the diff with one entry per line, prefixed by + for added,
+// - for removed and ~ for changed entries.
+func (d *AARDiff) String() string {
+	buf := &bytes.Buffer{}
+	for _, i := range d.Added {
+		fmt.Fprintf(buf, "+ %s (%d bytes)\n", i.Name, i.Size)
+	}
+	for _, i := range d.Removed {
+		fmt.Fprintf(buf, "- %s (%d bytes)\n", i.Name, i.Size)
+	}
+	for _, i := range d.Changed {
+		fmt.Fprintf(buf, "~ %s (%d -> %d bytes, %+d)\n", i.Name, i.OldSize, i.NewSize, i.NewSize-i.OldSize)
+	}
+	return buf.String()
+}
+
+// DiffAAR compares the entries of the aars at paths a and b.
+func DiffAAR(a, b string) (*AARDiff, error) {
+	ra, err := zip.OpenReader(a)
+	if err != nil {
+		return nil, err
+	}
+	defer ra.Close()
+
+	rb, err := zip.OpenReader(b)
+	if err != nil {
+		return nil, err
+	}
+	defer rb.Close()
+
+	before := map[string]*zip.File{}
+	for _, i := range ra.File {
+		before[i.Name] = i
+	}
+	after := map[string]*zip.File{}
+	for _, i := range rb.File {
+		after[i.Name] = i
+	}
+
+	d := &AARDiff{}
+	for name, i := range after {
+		o, ok := before[name]
+		if !ok {
+			d.Added = append(d.Added, AAREntry{Name: name, Size: int64(i.UncompressedSize64)})
+		} else if o.CRC32 != i.CRC32 || o.UncompressedSize64 != i.UncompressedSize64 {
+			d.Changed = append(d.Changed, AARChange{Name: name, OldSize: int64(o.UncompressedSize64), NewSize: int64(i.UncompressedSize64)})
+		}
+	}
+	for name, o := range before {
+		if _, ok := after[name]; !ok {
+			d.Removed = append(d.Removed, AAREntry{Name: name, Size: int64(o.UncompressedSize64)})
+		}
+	}
+
+	sort.Slice(d.Added, func(i, j int) bool { return d.Added[i].Name < d.Added[j].Name })
+	sort.Slice(d.Removed, func(i, j int) bool { return d.Removed[i].Name < d.Removed[j].Name })
+	sort.Slice(d.Changed, func(i, j int) bool { return d.Changed[i].Name < d.Changed[j].Name })
+	return d, nil
+}
+
+// VerifyAARAgainstGolden returns an error listing the differences between the
+// entries of the aar at aarPath and the golden file at goldenPath, which lists
+// the expected entries one per line. Blank lines and lines starting with #
+// are ignored, and a line may use the wildcards of path.Match to stand for
+// variable parts, e.g. jni/*/libgojni.so. Entries matching no line are
+// reported as added, and lines matching no entry as removed.
+func VerifyAARAgainstGolden(aarPath, goldenPath string) error {
+	data, err := ioutil.ReadFile(goldenPath)
+	if err != nil {
+		return err
+	}
+	patterns := []string{}
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, err := path.Match(line, ""); err != nil {
+			return fmt.Errorf("%s:%d: invalid pattern %q: %v", goldenPath, n+1, line, err)
+		}
+		patterns = append(patterns, line)
+	}
+
+	r, err := zip.OpenReader(aarPath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	matched := make([]bool, len(patterns))
+	added := []string{}
+	for _, file := range r.File {
+		found := false
+		for i, pattern := range patterns {
+			if ok, _ := path.Match(pattern, file.Name); ok {
+				matched[i] = true
+				found = true
+			}
+		}
+		if !found {
+			added = append(added, file.Name)
+		}
+	}
+	removed := []string{}
+	for i, pattern := range patterns {
+		if !matched[i] {
+			removed = append(removed, pattern)
+		}
+	}
+	if len(added) == 0 && len(removed) == 0 {
+		return nil
+	}
+
+	sort.Strings(added)
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "%s does not match %s:", aarPath, goldenPath)
+	for _, i := range added {
+		fmt.Fprintf(buf, "\n+ %s", i)
+	}
+	for _, i := range removed {
+		fmt.Fprintf(buf, "\n- %s", i)
+	}
+	return errors.New(buf.String())
+}
+
+// AARABIs returns the sorted ABIs with native libraries under jni/ in the
+// aar at path.
+func AARABIs(path string) ([]string, error) {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	seen := map[string]bool{}
+	abis := []string{}
+	for _, i := range r.File {
+		parts := strings.SplitN(i.Name, "/", 3)
+		if len(parts) != 3 || parts[0] != "jni" || parts[1] == "" || parts[2] == "" || strings.HasSuffix(i.Name, "/") {
+			continue
+		}
+		if !seen[parts[1]] {
+			seen[parts[1]] = true
+			abis = append(abis, parts[1])
+		}
+	}
+	sort.Strings(abis)
+	return abis, nil
+}
+
+// ReadAARManifest returns the AndroidManifest.xml of the aar at path with a
+// trailing newline. It is returned as written rather than reindented, since
+// encoding/xml does not preserve namespace prefixes such as android:.
+func ReadAARManifest(path string) (string, error) {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	for _, i := range r.File {
+		if i.Name != "AndroidManifest.xml" {
+			continue
+		}
+		data, err := readZipFile(i)
+		if err != nil {
+			return "", err
+		}
+		if !utf8.Valid(data) {
+			return "", fmt.Errorf("%s: AndroidManifest.xml is not text, it may be compiled binary XML", path)
+		}
+		manifest := strings.Replace(string(data), "\r\n", "\n", -1)
+		if !strings.HasSuffix(manifest, "\n") {
+			manifest += "\n"
+		}
+		return manifest, nil
+	}
+	return "", fmt.Errorf("%s: no AndroidManifest.xml", path)
+}
+
+// aarMetadataName is the entry holding the aar metadata read by version 7
+// and later of the Android Gradle plugin.
+const aarMetadataName = "META-INF/com/android/build/gradle/aar-metadata.properties"
+
+// aarMetadata returns the contents of the aar metadata expected by version
+// agpVersion of the Android Gradle plugin, e.g. 7.4.2, or "" if agpVersion is
+// unset or older than 7.0, which do not read it. compileSdk and
+// compileSdkExt, the API level and SDK extension level of the platform the
+// library was compiled against, are the lowest an app depending on it may
+// compile against. A compileSdk of 0 sets no minimum.
+func aarMetadata(agpVersion string, compileSdk, compileSdkExt int) (string, error) {
+	if agpVersion == "" {
+		return "", nil
+	}
+	ver := parseBuildToolsVersion(agpVersion)
+	if len(ver) < 2 {
+		return "", fmt.Errorf("invalid Android Gradle plugin version %q, e.g. 7.4.2", agpVersion)
+	}
+	if versionLess(ver, []int{7, 0}) {
+		return "", nil
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteString("aarFormatVersion=1.0\n")
+	buf.WriteString("aarMetadataVersion=1.0\n")
+	if compileSdk < 1 {
+		compileSdk = 1
+	}
+	fmt.Fprintf(buf, "minCompileSdk=%d\n", compileSdk)
+	if !versionLess(ver, []int{7, 3}) {
+		buf.WriteString("minAndroidGradlePluginVersion=1.0.0\n")
+	}
+	if !versionLess(ver, []int{8, 1}) {
+		fmt.Fprintf(buf, "minCompileSdkExtension=%d\n", compileSdkExt)
+	}
+	return buf.String(), nil
+}
+
+// archiveComment returns the zip comment of the aar, f.ArchiveComment or, if
+// it is unset, the version of matcha that built it and the time it was built.
+// The time is left out of reproducible builds.
+func archiveComment(f *Flags) string {
+	if f.ArchiveComment != "" {
+		return f.ArchiveComment
+	}
+	comment := "Built by matcha " + matchaVersion()
+	if !f.Reproducible {
+		comment += " at " + time.Now().UTC().Format(time.RFC3339)
+	}
+	return comment
+}
+
+// NativeAARPath returns the path of the aar holding the native libraries for
+// abi that SplitNativeAAR writes next to aarPath.
+func NativeAARPath(aarPath, abi string) string {
+	return strings.TrimSuffix(aarPath, ".aar") + "-native-" + abi + ".aar"
+}
+
+// SplitNativeAAR rewrites the aar at aarPath without its native libraries,
+// as an api aar with the classes, manifest and resources, and moves the
+// libraries of each of abis to their own aar at NativeAARPath. An app depends
+// on the api aar and the native aars of the ABIs it ships. The api aar lists
+// the native aars in matcha-native.properties, and each native aar has a
+// manifest package derived from the api aar's.
+func SplitNativeAAR(f *Flags, aarPath string, abis []string) error {
+	if f.BuildMode == "c-archive" {
+		return errors.New("split native aars need c-shared libraries")
+	}
+	if f.ShouldPrint() {
+		f.Logger.Printf("split %s %s\n", aarPath, strings.Join(abis, " "))
+	}
+	if !f.ShouldRun() {
+		return nil
+	}
+
+	// The aar is closed by splitNativeAAR before it is replaced.
+	tmpPath := aarPath + ".tmp"
+	if err := splitNativeAAR(f, aarPath, tmpPath, abis); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, aarPath)
+}
+
+// splitNativeAAR writes the native aars of abis split from the aar at
+// aarPath, and the api aar that replaces it to tmpPath.
+func splitNativeAAR(f *Flags, aarPath, tmpPath string, abis []string) error {
+	r, err := zip.OpenReader(aarPath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	pkg := ""
+	native := map[string][]*zip.File{}
+	for _, abi := range abis {
+		native[abi] = nil
+	}
+	for _, file := range r.File {
+		if file.Name == "AndroidManifest.xml" {
+			data, err := readZipFile(file)
+			if err != nil {
+				return err
+			}
+			m := struct {
+				Package string `xml:"package,attr"`
+			}{}
+			if err := xml.Unmarshal(data, &m); err != nil {
+				return fmt.Errorf("%s: parsing AndroidManifest.xml: %v", aarPath, err)
+			}
+			pkg = m.Package
+		}
+		if !strings.HasPrefix(file.Name, "jni/") || strings.HasSuffix(file.Name, "/") {
+			continue
+		}
+		abi := strings.SplitN(strings.TrimPrefix(file.Name, "jni/"), "/", 2)[0]
+		if _, ok := native[abi]; !ok {
+			return fmt.Errorf("%s: %s is not one of the ABIs being split", aarPath, file.Name)
+		}
+		native[abi] = append(native[abi], file)
+	}
+	if pkg == "" {
+		return fmt.Errorf("%s: AndroidManifest.xml has no package", aarPath)
+	}
+
+	minSDK, err := androidMinSDK(f)
+	if err != nil {
+		return err
+	}
+	const manifestFmt = `<manifest xmlns:android="http://schemas.android.com/apk/res/android" package=%q>
+%s</manifest>`
+	props := &bytes.Buffer{}
+	for _, abi := range abis {
+		nativePath := NativeAARPath(aarPath, abi)
+		fmt.Fprintf(props, "native.%s=%s\n", abi, filepath.Base(nativePath))
+
+		manifest := fmt.Sprintf(manifestFmt, pkg+".native_"+strings.Replace(abi, "-", "_", -1), usesSDKElement(minSDK, f.TargetSDK))
+		err := writeAARFile(nativePath, func(aarw *zip.Writer) error {
+			if err := writeManifestOnlyEntries(f, aarw, manifest); err != nil {
+				return err
+			}
+			return copyZipFiles(aarw, native[abi])
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	api := []*zip.File{}
+	for _, file := range r.File {
+		if !strings.HasPrefix(file.Name, "jni/") {
+			api = append(api, file)
+		}
+	}
+	return writeAARFile(tmpPath, func(aarw *zip.Writer) error {
+		if err := aarw.SetComment(r.Comment); err != nil {
+			return err
+		}
+		if err := copyZipFiles(aarw, api); err != nil {
+			return err
+		}
+		w, err := aarw.Create("matcha-native.properties")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(props.Bytes())
+		return err
+	})
+}
+
+// writeAARFile creates an aar at path with the entries written by write. The
+// file is removed if write fails.
+func writeAARFile(path string, write func(aarw *zip.Writer) error) (err error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+
+	aarw := zip.NewWriter(file)
+	if err := write(aarw); err != nil {
+		return err
+	}
+	return aarw.Close()
+}
+
+// copyZipFiles copies files, with their headers, to w.
+func copyZipFiles(w *zip.Writer, files []*zip.File) error {
+	for _, file := range files {
+		fh := file.FileHeader
+		fw, err := w.CreateHeader(&fh)
+		if err != nil {
+			return err
+		}
+		fr, err := file.Open()
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(fw, fr)
+		fr.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// aarDep is a dependency aar that is merged into the aar built by BuildAAR.
+type aarDep struct {
+	path string
+	name string // file name without the .aar extension
+	r    *zip.ReadCloser
+}
+
+// openAARDeps opens the aars at paths. The caller must close the returned
+// dependencies with closeAARDeps.
+func openAARDeps(paths []string) ([]*aarDep, error) {
+	deps := []*aarDep{}
+	names := map[string]string{}
+	for _, i := range paths {
+		name := strings.TrimSuffix(filepath.Base(i), ".aar")
+		if orig, ok := names[name]; ok {
+			closeAARDeps(deps)
+			return nil, fmt.Errorf("aar dependencies %s and %s have the same name", orig, i)
+		}
+		names[name] = i
+
+		r, err := zip.OpenReader(i)
+		if err != nil {
+			closeAARDeps(deps)
+			return nil, err
+		}
+		deps = append(deps, &aarDep{path: i, name: name, r: r})
+	}
+	return deps, nil
+}
+
+func closeAARDeps(deps []*aarDep) {
+	for _, i := range deps {
+		i.r.Close()
+	}
+}
+
+// aarManifest is an AndroidManifest.xml of a dependency aar.
+type aarManifest struct {
+	Package string         `xml:"package,attr"`
+	Nodes   []manifestNode `xml:",any"`
+}
+
+// manifestNode is an element of an AndroidManifest.xml with its attributes
+// and child elements.
+type manifestNode struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr     `xml:",any,attr"`
+	Nodes   []manifestNode `xml:",any"`
+}
+
+const (
+	androidNamespace = "http://schemas.android.com/apk/res/android"
+	toolsNamespace   = "http://schemas.android.com/tools"
+)
+
+// aarDepManifestElements are the children of <manifest> that are merged from
+// dependency aars. uses-sdk is left out, as the aar declares its own, and
+// the children of <application> are merged into an <application> element.
+var aarDepManifestElements = map[string]bool{
+	"uses-permission":        true,
+	"uses-permission-sdk-23": true,
+	"uses-feature":           true,
+	"permission":             true,
+	"permission-group":       true,
+	"permission-tree":        true,
+	"queries":                true,
+}
+
+// aarComponentElements are the children of <application> whose android:name
+// is a class name, which may be relative to the package of the manifest.
+var aarComponentElements = map[string]bool{
+	"activity":       true,
+	"activity-alias": true,
+	"service":        true,
+	"receiver":       true,
+	"provider":       true,
+}
+
+// aarDepManifest returns the elements declared by the manifests of the
+// dependencies, see aarDepManifestElements, together with extra, sorted and
+// with duplicates removed, for inclusion in the merged manifest. The
+// components and meta-data of their <application> elements follow in an
+// <application> element, with class names made absolute. The attributes of
+// the dependencies' <application> elements and tools: attributes are left
+// out. It is an error for a dependency to declare another element, or for
+// two dependencies to declare different components with the same name.
+func aarDepManifest(deps []*aarDep, extra []string) (string, error) {
+	elems := map[string]bool{}
+	for _, i := range extra {
+		elems[i] = true
+	}
+	appElems := map[string]bool{}
+	appNames := map[string]string{}
+	for _, dep := range deps {
+		for _, file := range dep.r.File {
+			if file.Name != "AndroidManifest.xml" {
+				continue
+			}
+			data, err := readZipFile(file)
+			if err != nil {
+				return "", err
+			}
+			m := aarManifest{}
+			if err := xml.Unmarshal(data, &m); err != nil {
+				return "", fmt.Errorf("%s: parsing AndroidManifest.xml: %v", dep.path, err)
+			}
+			for _, n := range m.Nodes {
+				switch name := n.XMLName.Local; {
+				case name == "uses-sdk":
+				case name == "application":
+					for _, c := range n.Nodes {
+						if aarComponentElements[c.XMLName.Local] {
+							c = c.withAbsoluteName(m.Package)
+						}
+						elem, err := c.xml()
+						if err != nil {
+							return "", fmt.Errorf("%s: %v", dep.path, err)
+						}
+						key := c.XMLName.Local + " " + c.attr(androidNamespace, "name")
+						if orig, ok := appNames[key]; ok && orig != elem {
+							return "", fmt.Errorf("%s: <%s android:name=%q> conflicts with another dependency's", dep.path, c.XMLName.Local, c.attr(androidNamespace, "name"))
+						}
+						appNames[key] = elem
+						appElems[elem] = true
+					}
+				case aarDepManifestElements[name]:
+					elem, err := n.xml()
+					if err != nil {
+						return "", fmt.Errorf("%s: %v", dep.path, err)
+					}
+					elems[elem] = true
+				default:
+					return "", fmt.Errorf("%s: merging <%s> from a dependency's AndroidManifest.xml is not supported", dep.path, name)
+				}
+			}
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	for _, i := range sortedKeys(elems) {
+		fmt.Fprintf(buf, "\n%s", i)
+	}
+	if len(appElems) > 0 {
+		buf.WriteString("\n<application>")
+		for _, i := range sortedKeys(appElems) {
+			fmt.Fprintf(buf, "\n%s", i)
+		}
+		buf.WriteString("\n</application>")
+	}
+	return buf.String(), nil
+}
+
+// sortedKeys returns the keys of m in increasing order.
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for i := range m {
+		keys = append(keys, i)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// attr returns the value of the attribute of n called local in namespace.
+func (n manifestNode) attr(namespace, local string) string {
+	for _, i := range n.Attrs {
+		if i.Name.Space == namespace && i.Name.Local == local {
+			return i.Value
+		}
+	}
+	return ""
+}
+
+// withAbsoluteName returns a copy of the component n whose android:name, and
+// android:targetActivity, are qualified with pkg if they are relative class
+// names, e.g. .Service or Service.
+func (n manifestNode) withAbsoluteName(pkg string) manifestNode {
+	attrs := make([]xml.Attr, len(n.Attrs))
+	copy(attrs, n.Attrs)
+	for i, a := range attrs {
+		if a.Name.Space != androidNamespace || (a.Name.Local != "name" && a.Name.Local != "targetActivity") {
+			continue
+		}
+		if strings.HasPrefix(a.Value, ".") {
+			attrs[i].Value = pkg + a.Value
+		} else if !strings.Contains(a.Value, ".") {
+			attrs[i].Value = pkg + "." + a.Value
+		}
+	}
+	n.Attrs = attrs
+	return n
+}
+
+// xml returns n as a single line of XML, with its android: attributes in
+// the namespace declared by the merged manifest.
+func (n manifestNode) xml() (string, error) {
+	buf := &bytes.Buffer{}
+	buf.WriteString("<" + n.XMLName.Local)
+	for _, a := range n.Attrs {
+		var name string
+		switch a.Name.Space {
+		case "":
+			name = a.Name.Local
+		case androidNamespace:
+			name = "android:" + a.Name.Local
+		case "xmlns", toolsNamespace:
+			continue
+		default:
+			return "", fmt.Errorf("<%s> has attribute %s in unsupported namespace %s", n.XMLName.Local, a.Name.Local, a.Name.Space)
+		}
+		if name == "xmlns" {
+			continue
+		}
+		buf.WriteString(" " + name + `="`)
+		xml.EscapeText(buf, []byte(a.Value))
+		buf.WriteString(`"`)
+	}
+	if len(n.Nodes) == 0 {
+		buf.WriteString("/>")
+		return buf.String(), nil
+	}
+	buf.WriteString(">")
+	for _, c := range n.Nodes {
+		elem, err := c.xml()
+		if err != nil {
+			return "", err
+		}
+		buf.WriteString(elem)
+	}
+	buf.WriteString("</" + n.XMLName.Local + ">")
+	return buf.String(), nil
+}
+
+// writeAARDeps copies the contents of deps into an archive using create.
+// Each classes.jar and libs/ jar is added under libs/, prefixed with the name
+// of its aar, and native libraries, assets and resources keep their names.
+// Files in the values directories, which may define any resources whatever
+// their name, are prefixed with the name of their aar too, so that only
+// resources with the same name conflict.
+// written maps the names of the entries already in the archive to where they
+// came from, and it is an error for a dependency to provide an entry with one
+// of those names.
+func writeAARDeps(create func(name string) (io.Writer, error), written map[string]string, deps []*aarDep) error {
+	for _, dep := range deps {
+		for _, file := range dep.r.File {
+			name := file.Name
+			switch {
+			case strings.HasSuffix(name, "/"):
+				continue
+			case name == "classes.jar":
+				name = "libs/" + dep.name + ".jar"
+			case strings.HasPrefix(name, "libs/") && strings.HasSuffix(name, ".jar"):
+				name = "libs/" + dep.name + "-" + path.Base(name)
+			case strings.HasPrefix(name, "res/values"):
+				name = path.Dir(name) + "/" + dep.name + "-" + path.Base(name)
+			case strings.HasPrefix(name, "jni/"), strings.HasPrefix(name, "assets/"), strings.HasPrefix(name, "res/"):
+			default:
+				continue
+			}
+
+			if orig, ok := written[name]; ok {
+				return fmt.Errorf("%s: %s conflicts with an entry from %s", dep.path, name, orig)
+			}
+
+			r, err := file.Open()
+			if err != nil {
+				return err
+			}
+			w, err := create(name)
+			if err == nil {
+				_, err = io.Copy(w, r)
+			}
+			r.Close()
+			if err != nil {
+				return err
+			}
+			written[name] = dep.path
+		}
+	}
+	return nil
+}
+
+// checkJars returns an error unless each of paths is a readable jar, so
+// that BuildAAR fails before compiling anything.
+func checkJars(paths []string) error {
+	for _, i := range paths {
+		r, err := zip.OpenReader(i)
+		if err != nil {
+			return fmt.Errorf("merging %s: %v", i, err)
+		}
+		r.Close()
+	}
+	return nil
+}
+
+// mergeJars copies the entries of the jars at paths into a jar using create.
+// written maps the names of the entries already in the jar to where they came
+// from, and it is an error for two jars to provide the same class. The
+// manifests, signatures and indexes of the jars describe the jars themselves
+// and are dropped. Their META-INF/services files are concatenated, and other
+// duplicate META-INF entries, such as licenses, are kept from the first jar.
+func mergeJars(create func(name string) (io.Writer, error), written map[string]string, paths []string) error {
+	services := map[string]*bytes.Buffer{}
+	serviceNames := []string{}
+	for _, i := range paths {
+		r, err := zip.OpenReader(i)
+		if err != nil {
+			return fmt.Errorf("merging %s: %v", i, err)
+		}
+		for _, file := range r.File {
+			name := file.Name
+			switch {
+			case strings.HasSuffix(name, "/"), isJarMetadata(name):
+				continue
+			case strings.HasPrefix(name, "META-INF/services/"):
+				data, err := readZipFile(file)
+				if err != nil {
+					r.Close()
+					return err
+				}
+				if services[name] == nil {
+					services[name] = &bytes.Buffer{}
+					serviceNames = append(serviceNames, name)
+				}
+				services[name].Write(data)
+				if len(data) > 0 && data[len(data)-1] != '\n' {
+					services[name].WriteByte('\n')
+				}
+				continue
+			}
+
+			if orig, ok := written[name]; ok {
+				if strings.HasPrefix(name, "META-INF/") {
+					continue
+				}
+				r.Close()
+				return fmt.Errorf("%s: %s conflicts with an entry from %s", i, name, orig)
+			}
+
+			fr, err := file.Open()
+			if err != nil {
+				r.Close()
+				return err
+			}
+			w, err := create(name)
+			if err == nil {
+				_, err = io.Copy(w, fr)
+			}
+			fr.Close()
+			if err != nil {
+				r.Close()
+				return err
+			}
+			written[name] = i
+		}
+		r.Close()
+	}
+
+	for _, name := range serviceNames {
+		if orig, ok := written[name]; ok {
+			return fmt.Errorf("%s conflicts with an entry from %s", name, orig)
+		}
+		w, err := create(name)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(services[name].Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isJarMetadata reports whether the jar entry name is the jar's manifest,
+// index or signature, which don't apply once it is merged into another jar.
+func isJarMetadata(name string) bool {
+	if !strings.HasPrefix(name, "META-INF/") || strings.Count(name, "/") != 1 {
+		return false
+	}
+	switch path.Ext(name) {
+	case ".SF", ".RSA", ".DSA", ".EC":
+		return true
+	}
+	return name == "META-INF/MANIFEST.MF" || name == "META-INF/INDEX.LIST"
+}
+
+// aarDepText concatenates the entries called name, such as proguard.txt or
+// R.txt, of each dependency.
+func aarDepText(deps []*aarDep, name string) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	for _, dep := range deps {
+		for _, file := range dep.r.File {
+			if file.Name != name {
+				continue
+			}
+			data, err := readZipFile(file)
+			if err != nil {
+				return nil, err
+			}
+			buf.Write(data)
+			if len(data) > 0 && data[len(data)-1] != '\n' {
+				buf.WriteByte('\n')
+			}
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// mergeRTxt merges rtxt, the library's own R.txt, with the R.txt entries of
+// deps, which list their resources as "<type> <class> <name> <value>" lines.
+// The app assigns the merged resources to the R class of the aar's package,
+// which the dependencies' own R classes forward to, see aarDepRSources.
+// The values are placeholders that are reassigned when the app is built, so
+// an entry found in more than one of them, such as an attr of a library they
+// share, is listed once. A dependency listing a resource twice with
+// different types is an error.
+func mergeRTxt(rtxt []byte, deps []*aarDep) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	seen := map[string]bool{}
+	add := func(origin string, data []byte) error {
+		types := map[string]string{}
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 4 {
+				continue
+			}
+			key := fields[1] + " " + fields[2]
+			if t, ok := types[key]; ok && t != fields[0] {
+				return fmt.Errorf("%s: R.txt lists %s %s as both %s and %s", origin, fields[1], fields[2], t, fields[0])
+			}
+			types[key] = fields[0]
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			fmt.Fprintln(buf, strings.TrimSpace(line))
+		}
+		return nil
+	}
+
+	if err := add("R.txt", rtxt); err != nil {
+		return nil, err
+	}
+	for _, dep := range deps {
+		for _, file := range dep.r.File {
+			if file.Name != "R.txt" {
+				continue
+			}
+			data, err := readZipFile(file)
+			if err != nil {
+				return nil, err
+			}
+			if err := add(dep.path, data); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// checkAARDepResources returns an error if two of deps define the same values
+// resource, with the same type and name in the same configuration, e.g.
+// values-fr. mergeRTxt lists such a resource once, but both definitions would
+// reach the app's resource merger, which rejects them. Resources in other
+// directories are files, which writeAARDeps rejects when two deps provide
+// the same one.
+func checkAARDepResources(deps []*aarDep) error {
+	defined := map[string]string{}
+	for _, dep := range deps {
+		for _, file := range dep.r.File {
+			dir := path.Dir(file.Name)
+			if !strings.HasPrefix(dir, "res/values") || path.Dir(dir) != "res" || path.Ext(file.Name) != ".xml" {
+				continue
+			}
+			data, err := readZipFile(file)
+			if err != nil {
+				return err
+			}
+			res := struct {
+				Resources []valuesResource `xml:",any"`
+			}{}
+			if err := xml.Unmarshal(data, &res); err != nil {
+				return fmt.Errorf("%s: parsing %s: %v", dep.path, file.Name, err)
+			}
+			for _, i := range res.Resources {
+				typ := i.resourceType()
+				if typ == "" || i.Name == "" {
+					continue
+				}
+				key := path.Base(dir) + " " + typ + " " + i.Name
+				if orig, ok := defined[key]; ok && orig != dep.path {
+					return fmt.Errorf("%s and %s both define %s %s in %s", orig, dep.path, typ, i.Name, path.Base(dir))
+				}
+				defined[key] = dep.path
+			}
+		}
+	}
+	return nil
+}
+
+// valuesResource is an element of a values resource file.
+type valuesResource struct {
+	XMLName xml.Name
+	Name    string `xml:"name,attr"`
+	Type    string `xml:"type,attr"`
+}
+
+// resourceType returns the type of the resource r defines, e.g. string for
+// <string> and array for <string-array>, or "" if it doesn't define one.
+func (r valuesResource) resourceType() string {
+	switch r.XMLName.Local {
+	case "item":
+		return r.Type
+	case "array", "string-array", "integer-array":
+		return "array"
+	case "declare-styleable":
+		return "styleable"
+	case "eat-comment", "skip", "public", "java-symbol", "add-resource":
+		return ""
+	}
+	return r.XMLName.Local
+}
+
+// aarDepRSources returns Java sources, by slash separated path, that give
+// each of deps an R class in its own package, as the app only generates an R
+// class for the package of the merged aar, rPkg. The fields of each
+// dependency's R, listed by its R.txt, forward to those of rPkg's R, whose
+// values the app assigns from the merged R.txt, so the dependencies' classes
+// find their resources. A stub of rPkg's R is included to compile them
+// against, and must be left out of classes.jar. Dependencies whose
+// classes.jar has an R class already are skipped.
+func aarDepRSources(deps []*aarDep, rPkg string) (map[string][]byte, error) {
+	stub := map[string][]rField{}
+	stubSeen := map[string]bool{}
+	sources := map[string][]byte{}
+	for _, dep := range deps {
+		var pkg string
+		var fields []rField
+		var jar []byte
+		for _, file := range dep.r.File {
+			switch file.Name {
+			case "AndroidManifest.xml", "R.txt", "classes.jar":
+			default:
+				continue
+			}
+			data, err := readZipFile(file)
+			if err != nil {
+				return nil, err
+			}
+			switch file.Name {
+			case "AndroidManifest.xml":
+				m := aarManifest{}
+				if err := xml.Unmarshal(data, &m); err != nil {
+					return nil, fmt.Errorf("%s: parsing AndroidManifest.xml: %v", dep.path, err)
+				}
+				pkg = m.Package
+			case "R.txt":
+				for _, line := range strings.Split(string(data), "\n") {
+					if f := strings.Fields(line); len(f) >= 4 {
+						fields = append(fields, rField{f[0], f[1], f[2]})
+					}
+				}
+			case "classes.jar":
+				jar = data
+			}
+		}
+		if pkg == "" || pkg == rPkg || len(fields) == 0 {
+			continue
+		}
+		if jar != nil {
+			r, err := zip.NewReader(bytes.NewReader(jar), int64(len(jar)))
+			if err != nil {
+				return nil, fmt.Errorf("%s: reading classes.jar: %v", dep.path, err)
+			}
+			hasR := false
+			for _, i := range r.File {
+				hasR = hasR || i.Name == strings.Replace(pkg, ".", "/", -1)+"/R.class"
+			}
+			if hasR {
+				continue
+			}
+		}
+
+		classes := map[string][]rField{}
+		seen := map[string]bool{}
+		for _, i := range fields {
+			key := i.class + " " + i.name
+			if !seen[key] {
+				seen[key] = true
+				classes[i.class] = append(classes[i.class], i)
+			}
+			if !stubSeen[key] {
+				stubSeen[key] = true
+				stub[i.class] = append(stub[i.class], i)
+			}
+		}
+		sources[strings.Replace(pkg, ".", "/", -1)+"/R.java"] = rSource(pkg, classes, rPkg)
+	}
+	if len(sources) > 0 {
+		sources[strings.Replace(rPkg, ".", "/", -1)+"/R.java"] = rSource(rPkg, stub, "")
+	}
+	return sources, nil
+}
+
+// rField is a field of an R class, listed in R.txt as "<typ> <class> <name>
+// <value>", e.g. int string app_name 0x7f010000.
+type rField struct {
+	typ, class, name string
+}
+
+// rSource returns the source of the R class of pkg with the fields in
+// classes, keyed by the name of their inner class. The fields are
+// initialized from the same fields of the R class of target, or left unset
+// if target is "". Either way they aren't constants, so classes compiled
+// against them read them when they run.
+func rSource(pkg string, classes map[string][]rField, target string) []byte {
+	names := make([]string, 0, len(classes))
+	for i := range classes {
+		names = append(names, i)
+	}
+	sort.Strings(names)
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "package %s;\n\npublic final class R {\n", pkg)
+	for _, class := range names {
+		fmt.Fprintf(buf, "    public static final class %s {\n", class)
+		for _, i := range classes[class] {
+			if target == "" {
+				fmt.Fprintf(buf, "        public static %s %s;\n", i.typ, i.name)
+			} else {
+				fmt.Fprintf(buf, "        public static %s %s = %s.R.%s.%s;\n", i.typ, i.name, target, class, i.name)
+			}
+		}
+		buf.WriteString("    }\n")
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+// readRTxt reads the R.txt at path, checking that each line declares a
+// resource as "int <type> <name> <value>", or the attrs of a styleable as
+// "int[] styleable <name> { <value>, ... }".
+func readRTxt(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for n, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		valid := false
+		switch fields[0] {
+		case "int":
+			valid = len(fields) == 4 && isResourceValue(fields[3])
+		case "int[]":
+			valid = len(fields) >= 5 && fields[1] == "styleable" && fields[3] == "{" && fields[len(fields)-1] == "}"
+			for i := 4; valid && i < len(fields)-1; i++ {
+				valid = isResourceValue(strings.TrimSuffix(fields[i], ","))
+			}
+		}
+		if !valid {
+			return nil, fmt.Errorf("%s:%d: expected int <type> <name> <value>, got %q", path, n+1, strings.TrimSpace(line))
+		}
+	}
+	return data, nil
+}
+
+// isResourceValue reports whether s is a resource id, in hex or decimal.
+func isResourceValue(s string) bool {
+	_, err := strconv.ParseInt(s, 0, 64)
+	return err == nil
+}
+
+func readZipFile(file *zip.File) ([]byte, error) {
+	r, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
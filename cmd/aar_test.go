@@ -0,0 +1,539 @@
+package cmd
+
+import (
+	"archive/zip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// writeTestAAR writes a zip archive containing files to dir/name.
+func writeTestAAR(t *testing.T, dir, name string, files map[string]string) string {
+	path := filepath.Join(dir, name)
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	zw := zip.NewWriter(file)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDiffAAR(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matcha-aar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := writeTestAAR(t, dir, "a.aar", map[string]string{
+		"AndroidManifest.xml":         "<manifest/>",
+		"jni/arm64-v8a/libgojni.so":   "arm64",
+		"jni/armeabi-v7a/libgojni.so": "arm",
+		"R.txt":                       "",
+	})
+	b := writeTestAAR(t, dir, "b.aar", map[string]string{
+		"AndroidManifest.xml":       "<manifest/>",
+		"jni/arm64-v8a/libgojni.so": "arm64-larger",
+		"jni/x86_64/libgojni.so":    "amd64",
+		"R.txt":                     "",
+	})
+
+	d, err := DiffAAR(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Added) != 1 || d.Added[0].Name != "jni/x86_64/libgojni.so" {
+		t.Errorf("Unexpected added entries: %v", d.Added)
+	}
+	if len(d.Removed) != 1 || d.Removed[0].Name != "jni/armeabi-v7a/libgojni.so" {
+		t.Errorf("Unexpected removed entries: %v", d.Removed)
+	}
+	if len(d.Changed) != 1 || d.Changed[0] != (AARChange{"jni/arm64-v8a/libgojni.so", 5, 12}) {
+		t.Errorf("Unexpected changed entries: %v", d.Changed)
+	}
+
+	expected := `+ jni/x86_64/libgojni.so (5 bytes)
+- jni/armeabi-v7a/libgojni.so (3 bytes)
+~ jni/arm64-v8a/libgojni.so (5 -> 12 bytes, +7)
+`
+	if d.String() != expected {
+		t.Errorf("Unexpected output:\n%s", d.String())
+	}
+
+	if d, err := DiffAAR(a, a); err != nil || !d.Empty() {
+		t.Errorf("Expected empty diff, got %v, %v", d, err)
+	}
+}
+
+func TestAARABIs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matcha-aar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	multi := writeTestAAR(t, dir, "multi.aar", map[string]string{
+		"AndroidManifest.xml":            "<manifest/>",
+		"jni/x86_64/libgojni.so":         "amd64",
+		"jni/arm64-v8a/libgojni.so":      "arm64",
+		"jni/arm64-v8a/libc++_shared.so": "arm64",
+		"jni/armeabi-v7a/libgojni.so":    "arm",
+		"jni/x86/":                       "",
+		"assets/jni/mips/libgojni.so":    "",
+		"classes.jar":                    "",
+	})
+	single := writeTestAAR(t, dir, "single.aar", map[string]string{
+		"AndroidManifest.xml":       "<manifest/>",
+		"jni/arm64-v8a/libgojni.so": "arm64",
+	})
+	none := writeTestAAR(t, dir, "none.aar", map[string]string{
+		"AndroidManifest.xml": "<manifest/>",
+	})
+
+	for _, i := range []struct {
+		path     string
+		expected []string
+	}{
+		{multi, []string{"arm64-v8a", "armeabi-v7a", "x86_64"}},
+		{single, []string{"arm64-v8a"}},
+		{none, []string{}},
+	} {
+		abis, err := AARABIs(i.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(abis, i.expected) {
+			t.Errorf("AARABIs(%s) = %v, expected %v", filepath.Base(i.path), abis, i.expected)
+		}
+	}
+
+	if _, err := AARABIs(filepath.Join(dir, "missing.aar")); err == nil {
+		t.Error("Expected an error for a missing aar")
+	}
+}
+
+func TestReadAARManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matcha-aar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	manifest := "<manifest xmlns:android=\"http://schemas.android.com/apk/res/android\" package=\"go.example\">\r\n<uses-sdk android:minSdkVersion=\"21\"/>\r\n</manifest>"
+	aar := writeTestAAR(t, dir, "a.aar", map[string]string{
+		"AndroidManifest.xml": manifest,
+		"classes.jar":         "",
+	})
+	m, err := ReadAARManifest(aar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := strings.Replace(manifest, "\r\n", "\n", -1) + "\n"; m != expected {
+		t.Errorf("ReadAARManifest() = %q, expected %q", m, expected)
+	}
+
+	binary := writeTestAAR(t, dir, "binary.aar", map[string]string{"AndroidManifest.xml": "\x03\x00\x08\x00\xff\xfe"})
+	if _, err := ReadAARManifest(binary); err == nil {
+		t.Error("Expected an error for a binary manifest")
+	}
+	none := writeTestAAR(t, dir, "none.aar", map[string]string{"classes.jar": ""})
+	if _, err := ReadAARManifest(none); err == nil {
+		t.Error("Expected an error for an aar without a manifest")
+	}
+}
+
+func TestVerifyAARAgainstGolden(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matcha-aar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	aar := writeTestAAR(t, dir, "a.aar", map[string]string{
+		"AndroidManifest.xml":         "<manifest/>",
+		"classes.jar":                 "",
+		"jni/arm64-v8a/libgojni.so":   "arm64",
+		"jni/armeabi-v7a/libgojni.so": "arm",
+		"R.txt":                       "",
+	})
+	for _, i := range []struct {
+		golden   string
+		problems []string
+	}{
+		{"# Entries of a.aar.\nAndroidManifest.xml\nclasses.jar\n\njni/*/libgojni.so\nR.txt\n", nil},
+		{"AndroidManifest.xml\nclasses.jar\njni/arm64-v8a/libgojni.so\nR.txt\nproguard.txt\n", []string{"\n+ jni/armeabi-v7a/libgojni.so", "\n- proguard.txt"}},
+		{"*\n*/*/*\nassets/*\n", []string{"\n- assets/*"}},
+		{"[\n", []string{"invalid pattern"}},
+	} {
+		golden := filepath.Join(dir, "golden.txt")
+		if err := ioutil.WriteFile(golden, []byte(i.golden), 0644); err != nil {
+			t.Fatal(err)
+		}
+		err := VerifyAARAgainstGolden(aar, golden)
+		if len(i.problems) == 0 {
+			if err != nil {
+				t.Errorf("VerifyAARAgainstGolden(%q) = %v", i.golden, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("VerifyAARAgainstGolden(%q) returned no error", i.golden)
+			continue
+		}
+		for _, j := range i.problems {
+			if !strings.Contains(err.Error(), j) {
+				t.Errorf("Error is missing %q:\n%v", j, err)
+			}
+		}
+	}
+}
+
+func TestFatAAR(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matcha-aar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := writeTestAAR(t, dir, "a.aar", map[string]string{
+		"AndroidManifest.xml": `<manifest xmlns:android="http://schemas.android.com/apk/res/android" xmlns:tools="http://schemas.android.com/tools" package="a">
+<uses-sdk android:minSdkVersion="21"/>
+<uses-permission android:name="android.permission.INTERNET"/>
+<uses-permission android:name="android.permission.WRITE_EXTERNAL_STORAGE" android:maxSdkVersion="18"/>
+<uses-feature android:name="android.hardware.camera" android:required="false"/>
+<application android:label="a" tools:ignore="MissingApplicationIcon">
+  <service android:name=".SyncService" android:exported="false">
+    <intent-filter><action android:name="a.SYNC"/></intent-filter>
+  </service>
+  <meta-data android:name="a.key" android:value="x &amp; y"/>
+</application></manifest>`,
+		"classes.jar":             "a",
+		"libs/util.jar":           "util",
+		"jni/arm64-v8a/liba.so":   "liba",
+		"res/values/values.xml":   "<resources/>",
+		"proguard.txt":            "-keep class a.** { *; }",
+		"R.txt":                   "int string a 0x7f010000\nint attr shared 0x7f020000\n",
+		"annotations.zip":         "",
+		"res/":                    "",
+		"assets/a/logo.png":       "logo",
+		"jni/armeabi-v7a/liba.so": "liba",
+	})
+	b := writeTestAAR(t, dir, "b.aar", map[string]string{
+		"AndroidManifest.xml": `<manifest xmlns:android="http://schemas.android.com/apk/res/android" package="b">
+<uses-permission android:name="android.permission.INTERNET"/>
+<application><receiver android:name="Receiver"/></application></manifest>`,
+		"classes.jar":           "b",
+		"proguard.txt":          "-keep class b.** { *; }\n",
+		"res/values/values.xml": "<resources/>",
+		"R.txt":                 "int attr shared 0x7f020000\nint string b 0x7f010000\n",
+	})
+
+	deps, err := openAARDeps([]string{a, b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeAARDeps(deps)
+
+	manifest, err := aarDepManifest(deps, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `
+<uses-feature android:name="android.hardware.camera" android:required="false"/>
+<uses-permission android:name="android.permission.INTERNET"/>
+<uses-permission android:name="android.permission.WRITE_EXTERNAL_STORAGE" android:maxSdkVersion="18"/>
+<application>
+<meta-data android:name="a.key" android:value="x &amp; y"/>
+<receiver android:name="b.Receiver"/>
+<service android:name="a.SyncService" android:exported="false"><intent-filter><action android:name="a.SYNC"/></intent-filter></service>
+</application>`
+	if manifest != expected {
+		t.Errorf("Unexpected manifest:\n%s", manifest)
+	}
+	if err := lintManifest([]byte(`<manifest xmlns:android="http://schemas.android.com/apk/res/android" package="go.m.gojni"><uses-sdk android:minSdkVersion="15"/>` + manifest + `</manifest>`)); err != nil {
+		t.Errorf("Merged manifest doesn't lint: %v", err)
+	}
+
+	// Different components with the same name, and elements that can't be
+	// merged, are errors.
+	for _, i := range []string{
+		`<application><service android:name="a.SyncService" android:exported="true"/></application>`,
+		`<instrumentation android:name="c.Test"/>`,
+	} {
+		c := writeTestAAR(t, dir, "c.aar", map[string]string{
+			"AndroidManifest.xml": `<manifest xmlns:android="http://schemas.android.com/apk/res/android" package="c">` + i + `</manifest>`,
+		})
+		cdeps, err := openAARDeps([]string{a, c})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := aarDepManifest(cdeps, nil); err == nil {
+			t.Errorf("Expected error merging %s", i)
+		}
+		closeAARDeps(cdeps)
+	}
+
+	proguard, err := aarDepText(deps, "proguard.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(proguard) != "-keep class a.** { *; }\n-keep class b.** { *; }\n" {
+		t.Errorf("Unexpected proguard rules:\n%s", proguard)
+	}
+
+	rtxt, err := mergeRTxt(nil, deps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rtxt) != "int string a 0x7f010000\nint attr shared 0x7f020000\nint string b 0x7f010000\n" {
+		t.Errorf("Unexpected R.txt:\n%s", rtxt)
+	}
+
+	names := []string{}
+	create := func(name string) (io.Writer, error) {
+		names = append(names, name)
+		return ioutil.Discard, nil
+	}
+	written := map[string]string{"jni/arm64-v8a/libgojni.so": "matcha.aar"}
+	if err := writeAARDeps(create, written, deps); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	expectedNames := []string{
+		"assets/a/logo.png",
+		"jni/arm64-v8a/liba.so",
+		"jni/armeabi-v7a/liba.so",
+		"libs/a-util.jar",
+		"libs/a.jar",
+		"libs/b.jar",
+		"res/values/a-values.xml",
+		"res/values/b-values.xml",
+	}
+	if !reflect.DeepEqual(names, expectedNames) {
+		t.Errorf("Unexpected entries %v", names)
+	}
+
+	// Writing the same dependencies again conflicts with the first copy.
+	if err := writeAARDeps(create, written, deps); err == nil {
+		t.Error("Expected conflict error")
+	}
+
+	// Both define the same resource with the same configuration, unlike a
+	// and b above.
+	if err := checkAARDepResources(deps); err != nil {
+		t.Error(err)
+	}
+	c := writeTestAAR(t, dir, "c.aar", map[string]string{
+		"AndroidManifest.xml":      `<manifest package="c"/>`,
+		"res/values/strings.xml":   `<resources><string name="title">C</string></resources>`,
+		"res/values-fr/values.xml": `<resources><item name="title" type="id"/></resources>`,
+		"R.txt":                    "int string title 0x7f010000\nint[] styleable View { 0x7f020000 }\n",
+	})
+	d := writeTestAAR(t, dir, "d.aar", map[string]string{
+		"AndroidManifest.xml":    `<manifest package="d"/>`,
+		"res/values/strings.xml": `<resources><string name="title">D</string></resources>`,
+	})
+	cdeps, err := openAARDeps([]string{c, d})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeAARDeps(cdeps)
+	if err := checkAARDepResources(cdeps); err == nil || !strings.Contains(err.Error(), "string title") {
+		t.Errorf("Expected duplicate resource error, got %v", err)
+	}
+
+	// c's R forwards to the R of the aar's package, which is stubbed.
+	sources, err := aarDepRSources(cdeps, "go.m.gojni")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedSources := map[string][]byte{
+		"c/R.java": []byte(`package c;
+
+public final class R {
+    public static final class string {
+        public static int title = go.m.gojni.R.string.title;
+    }
+    public static final class styleable {
+        public static int[] View = go.m.gojni.R.styleable.View;
+    }
+}
+`),
+		"go/m/gojni/R.java": []byte(`package go.m.gojni;
+
+public final class R {
+    public static final class string {
+        public static int title;
+    }
+    public static final class styleable {
+        public static int[] View;
+    }
+}
+`),
+	}
+	if !reflect.DeepEqual(sources, expectedSources) {
+		t.Errorf("Unexpected R sources %q", sources)
+	}
+}
+
+func TestSplitNativeAAR(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matcha-aar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := writeTestAAR(t, dir, "example.aar", map[string]string{
+		"AndroidManifest.xml":         `<manifest xmlns:android="http://schemas.android.com/apk/res/android" package="go.example.gojni"/>`,
+		"classes.jar":                 "classes",
+		"R.txt":                       "",
+		"jni/arm64-v8a/libgojni.so":   "arm64",
+		"jni/armeabi-v7a/libgojni.so": "arm",
+	})
+	f := &Flags{}
+	if err := SplitNativeAAR(f, path, []string{"arm64-v8a"}); err == nil {
+		t.Error("Expected error for an ABI that is not being split")
+	}
+	if err := SplitNativeAAR(f, path, []string{"armeabi-v7a", "arm64-v8a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	names := func(path string) map[string]string {
+		r, err := zip.OpenReader(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		entries := map[string]string{}
+		for _, file := range r.File {
+			data, err := readZipFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries[file.Name] = string(data)
+		}
+		return entries
+	}
+
+	api := names(path)
+	if _, ok := api["jni/arm64-v8a/libgojni.so"]; ok || api["classes.jar"] != "classes" {
+		t.Errorf("Unexpected api aar entries %v", api)
+	}
+	if api["matcha-native.properties"] != "native.armeabi-v7a=example-native-armeabi-v7a.aar\nnative.arm64-v8a=example-native-arm64-v8a.aar\n" {
+		t.Errorf("Unexpected matcha-native.properties:\n%s", api["matcha-native.properties"])
+	}
+
+	native := names(filepath.Join(dir, "example-native-arm64-v8a.aar"))
+	if native["jni/arm64-v8a/libgojni.so"] != "arm64" || len(native) != 4 {
+		t.Errorf("Unexpected native aar entries %v", native)
+	}
+	if err := lintManifest([]byte(native["AndroidManifest.xml"])); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAARMetadata(t *testing.T) {
+	for _, i := range []struct {
+		agp, expected string
+	}{
+		{"", ""},
+		{"4.2.2", ""},
+		{"7.0.4", "aarFormatVersion=1.0\naarMetadataVersion=1.0\nminCompileSdk=1\n"},
+		{"7.4.2", "aarFormatVersion=1.0\naarMetadataVersion=1.0\nminCompileSdk=1\nminAndroidGradlePluginVersion=1.0.0\n"},
+		{"8.1", "aarFormatVersion=1.0\naarMetadataVersion=1.0\nminCompileSdk=1\nminAndroidGradlePluginVersion=1.0.0\nminCompileSdkExtension=0\n"},
+	} {
+		metadata, err := aarMetadata(i.agp, 0, 0)
+		if err != nil || metadata != i.expected {
+			t.Errorf("aarMetadata(%q) = %q, %v, expected %q", i.agp, metadata, err, i.expected)
+		}
+	}
+	for _, i := range []string{"7", "seven", "8.0.0-beta01"} {
+		if _, err := aarMetadata(i, 0, 0); err == nil {
+			t.Errorf("Expected error for %q", i)
+		}
+	}
+
+	metadata, err := aarMetadata("8.1", 33, 4)
+	expected := "aarFormatVersion=1.0\naarMetadataVersion=1.0\nminCompileSdk=33\nminAndroidGradlePluginVersion=1.0.0\nminCompileSdkExtension=4\n"
+	if err != nil || metadata != expected {
+		t.Errorf("aarMetadata(8.1, 33, 4) = %q, %v, expected %q", metadata, err, expected)
+	}
+	if metadata, _ := aarMetadata("4.2.2", 33, 0); metadata != "" {
+		t.Errorf("Expected no metadata for AGP 4.2.2, got %q", metadata)
+	}
+}
+
+func TestArchiveComment(t *testing.T) {
+	if c := archiveComment(&Flags{}); !strings.HasPrefix(c, "Built by matcha ") || !strings.Contains(c, " at ") {
+		t.Errorf("Unexpected default comment %q", c)
+	}
+	if c := archiveComment(&Flags{Reproducible: true}); strings.Contains(c, " at ") {
+		t.Errorf("Reproducible comment %q has a timestamp", c)
+	}
+	if c := archiveComment(&Flags{ArchiveComment: "ci build 42", Reproducible: true}); c != "ci build 42" {
+		t.Errorf("Unexpected comment %q", c)
+	}
+	if err := (&Flags{ArchiveComment: strings.Repeat("x", 0x10000)}).Validate(); err == nil {
+		t.Error("Expected error for a comment over 64KB")
+	}
+}
+
+func TestReadRTxt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matcha-rtxt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	valid := "int string a 0x7f010000\n\nint attr shared 0x7f020000\nint[] styleable View { 0x7f020000, 0x7f020001 }\nint styleable View_shared 0\n"
+	for _, i := range []struct {
+		rtxt string
+		ok   bool
+	}{
+		{"", true},
+		{valid, true},
+		{"int string a\n", false},
+		{"string a 0x7f010000\n", false},
+		{"int string a zero\n", false},
+		{"int[] styleable View 0x7f020000\n", false},
+	} {
+		path := filepath.Join(dir, "R.txt")
+		if err := ioutil.WriteFile(path, []byte(i.rtxt), 0644); err != nil {
+			t.Fatal(err)
+		}
+		data, err := readRTxt(path)
+		if (err == nil) != i.ok {
+			t.Errorf("readRTxt(%q) = %v, expected ok %v", i.rtxt, err, i.ok)
+		}
+		if err == nil && string(data) != i.rtxt {
+			t.Errorf("readRTxt(%q) = %q", i.rtxt, data)
+		}
+	}
+
+	rtxt, err := mergeRTxt([]byte("int attr shared 0x7f020001\nint string own 0x7f010001\n"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rtxt) != "int attr shared 0x7f020001\nint string own 0x7f010001\n" {
+		t.Errorf("Unexpected R.txt:\n%s", rtxt)
+	}
+}
@@ -6,6 +6,10 @@ package cmd
 
 import (
 	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"go/build"
 	"io"
@@ -14,8 +18,11 @@ import (
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 )
 
 const (
@@ -27,12 +34,43 @@ Created-By: 1.0 (Go)
 `
 )
 
+// androidMinSDK returns the minSdkVersion of the aar, f.MinSDK or
+// defaultMinSDK if it is unset.
+func androidMinSDK(f *Flags) (int, error) {
+	if f.MinSDK == 0 {
+		return defaultMinSDK(f), nil
+	}
+	if f.MinSDK < minAndroidAPI {
+		return 0, fmt.Errorf("min SDK %d is below the lowest supported level, %d", f.MinSDK, minAndroidAPI)
+	}
+	return f.MinSDK, nil
+}
+
+// defaultMinSDK returns the min SDK of aars that don't set one. It is
+// minAndroidAPI, unless the NDK is r19 or later, which dropped it, where it
+// is the NDK's lowest API level so that its toolchains can build the aar.
+func defaultMinSDK(f *Flags) int {
+	ndkRoot, err := NDKPath(f)
+	if err != nil {
+		return minAndroidAPI
+	}
+	revision, err := ndkMajorRevision(f, ndkRoot)
+	if err != nil || revision < 19 {
+		return minAndroidAPI
+	}
+	return minUnifiedNDKAPI(revision)
+}
+
+// kotlincTargetVer is the JVM target of Kotlin sources, the oldest supported
+// by current versions of kotlinc.
+const kotlincTargetVer = "1.8"
+
 const (
 	missingAndroidHomeEnvVar  = "$ANDROID_HOME enviromental variable is unset and does not point to an Android SDK. "
 	missingAndroidHome        = "$ANDROID_HOME enviromental variable does not point to an Android SDK. "
 	missingAndroidPlatformDir = "$ANDROID_HOME enviromental variable does not point to an Android SDK. Missing directory at $ANDROID_HOME/platforms. "
-	missingAndroidPlatform    = "Android SDK platform with minimum API level of 15 was not found in $ANDROID_HOME/platforms. SDK platforms can be installed in Android Studio > SDK Manager."
-	missingNDK                = "NDK was not found at $ANDROID_HOME/ndk-bundle. NDK can be installed in Android Studio > SDK Manager."
+	missingAndroidPlatform    = "Android SDK platform with minimum API level of %d was not found in $ANDROID_HOME/platforms. SDK platforms can be installed in Android Studio > SDK Manager."
+	missingNDK                = "NDK was not found at $ANDROID_HOME/ndk-bundle or $ANDROID_HOME/ndk/<version>. NDK can be installed in Android Studio > SDK Manager."
 	missingJavac              = "javac was not found in $PATH. "
 	missingAndroidHomeWin     = "The SDK is often located at %USERPROFILE%\\AppData\\Local\\Android\\Sdk on Windows."
 	missingAndroidHomeMac     = "The SDK is often located at ~/Library/Android/sdk on macOS."
@@ -59,27 +97,84 @@ func validateAndroidInstall(f *Flags) error {
 	if _, err := NDKPath(f); err != nil {
 		return err
 	}
-	if _, err := LookPath(f, "javac"); err != nil {
+	javac, err := LookPath(f, "javac")
+	if err != nil {
+		f.tracef("javac: not found in $PATH")
 		return fmt.Errorf(missingJavac + javacErrorString())
 	}
+	f.tracef("javac: %s", javac)
 	return nil
 }
 
+// AndroidSDKPath returns the android SDK directory, $ANDROID_HOME. The SDK and
+// NDK are only ever read from, so they may be installed on a read-only mount.
+// Intermediate files are written to the temporary work directory instead.
 func AndroidSDKPath(f *Flags) (string, error) {
 	path := GetEnv(f, "ANDROID_HOME")
+	f.tracef("$ANDROID_HOME = %q", path)
 	if path == "" {
 		return "", fmt.Errorf(missingAndroidHomeEnvVar + androidHomeErrorString())
 	}
 
 	if !IsDir(f, path) {
+		f.tracef("%s: missing", path)
 		return "", fmt.Errorf(missingAndroidHome + androidHomeErrorString())
 	}
+	f.tracef("%s: exists", path)
 	return path, nil
 }
 
+// compileSDK returns the API level and SDK extension level of the platform
+// whose android.jar the Java sources are compiled against. Preview platforms,
+// named by their codename, and extension platforms record them in their
+// source.properties as AndroidVersion.ApiLevel and
+// AndroidVersion.ExtensionLevel.
+func compileSDK(f *Flags) (api, ext int, err error) {
+	platform, err := AndroidPlatformPath(f)
+	if err != nil {
+		return 0, 0, err
+	}
+	api, _ = strconv.Atoi(strings.TrimPrefix(filepath.Base(platform), "android-"))
+
+	props := filepath.Join(platform, "source.properties")
+	if !IsFile(f, props) {
+		if api == 0 && f.ShouldRun() {
+			return 0, 0, fmt.Errorf("Android SDK platform %s has no source.properties giving its API level", platform)
+		}
+		return api, 0, nil
+	}
+	data, err := ReadFile(f, props)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch strings.TrimSpace(kv[0]) {
+		case "AndroidVersion.ApiLevel":
+			if api, err = strconv.Atoi(strings.TrimSpace(kv[1])); err != nil {
+				return 0, 0, fmt.Errorf("%s: invalid AndroidVersion.ApiLevel %q", props, strings.TrimSpace(kv[1]))
+			}
+		case "AndroidVersion.ExtensionLevel":
+			if ext, err = strconv.Atoi(strings.TrimSpace(kv[1])); err != nil {
+				return 0, 0, fmt.Errorf("%s: invalid AndroidVersion.ExtensionLevel %q", props, strings.TrimSpace(kv[1]))
+			}
+		}
+	}
+	if api == 0 && f.ShouldRun() {
+		return 0, 0, fmt.Errorf("%s has no AndroidVersion.ApiLevel", props)
+	}
+	f.tracef("%s: API %d, extension %d", props, api, ext)
+	return api, ext, nil
+}
+
 // AndroidPlatformPath returns an android SDK platform directory under ANDROID_HOME.
-// If there are multiple platforms that satisfy the minimum version requirement
-// AndroidPlatformPath returns the latest one among them.
+// If there are multiple platforms that satisfy the minimum version requirement,
+// the min SDK or f.TargetSDK if it is higher, AndroidPlatformPath returns the
+// latest one among them. If f.SDKCodename is set, the preview platform with
+// that codename is returned instead.
 func AndroidPlatformPath(f *Flags) (string, error) {
 	androidHome, err := AndroidSDKPath(f)
 	if err != nil {
@@ -88,15 +183,37 @@ func AndroidPlatformPath(f *Flags) (string, error) {
 
 	platformsDir := filepath.Join(androidHome, "platforms")
 	if !IsDir(f, platformsDir) {
+		f.tracef("%s: missing", platformsDir)
 		return "", fmt.Errorf(missingAndroidPlatformDir + androidHomeErrorString())
 	}
 
+	if f.SDKCodename != "" {
+		p := filepath.Join(platformsDir, "android-"+strings.TrimPrefix(f.SDKCodename, "android-"))
+		if !IsFile(f, filepath.Join(p, "android.jar")) {
+			f.tracef("%s: missing", filepath.Join(p, "android.jar"))
+			return "", fmt.Errorf("Android SDK platform %s was not found in $ANDROID_HOME/platforms. Preview platforms can be installed in Android Studio > SDK Manager.", filepath.Base(p))
+		}
+		f.tracef("platform: %s", p)
+		return p, nil
+	}
+
+	minAPI, err := androidMinSDK(f)
+	if err != nil {
+		return "", err
+	}
+	if f.TargetSDK > minAPI {
+		minAPI = f.TargetSDK
+	}
+
 	platformsDirNames, err := ReadDirNames(f, platformsDir)
 	if err != nil {
 		return "", err
 	}
 	if !f.ShouldRun() {
 		platformsDirNames = []string{"android-21"}
+		if minAPI > 21 {
+			platformsDirNames = []string{"android-" + strconv.Itoa(minAPI)}
+		}
 	}
 
 	var apiPath string
@@ -104,50 +221,302 @@ func AndroidPlatformPath(f *Flags) (string, error) {
 	for _, i := range platformsDirNames {
 		verStr := strings.TrimPrefix(i, "android-")
 		if i == verStr {
+			f.tracef("%s: skipped, not an android-<api> directory", filepath.Join(platformsDir, i))
 			continue
 		}
 
 		ver, err := strconv.Atoi(verStr)
-		if err != nil || ver < minAndroidAPI || ver < apiVer {
+		if err != nil || ver < minAPI || ver < apiVer {
+			f.tracef("%s: skipped, API %q is invalid, below %d or older than API %d", filepath.Join(platformsDir, i), verStr, minAPI, apiVer)
 			continue
 		}
 
 		p := filepath.Join(platformsDir, i)
 		if !IsFile(f, filepath.Join(p, "android.jar")) {
+			f.tracef("%s: missing", filepath.Join(p, "android.jar"))
 			continue
 		}
+		f.tracef("%s: exists, API %d", filepath.Join(p, "android.jar"), ver)
 
 		apiPath = p
 		apiVer = ver
 	}
 
 	if apiVer == 0 {
-		return "", fmt.Errorf(missingAndroidPlatform)
+		return "", fmt.Errorf(missingAndroidPlatform, minAPI)
 	}
+	f.tracef("platform: %s", apiPath)
 	return apiPath, nil
 }
 
 func NDKPath(f *Flags) (string, error) {
+	if f.NDKRoot != "" {
+		return ndkRootOverride(f)
+	}
+
 	path, err := AndroidSDKPath(f)
 	if err != nil {
 		return "", err
 	}
 
-	path = filepath.Join(path, "ndk-bundle")
+	sdkPath := path
+	path = filepath.Join(sdkPath, "ndk-bundle")
 	if !IsDir(f, path) {
-		return "", fmt.Errorf(missingNDK)
+		f.tracef("%s: missing", path)
+		if path = sideBySideNDK(f, sdkPath); path == "" {
+			return "", fmt.Errorf(missingNDK)
+		}
+	}
+	f.tracef("%s: exists", path)
+	if err := verifyNDK(f, path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// sideBySideNDK returns the NDK installed side by side by the SDK manager in
+// the ndk/<version> directory of sdkPath, or "" if there is none. The
+// directory of f.NDKVersion is used if it is set, otherwise the newest.
+func sideBySideNDK(f *Flags, sdkPath string) string {
+	if !f.ShouldRun() {
+		return ""
+	}
+	dir := filepath.Join(sdkPath, "ndk")
+	if f.NDKVersion != "" {
+		if path := filepath.Join(dir, f.NDKVersion); IsDir(f, path) {
+			return path
+		}
+	}
+	names, err := ReadDirNames(f, dir)
+	if err != nil {
+		f.tracef("%s: missing", dir)
+		return ""
+	}
+	newest := []int(nil)
+	path := ""
+	for _, i := range names {
+		ver := parseBuildToolsVersion(i)
+		if len(ver) == 0 || !IsDir(f, filepath.Join(dir, i)) {
+			continue
+		}
+		if newest == nil || versionLess(newest, ver) {
+			newest = ver
+			path = filepath.Join(dir, i)
+		}
+	}
+	return path
+}
+
+// ndkRootOverride returns f.NDKRoot, which replaces the NDK in the SDK so a
+// locally patched toolchain can be used without changing $ANDROID_HOME. The
+// directory must have the NDK's layout, with clang under toolchains/llvm.
+func ndkRootOverride(f *Flags) (string, error) {
+	path, err := filepath.Abs(f.NDKRoot)
+	if err != nil {
+		return "", err
+	}
+	f.tracef("NDKRoot = %q", path)
+	for _, i := range []string{path, filepath.Join(path, "toolchains", "llvm", "prebuilt")} {
+		if !IsDir(f, i) {
+			f.tracef("%s: missing", i)
+			return "", fmt.Errorf("NDK root %s is missing %s", path, i)
+		}
+	}
+	f.tracef("%s: exists", path)
+	if err := verifyNDK(f, path); err != nil {
+		return "", err
 	}
 	return path, nil
 }
 
+// NDKRevision returns the Pkg.Revision of the NDK at ndkPath, as recorded in
+// its source.properties file.
+func NDKRevision(f *Flags, ndkPath string) (string, error) {
+	data, err := ReadFile(f, filepath.Join(ndkPath, "source.properties"))
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) == 2 && strings.TrimSpace(kv[0]) == "Pkg.Revision" {
+			f.tracef("%s: Pkg.Revision = %s", filepath.Join(ndkPath, "source.properties"), strings.TrimSpace(kv[1]))
+			return strings.TrimSpace(kv[1]), nil
+		}
+	}
+	return "", fmt.Errorf("NDK at %s has no Pkg.Revision in source.properties", ndkPath)
+}
+
+// verifyNDK checks the NDK at ndkPath against f.NDKVersion and f.NDKSHA256.
+// It does nothing if neither is set. The SHA-256 is computed by ndkSHA256. An
+// NDK is only verified once per Flags.
+func verifyNDK(f *Flags, ndkPath string) error {
+	if (f.NDKVersion == "" && f.NDKSHA256 == "") || f.ndkVerified == ndkPath || !f.ShouldRun() {
+		return nil
+	}
+
+	if f.NDKVersion != "" {
+		rev, err := NDKRevision(f, ndkPath)
+		if err != nil {
+			return err
+		}
+		if rev != f.NDKVersion {
+			return fmt.Errorf("NDK at %s is version %s, expected %s", ndkPath, rev, f.NDKVersion)
+		}
+	}
+	if f.NDKSHA256 != "" {
+		sum, err := ndkSHA256(f, ndkPath)
+		if err != nil {
+			return err
+		}
+		if !strings.EqualFold(sum, f.NDKSHA256) {
+			return fmt.Errorf("NDK at %s failed verification, it has SHA-256 %s, expected %s", ndkPath, sum, f.NDKSHA256)
+		}
+	}
+	f.ndkVerified = ndkPath
+	return nil
+}
+
+// sysrootOverlay returns the include directory and the library directory
+// for abi in f.SysrootOverlay, which are searched before the NDK's sysroot.
+// The overlay must have an include directory, a lib directory or both, and a
+// lib directory must have a subdirectory for each ABI being built. A
+// directory the overlay does not have is returned as "".
+func sysrootOverlay(f *Flags, abi string) (include, lib string, err error) {
+	overlay, err := filepath.Abs(f.SysrootOverlay)
+	if err != nil {
+		return "", "", err
+	}
+	if !IsDir(f, overlay) {
+		return "", "", fmt.Errorf("sysroot overlay %s does not exist", overlay)
+	}
+	if dir := filepath.Join(overlay, "include"); IsDir(f, dir) {
+		include = dir
+	}
+	if dir := filepath.Join(overlay, "lib"); IsDir(f, dir) {
+		lib = filepath.Join(dir, abi)
+		if !IsDir(f, lib) {
+			return "", "", fmt.Errorf("sysroot overlay %s has no libraries for %s, expected a lib/%s directory", overlay, abi, abi)
+		}
+	}
+	if include == "" && lib == "" {
+		return "", "", fmt.Errorf("sysroot overlay %s must have an include or lib directory", overlay)
+	}
+	return include, lib, nil
+}
+
+// ndkToolchainBinaries lists the host binaries of the llvm toolchain that
+// builds run, relative to its prebuilt directory, with the file names they
+// have on goos.
+func ndkToolchainBinaries(goos string) []string {
+	ext := ""
+	if goos == "windows" {
+		ext = ".exe"
+	}
+	return []string{"bin/clang" + ext, "bin/clang++" + ext, "bin/llvm-strip" + ext}
+}
+
+// ndkSHA256 returns the SHA-256 identifying the NDK at ndkPath. It is the
+// SHA-256 of the "sha256  path" lines, as printed by sha256sum, of the NDK's
+// source.properties and its toolchain binaries that exist, with paths
+// relative to ndkPath. The clang binary must exist. Running
+//
+//	sha256sum source.properties toolchains/llvm/prebuilt/linux-x86_64/bin/{clang,clang++,llvm-strip} | sha256sum
+//
+// in the NDK gives the same SHA-256 for a linux NDK with every binary.
+func ndkSHA256(f *Flags, ndkPath string) (string, error) {
+	hostTag, err := ndkHostTag(f, ndkPath)
+	if err != nil {
+		return "", err
+	}
+	files := []string{"source.properties"}
+	for _, i := range ndkToolchainBinaries(runtime.GOOS) {
+		files = append(files, "toolchains/llvm/prebuilt/"+hostTag+"/"+i)
+	}
+	h := sha256.New()
+	for i, name := range files {
+		sum, err := sha256File(filepath.Join(ndkPath, filepath.FromSlash(name)))
+		if os.IsNotExist(err) && i > 1 {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s  %s\n", sum, name)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// sha256File returns the hex encoded SHA-256 of the file at path.
+func sha256File(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
 func AndroidEnv(f *Flags, goarch string) ([]string, error) {
 	tc, err := toolchainForArch(f, goarch)
 	if err != nil {
 		return nil, err
 	}
-	flags := fmt.Sprintf("-target %s -gcc-toolchain %s", tc.clangTriple, tc.gccToolchain())
-	cflags := fmt.Sprintf("%s --sysroot %s -isystem %s -D__ANDROID_API__=%s", flags, tc.csysroot(), tc.isystem(), tc.api)
-	ldflags := fmt.Sprintf("%s --sysroot %s", flags, tc.ldsysroot())
+	var cflags, ldflags string
+	if tc.unified {
+		// The target's API level selects the headers and libraries in the
+		// sysroot, there is no separate gcc toolchain.
+		cflags = fmt.Sprintf("-target %s --sysroot %s", tc.clangTarget(), tc.csysroot())
+		ldflags = cflags
+	} else {
+		flags := "-target " + tc.clangTriple
+		if !tc.noGCC {
+			flags += " -gcc-toolchain " + tc.gccToolchain()
+		}
+		cflags = fmt.Sprintf("%s --sysroot %s -isystem %s -D__ANDROID_API__=%s", flags, tc.csysroot(), tc.isystem(), tc.api)
+		ldflags = fmt.Sprintf("%s --sysroot %s", flags, tc.ldsysroot())
+	}
+	if f.SysrootOverlay != "" {
+		include, lib, err := sysrootOverlay(f, GetAndroidABI(goarch))
+		if err != nil {
+			return nil, err
+		}
+		if include != "" {
+			cflags = "-I" + include + " " + cflags
+		}
+		if lib != "" {
+			ldflags = "-L" + lib + " " + ldflags
+		}
+	}
+	if f.Require16KB && pageSize16KBABIs[GetAndroidABI(goarch)] {
+		ldflags += " -Wl,-z,max-page-size=16384"
+	}
+	if len(f.Sanitizers) > 0 {
+		sanitize, err := sanitizeFlag(f.Sanitizers)
+		if err != nil {
+			return nil, err
+		}
+		cflags += " " + sanitize + " -fno-omit-frame-pointer"
+		ldflags += " " + sanitize
+	}
+
+	cxxflags := ""
+	abi := GetAndroidABI(goarch)
+	switch f.CppStdlib {
+	case "":
+	case "c++_static":
+		cxxflags = fmt.Sprintf("%s -stdlib=libc++ -isystem %s", cflags, tc.libcxxInclude())
+		ldflags += fmt.Sprintf(" -L%s -static-libstdc++", tc.libcxxLibDir(abi))
+	case "c++_shared":
+		cxxflags = fmt.Sprintf("%s -stdlib=libc++ -isystem %s", cflags, tc.libcxxInclude())
+		ldflags += fmt.Sprintf(" -L%s -lc++_shared", tc.libcxxLibDir(abi))
+	default:
+		return nil, fmt.Errorf("AndroidEnv(): Unsupported C++ standard library %q, valid values are c++_static and c++_shared", f.CppStdlib)
+	}
+
 	env := []string{
 		"GOOS=android",
 		"GOARCH=" + goarch,
@@ -158,61 +527,257 @@ func AndroidEnv(f *Flags, goarch string) ([]string, error) {
 		"CGO_LDFLAGS=" + ldflags,
 		"CGO_ENABLED=1",
 	}
+	if cxxflags != "" {
+		env = append(env, "CGO_CXXFLAGS="+cxxflags)
+	}
 	if goarch == "arm" {
 		env = append(env, "GOARM=7")
 	}
+	if f.Reproducible {
+		env = append(env, reproducibleEnv...)
+		if _, ok := f.GoEnv["GOFLAGS"]; !ok {
+			env = append(env, "GOFLAGS=")
+		}
+	}
+
+	keys := make([]string, 0, len(f.GoEnv))
+	for k := range f.GoEnv {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if k == "" || strings.ContainsAny(k, "= \t\n") {
+			return nil, fmt.Errorf("AndroidEnv(): Invalid environment variable name %q", k)
+		}
+		if protectedAndroidEnv[k] {
+			return nil, fmt.Errorf("AndroidEnv(): %s is set by matcha for the target and cannot be overridden", k)
+		}
+		if f.Reproducible && (k == "LC_ALL" || k == "TZ") {
+			return nil, fmt.Errorf("AndroidEnv(): %s is pinned for reproducible builds and cannot be overridden", k)
+		}
+		env = append(env, k+"="+f.GoEnv[k])
+	}
 	return env, nil
 }
 
+// reproducibleEnv is added to the environment of reproducible builds, so
+// that messages and anything the toolchain formats from the time don't
+// depend on the locale or time zone of the machine. GOFLAGS is also cleared
+// unless Flags.GoEnv sets it.
+var reproducibleEnv = []string{"LC_ALL=C", "TZ=UTC"}
+
+// protectedAndroidEnv are the environment variables set by AndroidEnv that
+// Flags.GoEnv cannot override.
+var protectedAndroidEnv = map[string]bool{
+	"GOOS": true, "GOARCH": true, "GOARM": true, "CC": true, "CXX": true,
+	"CGO_ENABLED": true, "CGO_CFLAGS": true, "CGO_CPPFLAGS": true, "CGO_CXXFLAGS": true, "CGO_LDFLAGS": true,
+}
+
 // Emulate the flags in the clang wrapper scripts generated
 // by make_standalone_toolchain.py
 // https://android.googlesource.com/platform/ndk/+/ndk-release-r16/docs/UnifiedHeaders.md
 // https://developer.android.com/ndk/guides/standalone_toolchain.html#c_stl_support
 // http://zwyuan.github.io/2015/12/22/three-ways-to-use-android-ndk-cross-compiler/
 type ndkToolchain struct {
+	goarch      string
+	abi         string
 	arch        string
 	api         string
 	gcc         string
 	triple      string
 	clangTriple string
 
-	ndkRoot string
-	hostTag string
+	ndkRoot  string
+	hostTag  string
+	revision int  // major revision of the NDK, 0 if it has no source.properties
+	unified  bool // NDK r19 or later, with the sysroot inside the llvm toolchain
+	noGCC    bool // the NDK has no standalone gcc toolchain for the arch
+}
+
+// ndkToolchains lists every architecture that can be built for android, in
+// the order they are built.
+var ndkToolchains = []ndkToolchain{
+	{
+		goarch:      "arm",
+		abi:         "armeabi-v7a",
+		arch:        "arm",
+		api:         "15",
+		gcc:         "arm-linux-androideabi-4.9",
+		triple:      "arm-linux-androideabi",
+		clangTriple: "armv7a-none-linux-androideabi",
+	},
+	{
+		goarch:      "arm64",
+		abi:         "arm64-v8a",
+		arch:        "arm64",
+		api:         "21",
+		gcc:         "aarch64-linux-android-4.9",
+		triple:      "aarch64-linux-android",
+		clangTriple: "aarch64-none-linux-android",
+	},
+	{
+		goarch:      "386",
+		abi:         "x86",
+		arch:        "x86",
+		api:         "15",
+		gcc:         "x86-4.9",
+		triple:      "i686-linux-android",
+		clangTriple: "i686-none-linux-android",
+	},
+	{
+		goarch:      "amd64",
+		abi:         "x86_64",
+		arch:        "x86_64",
+		api:         "21",
+		gcc:         "x86_64-4.9",
+		triple:      "x86_64-linux-android",
+		clangTriple: "x86_64-none-linux-android",
+	},
+}
+
+// SupportedArches returns the GOARCH values that can be built for android.
+func SupportedArches() []string {
+	arches := make([]string, 0, len(ndkToolchains))
+	for _, i := range ndkToolchains {
+		arches = append(arches, i.goarch)
+	}
+	return arches
+}
+
+// normalizeArches returns the GOARCH values in, without duplicates and in the
+// order of SupportedArches. It is an error for in to be empty or to contain a
+// value that is not supported.
+func normalizeArches(in []string) ([]string, error) {
+	set := map[string]bool{}
+	for _, i := range in {
+		set[i] = true
+	}
+
+	arches := []string{}
+	for _, i := range SupportedArches() {
+		if set[i] {
+			arches = append(arches, i)
+			delete(set, i)
+		}
+	}
+	if len(set) > 0 {
+		invalid := make([]string, 0, len(set))
+		for i := range set {
+			invalid = append(invalid, strconv.Quote(i))
+		}
+		sort.Strings(invalid)
+		return nil, fmt.Errorf("unsupported android architectures %v, valid values are %v", strings.Join(invalid, ", "), strings.Join(SupportedArches(), ", "))
+	}
+	if len(arches) == 0 {
+		return nil, errors.New("no android architectures to build")
+	}
+	return arches, nil
+}
+
+// ArchDecision records whether an arch was built into an aar and why.
+type ArchDecision struct {
+	Arch   string // GOARCH, e.g. arm64
+	ABI    string // android ABI, e.g. arm64-v8a
+	Built  bool
+	Reason string
+}
+
+// explainArches returns a decision for each supported arch, in the order of
+// SupportedArches, given the arches selected to be built. Arches that are
+// not selected by the targets are skipped, and so are selected arches the
+// detected NDK can't build for the requested API level, e.g. as it is below
+// the NDK's lowest. Selected arches whose first API level is above the min
+// SDK, or that have their own min SDK, are noted as built against that
+// level.
+func explainArches(f *Flags, androidArchs []string) ([]ArchDecision, error) {
+	minSDK, err := androidMinSDK(f)
+	if err != nil {
+		return nil, err
+	}
+	selected := map[string]bool{}
+	for _, i := range androidArchs {
+		selected[i] = true
+	}
+	// Without an NDK the arches can only be explained by the targets and
+	// API levels.
+	hasNDK := false
+	if f.ShouldRun() {
+		_, err := NDKPath(f)
+		hasNDK = err == nil
+	}
+
+	decisions := []ArchDecision{}
+	for _, tc := range ndkToolchains {
+		d := ArchDecision{Arch: tc.goarch, ABI: tc.abi, Built: selected[tc.goarch]}
+		var tcErr error
+		if d.Built && hasNDK {
+			_, tcErr = toolchainForArch(f, tc.goarch)
+		}
+		if !d.Built {
+			d.Reason = "not selected by the targets"
+		} else if tcErr != nil {
+			d.Built = false
+			d.Reason = "selected by the targets, but the NDK lacks support: " + tcErr.Error()
+		} else if api, ok := f.MinSDKPerABI[tc.abi]; ok {
+			d.Reason = fmt.Sprintf("selected by the targets, built for API %d, the min SDK for %s", api, tc.abi)
+		} else if api, _ := strconv.Atoi(tc.api); api > minSDK {
+			d.Reason = fmt.Sprintf("selected by the targets, built for API %d, the first with %s, rather than the min SDK %d", api, tc.abi, minSDK)
+		} else {
+			d.Reason = fmt.Sprintf("selected by the targets, built for the min SDK %d", minSDK)
+		}
+		decisions = append(decisions, d)
+	}
+	return decisions, nil
+}
+
+// SupportedABIs returns the android ABIs that can be built, in the same order
+// as SupportedArches.
+func SupportedABIs() []string {
+	abis := make([]string, 0, len(ndkToolchains))
+	for _, i := range ndkToolchains {
+		abis = append(abis, i.abi)
+	}
+	return abis
+}
+
+// GetAndroidArch returns the GOARCH of the android ABI abi, or "" if abi is
+// not supported.
+func GetAndroidArch(abi string) string {
+	for _, i := range ndkToolchains {
+		if i.abi == abi {
+			return i.goarch
+		}
+	}
+	return ""
+}
+
+// SelectABIForDevice returns the ABI whose libgojni.so a device would load,
+// given the ABIs the device supports in order of preference, as listed by
+// `getprop ro.product.cpu.abilist`, and the ABIs included in the aar. The
+// package manager installs the libraries of the first device ABI the app
+// provides, so an error means the app fails with an UnsatisfiedLinkError.
+func SelectABIForDevice(deviceABIs []string, builtABIs []string) (string, error) {
+	for _, i := range deviceABIs {
+		i = strings.TrimSpace(i)
+		for _, j := range builtABIs {
+			if i == j {
+				return i, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("none of the built ABIs %v are supported by the device, which supports %v", builtABIs, deviceABIs)
 }
 
 func toolchainForArch(f *Flags, goarch string) (*ndkToolchain, error) {
-	m := map[string]*ndkToolchain{
-		"arm": &ndkToolchain{
-			arch:        "arm",
-			api:         "15",
-			gcc:         "arm-linux-androideabi-4.9",
-			triple:      "arm-linux-androideabi",
-			clangTriple: "armv7a-none-linux-androideabi",
-		},
-		"arm64": &ndkToolchain{
-			arch:        "arm64",
-			api:         "21",
-			gcc:         "aarch64-linux-android-4.9",
-			triple:      "aarch64-linux-android",
-			clangTriple: "aarch64-none-linux-android",
-		},
-		"386": &ndkToolchain{
-			arch:        "x86",
-			api:         "15",
-			gcc:         "x86-4.9",
-			triple:      "i686-linux-android",
-			clangTriple: "i686-none-linux-android",
-		},
-		"amd64": &ndkToolchain{
-			arch:        "x86_64",
-			api:         "21",
-			gcc:         "x86_64-4.9",
-			triple:      "x86_64-linux-android",
-			clangTriple: "x86_64-none-linux-android",
-		},
-	}
-	toolchain, ok := m[goarch]
-	if !ok {
+	var toolchain *ndkToolchain
+	for _, i := range ndkToolchains {
+		if i.goarch == goarch {
+			tc := i
+			toolchain = &tc
+			break
+		}
+	}
+	if toolchain == nil {
 		return nil, fmt.Errorf("toolchainForArch(): Unknown arch %v", goarch)
 	}
 
@@ -222,250 +787,1459 @@ func toolchainForArch(f *Flags, goarch string) (*ndkToolchain, error) {
 	}
 	toolchain.ndkRoot = ndkRoot
 
-	hostTag, err := ndkHostTag()
+	// Build against the min SDK's platform when it is newer than the
+	// architecture's first.
+	minSDK, err := androidMinSDK(f)
+	if err != nil {
+		return nil, err
+	}
+	if api, _ := strconv.Atoi(toolchain.api); minSDK > api {
+		toolchain.api = strconv.Itoa(minSDK)
+	}
+	if abiSDK, ok := f.MinSDKPerABI[toolchain.abi]; ok {
+		if api, _ := strconv.Atoi(toolchain.api); abiSDK < api {
+			return nil, fmt.Errorf("min SDK %d for %s is below its first supported API level, %d", abiSDK, toolchain.abi, api)
+		}
+		toolchain.api = strconv.Itoa(abiSDK)
+	}
+
+	hostTag, err := ndkHostTag(f, ndkRoot)
 	if err != nil {
 		return nil, err
 	}
 	toolchain.hostTag = hostTag
+
+	if toolchain.revision, err = ndkMajorRevision(f, ndkRoot); err != nil {
+		return nil, err
+	}
+	toolchain.unified = toolchain.revision >= 19
+	if toolchain.unified {
+		// Building for a higher API level than the aar's minSdkVersion
+		// would link against symbols missing on the oldest devices it
+		// claims to support.
+		minAPI := minUnifiedNDKAPI(toolchain.revision)
+		if api, _ := strconv.Atoi(toolchain.api); api < minAPI {
+			return nil, fmt.Errorf("NDK r%d at %s supports API level %d and up, %s was requested for %s. Set the min SDK to at least %d or use an older NDK", toolchain.revision, ndkRoot, minAPI, toolchain.api, toolchain.abi, minAPI)
+		}
+	} else if f.ShouldRun() && !IsDir(f, filepath.Join(ndkRoot, "platforms")) {
+		return nil, fmt.Errorf("NDK at %s has no platforms directory. NDKs without one must be r19 or later, with a Pkg.Revision in source.properties", ndkRoot)
+	} else if f.ShouldRun() && !IsDir(f, toolchain.gccToolchain()) {
+		f.tracef("%s: missing", toolchain.gccToolchain())
+		toolchain.noGCC = true
+	}
+
+	if f.ShouldRun() {
+		apis, err := toolchain.availableAPIs(f)
+		if err != nil {
+			return nil, err
+		}
+		if api, _ := strconv.Atoi(toolchain.api); len(apis) > 0 && (api < apis[0] || api > apis[len(apis)-1]) {
+			return nil, fmt.Errorf("NDK at %s provides API levels %d to %d for %s, %d was requested. Set the min SDK within that range or use a different NDK", ndkRoot, apis[0], apis[len(apis)-1], toolchain.abi, api)
+		}
+	}
 	return toolchain, nil
 }
 
+// availableAPIs returns the API levels, in increasing order, that the NDK
+// has sysroot libraries for the toolchain's arch, read from the API
+// directories of the unified sysroot or from the platforms directory of
+// older NDKs.
+func (tc *ndkToolchain) availableAPIs(f *Flags) ([]int, error) {
+	apis := []int{}
+	if tc.unified {
+		dir := filepath.Join(tc.csysroot(), "usr", "lib", tc.triple)
+		names, err := ReadDirNames(f, dir)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, i := range names {
+			if api, err := strconv.Atoi(i); err == nil && IsDir(f, filepath.Join(dir, i)) {
+				apis = append(apis, api)
+			}
+		}
+	} else {
+		dir := filepath.Join(tc.ndkRoot, "platforms")
+		names, err := ReadDirNames(f, dir)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, i := range names {
+			api, err := strconv.Atoi(strings.TrimPrefix(i, "android-"))
+			if err == nil && strings.HasPrefix(i, "android-") && IsDir(f, filepath.Join(dir, i, "arch-"+tc.arch)) {
+				apis = append(apis, api)
+			}
+		}
+	}
+	sort.Ints(apis)
+	f.tracef("%s: NDK API levels %v", tc.abi, apis)
+	return apis, nil
+}
+
+// minUnifiedNDKAPI returns the lowest API level supported by NDK revision,
+// r19 or later. r24 dropped the API levels before 19, and r26 those before
+// 21.
+func minUnifiedNDKAPI(revision int) int {
+	if revision >= 26 {
+		return 21
+	}
+	if revision >= 24 {
+		return 19
+	}
+	return 16
+}
+
+// ndkMajorRevision returns the major revision of the NDK at ndkRoot, e.g. 21
+// for 21.4.7075529, or 0 if it has no source.properties, as before r11. r19
+// and later have a unified sysroot inside the llvm toolchain and encode the
+// API level in the clang target, and r25 removed the platforms directory.
+func ndkMajorRevision(f *Flags, ndkRoot string) (int, error) {
+	if !f.ShouldRun() || !IsFile(f, filepath.Join(ndkRoot, "source.properties")) {
+		return 0, nil
+	}
+	rev, err := NDKRevision(f, ndkRoot)
+	if err != nil {
+		return 0, err
+	}
+	major, err := strconv.Atoi(strings.SplitN(rev, ".", 2)[0])
+	if err != nil {
+		return 0, fmt.Errorf("NDK at %s has an invalid Pkg.Revision %q", ndkRoot, rev)
+	}
+	f.tracef("%s: NDK r%d, unified sysroot %t", ndkRoot, major, major >= 19)
+	return major, nil
+}
+
+func (tc *ndkToolchain) prebuiltDir() string {
+	return filepath.Join(tc.ndkRoot, "toolchains", "llvm", "prebuilt", tc.hostTag)
+}
+
+// clangTarget returns the -target passed to clang. Unified NDKs encode the
+// API level in the target, e.g. aarch64-linux-android21.
+func (tc *ndkToolchain) clangTarget() string {
+	if !tc.unified {
+		return tc.clangTriple
+	}
+	return strings.Replace(tc.clangTriple, "-none-", "-", 1) + tc.api
+}
+
 func (tc *ndkToolchain) gccToolchain() string {
 	return filepath.Join(tc.ndkRoot, "toolchains", tc.gcc, "prebuilt", tc.hostTag)
 }
 
 func (tc *ndkToolchain) clangPath() string {
-	return filepath.Join(tc.ndkRoot, "toolchains", "llvm", "prebuilt", tc.hostTag, "bin", "clang")
+	return filepath.Join(tc.prebuiltDir(), "bin", "clang")
 }
 
 func (tc *ndkToolchain) clangppPath() string {
-	return filepath.Join(tc.ndkRoot, "toolchains", "llvm", "prebuilt", tc.hostTag, "bin", "clang++")
+	return filepath.Join(tc.prebuiltDir(), "bin", "clang++")
 }
 
 func (tc *ndkToolchain) isystem() string {
-	return filepath.Join(tc.ndkRoot, "sysroot", "usr", "include", tc.triple)
+	return filepath.Join(tc.csysroot(), "usr", "include", tc.triple)
 }
 
 func (tc *ndkToolchain) csysroot() string {
+	if tc.unified {
+		return filepath.Join(tc.prebuiltDir(), "sysroot")
+	}
 	return filepath.Join(tc.ndkRoot, "sysroot")
 }
 
 func (tc *ndkToolchain) ldsysroot() string {
+	if tc.unified {
+		return tc.csysroot()
+	}
 	return filepath.Join(tc.ndkRoot, "platforms", "android-"+tc.api, "arch-"+tc.arch)
 }
 
-func GetAndroidABI(arch string) string {
-	switch arch {
-	case "arm":
-		return "armeabi-v7a"
-	case "arm64":
-		return "arm64-v8a"
-	case "386":
-		return "x86"
-	case "amd64":
-		return "x86_64"
+// stripPath returns the strip for the arch. r23 replaced the GNU binutils,
+// which r19 and later also install in the llvm toolchain, with llvm-strip.
+func (tc *ndkToolchain) stripPath() string {
+	switch {
+	case tc.revision >= 23:
+		return filepath.Join(tc.prebuiltDir(), "bin", "llvm-strip")
+	case tc.unified || tc.noGCC:
+		return filepath.Join(tc.prebuiltDir(), "bin", tc.triple+"-strip")
 	}
-	return ""
+	return filepath.Join(tc.gccToolchain(), "bin", tc.triple+"-strip")
 }
 
-func ndkHostTag() (string, error) {
-	if runtime.GOOS == "windows" && runtime.GOARCH == "386" {
-		return "windows", nil
-	} else {
-		var arch string
-		switch runtime.GOARCH {
-		case "386":
-			arch = "x86"
-		case "amd64":
-			arch = "x86_64"
-		default:
-			return "", fmt.Errorf("ndkHostTag(): Unsupported GOARCH %v", runtime.GOARCH)
+// sanitizerRuntimes maps the sanitizers supported by Flags.Sanitizers to the
+// name of their runtime library in the NDK.
+var sanitizerRuntimes = map[string]string{
+	"address":   "asan",
+	"undefined": "ubsan_standalone",
+}
+
+// asanWrapScript is the wrap.sh that preloads the address sanitizer runtime
+// when the app starts, see https://developer.android.com/ndk/guides/asan.
+const asanWrapScript = `#!/system/bin/sh
+HERE="$(cd "$(dirname "$0")" && pwd)"
+export ASAN_OPTIONS=log_to_syslog=false,allow_user_segv_handler=1
+ASAN_LIB=$(ls $HERE/libclang_rt.asan-*-android.so)
+if [ -f "$HERE/libc++_shared.so" ]; then
+    export LD_PRELOAD="$ASAN_LIB $HERE/libc++_shared.so"
+else
+    export LD_PRELOAD="$ASAN_LIB"
+fi
+"$@"
+`
+
+// sanitizeFlag returns the clang -fsanitize flag enabling sanitizers.
+func sanitizeFlag(sanitizers []string) (string, error) {
+	for _, i := range sanitizers {
+		if _, ok := sanitizerRuntimes[i]; !ok {
+			return "", fmt.Errorf("unsupported sanitizer %q, valid values are address and undefined", i)
 		}
-		return runtime.GOOS + "-" + arch, nil
 	}
+	return "-fsanitize=" + strings.Join(sanitizers, ","), nil
 }
 
-func androidHomeErrorString() string {
-	if runtime.GOOS == "windows" {
-		return missingAndroidHomeWin
-	} else if runtime.GOOS == "darwin" {
-		return missingAndroidHomeMac
-	}
-	return missingAndroidHomeLinux
+// sanitizerRuntimeName returns the file name of the shared runtime library of
+// sanitizer for arch.
+func sanitizerRuntimeName(sanitizer, arch string) string {
+	rtArch := map[string]string{"arm": "arm", "arm64": "aarch64", "386": "i686", "amd64": "x86_64"}[arch]
+	return fmt.Sprintf("libclang_rt.%s-%s-android.so", sanitizerRuntimes[sanitizer], rtArch)
 }
 
-func javacErrorString() string {
-	if runtime.GOOS == "windows" {
-		return missingJavacWin
+// sanitizerRuntime returns the path of the NDK's shared runtime library for
+// sanitizer, which is under the directory of the version of clang.
+func (tc *ndkToolchain) sanitizerRuntime(f *Flags, sanitizer string) (string, error) {
+	name := sanitizerRuntimeName(sanitizer, tc.goarch)
+	if !f.ShouldRun() {
+		return filepath.Join(tc.prebuiltDir(), "lib64", "clang", "$CLANG_VERSION", "lib", "linux", name), nil
+	}
+
+	matches := []string{}
+	for _, i := range []string{"lib64", "lib"} {
+		m, err := filepath.Glob(filepath.Join(tc.prebuiltDir(), i, "clang", "*", "lib", "linux", name))
+		if err != nil {
+			return "", err
+		}
+		matches = append(matches, m...)
+	}
+	if len(matches) == 0 {
+		return "", fmt.Errorf("NDK at %s has no %s runtime %s", tc.ndkRoot, sanitizer, name)
+	}
+	sort.Strings(matches)
+	return matches[len(matches)-1], nil
+}
+
+func (tc *ndkToolchain) libcxxInclude() string {
+	if tc.unified {
+		return filepath.Join(tc.csysroot(), "usr", "include", "c++", "v1")
+	}
+	return filepath.Join(tc.ndkRoot, "sources", "cxx-stl", "llvm-libc++", "include")
+}
+
+func (tc *ndkToolchain) libcxxLibDir(abi string) string {
+	if tc.unified {
+		return filepath.Join(tc.csysroot(), "usr", "lib", tc.triple)
+	}
+	return filepath.Join(tc.ndkRoot, "sources", "cxx-stl", "llvm-libc++", "libs", abi)
+}
+
+func GetAndroidABI(arch string) string {
+	for _, i := range ndkToolchains {
+		if i.goarch == arch {
+			return i.abi
+		}
+	}
+	return ""
+}
+
+// ToolchainInfo describes the resolved Android toolchain.
+type ToolchainInfo struct {
+	SDKPath      string
+	PlatformPath string // SDK platform providing android.jar
+	APILevel     int    // API level of the SDK platform
+	NDKPath      string
+	NDKVersion   string // Pkg.Revision of the NDK, or empty if unknown
+	HostTag      string // prebuilt toolchain directory for this machine, e.g. linux-x86_64
+	Arches       []ArchToolchainInfo
+}
+
+// ArchToolchainInfo describes the NDK toolchain used for one architecture.
+type ArchToolchainInfo struct {
+	Arch        string // GOARCH
+	ABI         string
+	APILevel    string // minimum API level the native code is built for
+	ClangTarget string
+	CC          string
+	CXX         string
+	Sysroot     string
+}
+
+// AndroidToolchainInfo resolves the SDK, NDK and per arch toolchains that
+// would be used to build for archs, without building anything.
+func AndroidToolchainInfo(f *Flags, archs []string) (*ToolchainInfo, error) {
+	info := &ToolchainInfo{}
+	var err error
+	if info.SDKPath, err = AndroidSDKPath(f); err != nil {
+		return nil, err
+	}
+	if info.PlatformPath, err = AndroidPlatformPath(f); err != nil {
+		return nil, err
+	}
+	info.APILevel, _ = strconv.Atoi(strings.TrimPrefix(filepath.Base(info.PlatformPath), "android-"))
+	if info.NDKPath, err = NDKPath(f); err != nil {
+		return nil, err
+	}
+	if IsFile(f, filepath.Join(info.NDKPath, "source.properties")) {
+		if info.NDKVersion, err = NDKRevision(f, info.NDKPath); err != nil {
+			return nil, err
+		}
+	}
+	if info.HostTag, err = ndkHostTag(f, info.NDKPath); err != nil {
+		return nil, err
+	}
+
+	for _, arch := range archs {
+		tc, err := toolchainForArch(f, arch)
+		if err != nil {
+			return nil, err
+		}
+		info.Arches = append(info.Arches, ArchToolchainInfo{
+			Arch:        tc.goarch,
+			ABI:         tc.abi,
+			APILevel:    tc.api,
+			ClangTarget: tc.clangTarget(),
+			CC:          tc.clangPath(),
+			CXX:         tc.clangppPath(),
+			Sysroot:     tc.csysroot(),
+		})
+	}
+	return info, nil
+}
+
+// ndkHostTag returns the name of the directory containing the NDK's prebuilt
+// toolchains for this machine.
+func ndkHostTag(f *Flags, ndkRoot string) (string, error) {
+	tag, err := hostTag(runtime.GOOS, runtime.GOARCH, func(tag string) bool {
+		path := filepath.Join(ndkRoot, "toolchains", "llvm", "prebuilt", tag)
+		exists := IsDir(f, path)
+		f.tracef("%s: exists %t", path, exists)
+		return exists
+	})
+	if err == nil {
+		f.tracef("NDK host tag: %s", tag)
+	}
+	return tag, err
+}
+
+// hostTag returns the NDK prebuilt directory for a goos/goarch host. exists
+// reports whether the NDK has a given prebuilt directory and is only called
+// when more than one could apply.
+func hostTag(goos, goarch string, exists func(tag string) bool) (string, error) {
+	// Newer NDKs only ship 64-bit windows prebuilts, which 32-bit binaries
+	// are usually running alongside.
+	if goos == "windows" && goarch == "386" {
+		if exists("windows") {
+			return "windows", nil
+		}
+		return "windows-x86_64", nil
+	} else {
+		var arch string
+		switch goarch {
+		case "386":
+			arch = "x86"
+		case "amd64":
+			arch = "x86_64"
+		default:
+			return "", fmt.Errorf("ndkHostTag(): Unsupported GOARCH %v", goarch)
+		}
+		return goos + "-" + arch, nil
+	}
+}
+
+func androidHomeErrorString() string {
+	if runtime.GOOS == "windows" {
+		return missingAndroidHomeWin
+	} else if runtime.GOOS == "darwin" {
+		return missingAndroidHomeMac
+	}
+	return missingAndroidHomeLinux
+}
+
+func javacErrorString() string {
+	if runtime.GOOS == "windows" {
+		return missingJavacWin
 	} else if runtime.GOOS == "darwin" {
 		return missingJavacMac
 	}
-	return missingJavacLinux
-}
+	return missingJavacLinux
+}
+
+// buildAndroidLibs builds mainPath as a shared library for each arch, writing
+// libgojni.so into the jniLibs directory of androidDir. Libraries for release
+// builds are stripped. If f.NativeDebugSymbols is set, an unstripped copy of
+// each library is kept in the symbols directory of androidDir. If
+// f.BuildMode is c-archive, static libgojni.a archives are written to the
+// staticlibs directory of androidDir instead.
+//
+// The NDK is needed even if the bound packages don't use cgo: the bridge
+// calls into the JVM through JNI with cgo, the Java classes load libgojni.so
+// to reach Go at all, and both build modes link with the NDK's clang.
+func buildAndroidLibs(f *Flags, mainPath, androidDir string, androidArchs []string, matchaPkgPath, gopathDir, tmpdir string) error {
+	buildMode := f.BuildMode
+	switch buildMode {
+	case "":
+		buildMode = "c-shared"
+	case "c-shared":
+	case "c-archive":
+	default:
+		return fmt.Errorf("invalid build mode %q, valid values are c-shared and c-archive", f.BuildMode)
+	}
+
+	lf := *f
+	if len(f.ExportedSymbols) > 0 {
+		versionScript := filepath.Join(androidDir, "libgojni.map")
+		if err := WriteFile(f, versionScript, strings.NewReader(exportsVersionScript(f.ExportedSymbols))); err != nil {
+			return err
+		}
+		lf.BuildLdflags = strings.TrimSpace(f.BuildLdflags + " '-extldflags=-Wl,--version-script=" + versionScript + "'")
+	}
+
+	buildArgs := []string{"-buildmode=" + buildMode}
+	if f.PGOProfile != "" {
+		profile, err := pgoProfile(f)
+		if err != nil {
+			return err
+		}
+		buildArgs = append(buildArgs, "-pgo="+profile)
+	}
+
+	for _, arch := range androidArchs {
+		env, err := AndroidEnv(f, arch)
+		if err != nil {
+			return err
+		}
+		env = append(env, "GOPATH="+gopathDir+string(filepath.ListSeparator)+GoEnv(f, "GOPATH"))
+
+		// The version script is passed to the external linker, so it only
+		// applies to the final link of libgojni.so.
+		archFlags := lf
+		if f.VersionScript != "" {
+			versionScript, err := filepath.Abs(strings.Replace(f.VersionScript, "{abi}", GetAndroidABI(arch), -1))
+			if err != nil {
+				return err
+			}
+			if !IsFile(f, versionScript) {
+				return fmt.Errorf("version script %s for %s does not exist", versionScript, GetAndroidABI(arch))
+			}
+			archFlags.BuildLdflags = strings.TrimSpace(f.BuildLdflags + " '-extldflags=-Wl,--version-script=" + versionScript + "'")
+		}
+
+		libPath := androidLibPath(f, androidDir, GetAndroidABI(arch))
+		err = GoBuild(&archFlags,
+			[]string{mainPath},
+			env,
+			[]string{"matcha"},
+			matchaPkgPath,
+			tmpdir,
+			append(buildArgs, "-o="+libPath)...,
+		)
+		if err != nil {
+			return err
+		}
+
+		if buildMode == "c-shared" {
+			// The sanitizer runtimes are loaded from the app's native
+			// libraries alongside libgojni.so.
+			for _, i := range f.Sanitizers {
+				tc, err := toolchainForArch(f, arch)
+				if err != nil {
+					return err
+				}
+				rt, err := tc.sanitizerRuntime(f, i)
+				if err != nil {
+					return err
+				}
+				if err := CopyFile(f, filepath.Join(filepath.Dir(libPath), filepath.Base(rt)), rt); err != nil {
+					return err
+				}
+				if i == "address" {
+					if err := WriteFile(f, filepath.Join(filepath.Dir(libPath), "wrap.sh"), strings.NewReader(asanWrapScript)); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		if f.NativeDebugSymbols && buildMode == "c-shared" {
+			if err := CopyFile(f, filepath.Join(androidDir, "symbols", GetAndroidABI(arch), "libgojni.so"), libPath); err != nil {
+				return err
+			}
+		}
+		if f.BuildVariant == "release" {
+			tc, err := toolchainForArch(f, arch)
+			if err != nil {
+				return err
+			}
+			strip := "--strip-unneeded"
+			if buildMode == "c-archive" {
+				strip = "--strip-debug"
+			}
+			if err := RunCmd(f, tmpdir, exec.Command(tc.stripPath(), strip, libPath)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// pgoProfile returns the absolute path of f.PGOProfile, checking that it
+// exists and that the installed Go supports profile-guided optimization.
+//
+// A profile is collected from a build without one by running the app's hot
+// paths with a CPU profile, e.g. between pprof.StartCPUProfile and
+// pprof.StopCPUProfile writing to a file in the app's files directory, and
+// copying the file off the device with adb pull. Profiles are merged with
+// go tool pprof -proto.
+func pgoProfile(f *Flags) (string, error) {
+	profile, err := filepath.Abs(f.PGOProfile)
+	if err != nil {
+		return "", err
+	}
+	if !IsFile(f, profile) {
+		return "", fmt.Errorf("PGO profile %s does not exist", profile)
+	}
+
+	ver, err := GoVersion(f)
+	if err != nil {
+		return "", err
+	}
+	if minor, ok := goMinorVersion(ver); f.ShouldRun() && ok && minor < 21 {
+		return "", fmt.Errorf("PGO profiles require Go 1.21 or later, found %s", bytes.TrimSpace(ver))
+	}
+	return profile, nil
+}
+
+// androidLibPath returns the path in androidDir of the library built for
+// abi, libgojni.so in jniLibs or, for c-archive builds, libgojni.a in
+// staticlibs.
+func androidLibPath(f *Flags, androidDir, abi string) string {
+	if f.BuildMode == "c-archive" {
+		return filepath.Join(androidDir, "staticlibs", abi, "libgojni.a")
+	}
+	return filepath.Join(androidDir, "src/main/jniLibs/"+abi+"/libgojni.so")
+}
+
+// exportsVersionScript returns a linker version script that exports symbols,
+// and the JNI entry points the Java classes rely on, hiding everything else.
+func exportsVersionScript(symbols []string) string {
+	buf := &bytes.Buffer{}
+	buf.WriteString("{\n  global:\n    JNI_OnLoad;\n    Java_*;\n")
+	for _, i := range symbols {
+		fmt.Fprintf(buf, "    %s;\n", i)
+	}
+	buf.WriteString("  local:\n    *;\n};\n")
+	return buf.String()
+}
+
+// buildAARLibs builds libgojni.so for each arch into the jniLibs directory of
+// androidDir, from a main package importing the packages being bound.
+func buildAARLibs(f *Flags, androidDir string, pkgs []*build.Package, androidArchs []string, tmpdir string) error {
+	f, release := f.withTimeout()
+	defer release()
+
+	matchaPkgPath, err := MatchaPkgPath(f)
+	if err != nil {
+		return err
+	}
+	roots := bindRoots(pkgs)
+	if len(roots) == 0 {
+		return errors.New("no packages to bind")
+	}
+	if f.CheckSymbols {
+		if err := CheckExportedSymbols(pkgs); err != nil {
+			return err
+		}
+	}
+	mainPath := filepath.Join(tmpdir, "androidlib", "main.go")
+	if err := WriteFile(f, mainPath, strings.NewReader(bindMainFile(roots))); err != nil {
+		return fmt.Errorf("failed to create the main package for android: %v", err)
+	}
+	gopathDir := filepath.Join(tmpdir, "ANDROID-GOPATH")
+	return buildAndroidLibs(f, mainPath, androidDir, androidArchs, matchaPkgPath, gopathDir, tmpdir)
+}
+
+// BuildSingleArch builds only the native library of pkgs for goarch into the
+// jniLibs directory of androidDir and returns its path, without compiling the
+// Java classes or assembling an aar. It is the quickest check that the Go code
+// builds for android, e.g. for editors building on save.
+func BuildSingleArch(f *Flags, androidDir string, pkgs []*build.Package, goarch, tmpdir string) (string, error) {
+	if err := f.Validate(); err != nil {
+		return "", err
+	}
+	archs, err := normalizeArches([]string{goarch})
+	if err != nil {
+		return "", err
+	}
+	if err := buildAARLibs(f, androidDir, pkgs, archs, tmpdir); err != nil {
+		return "", err
+	}
+	return androidLibPath(f, androidDir, GetAndroidABI(goarch)), nil
+}
+
+// BuildResult describes the output of BuildAAR.
+type BuildResult struct {
+	AARPath    string   // path of the aar
+	ABIs       []string // ABIs included in the aar
+	Signatures []string // detached signatures of the aar written by BuildAAR, see SignAAR
+
+	// JNIRegistration maps each ABI to how its libgojni.so registers native
+	// methods: "static", "dynamic", "mixed" or "none".
+	JNIRegistration map[string]string
+
+	// Arches explains why each supported arch was built or skipped.
+	Arches []ArchDecision
+
+	LibSizes   map[string]int64 // size of libgojni.so for each ABI
+	Assets     int              // number of assets
+	AssetBytes int64            // total size of the assets
+	Size       int64            // size of the aar
+
+	// Phases are the steps of the build in the order they ran and the time
+	// each one took.
+	Phases []BuildPhase
+
+	classesDir string // compiled Java classes, see buildAAR
+}
+
+// BuildPhase is a step of a build, e.g. compiling the native libraries.
+type BuildPhase struct {
+	Name     string
+	Duration time.Duration
+}
+
+// addPhase records that the phase name started at start and has finished.
+func (r *BuildResult) addPhase(name string, start time.Time) {
+	r.Phases = append(r.Phases, BuildPhase{Name: name, Duration: time.Since(start)})
+}
+
+// AAR is the format for the binary distribution of an Android Library Project
+// and it is a ZIP archive with extension .aar.
+// http://tools.android.com/tech-docs/new-build-system/aar-format
+//
+// These entries are directly at the root of the archive.
+//
+//  AndroidManifest.xml (mandatory)
+//  classes.jar (mandatory)
+//  assets/ (optional)
+//  jni/<abi>/libgojni.so
+//  R.txt (mandatory)
+//  res/ (mandatory)
+//  libs/*.jar (optional, not relevant)
+//  proguard.txt (optional)
+//  lint.jar (optional, not relevant)
+//  aidl (optional, not relevant)
+//
+// javac and jar commands are needed to build classes.jar. Unless
+// f.PrebuiltLibs is set, libgojni.so is first built for each arch into the
+// jniLibs directory of androidDir.
+//
+// The aars listed in f.FatAAR are merged into the built aar. Their jars are
+// added under libs/, and their native libraries, assets, resources, proguard
+// rules and manifest permissions and features are merged with its own.
+//
+// If f.SignKey is set, a detached signature is written next to the aar, and
+// then f.PostBuild is run with $MATCHA_ARTIFACT set to aarPath.
+func BuildAAR(f *Flags, androidDir string, pkgs []*build.Package, androidArchs []string, tmpdir string, aarPath string) (*BuildResult, error) {
+	result, err := buildAAR(f, androidDir, pkgs, androidArchs, tmpdir, aarPath, "")
+	if err != nil {
+		return nil, err
+	}
+	if f.SignKey != "" && !f.BuildN {
+		if result.Signatures, err = signAARs(f, aarPath, nil, tmpdir); err != nil {
+			return nil, err
+		}
+	}
+	if err := runPostBuild(f, aarPath, tmpdir); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// buildAAR is BuildAAR, using the Java classes already compiled in
+// classesDir if it is set. Bind compiles them once and shares them between
+// variants, which differ only in their native libraries. The classes
+// directory is returned in the result's classesDir.
+func buildAAR(f *Flags, androidDir string, pkgs []*build.Package, androidArchs []string, tmpdir string, aarPath string, classesDir string) (_ *BuildResult, err error) {
+	if err := f.Validate(); err != nil {
+		return nil, err
+	}
+	androidArchs, err = normalizeArches(androidArchs)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &BuildResult{
+		AARPath:         aarPath,
+		JNIRegistration: map[string]string{},
+		LibSizes:        map[string]int64{},
+	}
+	for _, arch := range androidArchs {
+		result.ABIs = append(result.ABIs, GetAndroidABI(arch))
+	}
+
+	if result.Arches, err = explainArches(f, androidArchs); err != nil {
+		return nil, err
+	}
+	for _, i := range result.Arches {
+		for _, arch := range androidArchs {
+			if !i.Built && i.Arch == arch {
+				return nil, fmt.Errorf("cannot build %s (%s): %s", i.Arch, i.ABI, i.Reason)
+			}
+		}
+	}
+	if f.BuildV {
+		for _, i := range result.Arches {
+			built := "skipped"
+			if i.Built {
+				built = "built"
+			}
+			f.Logger.Printf("arch %s (%s): %s, %s\n", i.Arch, i.ABI, built, i.Reason)
+		}
+	}
+	compileSdk, compileSdkExt := 0, 0
+	if f.AGPVersion != "" {
+		if compileSdk, compileSdkExt, err = compileSDK(f); err != nil {
+			return nil, err
+		}
+	}
+	metadata, err := aarMetadata(f.AGPVersion, compileSdk, compileSdkExt)
+	if err != nil {
+		return nil, err
+	}
+
+	if !f.PrebuiltLibs {
+		start := time.Now()
+		if err := buildAARLibs(f, androidDir, pkgs, androidArchs, tmpdir); err != nil {
+			return nil, err
+		}
+		result.addPhase("native", start)
+	}
+
+	if !f.ShouldRun() { // TODO(KD):
+		return result, nil
+	}
+	f, release := f.withTimeout()
+	defer release()
+
+	var out io.Writer = ioutil.Discard
+	if !f.BuildN {
+		file, err := os.Create(aarPath)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			if cerr := file.Close(); err == nil {
+				err = cerr
+			}
+			// Don't leave a partial aar behind, e.g. after a timeout.
+			if err != nil {
+				os.Remove(aarPath)
+			}
+		}()
+		out = file
+	}
+
+	deps, err := openAARDeps(f.FatAAR)
+	if err != nil {
+		return nil, err
+	}
+	defer closeAARDeps(deps)
+	if err := checkAARDepResources(deps); err != nil {
+		return nil, err
+	}
+	if err := checkJars(f.MergeJars); err != nil {
+		return nil, err
+	}
+	extraNames := make([]string, 0, len(f.ExtraAARFiles))
+	for name := range f.ExtraAARFiles {
+		extraNames = append(extraNames, name)
+	}
+	sort.Strings(extraNames)
+	for _, name := range extraNames {
+		if src := f.ExtraAARFiles[name]; !IsFile(f, src) {
+			return nil, fmt.Errorf("extra aar file %s: %s does not exist", name, src)
+		}
+	}
+	var rtxt []byte
+	if f.RTxt != "" {
+		if rtxt, err = readRTxt(f.RTxt); err != nil {
+			return nil, err
+		}
+	}
+
+	// The entries are recorded so that a script can assemble them with zip.
+	var scripted *scriptAAR
+	if f.script != nil {
+		scripted = newScriptAAR()
+	}
+
+	aarw := zip.NewWriter(out)
+	written := map[string]string{}
+	aarwcreateHeader := func(fh *zip.FileHeader) (io.Writer, error) {
+		if f.BuildV {
+			f.Logger.Printf("aar: %s\n", fh.Name)
+		}
+		written[fh.Name] = aarPath
+		w, err := aarw.CreateHeader(fh)
+		return scripted.add(fh.Name, w), err
+	}
+	aarwcreateRaw := func(fh *zip.FileHeader) (io.Writer, error) {
+		if f.BuildV {
+			f.Logger.Printf("aar: %s\n", fh.Name)
+		}
+		written[fh.Name] = aarPath
+		w, err := aarw.CreateRaw(fh)
+		scripted.add(fh.Name, w) // raw entries are compressed, only assets are written raw
+		return w, err
+	}
+	aarwcreate := func(name string) (io.Writer, error) {
+		return aarwcreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate})
+	}
+	manifest, err := aarManifestSource(f, pkgs, deps)
+	if err != nil {
+		return nil, err
+	}
+	w, err := aarwcreate("AndroidManifest.xml")
+	if err != nil {
+		return nil, err
+	}
+	io.WriteString(w, manifest)
+
+	if metadata != "" {
+		w, err = aarwcreate(aarMetadataName)
+		if err != nil {
+			return nil, err
+		}
+		io.WriteString(w, metadata)
+	}
+
+	src := filepath.Join(androidDir, "src/main/java")
+	pkgName := bindName(pkgs)
+	if hasBuildConfig(f) && classesDir == "" {
+		buildConfig, err := buildConfigSource(f, pkgName)
+		if err != nil {
+			return nil, err
+		}
+		if err := WriteFile(f, filepath.Join(src, "go", pkgName, "BuildConfig.java"), bytes.NewReader(buildConfig)); err != nil {
+			return nil, err
+		}
+	}
+	if f.EmbedVersion && classesDir == "" {
+		if err := WriteFile(f, filepath.Join(src, "go", pkgName, "MatchaVersion.java"), bytes.NewReader(versionSource(pkgName, f.Version))); err != nil {
+			return nil, err
+		}
+	}
+	rPkg := "go." + pkgName + ".gojni"
+	rSources := map[string][]byte{}
+	if classesDir == "" {
+		if rSources, err = aarDepRSources(deps, rPkg); err != nil {
+			return nil, err
+		}
+		rNames := make([]string, 0, len(rSources))
+		for name := range rSources {
+			rNames = append(rNames, name)
+		}
+		sort.Strings(rNames)
+		for _, name := range rNames {
+			if err := WriteFile(f, filepath.Join(src, filepath.FromSlash(name)), bytes.NewReader(rSources[name])); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if classesDir == "" {
+		start := time.Now()
+		if classesDir, err = compileJava(f, src, strings.Join(bindRoots(pkgs), " "), tmpdir); err != nil {
+			return nil, err
+		}
+		if f.VerifyJar {
+			if err := verifyJar(f, classesDir, tmpdir); err != nil {
+				return nil, err
+			}
+		}
+		if len(rSources) > 0 && f.ShouldRun() {
+			// The app generates the real R class of rPkg; drop the stub
+			// the dependencies' R classes were compiled against.
+			stubs, _ := filepath.Glob(filepath.Join(classesDir, filepath.FromSlash(strings.Replace(rPkg, ".", "/", -1)), "R*.class"))
+			for _, stub := range stubs {
+				if base := filepath.Base(stub); base == "R.class" || strings.HasPrefix(base, "R$") {
+					if err := os.Remove(stub); err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+		result.addPhase("java", start)
+	}
+	result.classesDir = classesDir
+
+	w, err = aarwcreate("proguard.txt")
+	if err != nil {
+		return nil, err
+	}
+	if f.NativeKeepRules {
+		rules, err := nativeKeepRules(f, classesDir, pkgs)
+		if err != nil {
+			return nil, err
+		}
+		w.Write(rules)
+	} else {
+		fmt.Fprintln(w, `-keep class go.** { *; }`)
+	}
+	// The consumer rules go in proguard.txt too: it is the only rules entry
+	// the Android Gradle plugin reads from an aar, and there are no library
+	// rules to keep apart as the aar is not shrunk.
+	if f.ConsumerRules != "" {
+		rules, err := ReadFile(f, f.ConsumerRules)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(w, "\n# %s\n%s\n", filepath.Base(f.ConsumerRules), bytes.TrimRight(rules, "\n"))
+	}
+	depProguard, err := aarDepText(deps, "proguard.txt")
+	if err != nil {
+		return nil, err
+	}
+	w.Write(depProguard)
+
+	w, err = aarwcreateHeader(classesJarHeader(f))
+	if err != nil {
+		return nil, err
+	}
+	packageStart := time.Now()
+	if err := writeJar(f, w, classesDir); err != nil {
+		return nil, err
+	}
+
+	assets, err := collectAssets(f, pkgs)
+	if err != nil {
+		return nil, err
+	}
+	if f.MaxAssetBytes > 0 {
+		if err := checkAssetBudget(assets, f.MaxAssetBytes); err != nil {
+			return nil, err
+		}
+	}
+	if f.AllowedAssetExts != nil {
+		if err := checkAssetExts(assets, f.AllowedAssetExts); err != nil {
+			if !f.WarnAssetExts {
+				return nil, err
+			}
+			f.warnf("%v", err)
+		}
+	}
+	if !f.NoAssetWarnings {
+		for _, i := range reservedAssetWarnings(assets) {
+			f.warnf("%s", i)
+		}
+	}
+	if f.Parallel > 1 {
+		err = writeAssetsParallel(f, aarwcreateRaw, assets)
+	} else {
+		err = writeAssets(f, aarwcreateHeader, assets)
+	}
+	if err != nil {
+		return nil, err
+	}
+	result.Assets = len(assets)
+	for _, i := range assets {
+		result.AssetBytes += i.info.Size()
+		scripted.source(i.name, i.path)
+	}
+
+	// Static archives are linked into the app's own native code rather than
+	// loaded from jni/.
+	jniArchs := androidArchs
+	if f.BuildMode == "c-archive" {
+		jniArchs = nil
+	}
+	for _, arch := range jniArchs {
+		lib := GetAndroidABI(arch) + "/libgojni.so"
+		libPath := filepath.Join(androidDir, "src/main/jniLibs/"+lib)
+		if err := writeFileEntry(aarwcreate, "jni/"+lib, libPath); err != nil {
+			return nil, err
+		}
+		scripted.source("jni/"+lib, libPath)
+		if !f.NoVerifyELF {
+			if err := verifyELFMachine(libPath, GetAndroidABI(arch)); err != nil {
+				return nil, err
+			}
+		}
+		if pageSize16KBABIs[GetAndroidABI(arch)] {
+			align, err := loadAlignment(libPath)
+			if err != nil {
+				return nil, err
+			}
+			if align < pageSize16KB {
+				msg := fmt.Sprintf("%s is aligned to %d byte pages and won't load on devices with 16KB pages, link it with -Wl,-z,max-page-size=16384", lib, align)
+				if f.Require16KB {
+					return nil, errors.New(msg)
+				}
+				f.warnf("%s.", msg)
+			}
+		}
+
+		reg, err := jniRegistration(libPath)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %v", libPath, err)
+		}
+		result.JNIRegistration[GetAndroidABI(arch)] = reg
+		if fi, err := os.Stat(libPath); err == nil {
+			result.LibSizes[GetAndroidABI(arch)] = fi.Size()
+		}
+		if f.BuildV {
+			f.Logger.Printf("jni: %s uses %s registration\n", lib, reg)
+		}
+		if f.BuildVariant == "release" && (reg == jniDynamic || reg == jniMixed) {
+			f.warnf("%s registers native methods dynamically in a release build, exporting Java_* symbols avoids the RegisterNatives calls at startup.", lib)
+		}
+
+		// Apps must load libc++_shared.so before libgojni.so on API levels
+		// below 18.
+		if f.CppStdlib == "c++_shared" {
+			tc, err := toolchainForArch(f, arch)
+			if err != nil {
+				return nil, err
+			}
+			abi := GetAndroidABI(arch)
+			src := filepath.Join(tc.libcxxLibDir(abi), "libc++_shared.so")
+			if err := writeFileEntry(aarwcreate, "jni/"+abi+"/libc++_shared.so", src); err != nil {
+				return nil, err
+			}
+			scripted.source("jni/"+abi+"/libc++_shared.so", src)
+		}
+		if err := writeSanitizerLibs(f, aarwcreate, scripted, androidDir, arch); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := writeAARDeps(aarwcreate, written, deps); err != nil {
+		return nil, err
+	}
+
+	// TODO(hyangah): do we need to use aapt to create R.txt? Until then
+	// f.RTxt supplies the resources of the library.
+	w, err = aarwcreate("R.txt")
+	if err != nil {
+		return nil, err
+	}
+	depRTxt, err := mergeRTxt(rtxt, deps)
+	if err != nil {
+		return nil, err
+	}
+	w.Write(depRTxt)
+
+	// Some versions of the Android Gradle plugin fail to parse an aar with a
+	// bare res/ entry, so f.MinimalRes adds an empty values resource instead.
+	// The values files of merged aars are prefixed with their names, so they
+	// don't conflict with it.
+	if !f.MinimalRes {
+		if _, err = aarwcreate("res/"); err != nil {
+			return nil, err
+		}
+	} else {
+		w, err = aarwcreate("res/values/values.xml")
+		if err != nil {
+			return nil, err
+		}
+		io.WriteString(w, minimalResValues)
+	}
 
-// AAR is the format for the binary distribution of an Android Library Project
-// and it is a ZIP archive with extension .aar.
-// http://tools.android.com/tech-docs/new-build-system/aar-format
-//
-// These entries are directly at the root of the archive.
-//
-//  AndroidManifest.xml (mandatory)
-//  classes.jar (mandatory)
-//  assets/ (optional)
-//  jni/<abi>/libgojni.so
-//  R.txt (mandatory)
-//  res/ (mandatory)
-//  libs/*.jar (optional, not relevant)
-//  proguard.txt (optional)
-//  lint.jar (optional, not relevant)
-//  aidl (optional, not relevant)
-//
-// javac and jar commands are needed to build classes.jar.
-func BuildAAR(f *Flags, androidDir string, pkgs []*build.Package, androidArchs []string, tmpdir string, aarPath string) (err error) {
-	if !f.ShouldRun() { // TODO(KD):
-		return nil
+	for _, name := range extraNames {
+		if orig, ok := written[name]; ok {
+			return nil, fmt.Errorf("extra aar file %s conflicts with an entry from %s", name, orig)
+		}
+		src := f.ExtraAARFiles[name]
+		if err := writeFileEntry(aarwcreate, name, src); err != nil {
+			return nil, err
+		}
+		scripted.source(name, src)
 	}
 
-	var out io.Writer = ioutil.Discard
-	if !f.BuildN {
-		f, err := os.Create(aarPath)
+	if scripted != nil {
+		manifest, err := jarManifest(f.JarManifestAttrs)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		defer func() {
-			if cerr := f.Close(); err == nil {
-				err = cerr
+		stageDir := filepath.Join(tmpdir, "aar", strings.TrimSuffix(filepath.Base(aarPath), ".aar"))
+		// Merged jars can't be rebuilt with zip, so the script writes the
+		// built classes.jar instead.
+		jarDir := classesDir
+		if len(f.MergeJars) > 0 {
+			jarDir = ""
+		}
+		f.script.aar(aarPath, stageDir, scripted, jarDir, manifest)
+	}
+
+	if err := aarw.SetComment(archiveComment(f)); err != nil {
+		return nil, err
+	}
+	if err := aarw.Close(); err != nil {
+		return nil, err
+	}
+	result.addPhase("package", packageStart)
+	if fi, err := os.Stat(aarPath); err == nil && !f.BuildN {
+		result.Size = fi.Size()
+	}
+
+	if f.BuildJavadoc {
+		buf := &bytes.Buffer{}
+		if err := BuildJavadocJar(f, src, buf); err != nil {
+			return nil, err
+		}
+		if buf.Len() > 0 {
+			if err := WriteFile(f, JavadocJarPath(aarPath), buf); err != nil {
+				return nil, err
 			}
-		}()
-		out = f
+		}
+	}
+	if f.TestHarness {
+		buf := &bytes.Buffer{}
+		if err := BuildTestHarnessJar(f, src, buf); err != nil {
+			return nil, err
+		}
+		if err := WriteFile(f, TestHarnessJarPath(aarPath), buf); err != nil {
+			return nil, err
+		}
+	}
+	if f.NativeDebugSymbols {
+		if err := writeNativeDebugSymbols(f, androidDir, androidArchs, NativeDebugSymbolsPath(aarPath)); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// minimalResValues is the values resource written when Flags.MinimalRes is
+// set. It defines no resources, so the aar's R.txt stays empty.
+const minimalResValues = `<?xml version="1.0" encoding="utf-8"?>
+<resources/>
+`
+
+// EstimateAARSize returns a rough estimate of the size in bytes of the aar
+// BuildAAR would build, without compiling anything. It is the total size of
+// the assets and of any native libraries already built into androidDir, so it
+// ignores compression and the Java classes.
+func EstimateAARSize(f *Flags, androidDir string, pkgs []*build.Package, androidArchs []string) (int64, error) {
+	assets, err := collectAssets(f, pkgs)
+	if err != nil {
+		return 0, err
+	}
+	size := int64(0)
+	for _, i := range assets {
+		size += i.info.Size()
 	}
 
-	aarw := zip.NewWriter(out)
-	aarwcreate := func(name string) (io.Writer, error) {
-		if f.BuildV {
-			f.Logger.Printf("aar: %s\n", name)
+	for _, arch := range androidArchs {
+		libPath := filepath.Join(androidDir, "src/main/jniLibs/"+GetAndroidABI(arch)+"/libgojni.so")
+		if info, err := os.Stat(libPath); err == nil {
+			size += info.Size()
+		} else if !os.IsNotExist(err) {
+			return 0, err
 		}
-		return aarw.Create(name)
 	}
-	w, err := aarwcreate("AndroidManifest.xml")
+	return size, nil
+}
+
+// AARFileName returns the file name of an aar built from module, following
+// the <module>-<variant>-<version>.aar scheme. Empty variants and versions are
+// left out of the name.
+func AARFileName(module, variant, version string) string {
+	name := module
+	for _, i := range []string{variant, version} {
+		if i != "" {
+			name += "-" + i
+		}
+	}
+	return name + ".aar"
+}
+
+// JavadocJarPath returns the path of the javadoc jar written next to aarPath.
+func JavadocJarPath(aarPath string) string {
+	return strings.TrimSuffix(aarPath, ".aar") + "-javadoc.jar"
+}
+
+// NativeDebugSymbolsPath returns the path of the native debug symbols zip
+// written next to aarPath.
+func NativeDebugSymbolsPath(aarPath string) string {
+	return strings.TrimSuffix(aarPath, ".aar") + "-native-debug-symbols.zip"
+}
+
+// writeNativeDebugSymbols zips the unstripped libraries kept by
+// buildAndroidLibs into path, laid out as <abi>/libgojni.so for upload to the
+// Play Console.
+func writeNativeDebugSymbols(f *Flags, androidDir string, androidArchs []string, path string) (err error) {
+	if f.ShouldPrint() {
+		f.Logger.Printf("write %s\n", path)
+	}
+	if !f.ShouldRun() {
+		return nil
+	}
+
+	file, err := os.Create(path)
 	if err != nil {
 		return err
 	}
-	const manifestFmt = `<manifest xmlns:android="http://schemas.android.com/apk/res/android" package=%q>
-<uses-sdk android:minSdkVersion="%d"/></manifest>`
-	fmt.Fprintf(w, manifestFmt, "go."+pkgs[0].Name+".gojni", minAndroidAPI)
+	defer func() {
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+	}()
 
-	w, err = aarwcreate("proguard.txt")
+	zipw := zip.NewWriter(file)
+	for _, arch := range androidArchs {
+		lib := GetAndroidABI(arch) + "/libgojni.so"
+		if err := writeFileEntry(zipw.Create, lib, filepath.Join(androidDir, "symbols", lib)); err != nil {
+			return err
+		}
+	}
+	return zipw.Close()
+}
+
+func BuildJar(f *Flags, w io.Writer, srcDir string, tmpdir string) error {
+	if err := f.Validate(); err != nil {
+		return err
+	}
+	dst, err := compileJava(f, srcDir, "", tmpdir)
 	if err != nil {
 		return err
 	}
-	fmt.Fprintln(w, `-keep class go.** { *; }`)
+	if f.VerifyJar {
+		if err := verifyJar(f, dst, tmpdir); err != nil {
+			return err
+		}
+	}
+	return writeJar(f, w, dst)
+}
+
+// compileJava compiles the Java sources in srcDir, returning the directory
+// containing the class files. cacheKey identifies the project in the cache of
+// incremental builds, srcDir is used if it is empty.
+func compileJava(f *Flags, srcDir, cacheKey, tmpdir string) (string, error) {
+	if f.JavaSourceTransform != nil && f.ShouldRun() {
+		stagingDir := filepath.Join(tmpdir, "java-staging")
+		if err := stageJavaSources(f, stagingDir, srcDir); err != nil {
+			return "", err
+		}
+		srcDir = stagingDir
+	}
+
+	if err := checkJavacTarget(f); err != nil {
+		return "", err
+	}
 
-	w, err = aarwcreate("classes.jar")
+	srcFiles, err := sourceFiles(f, srcDir, ".java")
 	if err != nil {
-		return err
+		return "", err
 	}
-	src := filepath.Join(androidDir, "src/main/java")
-	if err := BuildJar(f, w, src, tmpdir); err != nil {
-		return err
+
+	dst := filepath.Join(tmpdir, "javac-output")
+	if err := Mkdir(f, dst); err != nil {
+		return "", err
+	}
+	if f.ShouldRun() {
+		if err := os.Chmod(dst, f.tmpDirPerm()); err != nil {
+			return "", err
+		}
 	}
 
-	// Assets....
-	// files := map[string]string{}
-	// for _, pkg := range pkgs {
-	// 	assetsDir := filepath.Join(pkg.Dir, "assets")
-	// 	assetsDirExists := false
-	// 	if fi, err := os.Stat(assetsDir); err == nil {
-	// 		assetsDirExists = fi.IsDir()
-	// 	} else if !os.IsNotExist(err) {
-	// 		return err
-	// 	}
-
-	// 	if assetsDirExists {
-	// 		err := filepath.Walk(
-	// 			assetsDir, func(path string, info os.FileInfo, err error) error {
-	// 				if err != nil {
-	// 					return err
-	// 				}
-	// 				if info.IsDir() {
-	// 					return nil
-	// 				}
-	// 				f, err := os.Open(path)
-	// 				if err != nil {
-	// 					return err
-	// 				}
-	// 				defer f.Close()
-	// 				name := "assets/" + path[len(assetsDir)+1:]
-	// 				if orig, exists := files[name]; exists {
-	// 					return fmt.Errorf("package %s asset name conflict: %s already added from package %s",
-	// 						pkg.ImportPath, name, orig)
-	// 				}
-	// 				files[name] = pkg.ImportPath
-	// 				w, err := aarwcreate(name)
-	// 				if err != nil {
-	// 					return nil
-	// 				}
-	// 				_, err = io.Copy(w, f)
-	// 				return err
-	// 			})
-	// 		if err != nil {
-	// 			return err
-	// 		}
-	// 	}
-	// }
+	bClspath, err := bootClasspath(f)
+	if err != nil {
+		return "", err
+	}
 
-	for _, arch := range androidArchs {
-		lib := GetAndroidABI(arch) + "/libgojni.so"
-		w, err = aarwcreate("jni/" + lib)
-		if err != nil {
-			return err
+	// Kotlin sources are compiled first, referencing the Java sources, and
+	// javac then compiles the Java sources against their output.
+	var ktFiles []string
+	if f.ShouldRun() {
+		if ktFiles, err = sourceFiles(f, srcDir, ".kt"); err != nil {
+			return "", err
 		}
-		if !f.BuildN {
-			r, err := os.Open(filepath.Join(androidDir, "src/main/jniLibs/"+lib))
-			if err != nil {
-				return err
-			}
-			defer r.Close()
-			if _, err := io.Copy(w, r); err != nil {
-				return err
+	}
+	// Builds with Kotlin sources are always compiled in full.
+	if f.Incremental && len(ktFiles) == 0 && f.ShouldRun() {
+		return compileJavaIncremental(f, srcDir, srcFiles, cacheKey, bClspath, tmpdir)
+	}
+	if len(ktFiles) > 0 {
+		kotlinc := f.KotlincPath
+		if kotlinc == "" {
+			if kotlinc, err = LookPath(f, "kotlinc"); err != nil {
+				return "", fmt.Errorf("found Kotlin sources in %s but kotlinc was not found in $PATH, install it or set the kotlinc path", srcDir)
 			}
 		}
+		// javac compiles for the JVM target of the Kotlin classes.
+		target, err := kotlinTarget(f)
+		if err != nil {
+			return "", err
+		}
+		kf := *f
+		kf.JavaVersion = target
+		f = &kf
+		if !mergesKotlinStdlib(f) {
+			f.warnf("the Kotlin classes in classes.jar need kotlin-stdlib at runtime, apps must depend on org.jetbrains.kotlin:kotlin-stdlib of kotlinc's version or later, or merge kotlinc's lib/kotlin-stdlib.jar into the aar with --merge-jars")
+		}
+
+		ktArgs := []string{
+			"-d", dst,
+			"-jvm-target", target,
+			"-classpath", javaClasspath(f, bClspath),
+		}
+		ktArgs = append(ktArgs, ktFiles...)
+		ktArgs = append(ktArgs, srcFiles...)
+
+		cmd := exec.Command(kotlinc, ktArgs...)
+		cmd.Dir = srcDir
+		if err := RunCmd(f, tmpdir, cmd); err != nil {
+			return "", err
+		}
 	}
 
-	// TODO(hyangah): do we need to use aapt to create R.txt?
-	w, err = aarwcreate("R.txt")
+	args := javacArgs(f, dst, bClspath)
+	if len(ktFiles) > 0 {
+		args = append(args, "-classpath", javaClasspath(f, dst))
+	} else if len(f.MergeJars) > 0 {
+		args = append(args, "-classpath", javaClasspath(f))
+	}
+	args = append(args, srcFiles...)
+
+	javac := exec.Command("javac", args...)
+	javac.Dir = srcDir
+	if err := RunCmd(f, tmpdir, javac); err != nil {
+		return "", err
+	}
+	return dst, nil
+}
+
+// classesJarHeader returns the header of the classes.jar entry of the aar.
+// The jar is already compressed, so it is stored unless f.CompressClassesJar
+// is set.
+func classesJarHeader(f *Flags) *zip.FileHeader {
+	fh := &zip.FileHeader{Name: "classes.jar", Method: zip.Store}
+	if f.CompressClassesJar {
+		fh.Method = zip.Deflate
+	}
+	return fh
+}
+
+// writeJar writes the class files in classesDir to w as a jar.
+func writeJar(f *Flags, w io.Writer, classesDir string) error {
+	// fmt.Println("javac", args)
+	// if buildX {
+	// KD: printcmd("jar c -C %s .", dst)
+	// }
+	manifest, err := jarManifest(f.JarManifestAttrs)
 	if err != nil {
 		return err
 	}
-
-	w, err = aarwcreate("res/")
+	if !f.ShouldRun() {
+		return nil
+	}
+	jarw := zip.NewWriter(w)
+	jarwcreate := func(name string) (io.Writer, error) {
+		if f.BuildV {
+			f.Logger.Printf("jar: %s\n", name)
+		}
+		return jarw.Create(name)
+	}
+	manifestFile, err := jarwcreate("META-INF/MANIFEST.MF")
 	if err != nil {
 		return err
 	}
+	manifestFile.Write(manifest)
 
-	return aarw.Close()
+	written := map[string]string{}
+	create := func(name string) (io.Writer, error) {
+		written[name] = classesDir
+		return jarwcreate(name)
+	}
+	if err := writeDir(create, classesDir); err != nil {
+		return err
+	}
+	if err := mergeJars(jarwcreate, written, f.MergeJars); err != nil {
+		return err
+	}
+	return jarw.Close()
 }
 
-func BuildJar(f *Flags, w io.Writer, srcDir string, tmpdir string) error {
-	var srcFiles []string
-	if !f.ShouldRun() {
-		srcFiles = []string{"*.java"}
-	} else {
-		err := filepath.Walk(srcDir, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			if filepath.Ext(path) == ".java" {
-				srcFiles = append(srcFiles, filepath.Join(".", path[len(srcDir):]))
+// jarManifest returns the contents of META-INF/MANIFEST.MF, with attrs added
+// to the main section in sorted order. Attribute names and values are
+// validated and long lines are wrapped as described in the JAR File
+// Specification.
+func jarManifest(attrs map[string]string) ([]byte, error) {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	buf := &bytes.Buffer{}
+	buf.WriteString(strings.TrimSuffix(manifestHeader, "\n"))
+	for _, k := range keys {
+		if !isValidJarAttrName(k) {
+			return nil, fmt.Errorf("invalid jar manifest attribute name %q", k)
+		}
+		if strings.EqualFold(k, "Manifest-Version") || strings.EqualFold(k, "Created-By") {
+			return nil, fmt.Errorf("jar manifest attribute %s cannot be overridden", k)
+		}
+		v := attrs[k]
+		if strings.ContainsAny(v, "\r\n\x00") {
+			return nil, fmt.Errorf("jar manifest attribute %s has a value containing a line break or NUL", k)
+		}
+
+		// Lines are at most 72 bytes, continuation lines start with a space.
+		line := k + ": " + v
+		for len(line) > 72 {
+			n := 72
+			for n > 0 && !utf8.RuneStart(line[n]) {
+				n--
 			}
-			return nil
-		})
-		if err != nil {
-			return err
+			buf.WriteString(line[:n] + "\n")
+			line = " " + line[n:]
 		}
+		buf.WriteString(line + "\n")
 	}
+	buf.WriteString("\n")
+	return buf.Bytes(), nil
+}
 
-	dst := filepath.Join(tmpdir, "javac-output")
+// isValidJarAttrName reports whether name is 1 to 70 letters, digits,
+// hyphens and underscores, starting with a letter or digit.
+func isValidJarAttrName(name string) bool {
+	if name == "" || len(name) > 70 || name[0] == '-' || name[0] == '_' {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// BuildJavadocJar runs javadoc over the Java sources in srcDir and writes the
+// generated HTML to w as a jar, as required by Maven-style repositories. If
+// javadoc is not installed a warning is logged and nothing is written.
+func BuildJavadocJar(f *Flags, srcDir string, w io.Writer) error {
+	if _, err := LookPath(f, "javadoc"); err != nil {
+		f.warnf("javadoc was not found in $PATH, skipping javadoc jar.")
+		return nil
+	}
+
+	srcFiles, err := sourceFiles(f, srcDir, ".java")
+	if err != nil {
+		return err
+	}
+
+	tmpdir, err := NewTmpDir(f, "")
+	if err != nil {
+		return err
+	}
+	defer RemoveAll(f, tmpdir)
+
+	dst := filepath.Join(tmpdir, "javadoc-output")
 	if err := Mkdir(f, dst); err != nil {
 		return err
 	}
@@ -477,30 +2251,24 @@ func BuildJar(f *Flags, w io.Writer, srcDir string, tmpdir string) error {
 
 	args := []string{
 		"-d", dst,
-		"-source", javacTargetVer,
-		"-target", javacTargetVer,
+		"-quiet",
 		"-bootclasspath", bClspath,
-		// "-classpath", bindClasspath
 	}
 	args = append(args, srcFiles...)
 
-	javac := exec.Command("javac", args...)
-	javac.Dir = srcDir
-	if err := RunCmd(f, tmpdir, javac); err != nil {
+	javadoc := exec.Command("javadoc", args...)
+	javadoc.Dir = srcDir
+	if err := RunCmd(f, tmpdir, javadoc); err != nil {
 		return err
 	}
 
-	// fmt.Println("javac", args)
-	// if buildX {
-	// KD: printcmd("jar c -C %s .", dst)
-	// }
 	if !f.ShouldRun() {
 		return nil
 	}
 	jarw := zip.NewWriter(w)
 	jarwcreate := func(name string) (io.Writer, error) {
 		if f.BuildV {
-			f.Logger.Printf("jar: %s\n", name)
+			f.Logger.Printf("javadoc: %s\n", name)
 		}
 		return jarw.Create(name)
 	}
@@ -510,29 +2278,120 @@ func BuildJar(f *Flags, w io.Writer, srcDir string, tmpdir string) error {
 	}
 	fmt.Fprintf(manifestFile, manifestHeader)
 
-	err = filepath.Walk(dst, func(path string, info os.FileInfo, err error) error {
+	if err := writeDir(jarwcreate, dst); err != nil {
+		return err
+	}
+	return jarw.Close()
+}
+
+// stageJavaSources copies srcDir to dst, passing each Java source through
+// f.JavaSourceTransform.
+func stageJavaSources(f *Flags, dst, srcDir string) error {
+	return filepath.Walk(srcDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 		if info.IsDir() {
 			return nil
 		}
-		out, err := jarwcreate(filepath.ToSlash(path[len(dst)+1:]))
+		data, err := ioutil.ReadFile(path)
 		if err != nil {
 			return err
 		}
-		in, err := os.Open(path)
+		if filepath.Ext(path) == ".java" {
+			if data, err = f.JavaSourceTransform(path, data); err != nil {
+				return fmt.Errorf("transforming %s: %v", path, err)
+			}
+		}
+		return WriteFile(f, filepath.Join(dst, path[len(srcDir):]), bytes.NewReader(data))
+	})
+}
+
+// sourceFiles returns the paths, relative to srcDir, of all files under srcDir
+// with the extension ext.
+func sourceFiles(f *Flags, srcDir, ext string) ([]string, error) {
+	if !f.ShouldRun() {
+		return []string{"*" + ext}, nil
+	}
+
+	var srcFiles []string
+	err := filepath.Walk(srcDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-		defer in.Close()
-		_, err = io.Copy(out, in)
+		if filepath.Ext(path) == ext {
+			srcFiles = append(srcFiles, filepath.Join(".", path[len(srcDir):]))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return srcFiles, nil
+}
+
+// writeSanitizerLibs adds the files buildAndroidLibs copies next to
+// libgojni.so of arch for f.Sanitizers to the jni directory of an aar using
+// create: the sanitizer runtimes and, for the address sanitizer, wrap.sh.
+func writeSanitizerLibs(f *Flags, create func(name string) (io.Writer, error), scripted *scriptAAR, androidDir, arch string) error {
+	abi := GetAndroidABI(arch)
+	for _, i := range f.Sanitizers {
+		names := []string{sanitizerRuntimeName(i, arch)}
+		if i == "address" {
+			names = append(names, "wrap.sh")
+		}
+		for _, name := range names {
+			path := filepath.Join(androidDir, "src/main/jniLibs", abi, name)
+			if err := writeFileEntry(create, "jni/"+abi+"/"+name, path); err != nil {
+				return err
+			}
+			scripted.source("jni/"+abi+"/"+name, path)
+		}
+	}
+	return nil
+}
+
+// writeFileEntry adds the file at path to an archive as name using create.
+func writeFileEntry(create func(name string) (io.Writer, error), name, path string) error {
+	w, err := create(name)
+	if err != nil {
+		return err
+	}
+	r, err := os.Open(path)
+	if err != nil {
 		return err
+	}
+	defer r.Close()
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// writeDir adds every file under dir to an archive using create. Entries are
+// named by their slash separated path relative to dir, and are added in
+// sorted order so the archive doesn't depend on the order the file system
+// lists them in.
+func writeDir(create func(name string) (io.Writer, error), dir string) error {
+	names := []string{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			names = append(names, filepath.ToSlash(path[len(dir)+1:]))
+		}
+		return nil
 	})
 	if err != nil {
 		return err
 	}
-	return jarw.Close()
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := writeFileEntry(create, name, filepath.Join(dir, filepath.FromSlash(name))); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func bootClasspath(f *Flags) (string, error) {
@@ -0,0 +1,1425 @@
+package cmd
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"go/build"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSupportedArches(t *testing.T) {
+	arches := SupportedArches()
+	abis := SupportedABIs()
+	if len(arches) != len(abis) {
+		t.Fatalf("Mismatched arches %v and ABIs %v", arches, abis)
+	}
+
+	targets := ParseTargets("android")
+	for i, arch := range arches {
+		if abi := GetAndroidABI(arch); abi != abis[i] {
+			t.Errorf("GetAndroidABI(%v) = %v, expected %v", arch, abi, abis[i])
+		}
+		if _, ok := targets["android/"+arch]; !ok {
+			t.Errorf("ParseTargets(\"android\") is missing %v", arch)
+		}
+		if single := ParseTargets("android/" + arch); len(single) != 2 {
+			t.Errorf("ParseTargets(\"android/%v\") = %v", arch, single)
+		}
+	}
+	if len(targets) != len(arches)+1 {
+		t.Errorf("ParseTargets(\"android\") has unexpected targets %v", targets)
+	}
+	if GetAndroidABI("mips") != "" || len(ParseTargets("android/mips")) != 0 {
+		t.Error("Unsupported arch was accepted")
+	}
+}
+
+func TestNormalizeArches(t *testing.T) {
+	arches, err := normalizeArches([]string{"amd64", "arm64", "arm", "arm64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(arches, []string{"arm", "arm64", "amd64"}) {
+		t.Errorf("normalizeArches() = %v", arches)
+	}
+
+	_, err = normalizeArches([]string{"arm7", "arm", "mips"})
+	if err == nil || !strings.Contains(err.Error(), `"arm7", "mips"`) {
+		t.Errorf("Expected error naming arm7 and mips, got %v", err)
+	}
+	if _, err := normalizeArches(nil); err == nil {
+		t.Error("Expected error for no arches")
+	}
+}
+
+// snapshotDir returns the path and modification time of every file under dir.
+func snapshotDir(t *testing.T, dir string) map[string]time.Time {
+	files := map[string]time.Time{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		files[path] = info.ModTime()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// fakeSDK creates an Android SDK in a temporary directory with the
+// directories dirs, slash-separated paths relative to it, and points
+// ANDROID_HOME at it. The returned function removes the SDK, even if the test
+// made it read-only, and restores ANDROID_HOME.
+func fakeSDK(t *testing.T, dirs ...string) (string, func()) {
+	sdk, err := ioutil.TempDir("", "matcha-sdk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	androidHome := os.Getenv("ANDROID_HOME")
+	os.Setenv("ANDROID_HOME", sdk)
+	cleanup := func() {
+		os.Setenv("ANDROID_HOME", androidHome)
+		filepath.Walk(sdk, func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.IsDir() {
+				os.Chmod(path, 0755)
+			}
+			return nil
+		})
+		os.RemoveAll(sdk)
+	}
+	for _, i := range dirs {
+		if err := os.MkdirAll(filepath.Join(sdk, filepath.FromSlash(i)), 0755); err != nil {
+			cleanup()
+			t.Fatal(err)
+		}
+	}
+	return sdk, cleanup
+}
+
+func TestExplainArches(t *testing.T) {
+	decisions, err := explainArches(&Flags{MinSDK: 16}, []string{"arm", "arm64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	built := map[string]bool{}
+	for _, i := range decisions {
+		built[i.Arch] = i.Built
+		if i.Reason == "" {
+			t.Errorf("No reason given for %v", i.Arch)
+		}
+	}
+	if !reflect.DeepEqual(built, map[string]bool{"arm": true, "arm64": true, "386": false, "amd64": false}) {
+		t.Errorf("explainArches() built %v", built)
+	}
+	if !strings.Contains(decisions[1].Reason, "API 21") {
+		t.Errorf("Expected arm64 to be built for API 21, got %q", decisions[1].Reason)
+	}
+	decisions, err = explainArches(&Flags{MinSDK: 16, MinSDKPerABI: map[string]int{"arm64-v8a": 24}}, []string{"arm64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(decisions[1].Reason, "API 24") {
+		t.Errorf("Expected arm64 to be built for API 24, got %q", decisions[1].Reason)
+	}
+
+	if _, err := explainArches(&Flags{MinSDK: 10}, []string{"arm"}); err == nil {
+		t.Error("Expected error for a min SDK below the lowest supported level")
+	}
+
+	// An NDK whose lowest API level is above the min SDK can't build.
+	sdk, cleanup := fakeSDK(t, "ndk-bundle")
+	defer cleanup()
+	if err := ioutil.WriteFile(filepath.Join(sdk, "ndk-bundle", "source.properties"), []byte("Pkg.Revision = 25.2.9519653\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	decisions, err = explainArches(&Flags{Logger: log.New(ioutil.Discard, "", 0), MinSDK: 16}, []string{"arm", "arm64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decisions[0].Built || !strings.Contains(decisions[0].Reason, "NDK lacks support") || !strings.Contains(decisions[0].Reason, "at least 19") {
+		t.Errorf("Expected arm to be skipped for NDK r25, got %+v", decisions[0])
+	}
+	if !decisions[1].Built {
+		t.Errorf("Expected arm64 to be built, got %+v", decisions[1])
+	}
+}
+
+func TestReadOnlySDK(t *testing.T) {
+	sdk, cleanup := fakeSDK(t, "platforms/android-21", "ndk-bundle/platforms")
+	defer cleanup()
+
+	platform := filepath.Join(sdk, "platforms", "android-21")
+	if err := ioutil.WriteFile(filepath.Join(platform, "android.jar"), nil, 0444); err != nil {
+		t.Fatal(err)
+	}
+	err := filepath.Walk(sdk, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			err = os.Chmod(path, 0555)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := snapshotDir(t, sdk)
+	f := &Flags{Logger: log.New(ioutil.Discard, "", 0)}
+	f.TargetSDK = 26
+	if _, err := AndroidPlatformPath(f); err == nil || !strings.Contains(err.Error(), "minimum API level of 26") {
+		t.Errorf("Expected error for target SDK 26 with the android-21 platform, got %v", err)
+	}
+	f.TargetSDK = 0
+	if path, err := AndroidPlatformPath(f); err != nil || path != platform {
+		t.Errorf("AndroidPlatformPath() = %v, %v", path, err)
+	}
+	if path, err := bootClasspath(f); err != nil || path != filepath.Join(platform, "android.jar") {
+		t.Errorf("bootClasspath() = %v, %v", path, err)
+	}
+	if _, err := NDKPath(f); err != nil {
+		t.Error(err)
+	}
+	if _, err := AndroidEnv(f, "arm64"); err != nil {
+		t.Error(err)
+	}
+	if info, err := AndroidToolchainInfo(f, []string{"arm64"}); err != nil {
+		t.Error(err)
+	} else if info.APILevel != 21 || info.NDKPath != filepath.Join(sdk, "ndk-bundle") || len(info.Arches) != 1 || info.Arches[0].ABI != "arm64-v8a" {
+		t.Errorf("AndroidToolchainInfo() = %+v", info)
+	}
+	after := snapshotDir(t, sdk)
+	if !reflect.DeepEqual(before, after) {
+		t.Errorf("SDK was modified during discovery: %v, %v", before, after)
+	}
+}
+
+func TestAndroidGoEnv(t *testing.T) {
+	_, cleanup := fakeSDK(t, "ndk-bundle/platforms")
+	defer cleanup()
+
+	f := &Flags{Logger: log.New(ioutil.Discard, "", 0)}
+	f.GoEnv = map[string]string{"GOEXPERIMENT": "loopvar", "GODEBUG": "madvdontneed=1"}
+	if env, err := AndroidEnv(f, "arm64"); err != nil {
+		t.Error(err)
+	} else if env[len(env)-2] != "GODEBUG=madvdontneed=1" || env[len(env)-1] != "GOEXPERIMENT=loopvar" {
+		t.Errorf("AndroidEnv() with GoEnv = %v", env)
+	}
+	for _, i := range []string{"GOOS", "CC", "CGO_LDFLAGS", "A=B"} {
+		f.GoEnv = map[string]string{i: "x"}
+		if _, err := AndroidEnv(f, "arm64"); err == nil {
+			t.Errorf("Expected error overriding %v", i)
+		}
+	}
+}
+
+func TestMinSDK(t *testing.T) {
+	sdk, cleanup := fakeSDK(t, "platforms/android-21", "ndk-bundle/platforms")
+	defer cleanup()
+
+	if err := ioutil.WriteFile(filepath.Join(sdk, "platforms", "android-21", "android.jar"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f := &Flags{Logger: log.New(ioutil.Discard, "", 0), MinSDK: 24}
+	if tc, err := toolchainForArch(f, "arm"); err != nil || tc.api != "24" {
+		t.Errorf("toolchainForArch() with min SDK 24 = %+v, %v", tc, err)
+	}
+	if _, err := AndroidToolchainInfo(f, []string{"arm", "arm64"}); err == nil || !strings.Contains(err.Error(), "minimum API level of 24") {
+		t.Errorf("Expected error for min SDK 24 with the android-21 platform, got %v", err)
+	}
+	f.MinSDK = 9
+	if _, err := AndroidEnv(f, "arm"); err == nil {
+		t.Error("Expected error for min SDK below 15")
+	}
+}
+
+func TestTraceDiscovery(t *testing.T) {
+	sdk, cleanup := fakeSDK(t, "platforms/android-21", "platforms/android-26", "platforms/tools")
+	defer cleanup()
+
+	if err := ioutil.WriteFile(filepath.Join(sdk, "platforms", "android-21", "android.jar"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	f := &Flags{Logger: log.New(buf, "", 0), TraceDiscovery: true}
+	if _, err := AndroidPlatformPath(f); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NDKPath(f); err == nil {
+		t.Fatal("Expected error for missing NDK")
+	}
+	for _, i := range []string{
+		"discovery: " + filepath.Join(sdk, "platforms", "tools") + ": skipped, not an android-<api> directory",
+		"discovery: " + filepath.Join(sdk, "platforms", "android-21", "android.jar") + ": exists, API 21",
+		"discovery: " + filepath.Join(sdk, "platforms", "android-26", "android.jar") + ": missing",
+		"discovery: platform: " + filepath.Join(sdk, "platforms", "android-21"),
+		"discovery: " + filepath.Join(sdk, "ndk-bundle") + ": missing",
+	} {
+		if !strings.Contains(buf.String(), i+"\n") {
+			t.Errorf("Trace is missing %q:\n%s", i, buf.String())
+		}
+	}
+
+	// A preview platform is only selected by its codename.
+	preview := filepath.Join(sdk, "platforms", "android-TiramisuPrivacySandbox")
+	if err := os.MkdirAll(preview, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(preview, "android.jar"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := AndroidPlatformPath(&Flags{}); err != nil || p != filepath.Join(sdk, "platforms", "android-21") {
+		t.Errorf("AndroidPlatformPath() = %v, %v", p, err)
+	}
+	if p, err := AndroidPlatformPath(&Flags{SDKCodename: "TiramisuPrivacySandbox"}); err != nil || p != preview {
+		t.Errorf("AndroidPlatformPath() with codename = %v, %v", p, err)
+	}
+	if _, err := AndroidPlatformPath(&Flags{Logger: f.Logger, SDKCodename: "UpsideDownCake"}); err == nil {
+		t.Error("Expected error for a missing preview platform")
+	}
+
+	// The API level of a preview platform comes from its source.properties.
+	if api, ext, err := compileSDK(&Flags{}); err != nil || api != 21 || ext != 0 {
+		t.Errorf("compileSDK() = %d, %d, %v", api, ext, err)
+	}
+	if _, _, err := compileSDK(&Flags{SDKCodename: "TiramisuPrivacySandbox"}); err == nil {
+		t.Error("Expected error for a preview platform without source.properties")
+	}
+	props := "AndroidVersion.ApiLevel=33\nAndroidVersion.CodeName=TiramisuPrivacySandbox\nAndroidVersion.ExtensionLevel=4\n"
+	if err := ioutil.WriteFile(filepath.Join(preview, "source.properties"), []byte(props), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if api, ext, err := compileSDK(&Flags{SDKCodename: "TiramisuPrivacySandbox"}); err != nil || api != 33 || ext != 4 {
+		t.Errorf("compileSDK() with codename = %d, %d, %v", api, ext, err)
+	}
+}
+
+func TestUnifiedNDK(t *testing.T) {
+	sdk, cleanup := fakeSDK(t, "ndk-bundle")
+	defer cleanup()
+
+	props := "Pkg.Desc = Android NDK\nPkg.Revision = 25.2.9519653\n"
+	if err := ioutil.WriteFile(filepath.Join(sdk, "ndk-bundle", "source.properties"), []byte(props), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a min SDK, the manifest and the native code use the lowest
+	// API level r25 supports.
+	f := &Flags{Logger: log.New(ioutil.Discard, "", 0), CppStdlib: "c++_shared"}
+	if tc, err := toolchainForArch(f, "arm"); err != nil || tc.clangTarget() != "armv7a-linux-androideabi19" {
+		t.Errorf("toolchainForArch() without a min SDK = %+v, %v, expected API 19", tc, err)
+	}
+	if manifest, err := aarManifestSource(f, []*build.Package{{Name: "example"}}, nil); err != nil || !strings.Contains(manifest, `android:minSdkVersion="19"`) {
+		t.Errorf("aarManifestSource() without a min SDK = %s, %v", manifest, err)
+	}
+
+	// An explicit min SDK below it is an error, the native code must not
+	// target a higher level than the manifest.
+	f.MinSDK = 15
+	if _, err := AndroidEnv(f, "arm"); err == nil || !strings.Contains(err.Error(), "at least 19") {
+		t.Errorf("Expected error naming API 19 for API 15 with NDK r25, got %v", err)
+	}
+
+	f.MinSDK = 21
+	for _, arch := range SupportedArches() {
+		env, err := AndroidEnv(f, arch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tc, err := toolchainForArch(f, arch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !tc.unified {
+			t.Fatalf("NDK r25 toolchain for %v is not unified", arch)
+		}
+		paths := append(env, tc.stripPath(), tc.csysroot(), tc.ldsysroot(), tc.libcxxInclude(), tc.libcxxLibDir(tc.abi))
+		for _, i := range paths {
+			if strings.Contains(i, "platforms") || strings.Contains(i, "gcc-toolchain") {
+				t.Errorf("NDK r25 toolchain for %v uses the legacy layout: %v", arch, i)
+			}
+		}
+	}
+
+	tc, _ := toolchainForArch(f, "arm")
+	if target := tc.clangTarget(); target != "armv7a-linux-androideabi21" {
+		t.Errorf("clangTarget() = %v", target)
+	}
+
+	// The requested API level must be one the sysroot has libraries for.
+	tc, _ = toolchainForArch(f, "arm64")
+	for _, api := range []string{"23", "30", "33"} {
+		if err := os.MkdirAll(filepath.Join(tc.csysroot(), "usr", "lib", tc.triple, api), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if apis, err := tc.availableAPIs(f); err != nil || !reflect.DeepEqual(apis, []int{23, 30, 33}) {
+		t.Errorf("availableAPIs() = %v, %v", apis, err)
+	}
+	if _, err := toolchainForArch(f, "arm64"); err == nil || !strings.Contains(err.Error(), "23 to 33") {
+		t.Errorf("Expected error naming the available API levels, got %v", err)
+	}
+	f.MinSDK = 30
+	if _, err := toolchainForArch(f, "arm64"); err != nil {
+		t.Error(err)
+	}
+
+	// A min SDK for the ABI overrides the min SDK, within the same range.
+	f.MinSDK = 21
+	f.MinSDKPerABI = map[string]int{"arm64-v8a": 33}
+	if tc, err := toolchainForArch(f, "arm64"); err != nil || tc.api != "33" {
+		t.Errorf("toolchainForArch() = %v, %v, expected API 33", tc, err)
+	}
+	if tc, err := toolchainForArch(f, "arm"); err != nil || tc.api != "21" {
+		t.Errorf("toolchainForArch() = %v, %v, expected API 21", tc, err)
+	}
+	f.MinSDKPerABI["arm64-v8a"] = 34
+	if _, err := toolchainForArch(f, "arm64"); err == nil || !strings.Contains(err.Error(), "23 to 33") {
+		t.Errorf("Expected error naming the available API levels, got %v", err)
+	}
+	f.MinSDKPerABI = map[string]int{"x86_64": 16}
+	if _, err := toolchainForArch(f, "amd64"); err == nil {
+		t.Error("Expected error for a min SDK below the ABI's first API level")
+	}
+
+	// r26 dropped API levels 19 and 20, which its sysroot has no libraries
+	// for, and defaults to 21.
+	props = "Pkg.Desc = Android NDK\nPkg.Revision = 26.1.10909125\n"
+	if err := ioutil.WriteFile(filepath.Join(sdk, "ndk-bundle", "source.properties"), []byte(props), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f.MinSDK = 0
+	f.MinSDKPerABI = nil
+	tc, err := toolchainForArch(f, "arm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, api := range []string{"21", "34"} {
+		if err := os.MkdirAll(filepath.Join(tc.csysroot(), "usr", "lib", tc.triple, api), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if tc, err := toolchainForArch(f, "arm"); err != nil || tc.clangTarget() != "armv7a-linux-androideabi21" {
+		t.Errorf("toolchainForArch() without a min SDK on r26 = %+v, %v, expected API 21", tc, err)
+	}
+	if manifest, err := aarManifestSource(f, []*build.Package{{Name: "example"}}, nil); err != nil || !strings.Contains(manifest, `android:minSdkVersion="21"`) {
+		t.Errorf("aarManifestSource() without a min SDK on r26 = %s, %v", manifest, err)
+	}
+}
+
+func TestSideBySideNDK(t *testing.T) {
+	versions := []string{"19.2.5345600", "21.4.7075529", "9.0"}
+	sdk, cleanup := fakeSDK(t, "ndk/"+versions[0], "ndk/"+versions[1], "ndk/"+versions[2])
+	defer cleanup()
+
+	for _, i := range versions {
+		props := "Pkg.Desc = Android NDK\nPkg.Revision = " + i + "\n"
+		if err := ioutil.WriteFile(filepath.Join(sdk, "ndk", i, "source.properties"), []byte(props), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f := &Flags{Logger: log.New(ioutil.Discard, "", 0)}
+	ndk := filepath.Join(sdk, "ndk", "21.4.7075529")
+	if path, err := NDKPath(f); err != nil || path != ndk {
+		t.Errorf("NDKPath() = %v, %v, expected the newest NDK %v", path, err, ndk)
+	}
+	f.NDKVersion = "19.2.5345600"
+	if path, err := NDKPath(f); err != nil || path != filepath.Join(sdk, "ndk", "19.2.5345600") {
+		t.Errorf("NDKPath() with NDKVersion = %v, %v", path, err)
+	}
+	f.NDKVersion = ""
+
+	// r19 to r23 build for API 16 and up, with the API level in the target,
+	// which is the default.
+	f.MinSDK = 15
+	if _, err := toolchainForArch(f, "arm"); err == nil {
+		t.Error("Expected error for API 15 with NDK r21")
+	}
+	f.MinSDK = 0
+	tc, err := toolchainForArch(f, "arm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tc.unified || tc.revision != 21 {
+		t.Fatalf("NDK r21 toolchain is not unified: %+v", tc)
+	}
+	if target := tc.clangTarget(); target != "armv7a-linux-androideabi16" {
+		t.Errorf("clangTarget() = %v", target)
+	}
+	if strip := tc.stripPath(); strip != filepath.Join(tc.prebuiltDir(), "bin", "arm-linux-androideabi-strip") {
+		t.Errorf("stripPath() = %v", strip)
+	}
+	env, err := AndroidEnv(f, "arm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range env {
+		if strings.Contains(i, "platforms") || strings.Contains(i, "gcc-toolchain") {
+			t.Errorf("NDK r21 toolchain uses the legacy layout: %v", i)
+		}
+		if strings.HasPrefix(i, "CGO_CFLAGS=") && i != "CGO_CFLAGS=-target armv7a-linux-androideabi16 --sysroot "+tc.csysroot() {
+			t.Errorf("Unexpected %v", i)
+		}
+	}
+
+	if err := os.RemoveAll(filepath.Join(sdk, "ndk")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NDKPath(f); err == nil {
+		t.Error("Expected error without an NDK")
+	}
+
+	// r16 keeps the platforms layout, and drops -gcc-toolchain if the
+	// standalone gcc toolchain isn't installed.
+	legacy := filepath.Join(sdk, "ndk-bundle")
+	if err := os.MkdirAll(filepath.Join(legacy, "platforms"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(legacy, "source.properties"), []byte("Pkg.Revision = 16.1.4479499\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if tc, err = toolchainForArch(f, "arm64"); err != nil || tc.unified || !tc.noGCC {
+		t.Fatalf("toolchainForArch() = %+v, %v", tc, err)
+	}
+	if env, err = AndroidEnv(f, "arm64"); err != nil {
+		t.Fatal(err)
+	}
+	if joined := strings.Join(env, " "); strings.Contains(joined, "-gcc-toolchain") || !strings.Contains(joined, "-D__ANDROID_API__=21") {
+		t.Errorf("Unexpected environment %v", env)
+	}
+	if err := os.MkdirAll(tc.gccToolchain(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if env, err = AndroidEnv(f, "arm64"); err != nil || !strings.Contains(strings.Join(env, " "), "-gcc-toolchain "+tc.gccToolchain()) {
+		t.Errorf("AndroidEnv() with a gcc toolchain = %v, %v", env, err)
+	}
+}
+
+func TestSanitizers(t *testing.T) {
+	_, cleanup := fakeSDK(t, "ndk-bundle/platforms")
+	defer cleanup()
+
+	f := &Flags{Logger: log.New(ioutil.Discard, "", 0), Sanitizers: []string{"address", "undefined"}}
+	env, err := AndroidEnv(f, "arm64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range env {
+		if strings.HasPrefix(i, "CGO_CFLAGS=") && !strings.Contains(i, " -fsanitize=address,undefined -fno-omit-frame-pointer") {
+			t.Errorf("Missing sanitizer flags: %v", i)
+		}
+		if strings.HasPrefix(i, "CGO_LDFLAGS=") && !strings.Contains(i, " -fsanitize=address,undefined") {
+			t.Errorf("Missing sanitizer flags: %v", i)
+		}
+	}
+
+	f.Sanitizers = []string{"thread"}
+	if _, err := AndroidEnv(f, "arm64"); err == nil {
+		t.Error("Expected error for unsupported sanitizer")
+	}
+
+	tc, err := toolchainForArch(f, "arm64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tc.sanitizerRuntime(f, "address"); err == nil {
+		t.Error("Expected error for missing runtime")
+	}
+	rt := filepath.Join(tc.prebuiltDir(), "lib64", "clang", "9.0.8", "lib", "linux", "libclang_rt.asan-aarch64-android.so")
+	if err := os.MkdirAll(filepath.Dir(rt), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(rt, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if path, err := tc.sanitizerRuntime(f, "address"); err != nil || path != rt {
+		t.Errorf("sanitizerRuntime() = %v, %v", path, err)
+	}
+
+	// The runtimes copied next to libgojni.so, and wrap.sh, are added to
+	// the aar.
+	androidDir := filepath.Join(filepath.Dir(rt), "android")
+	f.Sanitizers = []string{"address", "undefined"}
+	for _, i := range []string{"libclang_rt.asan-aarch64-android.so", "libclang_rt.ubsan_standalone-aarch64-android.so", "wrap.sh"} {
+		path := filepath.Join(androidDir, "src", "main", "jniLibs", "arm64-v8a", i)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(i), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	if err := writeSanitizerLibs(f, zw.Create, nil, androidDir, "arm64"); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, i := range zr.File {
+		names = append(names, i.Name)
+	}
+	expected := []string{
+		"jni/arm64-v8a/libclang_rt.asan-aarch64-android.so",
+		"jni/arm64-v8a/wrap.sh",
+		"jni/arm64-v8a/libclang_rt.ubsan_standalone-aarch64-android.so",
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Unexpected aar entries %v", names)
+	}
+	if !strings.Contains(asanWrapScript, "LD_PRELOAD=\"$ASAN_LIB\"") {
+		t.Errorf("wrap.sh doesn't preload the runtime:\n%s", asanWrapScript)
+	}
+}
+
+func TestRequire16KB(t *testing.T) {
+	_, cleanup := fakeSDK(t, "ndk-bundle/platforms")
+	defer cleanup()
+
+	f := &Flags{Logger: log.New(ioutil.Discard, "", 0), Require16KB: true}
+	for _, i := range []struct {
+		arch     string
+		expected bool
+	}{
+		{"arm64", true},
+		{"amd64", true},
+		{"arm", false},
+		{"386", false},
+	} {
+		env, err := AndroidEnv(f, i.arch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, j := range env {
+			if strings.HasPrefix(j, "CGO_LDFLAGS=") && strings.Contains(j, " -Wl,-z,max-page-size=16384") != i.expected {
+				t.Errorf("%s: unexpected %v", i.arch, j)
+			}
+		}
+	}
+}
+
+func TestReproducibleEnv(t *testing.T) {
+	sdk, cleanup := fakeSDK(t, "ndk-bundle/platforms")
+	defer cleanup()
+
+	// Two builds on machines with different locales, time zones and
+	// GOFLAGS run go build with the same environment.
+	f := &Flags{Logger: log.New(ioutil.Discard, "", 0), Reproducible: true}
+	machines := [][]string{
+		{"LC_ALL=de_DE.UTF-8", "TZ=Europe/Berlin", "GOFLAGS=-mod=vendor", "HOME=/home/a"},
+		{"LANG=ja_JP.UTF-8", "TZ=Asia/Tokyo", "HOME=/home/b"},
+	}
+	builds := []map[string]string{}
+	for _, i := range machines {
+		env, err := AndroidEnv(f, "arm64")
+		if err != nil {
+			t.Fatal(err)
+		}
+		build := map[string]string{}
+		for _, j := range MergeEnviron(env, i) {
+			kv := strings.SplitN(j, "=", 2)
+			if kv[0] != "HOME" && kv[0] != "LANG" {
+				build[kv[0]] = kv[1]
+			}
+		}
+		builds = append(builds, build)
+	}
+	if !reflect.DeepEqual(builds[0], builds[1]) {
+		t.Errorf("Reproducible builds have different environments:\n%v\n%v", builds[0], builds[1])
+	}
+	if builds[0]["LC_ALL"] != "C" || builds[0]["TZ"] != "UTC" || builds[0]["GOFLAGS"] != "" {
+		t.Errorf("Unexpected environment %v", builds[0])
+	}
+
+	// The locked environment doesn't depend on where the NDK is installed.
+	env1, err := lockEnv(f, []string{"arm", "arm64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, cleanup2 := fakeSDK(t, "ndk-bundle/platforms")
+	env2, err := lockEnv(f, []string{"arm", "arm64"})
+	cleanup2()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(env1, env2) || len(env1["armeabi-v7a"]) == 0 || len(env1["arm64-v8a"]) == 0 {
+		t.Errorf("lockEnv() = %v, %v", env1, env2)
+	}
+	if s := strings.Join(env1["arm64-v8a"], " "); strings.Contains(s, sdk) || !strings.Contains(s, "CC=$NDK/") {
+		t.Errorf("lockEnv() has the NDK's path: %v", s)
+	}
+
+	f.GoEnv = map[string]string{"GOFLAGS": "-mod=mod"}
+	if env, err := AndroidEnv(f, "arm64"); err != nil || env[len(env)-1] != "GOFLAGS=-mod=mod" {
+		t.Errorf("AndroidEnv() with GOFLAGS = %v, %v", env, err)
+	}
+	for _, i := range []string{"LC_ALL", "TZ"} {
+		f.GoEnv = map[string]string{i: "x"}
+		if _, err := AndroidEnv(f, "arm64"); err == nil {
+			t.Errorf("Expected error overriding %v", i)
+		}
+	}
+	f.Reproducible, f.GoEnv = false, nil
+	if env, _ := AndroidEnv(f, "arm64"); strings.Contains(strings.Join(env, " "), "TZ=") {
+		t.Errorf("Unexpected environment %v", env)
+	}
+}
+
+func TestSysrootOverlay(t *testing.T) {
+	sdk, cleanup := fakeSDK(t, "ndk-bundle/platforms", "overlay/include", "overlay/lib/arm64-v8a")
+	defer cleanup()
+
+	overlay := filepath.Join(sdk, "overlay")
+
+	f := &Flags{Logger: log.New(ioutil.Discard, "", 0), SysrootOverlay: overlay}
+	env, err := AndroidEnv(f, "arm64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range env {
+		if strings.HasPrefix(i, "CGO_CFLAGS=") && !strings.HasPrefix(i, "CGO_CFLAGS=-I"+filepath.Join(overlay, "include")+" ") {
+			t.Errorf("Overlay include is not searched first: %v", i)
+		}
+		if strings.HasPrefix(i, "CGO_LDFLAGS=") && !strings.HasPrefix(i, "CGO_LDFLAGS=-L"+filepath.Join(overlay, "lib", "arm64-v8a")+" ") {
+			t.Errorf("Overlay lib is not searched first: %v", i)
+		}
+	}
+
+	if _, err := AndroidEnv(f, "arm"); err == nil {
+		t.Error("Expected error for an overlay without lib/armeabi-v7a")
+	}
+	f.SysrootOverlay = filepath.Join(sdk, "ndk-bundle")
+	if _, err := AndroidEnv(f, "arm64"); err == nil {
+		t.Error("Expected error for an overlay without include or lib")
+	}
+}
+
+func TestVerifyNDK(t *testing.T) {
+	ndk, err := ioutil.TempDir("", "matcha-ndk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(ndk)
+
+	hostTag, err := ndkHostTag(&Flags{}, ndk)
+	if err != nil {
+		t.Skip(err)
+	}
+	bin := filepath.Join(ndk, "toolchains", "llvm", "prebuilt", hostTag, "bin")
+	if err := os.MkdirAll(bin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	binaries := ndkToolchainBinaries(runtime.GOOS)
+	for _, i := range binaries[:2] {
+		if err := ioutil.WriteFile(filepath.Join(bin, filepath.Base(i)), []byte(path.Base(i)), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	props := "Pkg.Desc = Android NDK\nPkg.Revision = 16.1.4479499\n"
+	if err := ioutil.WriteFile(filepath.Join(ndk, "source.properties"), []byte(props), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The missing llvm-strip is left out.
+	h := sha256.New()
+	fmt.Fprintf(h, "%x  source.properties\n", sha256.Sum256([]byte(props)))
+	for _, i := range binaries[:2] {
+		fmt.Fprintf(h, "%x  toolchains/llvm/prebuilt/%s/%s\n", sha256.Sum256([]byte(path.Base(i))), hostTag, i)
+	}
+	clangSum := hex.EncodeToString(h.Sum(nil))
+	if !reflect.DeepEqual(ndkToolchainBinaries("windows"), []string{"bin/clang.exe", "bin/clang++.exe", "bin/llvm-strip.exe"}) {
+		t.Errorf("Unexpected windows binaries %v", ndkToolchainBinaries("windows"))
+	}
+
+	for _, i := range []struct {
+		version, sum string
+		ok           bool
+	}{
+		{"", "", true},
+		{"16.1.4479499", "", true},
+		{"16.1.4479499", clangSum, true},
+		{"", strings.ToUpper(clangSum), true},
+		{"17.2.4988734", "", false},
+		{"", strings.Repeat("0", 64), false},
+	} {
+		f := &Flags{Logger: log.New(ioutil.Discard, "", 0), NDKVersion: i.version, NDKSHA256: i.sum}
+		if err := verifyNDK(f, ndk); (err == nil) != i.ok {
+			t.Errorf("verifyNDK(%q, %q) = %v", i.version, i.sum, err)
+		}
+	}
+
+	// NDKRoot takes precedence over $ANDROID_HOME, which is not needed.
+	androidHome := os.Getenv("ANDROID_HOME")
+	os.Setenv("ANDROID_HOME", "")
+	defer os.Setenv("ANDROID_HOME", androidHome)
+
+	f := &Flags{Logger: log.New(ioutil.Discard, "", 0), NDKRoot: ndk, NDKVersion: "16.1.4479499"}
+	if path, err := NDKPath(f); err != nil || path != ndk {
+		t.Errorf("NDKPath() = %v, %v", path, err)
+	}
+	f = &Flags{Logger: log.New(ioutil.Discard, "", 0), NDKRoot: bin}
+	if _, err := NDKPath(f); err == nil {
+		t.Error("Expected error for NDKRoot without the NDK layout")
+	}
+
+	// The SHA-256 covers source.properties, and clang must exist.
+	if err := ioutil.WriteFile(filepath.Join(ndk, "source.properties"), []byte(props+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if sum, err := ndkSHA256(&Flags{}, ndk); err != nil || sum == clangSum {
+		t.Errorf("ndkSHA256() after changing source.properties = %v, %v", sum, err)
+	}
+	if err := os.Remove(filepath.Join(bin, filepath.Base(binaries[0]))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ndkSHA256(&Flags{}, ndk); err == nil {
+		t.Error("Expected error for an NDK without clang")
+	}
+}
+
+func TestAARFileName(t *testing.T) {
+	for _, i := range []struct {
+		module, variant, version, expected string
+	}{
+		{"example", "", "", "example.aar"},
+		{"example", "release", "", "example-release.aar"},
+		{"example", "", "1.2.0", "example-1.2.0.aar"},
+		{"example", "debug", "1.2.0", "example-debug-1.2.0.aar"},
+	} {
+		if name := AARFileName(i.module, i.variant, i.version); name != i.expected {
+			t.Errorf("AARFileName(%q, %q, %q) = %q, expected %q", i.module, i.variant, i.version, name, i.expected)
+		}
+	}
+}
+
+func TestBuildJavadocJar(t *testing.T) {
+	if path := JavadocJarPath("/out/example-release.aar"); path != "/out/example-release-javadoc.jar" {
+		t.Errorf("JavadocJarPath() = %v", path)
+	}
+
+	buf := &bytes.Buffer{}
+	f := &Flags{Logger: log.New(buf, "", 0), BuildN: true}
+	if err := BuildJavadocJar(f, "/src", &bytes.Buffer{}); err != nil {
+		t.Fatal(err)
+	}
+	expected := "javadoc -d $WORK/javadoc-output -quiet -bootclasspath $ANDROID_HOME/platforms/android-21/android.jar *.java"
+	if !strings.Contains(buf.String(), expected+"\n") {
+		t.Errorf("Expected %q in:\n%s", expected, buf)
+	}
+
+	if runtime.GOOS == "windows" {
+		t.Skip("fake javadoc is a shell script")
+	}
+	sdk, cleanup := fakeSDK(t, "platforms/android-21")
+	defer cleanup()
+	if err := ioutil.WriteFile(filepath.Join(sdk, "platforms", "android-21", "android.jar"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "matcha-javadoc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The fake javadoc writes its arguments to index.html and a page for
+	// the class.
+	bin := filepath.Join(dir, "bin")
+	src := filepath.Join(dir, "src")
+	files := map[string]string{
+		filepath.Join(bin, "javadoc"):                       "#!/bin/sh\nmkdir -p \"$2/go/example\" && echo \"$@\" > \"$2/index.html\" && echo example > \"$2/go/example/Example.html\"\n",
+		filepath.Join(src, "go", "example", "Example.java"): "package go.example;\n\npublic final class Example {}\n",
+	}
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldPath := os.Getenv("PATH")
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+oldPath)
+	defer os.Setenv("PATH", oldPath)
+
+	jar := &bytes.Buffer{}
+	f = &Flags{Logger: log.New(ioutil.Discard, "", 0)}
+	if err := BuildJavadocJar(f, src, jar); err != nil {
+		t.Fatal(err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(jar.Bytes()), int64(jar.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, i := range r.File {
+		names = append(names, i.Name)
+		if i.Name != "index.html" {
+			continue
+		}
+		rc, err := i.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		args, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(args), filepath.Join("go", "example", "Example.java")) {
+			t.Errorf("javadoc was not run over the sources: %s", args)
+		}
+	}
+	if !reflect.DeepEqual(names, []string{"META-INF/MANIFEST.MF", "go/example/Example.html", "index.html"}) {
+		t.Errorf("Unexpected javadoc jar entries %v", names)
+	}
+
+	// Without javadoc nothing is written.
+	os.Setenv("PATH", dir)
+	jar.Reset()
+	if err := BuildJavadocJar(f, src, jar); err != nil || jar.Len() != 0 {
+		t.Errorf("BuildJavadocJar() without javadoc wrote %d bytes, %v", jar.Len(), err)
+	}
+}
+
+func TestNativeDebugSymbols(t *testing.T) {
+	if path := NativeDebugSymbolsPath("/out/example-release.aar"); path != "/out/example-release-native-debug-symbols.zip" {
+		t.Errorf("NativeDebugSymbolsPath() = %v", path)
+	}
+
+	dir, err := ioutil.TempDir("", "matcha-symbols")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The unstripped libraries buildAndroidLibs keeps for each ABI.
+	androidDir := filepath.Join(dir, "android")
+	for _, abi := range []string{"armeabi-v7a", "arm64-v8a"} {
+		path := filepath.Join(androidDir, "symbols", abi, "libgojni.so")
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(abi+" symbols"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	path := filepath.Join(dir, "example-native-debug-symbols.zip")
+	f := &Flags{Logger: log.New(buf, "", 0), BuildN: true}
+	if err := writeNativeDebugSymbols(f, androidDir, []string{"arm", "arm64"}, path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) || buf.String() != "write "+path+"\n" {
+		t.Errorf("Dry run wrote %v, logged %q", err, buf)
+	}
+
+	f = &Flags{Logger: log.New(ioutil.Discard, "", 0)}
+	if err := writeNativeDebugSymbols(f, androidDir, []string{"arm", "arm64"}, path); err != nil {
+		t.Fatal(err)
+	}
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	entries := map[string]string{}
+	for _, i := range r.File {
+		rc, err := i.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[i.Name] = string(data)
+	}
+	expected := map[string]string{
+		"armeabi-v7a/libgojni.so": "armeabi-v7a symbols",
+		"arm64-v8a/libgojni.so":   "arm64-v8a symbols",
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("Unexpected symbols zip entries %v", entries)
+	}
+
+	// Every arch built must have kept its symbols.
+	if err := writeNativeDebugSymbols(f, androidDir, []string{"arm", "amd64"}, path); err == nil {
+		t.Error("Expected error for an ABI without symbols")
+	}
+}
+
+func TestJarManifest(t *testing.T) {
+	m, err := jarManifest(nil)
+	if err != nil || string(m) != manifestHeader {
+		t.Errorf("jarManifest(nil) = %q, %v", m, err)
+	}
+
+	m, err = jarManifest(map[string]string{
+		"Implementation-Version": "1.2.0",
+		"Built-By":               strings.Repeat("x", 100),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "Manifest-Version: 1.0\nCreated-By: 1.0 (Go)\n" +
+		"Built-By: " + strings.Repeat("x", 62) + "\n" +
+		" " + strings.Repeat("x", 38) + "\n" +
+		"Implementation-Version: 1.2.0\n\n"
+	if string(m) != expected {
+		t.Errorf("Unexpected manifest:\n%s", m)
+	}
+
+	for _, attrs := range []map[string]string{
+		{"Bad Name": "1"},
+		{"-Name": "1"},
+		{"Name": "a\nb"},
+		{"Created-By": "matcha"},
+	} {
+		if _, err := jarManifest(attrs); err == nil {
+			t.Errorf("jarManifest(%q) succeeded, expected error", attrs)
+		}
+	}
+}
+
+func TestDeterministicJar(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matcha-classes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Walking the directory visits a/B.class before a-b.class.
+	for _, i := range []string{"a/B.class", "a-b.class", "a/A.class", "Z.class"} {
+		path := filepath.Join(dir, filepath.FromSlash(i))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(i), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f := &Flags{Logger: log.New(ioutil.Discard, "", 0)}
+	jar1, jar2 := &bytes.Buffer{}, &bytes.Buffer{}
+	if err := writeJar(f, jar1, dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeJar(f, jar2, dir); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(jar1.Bytes(), jar2.Bytes()) {
+		t.Error("Jars of the same classes differ")
+	}
+
+	r, err := zip.NewReader(bytes.NewReader(jar1.Bytes()), int64(jar1.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, i := range r.File {
+		names = append(names, i.Name)
+	}
+	expected := []string{"META-INF/MANIFEST.MF", "Z.class", "a-b.class", "a/A.class", "a/B.class"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Jar entries %v, expected %v", names, expected)
+	}
+}
+
+func TestStoredClassesJar(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matcha-classes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	class := filepath.Join(dir, "go", "Seq.class")
+	if err := os.MkdirAll(filepath.Dir(class), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(class, []byte("class"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for compress, method := range map[bool]uint16{false: zip.Store, true: zip.Deflate} {
+		buf := &bytes.Buffer{}
+		aarw := zip.NewWriter(buf)
+		f := &Flags{Logger: log.New(ioutil.Discard, "", 0), CompressClassesJar: compress}
+		w, err := aarw.CreateHeader(classesJarHeader(f))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := writeJar(f, w, dir); err != nil {
+			t.Fatal(err)
+		}
+		if err := aarw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		aarr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if aarr.File[0].Name != "classes.jar" || aarr.File[0].Method != method {
+			t.Errorf("CompressClassesJar %v: %v has method %v, expected %v", compress, aarr.File[0].Name, aarr.File[0].Method, method)
+		}
+		jar, err := readZipFile(aarr.File[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		jarr, err := zip.NewReader(bytes.NewReader(jar), int64(len(jar)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := []string{}
+		for _, i := range jarr.File {
+			names = append(names, i.Name)
+		}
+		if !reflect.DeepEqual(names, []string{"META-INF/MANIFEST.MF", "go/Seq.class"}) {
+			t.Errorf("Unexpected classes.jar entries %v", names)
+		}
+	}
+}
+
+func TestHostTag(t *testing.T) {
+	for _, i := range []struct {
+		goos, goarch string
+		prebuilts    []string
+		expected     string
+	}{
+		{"linux", "amd64", nil, "linux-x86_64"},
+		{"darwin", "amd64", nil, "darwin-x86_64"},
+		{"windows", "amd64", []string{"windows", "windows-x86_64"}, "windows-x86_64"},
+		{"windows", "386", []string{"windows", "windows-x86_64"}, "windows"},
+		{"windows", "386", []string{"windows-x86_64"}, "windows-x86_64"},
+		{"windows", "386", nil, "windows-x86_64"},
+	} {
+		exists := func(tag string) bool {
+			for _, j := range i.prebuilts {
+				if j == tag {
+					return true
+				}
+			}
+			return false
+		}
+		if tag, err := hostTag(i.goos, i.goarch, exists); err != nil || tag != i.expected {
+			t.Errorf("hostTag(%v, %v) with %v = %v, %v, expected %v", i.goos, i.goarch, i.prebuilts, tag, err, i.expected)
+		}
+	}
+	if _, err := hostTag("linux", "arm64", func(string) bool { return true }); err == nil {
+		t.Error("Expected error for unsupported GOARCH")
+	}
+}
+
+func TestSelectABIForDevice(t *testing.T) {
+	pixel := strings.Split("arm64-v8a,armeabi-v7a,armeabi", ",")
+	emulator := strings.Split("x86_64,x86,arm64-v8a,armeabi-v7a,armeabi", ",")
+	for _, i := range []struct {
+		device, built []string
+		expected      string
+	}{
+		{pixel, SupportedABIs(), "arm64-v8a"},
+		{pixel, []string{"armeabi-v7a", "x86"}, "armeabi-v7a"},
+		{emulator, []string{"armeabi-v7a", "arm64-v8a"}, "arm64-v8a"},
+		{emulator, SupportedABIs(), "x86_64"},
+		{pixel, []string{"x86", "x86_64"}, ""},
+	} {
+		abi, err := SelectABIForDevice(i.device, i.built)
+		if abi != i.expected || (err == nil) != (i.expected != "") {
+			t.Errorf("SelectABIForDevice(%v, %v) = %v, %v, expected %v", i.device, i.built, abi, err, i.expected)
+		}
+	}
+}
+
+func TestEstimateAARSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matcha-estimate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]int{
+		"pkg/assets/logo.png":                            300,
+		"android/src/main/jniLibs/arm64-v8a/libgojni.so": 4000,
+	}
+	for name, size := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The armeabi-v7a library hasn't been built yet.
+	pkgs := []*build.Package{{Dir: filepath.Join(dir, "pkg"), ImportPath: "example.com/pkg"}}
+	size, err := EstimateAARSize(&Flags{}, filepath.Join(dir, "android"), pkgs, []string{"arm", "arm64"})
+	if err != nil || size != 4300 {
+		t.Errorf("EstimateAARSize() = %v, %v, expected 4300", size, err)
+	}
+}
+
+func TestExportsVersionScript(t *testing.T) {
+	expected := `{
+  global:
+    JNI_OnLoad;
+    Java_*;
+    matcha_embed_init;
+  local:
+    *;
+};
+`
+	if script := exportsVersionScript([]string{"matcha_embed_init"}); script != expected {
+		t.Errorf("Unexpected version script:\n%s", script)
+	}
+
+	f := &Flags{BuildMode: "c-archive"}
+	if path := androidLibPath(f, "android", "arm64-v8a"); path != filepath.Join("android", "staticlibs", "arm64-v8a", "libgojni.a") {
+		t.Errorf("androidLibPath() = %v", path)
+	}
+}
+
+func TestBuildSingleArch(t *testing.T) {
+	buf := &bytes.Buffer{}
+	f := &Flags{Logger: log.New(buf, "", 0), BuildN: true}
+	pkgs := []*build.Package{{Name: "example", ImportPath: "example.com/example"}}
+	if _, err := BuildSingleArch(f, "android", pkgs, "arm7", "$WORK"); err == nil {
+		t.Error("Expected error for an unsupported arch")
+	}
+
+	path, err := BuildSingleArch(f, "android", pkgs, "arm64", "$WORK")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != filepath.Join("android", "src", "main", "jniLibs", "arm64-v8a", "libgojni.so") {
+		t.Errorf("BuildSingleArch() = %v", path)
+	}
+	if out := buf.String(); strings.Contains(out, "javac") || strings.Contains(out, "GOARCH=arm ") {
+		t.Errorf("Unexpected commands:\n%s", out)
+	}
+}
+
+func TestMinimalResValues(t *testing.T) {
+	var res struct {
+		XMLName xml.Name
+		Items   []struct{} `xml:",any"`
+	}
+	if err := xml.Unmarshal([]byte(minimalResValues), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.XMLName.Local != "resources" || len(res.Items) != 0 {
+		t.Errorf("Unexpected values resource:\n%s", minimalResValues)
+	}
+}
+
+func TestVersionScript(t *testing.T) {
+	buf := &bytes.Buffer{}
+	f := &Flags{Logger: log.New(buf, "", 0), BuildN: true, VersionScript: "/scripts/{abi}.map"}
+	pkgs := []*build.Package{{Name: "example", ImportPath: "example.com/example"}}
+	if _, err := BuildSingleArch(f, "android", pkgs, "arm64", "$WORK"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "-extldflags=-Wl,--version-script=/scripts/arm64-v8a.map") {
+		t.Errorf("Missing version script in:\n%s", buf.String())
+	}
+
+	f.ExportedSymbols = []string{"matcha_embed_init"}
+	if _, err := BuildSingleArch(f, "android", pkgs, "arm64", "$WORK"); err == nil {
+		t.Error("Expected error for exported symbols and a version script")
+	}
+}
+
+func TestMergeJars(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matcha-classes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	classes := filepath.Join(dir, "classes")
+	if err := os.MkdirAll(filepath.Join(classes, "go"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(classes, "go", "Seq.class"), []byte("class"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestJar := func(name string, entries map[string]string) string {
+		path := filepath.Join(dir, name)
+		file, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		w := zip.NewWriter(file)
+		for _, i := range []string{"META-INF/", "META-INF/MANIFEST.MF", "META-INF/CERT.SF", "META-INF/LICENSE", "META-INF/services/a.Service", "b/", "b/B.class", "c/C.class"} {
+			if data, ok := entries[i]; ok {
+				fw, err := w.Create(i)
+				if err != nil {
+					t.Fatal(err)
+				}
+				fw.Write([]byte(data))
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	jar1 := writeTestJar("one.jar", map[string]string{
+		"META-INF/":                   "",
+		"META-INF/MANIFEST.MF":        "Manifest-Version: 1.0\n",
+		"META-INF/CERT.SF":            "signature",
+		"META-INF/LICENSE":            "one",
+		"META-INF/services/a.Service": "b.B",
+		"b/":                          "",
+		"b/B.class":                   "b",
+	})
+	jar2 := writeTestJar("two.jar", map[string]string{
+		"META-INF/LICENSE":            "two",
+		"META-INF/services/a.Service": "c.C\n",
+		"c/C.class":                   "c",
+	})
+
+	f := &Flags{Logger: log.New(ioutil.Discard, "", 0), MergeJars: []string{jar1, jar2}}
+	buf := &bytes.Buffer{}
+	if err := writeJar(f, buf, classes); err != nil {
+		t.Fatal(err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := map[string]string{}
+	names := []string{}
+	for _, i := range r.File {
+		data, err := readZipFile(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, i.Name)
+		entries[i.Name] = string(data)
+	}
+	expected := []string{"META-INF/MANIFEST.MF", "go/Seq.class", "META-INF/LICENSE", "b/B.class", "c/C.class", "META-INF/services/a.Service"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Jar entries %v, expected %v", names, expected)
+	}
+	if entries["META-INF/LICENSE"] != "one" {
+		t.Errorf("META-INF/LICENSE = %q, expected the first jar's", entries["META-INF/LICENSE"])
+	}
+	if entries["META-INF/services/a.Service"] != "b.B\nc.C\n" {
+		t.Errorf("META-INF/services/a.Service = %q", entries["META-INF/services/a.Service"])
+	}
+
+	f.MergeJars = []string{jar1, writeTestJar("three.jar", map[string]string{"b/B.class": "b"})}
+	if err := writeJar(f, &bytes.Buffer{}, classes); err == nil || !strings.Contains(err.Error(), "b/B.class") {
+		t.Errorf("Expected a conflict for b/B.class, got %v", err)
+	}
+
+	notJar := filepath.Join(dir, "not.jar")
+	if err := ioutil.WriteFile(notJar, []byte("text"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkJars([]string{jar1, notJar}); err == nil {
+		t.Error("Expected an error for a file that isn't a jar")
+	}
+}
+
+func TestReproducibleAAR(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "android" {
+		t.Skip("test binary is not an ELF file on", runtime.GOOS)
+	}
+	abi := GetAndroidABI(runtime.GOARCH)
+	if abi == "" {
+		t.Skip("no android abi for", runtime.GOARCH)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lib, err := ioutil.ReadFile(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, cleanup := fakeSDK(t, "ndk-bundle/platforms")
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "matcha-reproducible")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The native library, the test binary standing in for it, and the Java
+	// classes are built already, and the assets are found in the package's
+	// directory.
+	androidDir := filepath.Join(dir, "android")
+	classesDir := filepath.Join(dir, "classes")
+	pkgDir := filepath.Join(dir, "src", "example")
+	files := map[string]string{
+		androidLibPath(&Flags{}, androidDir, abi):     string(lib),
+		filepath.Join(classesDir, "go", "Seq.class"):  "class",
+		filepath.Join(pkgDir, "example.go"):           "package example\n",
+		filepath.Join(pkgDir, "assets", "a.txt"):      "a",
+		filepath.Join(pkgDir, "assets", "b", "c.txt"): "c",
+	}
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pkgs := []*build.Package{{Name: "example", ImportPath: "example.com/example", Dir: pkgDir}}
+
+	aars := [][]byte{}
+	for i, mode := range []os.FileMode{0644, 0755} {
+		// The second build's inputs are newer and have other modes.
+		mtime := time.Now().Add(time.Duration(i) * time.Hour)
+		for name := range files {
+			if err := os.Chmod(name, mode); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(name, mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+		}
+		f := &Flags{Logger: log.New(ioutil.Discard, "", 0), Reproducible: true, PrebuiltLibs: true}
+		aarPath := filepath.Join(dir, fmt.Sprintf("example%d.aar", i))
+		if _, err := buildAAR(f, androidDir, pkgs, []string{runtime.GOARCH}, dir, aarPath, classesDir); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(aarPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		aars = append(aars, data)
+	}
+	if !bytes.Equal(aars[0], aars[1]) {
+		t.Error("Reproducible builds of the same inputs wrote different aars")
+	}
+}
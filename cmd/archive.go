@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// buildOutputs returns the paths of the files written for the aar of result
+// that exist: the aar, its native aars, javadoc jar, native debug symbols,
+// test harness jar, build reports and the matcha.lock in its directory,
+// which records the modules it was built from, and the signatures BuildAAR
+// wrote. Signatures left next to the aar by an earlier build are not included.
+func buildOutputs(result *BuildResult) ([]string, error) {
+	aarPath := result.AARPath
+	aars := []string{aarPath}
+	for _, abi := range result.ABIs {
+		aars = append(aars, NativeAARPath(aarPath, abi))
+	}
+	paths := append([]string{}, aars...)
+	paths = append(paths, result.Signatures...)
+	paths = append(paths,
+		JavadocJarPath(aarPath),
+		NativeDebugSymbolsPath(aarPath),
+		TestHarnessJarPath(aarPath),
+		ReportPath(aarPath, "txt"),
+		ReportPath(aarPath, "html"),
+		filepath.Join(filepath.Dir(aarPath), LockFile),
+	)
+
+	outputs := []string{}
+	for i, path := range paths {
+		if _, err := os.Stat(path); os.IsNotExist(err) && i > 0 {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, path)
+	}
+	return outputs, nil
+}
+
+// ArchiveBuildOutputs writes a gzipped tar of the aar at result.AARPath and
+// the other files written next to it, see buildOutputs, to w. Each file is
+// stored under its base name, so the archive can be kept as a single record
+// of a release build.
+func ArchiveBuildOutputs(result *BuildResult, w io.Writer) error {
+	outputs, err := buildOutputs(result)
+	if err != nil {
+		return err
+	}
+
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	for _, path := range outputs {
+		if err := addTarFile(tw, filepath.Base(path), path); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// addTarFile adds the file at path to tw as name.
+func addTarFile(tw *tar.Writer, name, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	hdr, err := tar.FileInfoHeader(fi, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, file)
+	return err
+}
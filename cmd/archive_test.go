@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestArchiveBuildOutputs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matcha-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	aarPath := filepath.Join(dir, "example-release.aar")
+	files := map[string]string{
+		"example-release.aar":                        "aar",
+		"example-release-native-arm64-v8a.aar":       "arm64",
+		"example-release-native-debug-symbols.zip":   "symbols",
+		"example-release-build-report.txt":           "report",
+		LockFile:                                     "{}",
+		"example-debug.aar":                          "other variant",
+		"example-release-native-armeabi-v7a.aar.tmp": "partial",
+		"example-release.aar.sig":                    "signature",
+		"example-release.aar.asc":                    "stale signature",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	result := &BuildResult{
+		AARPath:    aarPath,
+		ABIs:       []string{"armeabi-v7a", "arm64-v8a"},
+		Signatures: []string{aarPath + ".sig"},
+	}
+	if err := ArchiveBuildOutputs(result, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	gr, err := gzip.NewReader(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gr)
+	extracted := map[string]string{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		extracted[hdr.Name] = string(data)
+	}
+	expected := map[string]string{
+		"example-release.aar":                      "aar",
+		"example-release-native-arm64-v8a.aar":     "arm64",
+		"example-release-native-debug-symbols.zip": "symbols",
+		"example-release-build-report.txt":         "report",
+		"example-release.aar.sig":                  "signature",
+		LockFile:                                   "{}",
+	}
+	if !reflect.DeepEqual(extracted, expected) {
+		t.Errorf("Unexpected archive contents %v", extracted)
+	}
+
+	result.AARPath = filepath.Join(dir, "missing.aar")
+	if err := ArchiveBuildOutputs(result, ioutil.Discard); err == nil {
+		t.Error("Expected error for a missing aar")
+	}
+}
@@ -0,0 +1,440 @@
+package cmd
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"fmt"
+	"go/build"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// maxAssetSize is the size an individual asset must stay below. Larger files
+// need a zip64 entry, which Android's asset manager cannot read. Archive wide
+// zip64 records, needed when the aar itself exceeds 4GB or 65535 entries, are
+// written automatically by archive/zip.
+const maxAssetSize = 1<<32 - 1
+
+// assetFile is a file that is copied into the assets/ directory of the aar.
+type assetFile struct {
+	name string // entry name in the aar, e.g. "assets/images/logo.png"
+	path string // path of the source file
+	pkg  string // import path of the package that provides the asset
+	info os.FileInfo
+}
+
+// collectAssets walks the assets directory of each package, or the directory
+// named by f.AssetsDirName, and returns the files that should be added to the
+// aar, sorted by entry name. Assets in the package's assets-debug or
+// assets-release directory, matching f.BuildVariant, replace assets of the
+// same name in the base directory. The assets listed in f.AssetManifest are
+// added too, see readAssetManifest. It is an error for two packages, or a
+// package and the manifest, to provide an asset with the same name. No
+// directories are walked if f.NoAssets is set.
+func collectAssets(f *Flags, pkgs []*build.Package) ([]*assetFile, error) {
+	if f.NoAssets && f.AssetManifest == "" {
+		return nil, nil
+	}
+	if f.NoAssets {
+		pkgs = nil
+	}
+
+	prefix := ""
+	if f.AssetPrefix != "" {
+		if !isCleanRelPath(f.AssetPrefix) {
+			return nil, fmt.Errorf("invalid asset prefix %q: must be a clean relative path", f.AssetPrefix)
+		}
+		prefix = f.AssetPrefix + "/"
+	}
+
+	dirName, err := assetsDirName(f)
+	if err != nil {
+		return nil, err
+	}
+	dirNames := []string{dirName}
+	switch f.BuildVariant {
+	case "":
+	case "debug", "release":
+		dirNames = append(dirNames, dirName+"-"+f.BuildVariant)
+	default:
+		return nil, fmt.Errorf("invalid build variant %q, valid values are debug and release", f.BuildVariant)
+	}
+
+	files := map[string]*assetFile{}
+	for _, pkg := range pkgs {
+		if pkg.Goroot {
+			continue
+		}
+
+		pkgFiles := map[string]*assetFile{}
+		for _, dirName := range dirNames {
+			assetsDir := filepath.Join(pkg.Dir, filepath.FromSlash(dirName))
+			assetsDirExists := false
+			if fi, err := os.Stat(assetsDir); err == nil {
+				assetsDirExists = fi.IsDir()
+			} else if !os.IsNotExist(err) {
+				return nil, err
+			}
+			if !assetsDirExists {
+				continue
+			}
+
+			err := filepath.Walk(assetsDir, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if info.IsDir() {
+					return nil
+				}
+				name := "assets/" + prefix + filepath.ToSlash(path[len(assetsDir)+1:])
+				if info.Size() >= maxAssetSize {
+					return fmt.Errorf("package %s asset %s is %d bytes, assets must be smaller than 4GB",
+						pkg.ImportPath, name, info.Size())
+				}
+				pkgFiles[name] = &assetFile{name: name, path: path, pkg: pkg.ImportPath, info: info}
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		for name, i := range pkgFiles {
+			if orig, exists := files[name]; exists {
+				return nil, fmt.Errorf("package %s asset name conflict: %s already added from package %s",
+					pkg.ImportPath, name, orig.pkg)
+			}
+			files[name] = i
+		}
+	}
+
+	if f.AssetManifest != "" {
+		manifestFiles, err := readAssetManifest(f.AssetManifest, prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range manifestFiles {
+			if orig, exists := files[i.name]; exists {
+				return nil, fmt.Errorf("asset manifest %s asset name conflict: %s already added from package %s",
+					f.AssetManifest, i.name, orig.pkg)
+			}
+			files[i.name] = i
+		}
+	}
+
+	assets := make([]*assetFile, 0, len(files))
+	for _, i := range files {
+		assets = append(assets, i)
+	}
+	sort.Slice(assets, func(i, j int) bool {
+		return assets[i].name < assets[j].name
+	})
+	return assets, nil
+}
+
+// readAssetManifest reads the asset manifest at path, a JSON object mapping
+// the paths of source files to their names in the assets directory of the
+// aar, after prefix. Relative source paths are relative to the manifest's
+// directory. Every source must be an existing file.
+//
+//	{
+//		"../shared/fonts/Roboto.ttf": "fonts/Roboto.ttf",
+//		"/data/models/model.bin": "models/model.bin"
+//	}
+func readAssetManifest(path, prefix string) ([]*assetFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	entries := map[string]string{}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("asset manifest %s: %v", path, err)
+	}
+
+	files := []*assetFile{}
+	names := map[string]string{}
+	for src, name := range entries {
+		if !isCleanRelPath(name) {
+			return nil, fmt.Errorf("asset manifest %s: invalid asset name %q for %s: must be a clean relative path", path, name, src)
+		}
+		name = "assets/" + prefix + name
+		if orig, exists := names[name]; exists {
+			return nil, fmt.Errorf("asset manifest %s: %s and %s are both named %s", path, orig, src, name)
+		}
+		names[name] = src
+
+		if !filepath.IsAbs(src) {
+			src = filepath.Join(filepath.Dir(path), filepath.FromSlash(src))
+		}
+		info, err := os.Stat(src)
+		if err != nil {
+			return nil, fmt.Errorf("asset manifest %s: %v", path, err)
+		}
+		if info.IsDir() {
+			return nil, fmt.Errorf("asset manifest %s: %s is a directory", path, src)
+		}
+		if info.Size() >= maxAssetSize {
+			return nil, fmt.Errorf("asset manifest %s asset %s is %d bytes, assets must be smaller than 4GB", path, name, info.Size())
+		}
+		files = append(files, &assetFile{name: name, path: src, pkg: path, info: info})
+	}
+	return files, nil
+}
+
+// reservedAssetPaths are the assets of the android framework, which the
+// asset manager of an app looks up alongside the app's own. Paths ending in
+// a slash reserve every asset under them.
+var reservedAssetPaths = []string{
+	"webkit/",
+	"images/android-logo-mask.png",
+	"images/android-logo-shine.png",
+	"images/clock_font.png",
+}
+
+// reservedAssetWarnings returns a warning for each asset whose name, below
+// assets/, collides with an asset of the android framework.
+func reservedAssetWarnings(assets []*assetFile) []string {
+	warnings := []string{}
+	for _, i := range assets {
+		name := strings.TrimPrefix(i.name, "assets/")
+		for _, j := range reservedAssetPaths {
+			if name == j || strings.HasSuffix(j, "/") && strings.HasPrefix(name, j) {
+				warnings = append(warnings, fmt.Sprintf("asset %s from %s collides with the android framework's %s, rename it or set an asset prefix", i.name, i.pkg, j))
+				break
+			}
+		}
+	}
+	return warnings
+}
+
+// assetsDirName returns the slash separated directory of each package's
+// assets, f.AssetsDirName or assets if it is unset.
+func assetsDirName(f *Flags) (string, error) {
+	if f.AssetsDirName == "" {
+		return "assets", nil
+	}
+	if !isCleanRelPath(f.AssetsDirName) {
+		return "", fmt.Errorf("invalid assets directory %q: must be a clean relative path", f.AssetsDirName)
+	}
+	return f.AssetsDirName, nil
+}
+
+// checkAssetBudget returns an error listing the largest assets if the total
+// size of assets is over max bytes.
+func checkAssetBudget(assets []*assetFile, max int64) error {
+	total := int64(0)
+	for _, i := range assets {
+		total += i.info.Size()
+	}
+	if total <= max {
+		return nil
+	}
+
+	largest := append([]*assetFile{}, assets...)
+	sort.SliceStable(largest, func(i, j int) bool {
+		return largest[i].info.Size() > largest[j].info.Size()
+	})
+	const top = 5
+	if len(largest) > top {
+		largest = largest[:top]
+	}
+	lines := []string{}
+	for _, i := range largest {
+		lines = append(lines, fmt.Sprintf("\t%s from %s: %d bytes", i.name, i.pkg, i.info.Size()))
+	}
+	return fmt.Errorf("assets are %d bytes, over the limit of %d bytes. Largest assets:\n%s", total, max, strings.Join(lines, "\n"))
+}
+
+// checkAssetExts returns an error listing the assets whose extension is not
+// one of allowed. Extensions are compared ignoring case, with or without
+// their leading dot, and "" allows assets without an extension.
+func checkAssetExts(assets []*assetFile, allowed []string) error {
+	exts := map[string]bool{}
+	for _, i := range allowed {
+		if i != "" && !strings.HasPrefix(i, ".") {
+			i = "." + i
+		}
+		exts[strings.ToLower(i)] = true
+	}
+	lines := []string{}
+	for _, i := range assets {
+		if !exts[strings.ToLower(path.Ext(i.name))] {
+			lines = append(lines, fmt.Sprintf("\t%s from %s", i.name, i.pkg))
+		}
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return fmt.Errorf("assets have extensions other than %s:\n%s", strings.Join(allowed, " "), strings.Join(lines, "\n"))
+}
+
+// defaultNoRecompressExts are the extensions of assets that are already
+// compressed, used when Flags.NoRecompressExts is nil.
+var defaultNoRecompressExts = []string{".gz", ".png", ".jpg", ".mp3", ".ogg"}
+
+// writeAssets copies assets into an archive using create. Assets with one of
+// the extensions in f.NoRecompressExts are stored rather than deflated. Each
+// asset keeps the permissions of its source file, so executables remain
+// executable, unless f.NormalizeAssetPerms or f.Reproducible is set.
+func writeAssets(f *Flags, create func(fh *zip.FileHeader) (io.Writer, error), assets []*assetFile) error {
+	for _, i := range assets {
+		w, err := create(assetHeader(f, i))
+		if err != nil {
+			return err
+		}
+		r, err := os.Open(i.path)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// assetHeader returns the header of the entry for asset i, see writeAssets.
+func assetHeader(f *Flags, i *assetFile) *zip.FileHeader {
+	noRecompressExts := f.NoRecompressExts
+	if noRecompressExts == nil {
+		noRecompressExts = defaultNoRecompressExts
+	}
+
+	fh := &zip.FileHeader{Name: i.name, Method: zip.Deflate}
+	if f.NormalizeAssetPerms || f.Reproducible {
+		fh.SetMode(0644)
+	} else if i.info != nil {
+		fh.SetMode(i.info.Mode().Perm())
+	}
+	ext := path.Ext(i.name)
+	for _, j := range noRecompressExts {
+		if strings.EqualFold(ext, j) {
+			fh.Method = zip.Store
+			break
+		}
+	}
+	return fh
+}
+
+// compressedAsset is an asset compressed by writeAssetsParallel.
+type compressedAsset struct {
+	fh   *zip.FileHeader
+	data []byte
+	err  error
+}
+
+// writeAssetsParallel writes the same entries as writeAssets, but compresses
+// up to f.Parallel assets at once into memory. The compressed entries are
+// written in order with createRaw, as a zip.Writer cannot be written to
+// concurrently, with the headers CreateHeader would write, see rawHeader, so
+// the archive is identical whatever the parallelism, and to one written by
+// writeAssets.
+func writeAssetsParallel(f *Flags, createRaw func(fh *zip.FileHeader) (io.Writer, error), assets []*assetFile) error {
+	results := make([]chan compressedAsset, len(assets))
+	for i := range results {
+		results[i] = make(chan compressedAsset, 1)
+	}
+
+	// sem bounds the assets held in memory, being compressed or waiting to
+	// be written, to f.Parallel.
+	sem := make(chan struct{}, f.Parallel)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for i, asset := range assets {
+			select {
+			case sem <- struct{}{}:
+			case <-done:
+				return
+			}
+			go func(i int, asset *assetFile) {
+				results[i] <- compressAsset(assetHeader(f, asset), asset.path)
+			}(i, asset)
+		}
+	}()
+
+	for i := range assets {
+		r := <-results[i]
+		if r.err != nil {
+			return r.err
+		}
+		fh, err := rawHeader(r.fh)
+		if err != nil {
+			return err
+		}
+		w, err := createRaw(fh)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(r.data); err != nil {
+			return err
+		}
+		<-sem
+	}
+	return nil
+}
+
+// rawHeader returns a copy of fh, whose sizes and checksum are set, with the
+// flags, versions and extra fields zip.Writer.CreateHeader would write, so
+// that the entry CreateRaw writes with it is identical to one written with
+// CreateHeader, including the data descriptor following its data.
+func rawHeader(fh *zip.FileHeader) (*zip.FileHeader, error) {
+	h := *fh
+	h.Extra = append([]byte(nil), fh.Extra...)
+	if _, err := zip.NewWriter(ioutil.Discard).CreateHeader(&h); err != nil {
+		return nil, err
+	}
+	h.CRC32 = fh.CRC32
+	h.CompressedSize64 = fh.CompressedSize64
+	h.UncompressedSize64 = fh.UncompressedSize64
+	return &h, nil
+}
+
+// compressAsset reads the file at path and returns it compressed with the
+// method of fh, with the sizes and checksum of fh set for zip.Writer.CreateRaw.
+func compressAsset(fh *zip.FileHeader, path string) compressedAsset {
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return compressedAsset{err: err}
+	}
+	fh.CRC32 = crc32.ChecksumIEEE(src)
+	fh.UncompressedSize64 = uint64(len(src))
+
+	data := src
+	if fh.Method == zip.Deflate {
+		buf := &bytes.Buffer{}
+		// Level 5 is what archive/zip uses, so entries match writeAssets.
+		fw, err := flate.NewWriter(buf, 5)
+		if err != nil {
+			return compressedAsset{err: err}
+		}
+		if _, err := fw.Write(src); err != nil {
+			return compressedAsset{err: err}
+		}
+		if err := fw.Close(); err != nil {
+			return compressedAsset{err: err}
+		}
+		data = buf.Bytes()
+	}
+	fh.CompressedSize64 = uint64(len(data))
+	return compressedAsset{fh: fh, data: data}
+}
+
+// isCleanRelPath reports whether p is a non-empty, slash separated relative
+// path that does not escape its parent directory.
+func isCleanRelPath(p string) bool {
+	if p == "" || path.IsAbs(p) || path.Clean(p) != p || strings.Contains(p, `\`) {
+		return false
+	}
+	return p != "." && p != ".." && !strings.HasPrefix(p, "../")
+}
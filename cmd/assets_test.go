@@ -0,0 +1,493 @@
+package cmd
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"go/build"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAssetsZip64(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping zip64 test in short mode")
+	}
+
+	dir, err := ioutil.TempDir("", "matcha-assets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "asset.txt")
+	if err := ioutil.WriteFile(src, []byte("asset"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// More entries than fit in a zip32 end of central directory record.
+	const count = 1<<16 + 10
+	assets := make([]*assetFile, count)
+	for i := range assets {
+		assets[i] = &assetFile{name: fmt.Sprintf("assets/%05d.txt", i), path: src, info: info}
+	}
+
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	if err := writeAssets(&Flags{}, zw.CreateHeader, assets); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != count {
+		t.Fatalf("Expected %v entries, got %v", count, len(zr.File))
+	}
+	r, err := zr.File[count-1].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	content, err := ioutil.ReadAll(r)
+	if err != nil || string(content) != "asset" {
+		t.Fatalf("Unexpected last entry %q, %v", content, err)
+	}
+}
+
+func TestAssetsTooLarge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matcha-assets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.Mkdir(filepath.Join(dir, "assets"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Create(filepath.Join(dir, "assets", "model.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Sparse, so no disk space is used.
+	if _, err := file.Seek(maxAssetSize, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write([]byte{0}); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	pkgs := []*build.Package{{Dir: dir, ImportPath: "example.com/model"}}
+	if _, err := collectAssets(&Flags{}, pkgs); err == nil {
+		t.Fatal("Expected error for asset larger than 4GB")
+	}
+}
+
+func TestAssetsVariant(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matcha-assets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"assets/config.json":         "base",
+		"assets/logo.png":            "logo",
+		"assets-debug/config.json":   "debug",
+		"assets-debug/debug.txt":     "debug only",
+		"assets-release/config.json": "release",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pkgs := []*build.Package{{Dir: dir, ImportPath: "example.com/app"}}
+
+	for variant, expected := range map[string]map[string]string{
+		"":        {"assets/config.json": "assets/config.json", "assets/logo.png": "assets/logo.png"},
+		"debug":   {"assets/config.json": "assets-debug/config.json", "assets/debug.txt": "assets-debug/debug.txt", "assets/logo.png": "assets/logo.png"},
+		"release": {"assets/config.json": "assets-release/config.json", "assets/logo.png": "assets/logo.png"},
+	} {
+		assets, err := collectAssets(&Flags{BuildVariant: variant}, pkgs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(assets) != len(expected) {
+			t.Errorf("Variant %q: expected %v assets, got %v", variant, len(expected), len(assets))
+		}
+		for _, i := range assets {
+			if src := filepath.Join(dir, filepath.FromSlash(expected[i.name])); i.path != src {
+				t.Errorf("Variant %q: %v from %v, expected %v", variant, i.name, i.path, src)
+			}
+		}
+	}
+
+	if _, err := collectAssets(&Flags{BuildVariant: "profile"}, pkgs); err == nil {
+		t.Error("Expected error for unknown variant")
+	}
+
+	path := filepath.Join(dir, "res", "raw", "sound.ogg")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte("sound"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	assets, err := collectAssets(&Flags{AssetsDirName: "res/raw"}, pkgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(assets) != 1 || assets[0].name != "assets/sound.ogg" || assets[0].path != path {
+		t.Errorf("Unexpected assets from res/raw: %v", assets)
+	}
+	if _, err := collectAssets(&Flags{AssetsDirName: "../assets"}, pkgs); err == nil {
+		t.Error("Expected error for assets directory outside the package")
+	}
+	if assets, err := collectAssets(&Flags{NoAssets: true, BuildVariant: "debug"}, pkgs); err != nil || len(assets) != 0 {
+		t.Errorf("Expected no assets, got %v, %v", assets, err)
+	}
+}
+
+func TestAssetsNoRecompress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matcha-assets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	assets := []*assetFile{}
+	for _, name := range []string{"config.json", "data.bin.gz", "logo.PNG"} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, bytes.Repeat([]byte(name), 100), 0644); err != nil {
+			t.Fatal(err)
+		}
+		assets = append(assets, &assetFile{name: "assets/" + name, path: path})
+	}
+
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	if err := writeAssets(&Flags{}, zw.CreateHeader, assets); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]uint16{
+		"assets/config.json": zip.Deflate,
+		"assets/data.bin.gz": zip.Store,
+		"assets/logo.PNG":    zip.Store,
+	}
+	for _, i := range zr.File {
+		if i.Method != expected[i.Name] {
+			t.Errorf("%v has method %v, expected %v", i.Name, i.Method, expected[i.Name])
+		}
+	}
+}
+
+func TestAssetsParallel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matcha-assets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	assets := []*assetFile{}
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("%02d.txt", i)
+		if i%3 == 0 {
+			name = fmt.Sprintf("%02d.png", i)
+		}
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, bytes.Repeat([]byte(name), 1000*i), 0644); err != nil {
+			t.Fatal(err)
+		}
+		assets = append(assets, &assetFile{name: "assets/" + name, path: path})
+	}
+
+	write := func(parallel int) []byte {
+		buf := &bytes.Buffer{}
+		zw := zip.NewWriter(buf)
+		if err := writeAssetsParallel(&Flags{Parallel: parallel}, zw.CreateRaw, assets); err != nil {
+			t.Fatal(err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	data := write(4)
+	if !bytes.Equal(data, write(2)) {
+		t.Error("Archive depends on the parallelism")
+	}
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	if err := writeAssets(&Flags{}, zw.CreateHeader, assets); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, buf.Bytes()) {
+		t.Error("Archive written in parallel differs from one written sequentially")
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != len(assets) {
+		t.Fatalf("Expected %v entries, got %v", len(assets), len(zr.File))
+	}
+	for i, file := range zr.File {
+		if file.Name != assets[i].name || file.Method != assetHeader(&Flags{}, assets[i]).Method {
+			t.Errorf("Unexpected entry %v with method %v", file.Name, file.Method)
+		}
+		content, err := readZipFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, _ := ioutil.ReadFile(assets[i].path)
+		if !bytes.Equal(content, expected) {
+			t.Errorf("%v has the wrong contents", file.Name)
+		}
+	}
+
+	assets = append(assets, &assetFile{name: "assets/missing.txt", path: filepath.Join(dir, "missing.txt")})
+	zw = zip.NewWriter(ioutil.Discard)
+	if err := writeAssetsParallel(&Flags{Parallel: 2}, zw.CreateRaw, assets); err == nil {
+		t.Error("Expected error for a missing asset")
+	}
+}
+
+func TestAssetsPerms(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matcha-assets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "helper.sh")
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assets := []*assetFile{{name: "assets/helper.sh", path: path, info: info}}
+
+	for normalize, expected := range map[bool]os.FileMode{false: 0755, true: 0644} {
+		buf := &bytes.Buffer{}
+		zw := zip.NewWriter(buf)
+		if err := writeAssets(&Flags{NormalizeAssetPerms: normalize}, zw.CreateHeader, assets); err != nil {
+			t.Fatal(err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode := zr.File[0].Mode(); mode != expected {
+			t.Errorf("NormalizeAssetPerms %v: mode %v, expected %v", normalize, mode, expected)
+		}
+	}
+}
+
+func TestReproducibleAssets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matcha-assets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The same asset checked out on two machines with different umasks.
+	archives := [][]byte{}
+	for _, perm := range []os.FileMode{0644, 0755} {
+		path := filepath.Join(dir, perm.String(), "helper.sh")
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"), perm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(path, perm); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assets := []*assetFile{{name: "assets/helper.sh", path: path, info: info}}
+
+		buf := &bytes.Buffer{}
+		zw := zip.NewWriter(buf)
+		if err := writeAssets(&Flags{Reproducible: true}, zw.CreateHeader, assets); err != nil {
+			t.Fatal(err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		archives = append(archives, buf.Bytes())
+	}
+	if !bytes.Equal(archives[0], archives[1]) {
+		t.Error("Reproducible builds wrote different assets")
+	}
+}
+
+func TestAssetBudget(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matcha-assets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	assets := []*assetFile{}
+	for i := 1; i <= 7; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("%d.bin", i))
+		if err := ioutil.WriteFile(path, make([]byte, i*100), 0644); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assets = append(assets, &assetFile{name: "assets/" + info.Name(), path: path, pkg: "example.com/app", info: info})
+	}
+
+	if err := checkAssetBudget(assets, 2800); err != nil {
+		t.Errorf("Expected assets to fit, got %v", err)
+	}
+	err = checkAssetBudget(assets, 2799)
+	if err == nil {
+		t.Fatal("Expected assets to be over budget")
+	}
+	msg := err.Error()
+	if !strings.Contains(msg, "assets/7.bin") || !strings.Contains(msg, "assets/3.bin") || strings.Contains(msg, "assets/2.bin") {
+		t.Errorf("Unexpected largest assets: %v", msg)
+	}
+}
+
+func TestAssetManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matcha-assets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"app/assets/logo.png", "shared/fonts/Roboto.ttf", "shared/model.bin"} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pkgs := []*build.Package{{Dir: filepath.Join(dir, "app"), ImportPath: "example.com/app"}}
+
+	writeManifest := func(manifest string) string {
+		path := filepath.Join(dir, "assets.json")
+		if err := ioutil.WriteFile(path, []byte(manifest), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	manifest := writeManifest(`{"shared/fonts/Roboto.ttf": "fonts/Roboto.ttf", "` + filepath.ToSlash(filepath.Join(dir, "shared", "model.bin")) + `": "model.bin"}`)
+
+	assets, err := collectAssets(&Flags{AssetManifest: manifest}, pkgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, i := range assets {
+		names = append(names, i.name)
+	}
+	if !reflect.DeepEqual(names, []string{"assets/fonts/Roboto.ttf", "assets/logo.png", "assets/model.bin"}) {
+		t.Errorf("Unexpected assets %v", names)
+	}
+
+	assets, err = collectAssets(&Flags{AssetManifest: manifest, NoAssets: true}, pkgs)
+	if err != nil || len(assets) != 2 {
+		t.Errorf("Expected only the manifest's assets without the packages', got %v, %v", len(assets), err)
+	}
+
+	for _, i := range []string{
+		`{"shared/model.bin": "logo.png"}`,
+		`{"shared/missing.bin": "missing.bin"}`,
+		`{"shared/fonts": "fonts"}`,
+		`{"shared/model.bin": "../model.bin"}`,
+		`{"shared/model.bin": "model.bin", "shared/fonts/Roboto.ttf": "model.bin"}`,
+		`["model.bin"]`,
+	} {
+		if _, err := collectAssets(&Flags{AssetManifest: writeManifest(i)}, pkgs); err == nil {
+			t.Errorf("Expected error for manifest %s", i)
+		}
+	}
+}
+
+func TestReservedAssetWarnings(t *testing.T) {
+	assets := []*assetFile{
+		{name: "assets/webkit/index.html", pkg: "example.com/app"},
+		{name: "assets/images/clock_font.png", pkg: "example.com/app"},
+		{name: "assets/images/logo.png", pkg: "example.com/app"},
+		{name: "assets/app/webkit/index.html", pkg: "example.com/app"},
+	}
+	warnings := reservedAssetWarnings(assets)
+	if len(warnings) != 2 || !strings.Contains(warnings[0], "assets/webkit/index.html") || !strings.Contains(warnings[1], "assets/images/clock_font.png") {
+		t.Errorf("Unexpected warnings %v", warnings)
+	}
+}
+
+func TestCheckAssetExts(t *testing.T) {
+	assets := []*assetFile{
+		{name: "assets/logo.PNG", pkg: "example.com/app"},
+		{name: "assets/data/config.json", pkg: "example.com/app"},
+		{name: "assets/LICENSE", pkg: "example.com/app"},
+		{name: "assets/main.go", pkg: "example.com/app"},
+		{name: "assets/go/Seq.class", pkg: "example.com/lib"},
+	}
+	if err := checkAssetExts(assets, []string{".png", "json", ".go", ".class", ""}); err != nil {
+		t.Error(err)
+	}
+	err := checkAssetExts(assets, []string{".png", "json"})
+	if err == nil {
+		t.Fatal("Expected error for assets with other extensions")
+	}
+	for _, i := range []string{"assets/LICENSE from example.com/app", "assets/main.go from example.com/app", "assets/go/Seq.class from example.com/lib"} {
+		if !strings.Contains(err.Error(), i) {
+			t.Errorf("Error is missing %q:\n%v", i, err)
+		}
+	}
+	if strings.Contains(err.Error(), "logo.PNG") || strings.Contains(err.Error(), "config.json") {
+		t.Errorf("Error lists allowed assets:\n%v", err)
+	}
+}
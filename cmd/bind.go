@@ -9,11 +9,13 @@ import (
 	"errors"
 	"fmt"
 	"go/build"
+	"os"
 	"os/exec"
-	"path"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
+	"time"
 )
 
 func ParseTargets(a string) map[string]struct{} {
@@ -30,13 +32,9 @@ func ParseTargets(a string) map[string]struct{} {
 		switch i {
 		case "android":
 			targets["android"] = struct{}{}
-			targets["android/arm"] = struct{}{}
-			targets["android/arm64"] = struct{}{}
-			targets["android/386"] = struct{}{}
-			targets["android/amd64"] = struct{}{}
-		case "android/arm", "android/arm64", "android/386", "android/amd64":
-			targets["android"] = struct{}{}
-			targets[i] = struct{}{}
+			for _, arch := range SupportedArches() {
+				targets["android/"+arch] = struct{}{}
+			}
 		case "ios":
 			targets["ios"] = struct{}{}
 			targets["ios/arm"] = struct{}{}
@@ -46,6 +44,11 @@ func ParseTargets(a string) map[string]struct{} {
 		case "ios/arm", "ios/arm64", "ios/386", "ios/amd64":
 			targets["ios"] = struct{}{}
 			targets[i] = struct{}{}
+		default:
+			if arch := strings.TrimPrefix(i, "android/"); arch != i && GetAndroidABI(arch) != "" {
+				targets["android"] = struct{}{}
+				targets[i] = struct{}{}
+			}
 		}
 	}
 	return targets
@@ -61,7 +64,29 @@ func Build(flags *Flags, args []string) error {
 	return Bind(flags, args)
 }
 
+// runPostBuild runs f.PostBuild, if set, with $MATCHA_ARTIFACT set to dst.
+// Bind runs it for each aar once every aar, the files next to them and the
+// matcha.lock are in their final place, and BuildAAR once the aar is written
+// and signed, so a hook that uploads the aar sees what is shipped.
+func runPostBuild(f *Flags, dst, tmpdir string) error {
+	if len(f.PostBuild) == 0 {
+		return nil
+	}
+	cmd := exec.Command(f.PostBuild[0], f.PostBuild[1:]...)
+	cmd.Env = []string{"MATCHA_ARTIFACT=" + dst}
+	if err := RunCmd(f, tmpdir, cmd); err != nil {
+		return fmt.Errorf("post build command: %v", err)
+	}
+	return nil
+}
+
 func Bind(flags *Flags, args []string) error {
+	if err := flags.Validate(); err != nil {
+		return err
+	}
+	if flags.EmitScript != "" {
+		flags.script = newBuildScript(runtime.GOOS)
+	}
 	targets := ParseTargets(flags.BuildTargets)
 
 	// Validate Go
@@ -114,30 +139,22 @@ func Bind(flags *Flags, args []string) error {
 	ctx.GOOS = "darwin"
 	ctx.BuildTags = append(ctx.BuildTags, "matcha")
 
-	// Get import paths to be built.
+	// Get import paths to be built, expanding patterns such as ./...
+	roots, err := ResolvePackages(args, flags)
+	if err != nil {
+		return err
+	}
 	importPaths := []string{}
-	if len(args) == 0 {
-		importPaths = append(importPaths, ".")
-	} else {
-		for _, i := range args {
-			i = path.Clean(i)
-			importPaths = append(importPaths, i)
-		}
+	for _, i := range roots {
+		importPaths = append(importPaths, i.ImportPath)
 	}
 
-	// Get packages to be built
+	// Get packages to be built, and their dependencies.
 	pkgs, err := ImportAll(flags, &ctx, importPaths, cwd, build.ImportComment)
 	if err != nil {
 		return err
 	}
 
-	// Check if any of the package is main.
-	for _, pkg := range pkgs {
-		if pkg.Name == "main" {
-			return fmt.Errorf("binding 'main' package (%s) is not supported", pkg.ImportComment)
-		}
-	}
-
 	// Get the supporting files
 	bridgePath, err := PackageDir(flags, "gomatcha.io/matcha/bridge")
 	if err != nil {
@@ -168,7 +185,7 @@ func Bind(flags *Flags, args []string) error {
 
 		// Create the "main" go package, that references the other go packages
 		mainPath := filepath.Join(tempdir, "src", "iosbin", "main.go")
-		err = WriteFile(flags, mainPath, strings.NewReader(fmt.Sprintf(BindFile, args[0]))) // TODO(KD): Should this be args[0] or should it use the logic to generate pkgs
+		err = WriteFile(flags, mainPath, strings.NewReader(bindMainFile(importPaths)))
 		if err != nil {
 			return fmt.Errorf("failed to create the binding package for iOS: %v", err)
 		}
@@ -304,6 +321,10 @@ func Bind(flags *Flags, args []string) error {
 		// }
 	}
 	if _, ok := targets["android"]; ok {
+		var release func()
+		flags, release = flags.withTimeout()
+		defer release()
+
 		// Validate Android installation
 		if err := ValidateAndroidInstall(flags); err != nil {
 			return err
@@ -313,23 +334,29 @@ func Bind(flags *Flags, args []string) error {
 		gopathDir := filepath.Join(tempdir, "ANDROID-GOPATH")
 
 		androidArchs := []string{}
-		if _, ok := targets["android/arm"]; ok {
-			androidArchs = append(androidArchs, "arm")
-		}
-		if _, ok := targets["android/arm64"]; ok {
-			androidArchs = append(androidArchs, "arm64")
-		}
-		if _, ok := targets["android/386"]; ok {
-			androidArchs = append(androidArchs, "386")
-		}
-		if _, ok := targets["android/amd64"]; ok {
-			androidArchs = append(androidArchs, "amd64")
+		for _, arch := range SupportedArches() {
+			if _, ok := targets["android/"+arch]; ok {
+				androidArchs = append(androidArchs, arch)
+			}
 		}
 
 		androidDir := filepath.Join(tempdir, "android")
 		mainPath := filepath.Join(tempdir, "androidlib/main.go")
 
-		err = WriteFile(flags, mainPath, strings.NewReader(fmt.Sprintf(BindFile, args[0]))) // TODO(KD): Should this be args[0] or should it use the logic to generate pkgs
+		// Hermetic builds read copies of the packages and their
+		// dependencies in $WORK, which are found first in the GOPATH of the
+		// build.
+		if flags.Hermetic {
+			actx := build.Default
+			actx.GOOS = "android"
+			actx.CgoEnabled = true
+			actx.BuildTags = append(actx.BuildTags, "matcha")
+			if pkgs, err = hermeticPackages(flags, &actx, pkgs, androidArchs, gopathDir); err != nil {
+				return err
+			}
+		}
+
+		err = WriteFile(flags, mainPath, strings.NewReader(bindMainFile(importPaths)))
 		if err != nil {
 			return fmt.Errorf("failed to create the main package for android: %v", err)
 		}
@@ -348,6 +375,49 @@ func Bind(flags *Flags, args []string) error {
 			return err
 		}
 
+		if flags.ShouldRun() {
+			missing, err := VerifyBindingCoverage(flags, pkgs, filepath.Join(androidDir, "src", "main", "java"))
+			if err != nil {
+				return err
+			}
+			if len(missing) > 0 && flags.StrictBinding {
+				return fmt.Errorf("JNI functions have no Java native method: %s", strings.Join(missing, ", "))
+			} else if len(missing) > 0 {
+				flags.warnf("JNI functions have no Java native method: %s", strings.Join(missing, ", "))
+			}
+		}
+
+		if flags.CheckSymbols {
+			if err := CheckExportedSymbols(pkgs); err != nil {
+				return err
+			}
+		}
+		if flags.Report != "" {
+			if err := checkReportFormat(flags.Report); err != nil {
+				return err
+			}
+		}
+
+		// Record the versions the aars are built with, and check them
+		// against a previous build's lock. Finding them runs go, javac and
+		// go list, so it's only done when the lock or a report needs them.
+		var lock *Lock
+		if flags.Lock || flags.VerifyLock != "" || flags.Report != "" {
+			if lock, err = CurrentLock(flags, cwd); err != nil {
+				return err
+			}
+		}
+		if flags.VerifyLock != "" {
+			if err := VerifyLock(flags, flags.VerifyLock, lock); err != nil {
+				return err
+			}
+		}
+		if flags.Lock && flags.Reproducible {
+			if lock.Env, err = lockEnv(flags, androidArchs); err != nil {
+				return err
+			}
+		}
+
 		// Make $WORK/matcha-android
 		workOutputDir := filepath.Join(tempdir, "matcha-android")
 		if err := Mkdir(flags, workOutputDir); err != nil {
@@ -356,45 +426,150 @@ func Bind(flags *Flags, args []string) error {
 
 		// Make aar output file.
 		aarDirPath := filepath.Join(workOutputDir, "MatchaBridge")
-		aarPath := filepath.Join(workOutputDir, "MatchaBridge", "matchabridge.aar")
 		if err := Mkdir(flags, aarDirPath); err != nil {
 			return err
 		}
 
-		// Generate binding code and java source code only when processing the first package.
-		for _, arch := range androidArchs {
-			env, err := AndroidEnv(flags, arch)
-			if err != nil {
+		// Create output dir
+		outputDir := flags.BuildO
+		if outputDir == "" {
+			outputDir = "Matcha-iOS"
+		}
+
+		lockDir := filepath.Join(outputDir, "android")
+		if flags.OutputDir != "" {
+			if err := Mkdir(flags, flags.OutputDir); err != nil {
 				return err
 			}
-			env = append(env, "GOPATH="+gopathDir+string(filepath.ListSeparator)+GoEnv(flags, "GOPATH"))
-
-			err = GoBuild(flags,
-				[]string{mainPath},
-				env,
-				[]string{"matcha"},
-				matchaPkgPath,
-				tempdir,
-				"-buildmode=c-shared",
-				"-o="+filepath.Join(androidDir, "src/main/jniLibs/"+GetAndroidABI(arch)+"/libgojni.so"),
-			)
-			if err != nil {
+			lockDir = flags.OutputDir
+		}
+
+		variants := []string{flags.BuildVariant}
+		if flags.BuildAllVariants {
+			variants = []string{"debug", "release"}
+		}
+		minSDKs := []int{flags.MinSDK}
+		if len(flags.MinSDKVariants) > 0 {
+			minSDKs = flags.MinSDKVariants
+		}
+		classesDir := ""
+		artifacts := []string{}
+		for _, variant := range variants {
+			for _, minSDK := range minSDKs {
+				// Each variant gets its own native libraries, the compiled Java classes are shared.
+				vflags := *flags
+				vflags.BuildVariant = variant
+				vflags.BuildAllVariants = false
+				vflags.MinSDK = minSDK
+				vflags.MinSDKVariants = nil
+				vflags.PrebuiltLibs = true
+				nativeStart := time.Now()
+				if err := buildAndroidLibs(&vflags, mainPath, androidDir, androidArchs, matchaPkgPath, gopathDir, tempdir); err != nil {
+					return err
+				}
+				nativeTime := time.Since(nativeStart)
+
+				name := "matchabridge"
+				if flags.BuildAllVariants {
+					name += "-" + variant
+				}
+				module := bindName(pkgs)
+				if len(flags.MinSDKVariants) > 0 {
+					name += fmt.Sprintf("-minsdk%d", minSDK)
+					module += fmt.Sprintf("-minsdk%d", minSDK)
+				}
+				aarPath := filepath.Join(aarDirPath, name+".aar")
+				result, err := buildAAR(&vflags, androidDir, pkgs, androidArchs, tempdir, aarPath, classesDir)
+				if err != nil {
+					return err
+				}
+				result.Phases = append([]BuildPhase{{Name: "native", Duration: nativeTime}}, result.Phases...)
+				classesDir = result.classesDir
+				abis := []string{}
+				for _, arch := range androidArchs {
+					abis = append(abis, GetAndroidABI(arch))
+				}
+				if flags.SplitNative {
+					if err := SplitNativeAAR(&vflags, aarPath, abis); err != nil {
+						return err
+					}
+				}
+
+				// Copy binary into place.
+				dst := filepath.Join(outputDir, "android", name+".aar")
+				if flags.OutputDir != "" {
+					dst = filepath.Join(flags.OutputDir, AARFileName(module, variant, flags.Version))
+				}
+				if err := CopyFile(flags, dst, aarPath); err != nil {
+					return err
+				}
+				if flags.SplitNative {
+					for _, abi := range abis {
+						if err := CopyFile(flags, NativeAARPath(dst, abi), NativeAARPath(aarPath, abi)); err != nil {
+							return err
+						}
+					}
+				}
+				if flags.SignKey != "" && !flags.BuildN {
+					if _, err := signAARs(flags, dst, abis, tempdir); err != nil {
+						return err
+					}
+				}
+				if flags.BuildJavadoc && IsFile(flags, JavadocJarPath(aarPath)) {
+					if err := CopyFile(flags, JavadocJarPath(dst), JavadocJarPath(aarPath)); err != nil {
+						return err
+					}
+				}
+				if flags.NativeDebugSymbols {
+					if err := CopyFile(flags, NativeDebugSymbolsPath(dst), NativeDebugSymbolsPath(aarPath)); err != nil {
+						return err
+					}
+				}
+				if flags.TestHarness {
+					if err := CopyFile(flags, TestHarnessJarPath(dst), TestHarnessJarPath(aarPath)); err != nil {
+						return err
+					}
+				}
+				if flags.Report != "" {
+					if err := WriteBuildReport(flags, ReportPath(dst, flags.Report), flags.Report, result, lock); err != nil {
+						return err
+					}
+				}
+				if flags.BuildMode == "c-archive" {
+					for _, arch := range androidArchs {
+						abi := GetAndroidABI(arch)
+						lib := androidLibPath(flags, androidDir, abi)
+						staticDir := filepath.Join(filepath.Dir(dst), strings.TrimSuffix(filepath.Base(dst), ".aar")+"-static", abi)
+						if err := CopyFile(flags, filepath.Join(staticDir, "libgojni.a"), lib); err != nil {
+							return err
+						}
+						if err := CopyFile(flags, filepath.Join(staticDir, "libgojni.h"), strings.TrimSuffix(lib, ".a")+".h"); err != nil {
+							return err
+						}
+					}
+				}
+				artifacts = append(artifacts, dst)
+			}
+		}
+		if flags.Lock {
+			if err := WriteLock(flags, lockDir, lock); err != nil {
 				return err
 			}
 		}
-
-		if err := BuildAAR(flags, androidDir, pkgs, androidArchs, tempdir, aarPath); err != nil {
-			return err
+		for _, dst := range artifacts {
+			if err := runPostBuild(flags, dst, tempdir); err != nil {
+				return err
+			}
 		}
+	}
 
-		// Create output dir
-		outputDir := flags.BuildO
-		if outputDir == "" {
-			outputDir = "Matcha-iOS"
+	if flags.script != nil {
+		script := flags.script
+		flags.script = nil
+		if err := WriteFile(flags, flags.EmitScript, bytes.NewReader(script.Bytes())); err != nil {
+			return err
 		}
-
-		// Copy binary into place.
-		if err := CopyFile(flags, filepath.Join(outputDir, "android", "matchabridge.aar"), aarPath); err != nil {
+		if err := os.Chmod(flags.EmitScript, 0755); err != nil {
 			return err
 		}
 	}
@@ -413,3 +588,48 @@ import "C"
 
 func main() {}
 `
+
+// bindMainFile returns the source of a main package like BindFile that
+// imports every package in importPaths.
+func bindMainFile(importPaths []string) string {
+	imports := ""
+	for _, i := range importPaths {
+		imports += fmt.Sprintf("    _ %q\n", i)
+	}
+	return strings.Replace(BindFile, "    _ \"%s\"\n", imports, 1)
+}
+
+// bindRoots returns the import paths of the packages in pkgs that are not
+// imported by any of the others, sorted. These are the packages that were
+// requested to be bound, pkgs also containing their dependencies.
+func bindRoots(pkgs []*build.Package) []string {
+	imported := map[string]bool{}
+	for _, pkg := range pkgs {
+		for _, i := range pkg.Imports {
+			imported[i] = true
+		}
+	}
+	roots := []string{}
+	for _, pkg := range pkgs {
+		if !pkg.Goroot && !imported[pkg.ImportPath] && pkg.ImportPath != "gomatcha.io/matcha/bridge" {
+			roots = append(roots, pkg.ImportPath)
+		}
+	}
+	sort.Strings(roots)
+	return roots
+}
+
+// bindName returns the package name of the first of bindRoots(pkgs). It names
+// the artifacts of the binding, which must not depend on the order of pkgs.
+func bindName(pkgs []*build.Package) string {
+	roots := bindRoots(pkgs)
+	if len(roots) == 0 {
+		return pkgs[0].Name
+	}
+	for _, pkg := range pkgs {
+		if pkg.ImportPath == roots[0] {
+			return pkg.Name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"go/build"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBindRoots(t *testing.T) {
+	pkgs := []*build.Package{
+		{Name: "bridge", ImportPath: "gomatcha.io/matcha/bridge"},
+		{Name: "fmt", ImportPath: "fmt", Goroot: true},
+		{Name: "other", ImportPath: "example.com/other"},
+		{Name: "view", ImportPath: "example.com/app/view", Imports: []string{"gomatcha.io/matcha/bridge"}},
+		{Name: "app", ImportPath: "example.com/app", Imports: []string{"example.com/app/view", "fmt", "gomatcha.io/matcha/bridge"}},
+	}
+	roots := bindRoots(pkgs)
+	if !reflect.DeepEqual(roots, []string{"example.com/app", "example.com/other"}) {
+		t.Fatalf("bindRoots() = %v", roots)
+	}
+	// The name doesn't depend on the order of the dependencies.
+	for i := range pkgs {
+		rotated := append(append([]*build.Package{}, pkgs[i:]...), pkgs[:i]...)
+		if name := bindName(rotated); name != "app" {
+			t.Errorf("bindName() of %v first = %q, want app", rotated[0].ImportPath, name)
+		}
+	}
+
+	src := bindMainFile(roots)
+	if !strings.Contains(src, "    _ \"example.com/app\"\n    _ \"example.com/other\"\n)") || strings.Contains(src, "%s") {
+		t.Errorf("Unexpected main file:\n%s", src)
+	}
+}
+
+func TestRunPostBuild(t *testing.T) {
+	r := &recordingRunner{}
+	f := &Flags{Logger: log.New(ioutil.Discard, "", 0), Runner: r}
+	if err := runPostBuild(f, "/out/example.aar", ""); err != nil || len(r.args) != 0 {
+		t.Errorf("runPostBuild() without a command = %v, ran %v", err, r.args)
+	}
+
+	f.PostBuild = []string{"upload", "--bucket", "libs"}
+	if err := runPostBuild(f, "/out/example.aar", ""); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(r.args, [][]string{{"upload", "--bucket", "libs"}}) {
+		t.Errorf("Unexpected commands %v", r.args)
+	}
+	found := false
+	for _, i := range r.env[0] {
+		found = found || i == "MATCHA_ARTIFACT=/out/example.aar"
+	}
+	if !found {
+		t.Errorf("MATCHA_ARTIFACT is not the destination in %v", r.env[0])
+	}
+}
@@ -0,0 +1,158 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"go/build"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+var (
+	cJNIFuncRegexp    = regexp.MustCompile(`JNICALL\s+(Java_\w+)\s*\(`)
+	goJNIExportRegexp = regexp.MustCompile(`(?m)^//export\s+(Java_\w+)`)
+	goExportRegexp    = regexp.MustCompile(`(?m)^//export\s+(\w+)`)
+	javaPackageRegexp = regexp.MustCompile(`(?m)^\s*package\s+([\w.]+)\s*;`)
+	javaNativeRegexp  = regexp.MustCompile(`\bnative\s+[\w\[\]<>.,? ]+?\s+(\w+)\s*\(`)
+)
+
+// VerifyBindingCoverage returns the JNI functions exported by the C and Go
+// files of pkgs that have no matching native method in the Java sources
+// under srcDir, sorted by name. Files are scanned regardless of their build
+// constraints, and methods of nested Java classes are not recognized.
+func VerifyBindingCoverage(f *Flags, pkgs []*build.Package, srcDir string) ([]string, error) {
+	exports := map[string]string{}
+	for _, pkg := range pkgs {
+		if pkg.Goroot || pkg.Dir == "" {
+			continue
+		}
+		files, err := ioutil.ReadDir(pkg.Dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range files {
+			var re *regexp.Regexp
+			switch filepath.Ext(i.Name()) {
+			case ".c":
+				re = cJNIFuncRegexp
+			case ".go":
+				re = goJNIExportRegexp
+			default:
+				continue
+			}
+			data, err := ioutil.ReadFile(filepath.Join(pkg.Dir, i.Name()))
+			if err != nil {
+				return nil, err
+			}
+			for _, m := range re.FindAllStringSubmatch(string(data), -1) {
+				exports[m[1]] = pkg.ImportPath
+			}
+		}
+	}
+
+	natives := map[string]bool{}
+	err := filepath.Walk(srcDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || filepath.Ext(path) != ".java" {
+			return err
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		class := strings.TrimSuffix(filepath.Base(path), ".java")
+		if m := javaPackageRegexp.FindStringSubmatch(string(data)); m != nil {
+			class = m[1] + "." + class
+		}
+		for _, m := range javaNativeRegexp.FindAllStringSubmatch(string(data), -1) {
+			natives["Java_"+jniMangle(class)+"_"+jniMangle(m[1])] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	missing := []string{}
+	for name, pkg := range exports {
+		// Overloaded methods are suffixed with "__" and their mangled signature.
+		short := name
+		if idx := strings.Index(name, "__"); idx != -1 {
+			short = name[:idx]
+		}
+		if !natives[short] {
+			if f.BuildV {
+				f.Logger.Printf("binding: %s exported by %s has no Java native method\n", name, pkg)
+			}
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+	return missing, nil
+}
+
+// CheckExportedSymbols returns an error naming the symbol and packages if two
+// of pkgs export a C function with the same name using a cgo //export
+// comment, which would otherwise fail when linking libgojni.so. Only the
+// GoFiles and CgoFiles of each package, the files its build context
+// selected, are read.
+func CheckExportedSymbols(pkgs []*build.Package) error {
+	exports := map[string]string{}
+	conflicts := []string{}
+	for _, pkg := range pkgs {
+		if pkg.Goroot || pkg.Dir == "" {
+			continue
+		}
+		pkgExports := map[string]bool{}
+		for _, i := range append(append([]string{}, pkg.GoFiles...), pkg.CgoFiles...) {
+			data, err := ioutil.ReadFile(filepath.Join(pkg.Dir, i))
+			if err != nil {
+				return err
+			}
+			for _, m := range goExportRegexp.FindAllStringSubmatch(string(data), -1) {
+				pkgExports[m[1]] = true
+			}
+		}
+		for name := range pkgExports {
+			if orig, ok := exports[name]; ok {
+				conflicts = append(conflicts, fmt.Sprintf("%s is exported by %s and %s", name, orig, pkg.ImportPath))
+				continue
+			}
+			exports[name] = pkg.ImportPath
+		}
+	}
+	if len(conflicts) > 0 {
+		sort.Strings(conflicts)
+		return fmt.Errorf("duplicate exported symbols:\n\t%s", strings.Join(conflicts, "\n\t"))
+	}
+	return nil
+}
+
+// jniMangle escapes a fully qualified class or method name as described in
+// the JNI specification's "Resolving Native Method Names". Other characters
+// are escaped as their UTF-16 code units, so runes outside the Basic
+// Multilingual Plane become a surrogate pair of escapes.
+func jniMangle(name string) string {
+	buf := &bytes.Buffer{}
+	for _, c := range utf16.Encode([]rune(name)) {
+		switch {
+		case c == '.' || c == '/':
+			buf.WriteByte('_')
+		case c == '_':
+			buf.WriteString("_1")
+		case c == ';':
+			buf.WriteString("_2")
+		case c == '[':
+			buf.WriteString("_3")
+		case c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9':
+			buf.WriteByte(byte(c))
+		default:
+			fmt.Fprintf(buf, "_0%04x", c)
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,117 @@
+package cmd
+
+import (
+	"go/build"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestVerifyBindingCoverage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matcha-binding")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Check the bridge package against its own Java sources.
+	bridgeDir := filepath.Join("..", "bridge")
+	javaDir := filepath.Join(dir, "java", "io", "gomatcha", "bridge")
+	if err := os.MkdirAll(javaDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []string{"GoValue", "Bridge", "Tracker"} {
+		data, err := ioutil.ReadFile(filepath.Join(bridgeDir, "java-"+i+".java"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(javaDir, i+".java"), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f := &Flags{Logger: log.New(ioutil.Discard, "", 0)}
+	pkgs := []*build.Package{{Dir: bridgeDir, ImportPath: "gomatcha.io/matcha/bridge"}}
+	missing, err := VerifyBindingCoverage(f, pkgs, filepath.Join(dir, "java"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != 0 {
+		t.Errorf("Bridge is missing bindings: %v", missing)
+	}
+
+	// An export without a native method is reported.
+	pkgDir := filepath.Join(dir, "pkg")
+	if err := os.MkdirAll(pkgDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	src := "package pkg\n\nimport \"C\"\n\n//export Java_io_gomatcha_bridge_GoValue_matchaExtra\nfunc extra() {}\n\n//export Java_io_gomatcha_bridge_GoValue_matchaGoInt__I\nfunc goInt() {}\n"
+	if err := ioutil.WriteFile(filepath.Join(pkgDir, "pkg.go"), []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pkgs = append(pkgs, &build.Package{Dir: pkgDir, ImportPath: "example.com/pkg"})
+	missing, err = VerifyBindingCoverage(f, pkgs, filepath.Join(dir, "java"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(missing, []string{"Java_io_gomatcha_bridge_GoValue_matchaExtra"}) {
+		t.Errorf("Unexpected missing bindings %v", missing)
+	}
+}
+
+func TestJNIMangle(t *testing.T) {
+	for name, expected := range map[string]string{
+		"io.gomatcha.bridge.GoValue": "io_gomatcha_bridge_GoValue",
+		"matcha_init":                "matcha_1init",
+		"café":                       "caf_000e9",
+		"emoji😀":                     "emoji_0d83d_0de00",
+	} {
+		if mangled := jniMangle(name); mangled != expected {
+			t.Errorf("jniMangle(%q) = %q, expected %q", name, mangled, expected)
+		}
+	}
+}
+
+func TestCheckExportedSymbols(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matcha-binding")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pkgs := []*build.Package{}
+	for name, src := range map[string]string{
+		"a": "package a\n\nimport \"C\"\n\n//export matchaInit\nfunc matchaInit() {}\n\n//export aOnly\nfunc aOnly() {}\n",
+		"b": "package b\n\nimport \"C\"\n\n//export bOnly\nfunc bOnly() {}\n",
+		"c": "package c\n\nimport \"C\"\n\n//export matchaInit\nfunc matchaInit() {}\n",
+	} {
+		pkgDir := filepath.Join(dir, name)
+		if err := os.MkdirAll(pkgDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(pkgDir, name+".go"), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// Files the build context left out, e.g. for another OS, don't count.
+		other := "package " + name + "\n\nimport \"C\"\n\n//export other\nfunc other() {}\n"
+		if err := ioutil.WriteFile(filepath.Join(pkgDir, name+"_ios.go"), []byte(other), 0644); err != nil {
+			t.Fatal(err)
+		}
+		pkgs = append(pkgs, &build.Package{Dir: pkgDir, ImportPath: "example.com/" + name, CgoFiles: []string{name + ".go"}})
+	}
+
+	if err := CheckExportedSymbols(pkgs[:0]); err != nil {
+		t.Error(err)
+	}
+	err = CheckExportedSymbols(pkgs)
+	if err == nil {
+		t.Fatal("Expected duplicate symbol error")
+	}
+	if !strings.Contains(err.Error(), "matchaInit is exported by example.com/") || strings.Contains(err.Error(), "Only") || strings.Contains(err.Error(), "other") {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
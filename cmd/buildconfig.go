@@ -0,0 +1,144 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"unicode/utf16"
+)
+
+// javaKeywords are reserved words that cannot be used as field names.
+var javaKeywords = map[string]bool{
+	"abstract": true, "assert": true, "boolean": true, "break": true, "byte": true,
+	"case": true, "catch": true, "char": true, "class": true, "const": true,
+	"continue": true, "default": true, "do": true, "double": true, "else": true,
+	"enum": true, "extends": true, "final": true, "finally": true, "float": true,
+	"for": true, "goto": true, "if": true, "implements": true, "import": true,
+	"instanceof": true, "int": true, "interface": true, "long": true, "native": true,
+	"new": true, "package": true, "private": true, "protected": true, "public": true,
+	"return": true, "short": true, "static": true, "strictfp": true, "super": true,
+	"switch": true, "synchronized": true, "this": true, "throw": true, "throws": true,
+	"transient": true, "try": true, "void": true, "volatile": true,
+	"true": true, "false": true, "null": true,
+}
+
+// hasBuildConfig reports whether f requests a BuildConfig class.
+func hasBuildConfig(f *Flags) bool {
+	return len(f.BuildConfig) > 0 || len(f.BuildConfigInt) > 0 || len(f.BuildConfigBool) > 0
+}
+
+// buildConfigSource returns the source of the go.<pkgName>.BuildConfig class,
+// which has a public static final field for each entry of f.BuildConfig,
+// f.BuildConfigInt and f.BuildConfigBool.
+func buildConfigSource(f *Flags, pkgName string) ([]byte, error) {
+	fields := map[string]string{}
+	add := func(name, decl string) error {
+		if !isJavaIdentifier(name) {
+			return fmt.Errorf("BuildConfig field %q is not a valid Java identifier", name)
+		}
+		if _, ok := fields[name]; ok {
+			return fmt.Errorf("BuildConfig field %q is defined more than once", name)
+		}
+		fields[name] = decl
+		return nil
+	}
+	for k, v := range f.BuildConfig {
+		if err := add(k, fmt.Sprintf("String %s = %s", k, javaQuote(v))); err != nil {
+			return nil, err
+		}
+	}
+	for k, v := range f.BuildConfigInt {
+		if v < math.MinInt32 || v > math.MaxInt32 {
+			return nil, fmt.Errorf("BuildConfig field %q value %d does not fit in a Java int", k, v)
+		}
+		if err := add(k, fmt.Sprintf("int %s = %d", k, v)); err != nil {
+			return nil, err
+		}
+	}
+	for k, v := range f.BuildConfigBool {
+		if err := add(k, fmt.Sprintf("boolean %s = %t", k, v)); err != nil {
+			return nil, err
+		}
+	}
+
+	names := make([]string, 0, len(fields))
+	for k := range fields {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "// Code generated by matcha. DO NOT EDIT.\n\npackage go.%s;\n\npublic final class BuildConfig {\n", pkgName)
+	for _, i := range names {
+		fmt.Fprintf(buf, "    public static final %s;\n", fields[i])
+	}
+	fmt.Fprintf(buf, "\n    private BuildConfig() {}\n}\n")
+	return buf.Bytes(), nil
+}
+
+// versionSource returns the source of the go.<pkgName>.MatchaVersion class,
+// which holds version and lets apps check that they were built against the
+// aar they ship with.
+func versionSource(pkgName, version string) []byte {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "// Code generated by matcha. DO NOT EDIT.\n\npackage go.%s;\n\npublic final class MatchaVersion {\n", pkgName)
+	fmt.Fprintf(buf, "    public static final String VERSION = %s;\n\n    private MatchaVersion() {}\n\n", javaQuote(version))
+	fmt.Fprintf(buf, `    /** Throws an IllegalStateException unless the aar's version is expected. */
+    public static void check(String expected) {
+        if (!VERSION.equals(expected)) {
+            throw new IllegalStateException("go.%s aar is version " + VERSION + ", expected " + expected);
+        }
+    }
+}
+`, pkgName)
+	return buf.Bytes()
+}
+
+// isJavaIdentifier reports whether name is an ASCII Java identifier.
+func isJavaIdentifier(name string) bool {
+	if name == "" || javaKeywords[name] {
+		return false
+	}
+	for i, c := range name {
+		isLetter := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == '$'
+		isDigit := c >= '0' && c <= '9'
+		if !isLetter && (i == 0 || !isDigit) {
+			return false
+		}
+	}
+	return true
+}
+
+// javaQuote returns s as a Java string literal. ASCII control characters are
+// written as octal escapes and the others outside of printable ASCII as \u
+// escapes. javac translates \u escapes before lexing, so a \u000d or \u000a
+// would end the line in the middle of the literal.
+func javaQuote(s string) string {
+	buf := &bytes.Buffer{}
+	buf.WriteByte('"')
+	for _, c := range s {
+		switch {
+		case c == '"' || c == '\\':
+			buf.WriteByte('\\')
+			buf.WriteRune(c)
+		case c == '\n':
+			buf.WriteString(`\n`)
+		case c == '\r':
+			buf.WriteString(`\r`)
+		case c == '\t':
+			buf.WriteString(`\t`)
+		case c >= 0x20 && c < 0x7f:
+			buf.WriteRune(c)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(buf, `\%03o`, c)
+		case c > 0xffff:
+			r1, r2 := utf16.EncodeRune(c)
+			fmt.Fprintf(buf, `\u%04x\u%04x`, r1, r2)
+		default:
+			fmt.Fprintf(buf, `\u%04x`, c)
+		}
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
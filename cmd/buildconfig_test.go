@@ -0,0 +1,83 @@
+package cmd
+
+import "testing"
+
+func TestBuildConfigSource(t *testing.T) {
+	f := &Flags{
+		BuildConfig:     map[string]string{"API_URL": "https://example.com/\"v1\"", "GREETING": "héllo 😀"},
+		BuildConfigInt:  map[string]int{"VERSION_CODE": 12},
+		BuildConfigBool: map[string]bool{"DEBUG": true},
+	}
+	src, err := buildConfigSource(f, "example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `// Code generated by matcha. DO NOT EDIT.
+
+package go.example;
+
+public final class BuildConfig {
+    public static final String API_URL = "https://example.com/\"v1\"";
+    public static final boolean DEBUG = true;
+    public static final String GREETING = "h\u00e9llo \ud83d\ude00";
+    public static final int VERSION_CODE = 12;
+
+    private BuildConfig() {}
+}
+`
+	if string(src) != expected {
+		t.Errorf("Unexpected source:\n%s", src)
+	}
+
+	for _, f := range []*Flags{
+		{BuildConfig: map[string]string{"class": ""}},
+		{BuildConfig: map[string]string{"1ST": ""}},
+		{BuildConfig: map[string]string{"DEBUG": ""}, BuildConfigBool: map[string]bool{"DEBUG": false}},
+	} {
+		if _, err := buildConfigSource(f, "example"); err == nil {
+			t.Errorf("buildConfigSource(%+v) succeeded, expected error", f)
+		}
+	}
+}
+
+func TestVersionSource(t *testing.T) {
+	expected := `// Code generated by matcha. DO NOT EDIT.
+
+package go.example;
+
+public final class MatchaVersion {
+    public static final String VERSION = "1.2.0";
+
+    private MatchaVersion() {}
+
+    /** Throws an IllegalStateException unless the aar's version is expected. */
+    public static void check(String expected) {
+        if (!VERSION.equals(expected)) {
+            throw new IllegalStateException("go.example aar is version " + VERSION + ", expected " + expected);
+        }
+    }
+}
+`
+	if src := versionSource("example", "1.2.0"); string(src) != expected {
+		t.Errorf("Unexpected source:\n%s", src)
+	}
+}
+
+func TestJavaQuote(t *testing.T) {
+	for s, expected := range map[string]string{
+		"":                 `""`,
+		"plain text":       `"plain text"`,
+		`say "hi"`:         `"say \"hi\""`,
+		`C:\dir`:           `"C:\\dir"`,
+		`\u000a`:           `"\\u000a"`,
+		"a\nb\r\nc\td":     `"a\nb\r\nc\td"`,
+		"\x00\x01\x1b\x7f": `"\000\001\033\177"`,
+		"héllo":            `"h\u00e9llo"`,
+		"\u2028":           `"\u2028"`,
+		"😀":                `"\ud83d\ude00"`,
+	} {
+		if quoted := javaQuote(s); quoted != expected {
+			t.Errorf("javaQuote(%q) = %s, expected %s", s, quoted, expected)
+		}
+	}
+}
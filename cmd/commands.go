@@ -6,6 +6,7 @@ package cmd
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"go/build"
 	"io"
@@ -17,12 +18,52 @@ import (
 	"strings"
 )
 
+// Runner runs external commands. Implementations may run commands remotely or
+// in a sandbox, or record them in tests. Run must wait for cmd to finish,
+// writing its output to cmd.Stdout and cmd.Stderr, and should stop it if ctx
+// is done.
+type Runner interface {
+	Run(ctx context.Context, cmd *exec.Cmd) error
+}
+
+// localRunner runs commands on the local machine. It is used when
+// Flags.Runner is nil.
+type localRunner struct{}
+
+func (localRunner) Run(ctx context.Context, cmd *exec.Cmd) error {
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		cmd.Process.Kill()
+		<-done
+		return ctx.Err()
+	}
+}
+
 func RunCmd(f *Flags, tmpdir string, cmd *exec.Cmd) error {
 	_, err := OutputCmd(f, nil, tmpdir, cmd)
 	return err
 }
 
 func OutputCmd(f *Flags, fallback []byte, tmpdir string, cmd *exec.Cmd) ([]byte, error) {
+	return outputCmd(f, fallback, tmpdir, cmd, false)
+}
+
+// CombinedOutputCmd is like OutputCmd, but returns what cmd writes to
+// stderr together with its stdout.
+func CombinedOutputCmd(f *Flags, fallback []byte, tmpdir string, cmd *exec.Cmd) ([]byte, error) {
+	return outputCmd(f, fallback, tmpdir, cmd, true)
+}
+
+func outputCmd(f *Flags, fallback []byte, tmpdir string, cmd *exec.Cmd, combined bool) ([]byte, error) {
 	if f.ShouldPrint() {
 		str := ""
 		if cmd.Dir != "" {
@@ -34,11 +75,17 @@ func OutputCmd(f *Flags, fallback []byte, tmpdir string, cmd *exec.Cmd) ([]byte,
 		str += strings.Join(cmd.Args, " ")
 		f.Logger.Println(str)
 	}
+	if f.shouldRecord() {
+		f.script.command(cmd)
+	}
 
 	outbuf := new(bytes.Buffer)
 	errbuf := new(bytes.Buffer)
 	cmd.Stdout = outbuf
 	cmd.Stderr = errbuf
+	if combined {
+		cmd.Stderr = outbuf
+	}
 
 	if f.BuildWork && tmpdir != "" {
 		if runtime.GOOS == "windows" {
@@ -52,8 +99,32 @@ func OutputCmd(f *Flags, fallback []byte, tmpdir string, cmd *exec.Cmd) ([]byte,
 	var output []byte
 	if f.ShouldRun() {
 		cmd.Env = MergeEnviron(cmd.Env, os.Environ())
-		if err := cmd.Run(); err != nil {
-			return nil, fmt.Errorf("%s failed: %v\n%s\n%s", strings.Join(cmd.Args, " "), err, outbuf, errbuf)
+		if err := f.timeoutErr(); err != nil {
+			return nil, err
+		}
+		for attempt := 0; ; attempt++ {
+			err := f.runner().Run(f.context(), cmd)
+			if err == nil {
+				break
+			}
+			if err := f.timeoutErr(); err != nil {
+				return nil, err
+			}
+			if attempt >= f.ToolRetries || !isTransientCmdError(err, errbuf.Bytes()) {
+				return nil, fmt.Errorf("%s failed: %v\n%s\n%s", strings.Join(cmd.Args, " "), err, outbuf, errbuf)
+			}
+			f.warnf("%s failed with a transient error, retrying: %v", cmd.Args[0], err)
+			outbuf.Reset()
+			errbuf.Reset()
+			cmd = &exec.Cmd{
+				Path:   cmd.Path,
+				Args:   cmd.Args,
+				Env:    cmd.Env,
+				Dir:    cmd.Dir,
+				Stdin:  cmd.Stdin,
+				Stdout: cmd.Stdout,
+				Stderr: cmd.Stderr,
+			}
 		}
 		output = outbuf.Bytes()
 	} else {
@@ -73,6 +144,26 @@ func OutputCmd(f *Flags, fallback []byte, tmpdir string, cmd *exec.Cmd) ([]byte,
 	return output, nil
 }
 
+// transientCmdErrors are substrings of errors caused by the build machine
+// running out of resources rather than by the command's input.
+var transientCmdErrors = []string{
+	"cannot allocate memory",
+	"resource temporarily unavailable",
+	"too many open files",
+}
+
+// isTransientCmdError reports whether a command that failed with err and
+// wrote stderr is worth retrying.
+func isTransientCmdError(err error, stderr []byte) bool {
+	msg := strings.ToLower(err.Error() + "\n" + string(stderr))
+	for _, i := range transientCmdErrors {
+		if strings.Contains(msg, i) {
+			return true
+		}
+	}
+	return false
+}
+
 // environ merges os.Environ and the given "key=value" pairs.
 // If a key is in both curr and kv, kv takes precedence.
 func MergeEnviron(kv, cur []string) []string {
@@ -119,6 +210,9 @@ func NewTmpDir(f *Flags, path string) (string, error) {
 		if err != nil {
 			return "", err
 		}
+		if err := os.Chmod(tmpdir, f.tmpDirPerm()); err != nil {
+			return "", err
+		}
 	} else {
 		if path == "" {
 			tmpdir = "$WORK"
@@ -129,6 +223,9 @@ func NewTmpDir(f *Flags, path string) (string, error) {
 	if f.ShouldPrint() || f.BuildWork {
 		f.Logger.Println("WORK=" + tmpdir)
 	}
+	if f.shouldRecord() {
+		f.script.mkdir(tmpdir)
+	}
 	return tmpdir, nil
 }
 
@@ -151,6 +248,9 @@ func RemoveAll(f *Flags, path string) error {
 	if f.ShouldPrint() {
 		f.Logger.Printf("rm -r -f %s\n", path)
 	}
+	if f.shouldRecord() {
+		f.script.remove(path)
+	}
 	if f.ShouldRun() {
 		return os.RemoveAll(path)
 	}
@@ -161,6 +261,21 @@ func WriteFile(f *Flags, filename string, r io.Reader) (err error) {
 	if f.ShouldPrint() {
 		f.Logger.Printf("write %s\n", filename)
 	}
+	if f.shouldRecord() {
+		// The contents are recorded once they have been read.
+		buf := &bytes.Buffer{}
+		r = io.TeeReader(r, buf)
+		defer func() {
+			if err == nil {
+				f.script.write(filename, buf.Bytes())
+			}
+		}()
+		if !f.ShouldRun() {
+			if _, err = io.Copy(ioutil.Discard, r); err != nil {
+				return
+			}
+		}
+	}
 
 	disablePrint := f.disablePrint
 	f.disablePrint = true
@@ -204,6 +319,9 @@ func CopyFile(f *Flags, dst, src string) error {
 	if f.ShouldPrint() {
 		f.Logger.Printf("cp %s %s\n", src, dst)
 	}
+	if f.shouldRecord() {
+		f.script.copy(dst, src)
+	}
 
 	disablePrint := f.disablePrint
 	f.disablePrint = true
@@ -236,6 +354,9 @@ func Mkdir(f *Flags, dir string) error {
 	if f.ShouldPrint() {
 		f.Logger.Printf("mkdir -p %s\n", dir)
 	}
+	if f.shouldRecord() {
+		f.script.mkdir(dir)
+	}
 	if f.ShouldRun() {
 		return os.MkdirAll(dir, 0755)
 	}
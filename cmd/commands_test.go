@@ -0,0 +1,136 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// recordingRunner records the arguments of each command instead of running it.
+type recordingRunner struct {
+	args   [][]string
+	env    [][]string
+	output string
+	stderr string
+}
+
+func (r *recordingRunner) Run(ctx context.Context, cmd *exec.Cmd) error {
+	r.args = append(r.args, cmd.Args)
+	r.env = append(r.env, cmd.Env)
+	fmt.Fprint(cmd.Stdout, r.output)
+	fmt.Fprint(cmd.Stderr, r.stderr)
+	return nil
+}
+
+func TestRunner(t *testing.T) {
+	r := &recordingRunner{output: "go version go1.9 linux/amd64"}
+	f := &Flags{Logger: log.New(ioutil.Discard, "", 0), Runner: r}
+
+	out, err := GoVersion(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != r.output {
+		t.Errorf("GoVersion() = %q, expected %q", out, r.output)
+	}
+	if !reflect.DeepEqual(r.args, [][]string{{"go", "version"}}) {
+		t.Errorf("Unexpected commands %v", r.args)
+	}
+}
+
+func TestLocalRunnerCancel(t *testing.T) {
+	if _, err := exec.LookPath("sleep"); err != nil {
+		t.Skip("sleep not found")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := (localRunner{}).Run(ctx, exec.Command("sleep", "10")); err != context.Canceled {
+		t.Errorf("Run() = %v, expected %v", err, context.Canceled)
+	}
+}
+
+// failingRunner fails the first n commands with err.
+type failingRunner struct {
+	n     int
+	err   error
+	calls int
+}
+
+func (r *failingRunner) Run(ctx context.Context, cmd *exec.Cmd) error {
+	r.calls++
+	if r.calls <= r.n {
+		return r.err
+	}
+	return nil
+}
+
+func TestToolRetries(t *testing.T) {
+	transient := errors.New("fork/exec /usr/bin/javac: resource temporarily unavailable")
+	for _, i := range []struct {
+		retries, failures int
+		err               error
+		calls             int
+		ok                bool
+	}{
+		{0, 1, transient, 1, false},
+		{2, 2, transient, 3, true},
+		{2, 3, transient, 3, false},
+		{2, 1, errors.New("exit status 1"), 1, false},
+	} {
+		r := &failingRunner{n: i.failures, err: i.err}
+		f := &Flags{Logger: log.New(ioutil.Discard, "", 0), Runner: r, ToolRetries: i.retries}
+		err := RunCmd(f, "", exec.Command("javac", "Bridge.java"))
+		if (err == nil) != i.ok || r.calls != i.calls {
+			t.Errorf("%d retries of %d %q failures: got %v after %d calls", i.retries, i.failures, i.err, err, r.calls)
+		}
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	if _, err := exec.LookPath("sleep"); err != nil {
+		t.Skip("sleep not found")
+	}
+	f := &Flags{Logger: log.New(ioutil.Discard, "", 0), Timeout: 50 * time.Millisecond}
+	timed, release := f.withTimeout()
+	err := RunCmd(timed, "", exec.Command("sleep", "10"))
+	release()
+	if err == nil || err.Error() != "build exceeded 50ms" {
+		t.Errorf("RunCmd() = %v, expected timeout", err)
+	}
+	if f.ctx != nil {
+		t.Error("Deadline was set on the shared flags")
+	}
+	if err := RunCmd(f, "", exec.Command("sleep", "0")); err != nil {
+		t.Errorf("RunCmd() after timeout = %v", err)
+	}
+}
+
+func TestTmpDirPerm(t *testing.T) {
+	for perm, expected := range map[os.FileMode]os.FileMode{0: 0700, 0750: 0750} {
+		f := &Flags{Logger: log.New(ioutil.Discard, "", 0), TmpDirPerm: perm}
+		dir, err := NewTmpDir(f, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(dir)
+		os.RemoveAll(dir)
+		if err != nil {
+			t.Fatal(err)
+		} else if fi.Mode().Perm() != expected {
+			t.Errorf("TmpDirPerm %v: work directory has mode %v, expected %v", perm, fi.Mode().Perm(), expected)
+		}
+	}
+
+	for _, perm := range []os.FileMode{0600, 01777, os.ModeDir | 0700} {
+		if err := (&Flags{TmpDirPerm: perm}).Validate(); err == nil {
+			t.Errorf("Expected error for TmpDirPerm %v", perm)
+		}
+	}
+}
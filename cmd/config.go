@@ -0,0 +1,130 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ProjectConfigFile is the name of the build config file read from the
+// project root.
+const ProjectConfigFile = "matcha.json"
+
+// ProjectConfig is the schema of matcha.json, which holds build options so
+// they can be kept under version control. Options set on the command line
+// take precedence over the file.
+//
+//	{
+//		"packages": ["example.com/app"],
+//		"targets": ["android/arm", "android/arm64", "ios"],
+//		"minSdk": 21,
+//		"targetSdk": 34,
+//		"assetsDir": "assets",
+//		"proguard": "proguard-rules.pro"
+//	}
+type ProjectConfig struct {
+	Packages         []string       `json:"packages"`         // import paths to bind if none are given
+	Targets          []string       `json:"targets"`          // os/arch targets, e.g. android/arm64
+	MinSDK           int            `json:"minSdk"`           // Flags.MinSDK
+	TargetSDK        int            `json:"targetSdk"`        // Flags.TargetSDK
+	MinSDKPerABI     map[string]int `json:"minSdkPerAbi"`     // Flags.MinSDKPerABI
+	Variant          string         `json:"variant"`          // Flags.BuildVariant
+	Version          string         `json:"version"`          // Flags.Version
+	OutputDir        string         `json:"outputDir"`        // Flags.OutputDir, relative to the project root
+	Permissions      []string       `json:"permissions"`      // Flags.Permissions
+	AssetPrefix      string         `json:"assetPrefix"`      // Flags.AssetPrefix
+	AssetsDir        string         `json:"assetsDir"`        // Flags.AssetsDirName
+	NoRecompressExts []string       `json:"noRecompressExts"` // Flags.NoRecompressExts
+	AllowedAssetExts []string       `json:"allowedAssetExts"` // Flags.AllowedAssetExts
+	MaxAssetBytes    int64          `json:"maxAssetBytes"`    // Flags.MaxAssetBytes
+	Proguard         string         `json:"proguard"`         // Flags.ConsumerRules, relative to the project root
+
+	dir string
+}
+
+// ReadProjectConfig reads the matcha.json in dir. It returns nil and no error
+// if there is no such file.
+func ReadProjectConfig(dir string) (*ProjectConfig, error) {
+	path := filepath.Join(dir, ProjectConfigFile)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	c := &ProjectConfig{dir: dir}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for _, i := range c.Targets {
+		if len(ParseTargets(i)) == 0 {
+			return nil, fmt.Errorf("%s: unsupported target %q", path, i)
+		}
+	}
+	return c, nil
+}
+
+// Apply copies the options in c to the fields of f that are unset, and
+// returns the packages to build, args or c.Packages if args is empty.
+func (c *ProjectConfig) Apply(f *Flags, args []string) []string {
+	setString := func(dst *string, v string) {
+		if *dst == "" {
+			*dst = v
+		}
+	}
+	setPath := func(dst *string, v string) {
+		if *dst == "" && v != "" {
+			if !filepath.IsAbs(v) {
+				v = filepath.Join(c.dir, filepath.FromSlash(v))
+			}
+			*dst = v
+		}
+	}
+
+	if f.BuildTargets == "" {
+		f.BuildTargets = strings.Join(c.Targets, " ")
+	}
+	// Min SDK variants and all variants on the command line replace the
+	// file's single min SDK and variant, rather than conflicting with them.
+	if f.MinSDK == 0 && len(f.MinSDKVariants) == 0 {
+		f.MinSDK = c.MinSDK
+	}
+	if f.TargetSDK == 0 {
+		f.TargetSDK = c.TargetSDK
+	}
+	if f.MinSDKPerABI == nil {
+		f.MinSDKPerABI = c.MinSDKPerABI
+	}
+	if !f.BuildAllVariants {
+		setString(&f.BuildVariant, c.Variant)
+	}
+	setString(&f.Version, c.Version)
+	setPath(&f.OutputDir, c.OutputDir)
+	if f.Permissions == nil {
+		f.Permissions = c.Permissions
+	}
+	setString(&f.AssetPrefix, c.AssetPrefix)
+	setString(&f.AssetsDirName, c.AssetsDir)
+	if f.NoRecompressExts == nil {
+		f.NoRecompressExts = c.NoRecompressExts
+	}
+	if f.AllowedAssetExts == nil {
+		f.AllowedAssetExts = c.AllowedAssetExts
+	}
+	if f.MaxAssetBytes == 0 {
+		f.MaxAssetBytes = c.MaxAssetBytes
+	}
+	setPath(&f.ConsumerRules, c.Proguard)
+
+	if len(args) == 0 {
+		return c.Packages
+	}
+	return args
+}
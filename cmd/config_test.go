@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestProjectConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matcha-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if c, err := ReadProjectConfig(dir); c != nil || err != nil {
+		t.Errorf("ReadProjectConfig() without a file = %v, %v", c, err)
+	}
+
+	config := `{
+	"packages": ["example.com/app"],
+	"targets": ["android/arm64", "ios"],
+	"minSdk": 21,
+	"version": "1.0",
+	"assetsDir": "res/raw",
+	"proguard": "proguard-rules.pro"
+}`
+	if err := ioutil.WriteFile(filepath.Join(dir, ProjectConfigFile), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := ReadProjectConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Command line flags take precedence.
+	f := &Flags{Version: "2.0"}
+	args := c.Apply(f, nil)
+	if !reflect.DeepEqual(args, []string{"example.com/app"}) {
+		t.Errorf("Unexpected packages %v", args)
+	}
+	if f.BuildTargets != "android/arm64 ios" || f.MinSDK != 21 || f.Version != "2.0" || f.AssetsDirName != "res/raw" {
+		t.Errorf("Unexpected flags %+v", f)
+	}
+	if f.ConsumerRules != filepath.Join(dir, "proguard-rules.pro") {
+		t.Errorf("Unexpected proguard file %v", f.ConsumerRules)
+	}
+	if args := c.Apply(&Flags{}, []string{"example.com/other"}); !reflect.DeepEqual(args, []string{"example.com/other"}) {
+		t.Errorf("Unexpected packages %v", args)
+	}
+
+	// Variants on the command line replace the file's min SDK and variant.
+	c.Variant = "release"
+	f = &Flags{MinSDKVariants: []int{16, 24}}
+	c.Apply(f, nil)
+	if f.MinSDK != 0 || f.BuildVariant != "release" {
+		t.Errorf("Unexpected flags with min SDK variants %+v", f)
+	}
+	if err := f.Validate(); err != nil {
+		t.Errorf("Validate() with min SDK variants = %v", err)
+	}
+	f = &Flags{BuildAllVariants: true}
+	c.Apply(f, nil)
+	if f.BuildVariant != "" || f.MinSDK != 21 {
+		t.Errorf("Unexpected flags with all variants %+v", f)
+	}
+	if err := f.Validate(); err != nil {
+		t.Errorf("Validate() with all variants = %v", err)
+	}
+
+	for _, i := range []string{`{"minSDK": 21, "typo": true}`, `{"targets": ["android/mips"]}`, `{`} {
+		if err := ioutil.WriteFile(filepath.Join(dir, ProjectConfigFile), []byte(i), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadProjectConfig(dir); err == nil {
+			t.Errorf("Expected error for %s", i)
+		}
+	}
+}
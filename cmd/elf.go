@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"debug/elf"
+	"fmt"
+	"strings"
+)
+
+// JNI registration strategies reported by jniRegistration.
+const (
+	jniStatic  = "static"  // Java_* symbols resolved by the VM
+	jniDynamic = "dynamic" // RegisterNatives called from JNI_OnLoad
+	jniMixed   = "mixed"
+	jniNone    = "none"
+)
+
+// jniRegistration inspects the dynamic symbols of the shared library at path
+// to determine how its native methods are registered with the VM.
+func jniRegistration(path string) (string, error) {
+	file, err := elf.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	syms, err := file.DynamicSymbols()
+	if err != nil {
+		return "", err
+	}
+	hasJava, hasOnLoad := false, false
+	for _, i := range syms {
+		if i.Section == elf.SHN_UNDEF {
+			continue
+		}
+		if strings.HasPrefix(i.Name, "Java_") {
+			hasJava = true
+		} else if i.Name == "JNI_OnLoad" {
+			hasOnLoad = true
+		}
+	}
+
+	switch {
+	case hasJava && hasOnLoad:
+		return jniMixed, nil
+	case hasJava:
+		return jniStatic, nil
+	case hasOnLoad:
+		return jniDynamic, nil
+	}
+	return jniNone, nil
+}
+
+// abiMachines maps each Android ABI to the ELF machine of its libraries.
+var abiMachines = map[string]elf.Machine{
+	"armeabi-v7a": elf.EM_ARM,
+	"arm64-v8a":   elf.EM_AARCH64,
+	"x86":         elf.EM_386,
+	"x86_64":      elf.EM_X86_64,
+}
+
+// verifyELFMachine returns an error if the shared library at path is not
+// built for the machine of abi, as happens when a misconfigured toolchain
+// puts another architecture's library in abi's directory.
+func verifyELFMachine(path, abi string) error {
+	want, ok := abiMachines[abi]
+	if !ok {
+		return fmt.Errorf("unknown abi %q", abi)
+	}
+	file, err := elf.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if file.Machine != want {
+		return fmt.Errorf("%s is built for %v, but abi %s needs %v", path, file.Machine, abi, want)
+	}
+	return nil
+}
+
+// pageSize16KB is the page size that the native libraries of 64 bit ABIs
+// must support to load on Android 15 and later devices with 16KB pages.
+const pageSize16KB = 16384
+
+// pageSize16KBABIs are the ABIs of the devices that may have 16KB pages.
+var pageSize16KBABIs = map[string]bool{"arm64-v8a": true, "x86_64": true}
+
+// loadAlignment returns the smallest alignment of the loadable segments of
+// the shared library at path, the largest page size it can be loaded with.
+func loadAlignment(path string) (uint64, error) {
+	file, err := elf.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	align := uint64(0)
+	for _, i := range file.Progs {
+		if i.Type == elf.PT_LOAD && (align == 0 || i.Align < align) {
+			align = i.Align
+		}
+	}
+	if align == 0 {
+		return 0, fmt.Errorf("%s has no loadable segments", path)
+	}
+	return align, nil
+}
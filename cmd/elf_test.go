@@ -0,0 +1,153 @@
+package cmd
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// testELFFile returns a little-endian ELF64 shared library with only the
+// section headers and dynamic symbols that jniRegistration reads, the
+// symbols in defined and, undefined, those in undefined.
+func testELFFile(defined, undefined []string) []byte {
+	dynstr := []byte{0}
+	dynsym := &bytes.Buffer{}
+	binary.Write(dynsym, binary.LittleEndian, elf.Sym64{})
+	for i, names := range [][]string{defined, undefined} {
+		shndx := uint16(elf.SHN_ABS)
+		if i == 1 {
+			shndx = uint16(elf.SHN_UNDEF)
+		}
+		for _, name := range names {
+			binary.Write(dynsym, binary.LittleEndian, elf.Sym64{
+				Name:  uint32(len(dynstr)),
+				Info:  byte(elf.STB_GLOBAL)<<4 | byte(elf.STT_FUNC),
+				Shndx: shndx,
+			})
+			dynstr = append(append(dynstr, name...), 0)
+		}
+	}
+	shstrtab := []byte("\x00.dynstr\x00.dynsym\x00.shstrtab\x00")
+	for len(dynstr)%8 != 0 {
+		dynstr = append(dynstr, 0)
+	}
+
+	const headerSize = 64
+	dynstrOff := uint64(headerSize)
+	dynsymOff := dynstrOff + uint64(len(dynstr))
+	shstrtabOff := dynsymOff + uint64(dynsym.Len())
+	shoff := (shstrtabOff + uint64(len(shstrtab)) + 7) &^ 7
+
+	buf := &bytes.Buffer{}
+	w := func(v interface{}) { binary.Write(buf, binary.LittleEndian, v) }
+	header := elf.Header64{
+		Type:      uint16(elf.ET_DYN),
+		Machine:   uint16(elf.EM_AARCH64),
+		Version:   uint32(elf.EV_CURRENT),
+		Shoff:     shoff,
+		Ehsize:    headerSize,
+		Shentsize: 64,
+		Shnum:     4,
+		Shstrndx:  3,
+	}
+	copy(header.Ident[:], elf.ELFMAG)
+	header.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	header.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	header.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	w(header)
+	buf.Write(dynstr)
+	buf.Write(dynsym.Bytes())
+	buf.Write(shstrtab)
+	buf.Write(make([]byte, shoff-uint64(buf.Len())))
+	w(elf.Section64{})
+	w(elf.Section64{Name: 1, Type: uint32(elf.SHT_STRTAB), Off: dynstrOff, Size: uint64(len(dynstr)), Addralign: 1})
+	w(elf.Section64{Name: 9, Type: uint32(elf.SHT_DYNSYM), Off: dynsymOff, Size: uint64(dynsym.Len()), Link: 1, Info: 1, Addralign: 8, Entsize: 24})
+	w(elf.Section64{Name: 17, Type: uint32(elf.SHT_STRTAB), Off: shstrtabOff, Size: uint64(len(shstrtab)), Addralign: 1})
+	return buf.Bytes()
+}
+
+func TestJNIRegistration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matcha-elf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, i := range []struct {
+		defined, undefined []string
+		expected           string
+	}{
+		{[]string{"Java_io_gomatcha_bridge_GoValue_call", "crosscall2"}, nil, jniStatic},
+		{[]string{"JNI_OnLoad", "crosscall2"}, nil, jniDynamic},
+		{[]string{"JNI_OnLoad", "Java_io_gomatcha_bridge_GoValue_call"}, nil, jniMixed},
+		{[]string{"crosscall2"}, nil, jniNone},
+		// Symbols the library imports are not its registrations.
+		{[]string{"JNI_OnLoad"}, []string{"Java_io_gomatcha_bridge_GoValue_call"}, jniDynamic},
+		{nil, []string{"JNI_OnLoad"}, jniNone},
+	} {
+		path := filepath.Join(dir, "libgojni.so")
+		if err := ioutil.WriteFile(path, testELFFile(i.defined, i.undefined), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if reg, err := jniRegistration(path); err != nil || reg != i.expected {
+			t.Errorf("jniRegistration() with %v defined and %v undefined = %q, %v, expected %q", i.defined, i.undefined, reg, err, i.expected)
+		}
+	}
+
+	if _, err := jniRegistration(filepath.Join(dir, "missing.so")); err == nil {
+		t.Error("Expected an error for a missing library")
+	}
+}
+
+func TestVerifyELFMachine(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "android" {
+		t.Skip("test binary is not an ELF file on", runtime.GOOS)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	abi := GetAndroidABI(runtime.GOARCH)
+	if abi == "" {
+		t.Skip("no android abi for", runtime.GOARCH)
+	}
+	if err := verifyELFMachine(exe, abi); err != nil {
+		t.Errorf("verifyELFMachine(%q) = %v", abi, err)
+	}
+
+	other := "arm64-v8a"
+	if abi == other {
+		other = "x86_64"
+	}
+	err = verifyELFMachine(exe, other)
+	if err == nil || !strings.Contains(err.Error(), other) {
+		t.Errorf("verifyELFMachine(%q) = %v, want an error naming the abi", other, err)
+	}
+}
+
+func TestLoadAlignment(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "android" {
+		t.Skip("test binary is not an ELF file on", runtime.GOOS)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	align, err := loadAlignment(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if align < 4096 || align&(align-1) != 0 {
+		t.Errorf("loadAlignment() = %d, expected a power of two page size", align)
+	}
+
+	if _, err := loadAlignment(filepath.Join(t.Name(), "missing.so")); err == nil {
+		t.Error("Expected an error for a missing library")
+	}
+}
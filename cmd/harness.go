@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// TestHarnessJarPath returns the path of the test harness jar written next
+// to aarPath.
+func TestHarnessJarPath(aarPath string) string {
+	return strings.TrimSuffix(aarPath, ".aar") + "-test-harness.jar"
+}
+
+// BuildTestHarnessJar compiles the Java sources in srcDir with their native
+// methods stubbed out by stubNativeMethods and writes the classes to w as a
+// jar. The classes load on a JVM without libgojni.so, so JUnit tests can run
+// against the bindings without a device. Kotlin external functions are left
+// as they are.
+func BuildTestHarnessJar(f *Flags, srcDir string, w io.Writer) error {
+	tmpdir, err := NewTmpDir(f, "")
+	if err != nil {
+		return err
+	}
+	defer RemoveAll(f, tmpdir)
+
+	hf := *f
+	hf.Incremental = false
+	hf.JavaSourceTransform = func(path string, src []byte) ([]byte, error) {
+		if f.JavaSourceTransform != nil {
+			var err error
+			if src, err = f.JavaSourceTransform(path, src); err != nil {
+				return nil, err
+			}
+		}
+		return stubNativeMethods(src), nil
+	}
+	dst, err := compileJava(&hf, srcDir, "", tmpdir)
+	if err != nil {
+		return err
+	}
+	return writeJar(&hf, w, dst)
+}
+
+var (
+	loadLibraryRe  = regexp.MustCompile(`System\.loadLibrary\([^)]*\);`)
+	nativeMethodRe = regexp.MustCompile(`\bnative\s+([\w.<>\[\], ?]+?)\s+(\w+)\s*\(([^)]*)\)\s*(throws\s+[\w.,\s]+?)?\s*;`)
+)
+
+// stubNativeMethods returns the Java source src with its calls to
+// System.loadLibrary commented out and its native methods replaced by ones
+// returning the zero value of their type.
+func stubNativeMethods(src []byte) []byte {
+	src = loadLibraryRe.ReplaceAllFunc(src, func(call []byte) []byte {
+		return []byte("/* " + string(call) + " */")
+	})
+	return nativeMethodRe.ReplaceAllFunc(src, func(method []byte) []byte {
+		m := nativeMethodRe.FindSubmatch(method)
+		buf := &bytes.Buffer{}
+		buf.Write(m[1])
+		buf.WriteByte(' ')
+		buf.Write(m[2])
+		buf.WriteByte('(')
+		buf.Write(m[3])
+		buf.WriteString(") ")
+		if len(m[4]) > 0 {
+			buf.Write(bytes.TrimSpace(m[4]))
+			buf.WriteByte(' ')
+		}
+		fields := strings.Fields(string(m[1]))
+		switch fields[len(fields)-1] {
+		case "void":
+			buf.WriteString("{}")
+		case "boolean":
+			buf.WriteString("{ return false; }")
+		case "byte", "char", "short", "int", "long", "float", "double":
+			buf.WriteString("{ return 0; }")
+		default:
+			buf.WriteString("{ return null; }")
+		}
+		return buf.Bytes()
+	})
+}
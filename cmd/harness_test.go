@@ -0,0 +1,41 @@
+package cmd
+
+import "testing"
+
+func TestStubNativeMethods(t *testing.T) {
+	src := `public class GoValue {
+   static {
+      System.loadLibrary("gojni");
+      matchaInit(Tracker.singleton());
+   }
+   private static native void matchaInit(Object tracker);
+   private static native boolean matchaGoIsNil(long a);
+   public native int size() throws java.io.IOException;
+   private static native long[] matchaGoToArray(long a);
+   protected static native String matchaGoToString(long a);
+   // Returns the native value.
+   public long goRef() {
+      return goRef;
+   }
+}
+`
+	expected := `public class GoValue {
+   static {
+      /* System.loadLibrary("gojni"); */
+      matchaInit(Tracker.singleton());
+   }
+   private static void matchaInit(Object tracker) {}
+   private static boolean matchaGoIsNil(long a) { return false; }
+   public int size() throws java.io.IOException { return 0; }
+   private static long[] matchaGoToArray(long a) { return null; }
+   protected static String matchaGoToString(long a) { return null; }
+   // Returns the native value.
+   public long goRef() {
+      return goRef;
+   }
+}
+`
+	if stubbed := string(stubNativeMethods([]byte(src))); stubbed != expected {
+		t.Errorf("Unexpected stubs:\n%s", stubbed)
+	}
+}
@@ -0,0 +1,156 @@
+package cmd
+
+import (
+	"fmt"
+	"go/build"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// hermeticPackages copies each package in pkgs that is not in GOROOT, and the
+// packages outside GOROOT they import as resolved by ctx for any of goarches,
+// into the src directory of gopathDir, which comes first in the GOPATH of the
+// android build, so the build reads the copies rather than the source tree.
+// The files directly in each package's directory are copied together with its
+// asset directories, and the copies are made read-only. It returns copies of
+// pkgs whose Dir is the copied directory.
+//
+// Module builds ignore GOPATH and would read the source tree regardless, so
+// it is an error to call hermeticPackages in module mode.
+func hermeticPackages(f *Flags, ctx *build.Context, pkgs []*build.Package, goarches []string, gopathDir string) ([]*build.Package, error) {
+	if f.ShouldRun() {
+		if gomod := GoEnv(f, "GOMOD"); gomod != "" && gomod != os.DevNull {
+			return nil, fmt.Errorf("hermetic builds are not supported in module mode (%s), set GO111MODULE=off", gomod)
+		}
+	}
+
+	dirName, err := assetsDirName(f)
+	if err != nil {
+		return nil, err
+	}
+	assetDirs := []string{dirName, dirName + "-debug", dirName + "-release"}
+
+	deps, err := hermeticDeps(ctx, pkgs, goarches)
+	if err != nil {
+		return nil, err
+	}
+	for _, pkg := range deps {
+		dst := filepath.Join(gopathDir, "src", filepath.FromSlash(pkg.ImportPath))
+		if err := copyHermeticDir(f, dst, pkg.Dir, false); err != nil {
+			return nil, err
+		}
+	}
+
+	copied := make([]*build.Package, 0, len(pkgs))
+	for _, pkg := range pkgs {
+		if pkg.Goroot {
+			copied = append(copied, pkg)
+			continue
+		}
+		dst := filepath.Join(gopathDir, "src", filepath.FromSlash(pkg.ImportPath))
+		if err := copyHermeticDir(f, dst, pkg.Dir, false); err != nil {
+			return nil, err
+		}
+		for _, i := range assetDirs {
+			src := filepath.Join(pkg.Dir, filepath.FromSlash(i))
+			if fi, err := os.Stat(src); err != nil || !fi.IsDir() {
+				continue
+			}
+			if err := copyHermeticDir(f, filepath.Join(dst, filepath.FromSlash(i)), src, true); err != nil {
+				return nil, err
+			}
+		}
+
+		c := *pkg
+		c.Dir = dst
+		copied = append(copied, &c)
+	}
+	return copied, nil
+}
+
+// hermeticDeps returns the packages outside GOROOT imported, directly or
+// indirectly, by pkgs that are not in pkgs themselves. Files and imports
+// can be specific to an architecture, so the imports are resolved by ctx
+// for each of goarches and the union is returned.
+func hermeticDeps(ctx *build.Context, pkgs []*build.Package, goarches []string) ([]*build.Package, error) {
+	seen := map[string]*build.Package{}
+	for _, pkg := range pkgs {
+		seen[pkg.Dir] = pkg
+	}
+	union := map[string]*build.Package{}
+	for _, goarch := range goarches {
+		actx := *ctx
+		actx.GOARCH = goarch
+		imported := map[string]*build.Package{}
+		for _, pkg := range pkgs {
+			if pkg.Goroot {
+				continue
+			}
+			archPkg, err := actx.ImportDir(pkg.Dir, build.ImportComment)
+			if _, ok := err.(*build.NoGoError); ok {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			for _, i := range archPkg.Imports {
+				if err := Import(&actx, i, pkg.Dir, build.ImportComment, imported); err != nil {
+					return nil, err
+				}
+			}
+		}
+		for dir, pkg := range imported {
+			if _, ok := union[dir]; !ok {
+				union[dir] = pkg
+			}
+		}
+	}
+
+	deps := []*build.Package{}
+	for dir, pkg := range union {
+		if _, ok := seen[dir]; ok || pkg.Goroot {
+			continue
+		}
+		deps = append(deps, pkg)
+	}
+	sort.Slice(deps, func(i, j int) bool { return deps[i].ImportPath < deps[j].ImportPath })
+	return deps, nil
+}
+
+// copyHermeticDir copies the regular files in src to dst as read-only files,
+// and the files in its subdirectories if recursive is set.
+func copyHermeticDir(f *Flags, dst, src string, recursive bool) error {
+	if err := Mkdir(f, dst); err != nil {
+		return err
+	}
+	names, err := ReadDirNames(f, src)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		fi, err := os.Stat(filepath.Join(src, name))
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			if recursive {
+				if err := copyHermeticDir(f, filepath.Join(dst, name), filepath.Join(src, name), true); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		if err := CopyFile(f, filepath.Join(dst, name), filepath.Join(src, name)); err != nil {
+			return err
+		}
+		if f.ShouldRun() {
+			if err := os.Chmod(filepath.Join(dst, name), 0444); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
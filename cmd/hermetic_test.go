@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"go/build"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHermeticPackages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matcha-hermetic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// app imports armdep only when built for arm.
+	src := filepath.Join(dir, "src", "example.com", "app")
+	files := map[string]string{
+		"app/app.go":                     "package app\n\nimport (\n\t_ \"example.com/dep\"\n\t_ \"strings\"\n)\n",
+		"app/app_arm.go":                 "package app\n\nimport _ \"example.com/armdep\"\n",
+		"app/assets/images/logo.png":     "logo",
+		"app/assets-release/config.json": "{}",
+		"app/sub/sub.go":                 "package sub\n",
+		"dep/dep.go":                     "package dep\n\nimport \"strings\"\n\nvar _ = strings.Title\n",
+		"armdep/armdep.go":               "package armdep\n",
+		"unused/unused.go":               "package unused\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, "src", "example.com", filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	defer os.Setenv("GOMOD", os.Getenv("GOMOD"))
+	os.Setenv("GOMOD", os.DevNull)
+
+	ctx := build.Default
+	ctx.GOPATH = dir
+	ctx.GOOS = "android"
+	gopathDir := filepath.Join(dir, "work")
+	fmtPkg := &build.Package{Dir: "/goroot/src/fmt", ImportPath: "fmt", Goroot: true}
+	pkgs := []*build.Package{{Dir: src, ImportPath: "example.com/app", Imports: []string{"example.com/dep", "strings"}}, fmtPkg}
+	copied, err := hermeticPackages(&Flags{}, &ctx, pkgs, []string{"arm", "arm64"}, gopathDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(gopathDir, "src", "example.com", "app")
+	if copied[0].Dir != dst || pkgs[0].Dir != src || copied[1] != fmtPkg {
+		t.Errorf("Unexpected packages %v, %v", copied[0].Dir, copied[1].Dir)
+	}
+
+	for _, i := range []string{"app.go", "app_arm.go", "assets/images/logo.png", "assets-release/config.json"} {
+		fi, err := os.Stat(filepath.Join(dst, filepath.FromSlash(i)))
+		if err != nil {
+			t.Error(err)
+		} else if fi.Mode().Perm() != 0444 {
+			t.Errorf("%v has mode %v, expected read-only", i, fi.Mode())
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dst, "sub")); !os.IsNotExist(err) {
+		t.Errorf("Subpackage was copied: %v", err)
+	}
+	if fi, err := os.Stat(filepath.Join(gopathDir, "src", "example.com", "dep", "dep.go")); err != nil {
+		t.Error(err)
+	} else if fi.Mode().Perm() != 0444 {
+		t.Errorf("dep.go has mode %v, expected read-only", fi.Mode())
+	}
+	if _, err := os.Stat(filepath.Join(gopathDir, "src", "strings")); !os.IsNotExist(err) {
+		t.Errorf("GOROOT package was copied: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(gopathDir, "src", "example.com", "armdep", "armdep.go")); err != nil {
+		t.Errorf("Dependency of arm was not copied: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(gopathDir, "src", "example.com", "unused")); !os.IsNotExist(err) {
+		t.Errorf("Unused package was copied: %v", err)
+	}
+
+	os.Setenv("GOMOD", filepath.Join(dir, "go.mod"))
+	if _, err := hermeticPackages(&Flags{}, &ctx, pkgs, []string{"arm64"}, filepath.Join(dir, "work2")); err == nil {
+		t.Error("Expected error for a hermetic build in module mode")
+	}
+
+	if err := (&Flags{Hermetic: true}).Validate(); err == nil {
+		t.Error("Expected error for a hermetic build without an output directory")
+	}
+}
@@ -101,38 +101,11 @@ func Init(f *Flags) error {
 		}
 
 		// Install standard libraries for cross compilers.
-		if _, ok := targets["android/arm"]; ok {
-			env, err := AndroidEnv(f, "arm")
-			if err != nil {
-				return err
-			}
-			if err := InstallPkg(f, matchaPkgPath, tmpdir, "std", env); err != nil {
-				return err
-			}
-		}
-
-		if _, ok := targets["android/arm64"]; ok {
-			env, err := AndroidEnv(f, "arm64")
-			if err != nil {
-				return err
+		for _, arch := range SupportedArches() {
+			if _, ok := targets["android/"+arch]; !ok {
+				continue
 			}
-			if err := InstallPkg(f, matchaPkgPath, tmpdir, "std", env); err != nil {
-				return err
-			}
-		}
-
-		if _, ok := targets["android/386"]; ok {
-			env, err := AndroidEnv(f, "386")
-			if err != nil {
-				return err
-			}
-			if err := InstallPkg(f, matchaPkgPath, tmpdir, "std", env); err != nil {
-				return err
-			}
-		}
-
-		if _, ok := targets["android/amd64"]; ok {
-			env, err := AndroidEnv(f, "amd64")
+			env, err := AndroidEnv(f, arch)
 			if err != nil {
 				return err
 			}
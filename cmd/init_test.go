@@ -93,6 +93,7 @@ test -d $GOPATH/pkg/matcha
 read $GOPATH/pkg/matcha/version
 go version
 pwd
+GOOS=android GOARCH=arm64 CGO_ENABLED=1 go list -tags matcha -f {{.ImportPath}}	{{.Dir}}	{{join .Match "\t"}} gomatcha.io/matcha/examples
 go importall $CWD gomatcha.io/matcha/examples
 go findpackage gomatcha.io/matcha/bridge
 which xcrun
@@ -0,0 +1,538 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// javacCache records the Java sources compiled into the classes directory of
+// an incremental build, see compileJavaIncremental.
+type javacCache struct {
+	Bootclasspath string
+	Classpath     string // f.MergeJars
+	Target        string
+	Sources       map[string]*javacSource // keyed by slash separated path relative to the source directory
+}
+
+// javacSource is a Java source in a javacCache.
+type javacSource struct {
+	ModTime time.Time
+	Size    int64
+	SHA256  string
+	Classes []string // class files compiled from the source, relative to the classes directory
+}
+
+// compileJavaIncremental compiles srcFiles, relative to srcDir, into a
+// classes directory kept in $GOPATH/pkg/matcha between builds, and returns a
+// copy of it in tmpdir. Each project, identified by cacheKey or srcDir if it
+// is empty, and boot classpath has a cache of its own, which is locked while
+// it is updated and copied so concurrent builds don't remove each other's
+// classes. Only the sources that changed since the last build, by
+// modification time and hash, are recompiled, together with the sources that
+// depend on a changed or removed class, see javaDependents. Everything is
+// recompiled if the target changes, or if the previous build failed.
+func compileJavaIncremental(f *Flags, srcDir string, srcFiles []string, cacheKey, bClspath, tmpdir string) (string, error) {
+	matchaPkgPath, err := MatchaPkgPath(f)
+	if err != nil {
+		return "", err
+	}
+	if cacheKey == "" {
+		cacheKey = srcDir
+	}
+	sum := sha256.Sum256([]byte(cacheKey + "\n" + bClspath))
+	cacheDir := filepath.Join(matchaPkgPath, "javac", hex.EncodeToString(sum[:8]))
+	if err := os.MkdirAll(filepath.Dir(cacheDir), 0755); err != nil {
+		return "", err
+	}
+	unlock, err := lockJavacCache(f, cacheDir+".lock")
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	classesDir, err := updateJavacCache(f, cacheDir, srcDir, srcFiles, bClspath, tmpdir)
+	if err != nil {
+		return "", err
+	}
+	dst := filepath.Join(tmpdir, "javac-classes")
+	if err := copyClasses(dst, classesDir); err != nil {
+		return "", err
+	}
+	return dst, nil
+}
+
+// lockJavacCache creates the lock file at path, waiting while another build
+// holds it, and returns a function that removes it. The lock file names the
+// host and process id of its owner, and is taken over if the owner ran on
+// this host and has exited, e.g. because the build was killed. Waiting stops
+// with an error once f's context is done, see Flags.Timeout.
+func lockJavacCache(f *Flags, path string) (func(), error) {
+	hostname, _ := os.Hostname()
+	owner := fmt.Sprintf("%s %d\n", hostname, os.Getpid())
+	for {
+		// The owner is written before the lock file appears, by linking a
+		// complete temporary file to path, so it is never read half written.
+		tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".")
+		if err != nil {
+			return nil, err
+		}
+		_, err = tmp.WriteString(owner)
+		if cerr := tmp.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Link(tmp.Name(), path)
+		}
+		os.Remove(tmp.Name())
+		if err == nil {
+			return func() { os.Remove(path) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if data, err := ioutil.ReadFile(path); err == nil && !javacLockOwnerAlive(hostname, string(data)) {
+			// Only remove the lock if it hasn't been taken over meanwhile.
+			if current, err := ioutil.ReadFile(path); err == nil && bytes.Equal(current, data) {
+				os.Remove(path)
+			}
+			continue
+		}
+		select {
+		case <-f.context().Done():
+			if err := f.timeoutErr(); err != nil {
+				return nil, err
+			}
+			return nil, f.context().Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// javacLockOwnerAlive reports whether the owner of a javac cache lock, "host
+// pid" as written by lockJavacCache, may still hold it. Owners on other hosts
+// sharing the cache can't be checked, and are assumed alive.
+func javacLockOwnerAlive(hostname, owner string) bool {
+	fields := strings.Fields(owner)
+	if len(fields) != 2 || fields[0] != hostname {
+		return true
+	}
+	pid, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return true
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		// On Windows, FindProcess fails if the process doesn't exist.
+		return false
+	}
+	defer p.Release()
+	if runtime.GOOS == "windows" {
+		return true
+	}
+	// Signal 0 only checks the process exists. EPERM means it does, but
+	// belongs to another user.
+	return p.Signal(syscall.Signal(0)) != os.ErrProcessDone
+}
+
+// copyClasses copies the class files in src and its subdirectories to dst.
+func copyClasses(dst, src string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return os.MkdirAll(filepath.Join(dst, rel), 0755)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(filepath.Join(dst, rel), data, 0644)
+	})
+}
+
+// updateJavacCache brings the classes directory of the javac cache in
+// cacheDir up to date with srcFiles and returns it. The caller holds the
+// cache's lock.
+func updateJavacCache(f *Flags, cacheDir, srcDir string, srcFiles []string, bClspath, tmpdir string) (string, error) {
+	classesDir := filepath.Join(cacheDir, "classes")
+	manifestPath := filepath.Join(cacheDir, "manifest.json")
+
+	cache := &javacCache{}
+	if data, err := ioutil.ReadFile(manifestPath); err == nil {
+		if err := json.Unmarshal(data, cache); err != nil {
+			cache = &javacCache{}
+		}
+	}
+	jars := javaClasspath(f)
+	if cache.Bootclasspath != bClspath || cache.Classpath != jars || cache.Target != javaTarget(f) || cache.Sources == nil {
+		if err := RemoveAll(f, classesDir); err != nil {
+			return "", err
+		}
+		cache = &javacCache{Bootclasspath: bClspath, Classpath: jars, Target: javaTarget(f), Sources: map[string]*javacSource{}}
+	}
+	if err := Mkdir(f, classesDir); err != nil {
+		return "", err
+	}
+
+	sources := map[string]*javacSource{}
+	changed := map[string]bool{}
+	for _, i := range srcFiles {
+		name := filepath.ToSlash(i)
+		old := cache.Sources[name]
+		src, err := javacSourceInfo(filepath.Join(srcDir, i), old)
+		if err != nil {
+			return "", err
+		}
+		if old == nil || old.SHA256 != src.SHA256 {
+			changed[name] = true
+		} else {
+			src.Classes = old.Classes
+		}
+		sources[name] = src
+	}
+
+	// Classes of changed and removed sources are deleted, and any source that
+	// mentions one of them is recompiled too.
+	staleNames := []string{}
+	for name, old := range cache.Sources {
+		if _, ok := sources[name]; ok && !changed[name] {
+			continue
+		}
+		for _, i := range old.Classes {
+			os.Remove(filepath.Join(classesDir, filepath.FromSlash(i)))
+		}
+		staleNames = append(staleNames, strings.TrimSuffix(path.Base(name), ".java"))
+	}
+	for name := range changed {
+		staleNames = append(staleNames, strings.TrimSuffix(path.Base(name), ".java"))
+	}
+	unchanged := []string{}
+	for name := range sources {
+		if !changed[name] {
+			unchanged = append(unchanged, name)
+		}
+	}
+	dependents, err := javaDependents(srcDir, unchanged, staleNames)
+	if err != nil {
+		return "", err
+	}
+	for _, name := range dependents {
+		for _, i := range sources[name].Classes {
+			os.Remove(filepath.Join(classesDir, filepath.FromSlash(i)))
+		}
+		changed[name] = true
+	}
+
+	if f.BuildV {
+		f.Logger.Printf("javac: recompiling %d of %d sources\n", len(changed), len(sources))
+	}
+	if len(changed) == 0 {
+		return classesDir, nil
+	}
+
+	// Remove the manifest until javac succeeds, so a failed build is
+	// followed by a full one.
+	if err := os.Remove(manifestPath); err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+
+	args := append(javacArgs(f, classesDir, bClspath), "-classpath", javaClasspath(f, classesDir))
+	names := []string{}
+	for name := range changed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, i := range names {
+		args = append(args, filepath.FromSlash(i))
+	}
+
+	javac := exec.Command("javac", args...)
+	javac.Dir = srcDir
+	if err := RunCmd(f, tmpdir, javac); err != nil {
+		return "", err
+	}
+
+	for name := range changed {
+		if sources[name].Classes, err = javaClasses(classesDir, name); err != nil {
+			return "", err
+		}
+	}
+	cache.Sources = sources
+	data, err := json.MarshalIndent(cache, "", "\t")
+	if err != nil {
+		return "", err
+	}
+	if err := WriteFile(f, manifestPath, bytes.NewReader(data)); err != nil {
+		return "", err
+	}
+	return classesDir, nil
+}
+
+// javacSourceInfo returns the modification time, size and hash of the source
+// at path. The hash is only computed if the modification time or size differ
+// from old.
+func javacSourceInfo(path string, old *javacSource) (*javacSource, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	src := &javacSource{ModTime: fi.ModTime(), Size: fi.Size()}
+	if old != nil && src.ModTime.Equal(old.ModTime) && src.Size == old.Size {
+		src.SHA256 = old.SHA256
+		return src, nil
+	}
+	if src.SHA256, err = sha256File(path); err != nil {
+		return nil, err
+	}
+	return src, nil
+}
+
+// javaDependents returns the sources in names, relative to srcDir, that
+// contain one of classNames as a word, or the name of a class in another
+// dependent. Dependents are found transitively since javac inlines static
+// final constants, so a class can hold a value that reached it through an
+// unchanged class in between. This is conservative, a source that only
+// mentions a class in a comment is also a dependent.
+func javaDependents(srcDir string, names []string, classNames []string) ([]string, error) {
+	sources := map[string][]byte{}
+	for _, name := range names {
+		data, err := ioutil.ReadFile(filepath.Join(srcDir, filepath.FromSlash(name)))
+		if err != nil {
+			return nil, err
+		}
+		sources[name] = data
+	}
+
+	dependents := []string{}
+	for len(classNames) > 0 {
+		quoted := make([]string, 0, len(classNames))
+		for _, i := range classNames {
+			quoted = append(quoted, regexp.QuoteMeta(i))
+		}
+		re := regexp.MustCompile(`\b(` + strings.Join(quoted, "|") + `)\b`)
+
+		classNames = nil
+		for _, name := range names {
+			if data, ok := sources[name]; ok && re.Match(data) {
+				dependents = append(dependents, name)
+				classNames = append(classNames, strings.TrimSuffix(path.Base(name), ".java"))
+				delete(sources, name)
+			}
+		}
+	}
+	sort.Strings(dependents)
+	return dependents, nil
+}
+
+// javaClasses returns the class files in classesDir compiled from the source
+// name, which must be in the directory of its package. These are the class
+// with the source's name and its nested classes.
+func javaClasses(classesDir, name string) ([]string, error) {
+	dir := path.Dir(name)
+	base := strings.TrimSuffix(path.Base(name), ".java")
+	files, err := ioutil.ReadDir(filepath.Join(classesDir, filepath.FromSlash(dir)))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	classes := []string{}
+	for _, i := range files {
+		if i.Name() == base+".class" || (strings.HasPrefix(i.Name(), base+"$") && strings.HasSuffix(i.Name(), ".class")) {
+			classes = append(classes, path.Join(dir, i.Name()))
+		}
+	}
+	return classes, nil
+}
+
+// javaTarget returns the Java version the sources are compiled for,
+// f.JavaVersion or javacTargetVer if it is unset.
+func javaTarget(f *Flags) string {
+	if f.JavaVersion != "" {
+		return f.JavaVersion
+	}
+	return javacTargetVer
+}
+
+// kotlinTarget returns the JVM target of Kotlin sources, which the Java
+// sources are compiled for too. It is the Java version of f, raised to
+// kotlincTargetVer, the oldest kotlinc supports, if f.JavaVersion is unset.
+func kotlinTarget(f *Flags) (string, error) {
+	major, err := javaMajorVersion(javaTarget(f))
+	if err != nil {
+		return "", err
+	}
+	min, _ := javaMajorVersion(kotlincTargetVer)
+	switch {
+	case major > min:
+		return strconv.Itoa(major), nil
+	case major == min || f.JavaVersion == "":
+		return kotlincTargetVer, nil
+	}
+	return "", fmt.Errorf("Kotlin sources need Java %s or later, but the Java version is %s", kotlincTargetVer, f.JavaVersion)
+}
+
+// mergesKotlinStdlib reports whether f.MergeJars includes kotlin-stdlib, so
+// the aar ships the runtime of its Kotlin classes.
+func mergesKotlinStdlib(f *Flags) bool {
+	for _, i := range f.MergeJars {
+		if strings.HasPrefix(filepath.Base(i), "kotlin-stdlib") {
+			return true
+		}
+	}
+	return false
+}
+
+// javaClasspath returns a classpath of dirs followed by f.MergeJars, whose
+// classes the Java sources may use as they end up in classes.jar too.
+func javaClasspath(f *Flags, dirs ...string) string {
+	return strings.Join(append(append([]string{}, dirs...), f.MergeJars...), string(os.PathListSeparator))
+}
+
+// javacArgs returns the arguments of javac compiling for the Java version
+// of f against bootclasspath into dst.
+func javacArgs(f *Flags, dst, bootclasspath string) []string {
+	return []string{
+		"-d", dst,
+		"-source", javaTarget(f),
+		"-target", javaTarget(f),
+		"-bootclasspath", bootclasspath,
+	}
+}
+
+// CompileJavaFile compiles the Java source file against the android.jar of
+// the SDK platform, as the sources of an aar are, into a directory in
+// tmpdir. The returned error includes javac's diagnostics. It checks a
+// single generated class without building the whole jar. The classes it
+// uses, such as go.Seq, are found in the source tree file belongs to, by its
+// package declaration, or among the classes compiled in tmpdir by a build.
+func CompileJavaFile(f *Flags, file string, tmpdir string) error {
+	if err := checkJavacTarget(f); err != nil {
+		return err
+	}
+	if !IsFile(f, file) {
+		return fmt.Errorf("Java source %s does not exist", file)
+	}
+	bClspath, err := bootClasspath(f)
+	if err != nil {
+		return err
+	}
+	dst := filepath.Join(tmpdir, "javac-file")
+	if err := Mkdir(f, dst); err != nil {
+		return err
+	}
+
+	file, err = filepath.Abs(file)
+	if err != nil {
+		return err
+	}
+	src, err := ReadFile(f, file)
+	if err != nil {
+		return err
+	}
+	args := append(javacArgs(f, dst, bClspath),
+		"-sourcepath", javaSourceRoot(file, src),
+		"-classpath", javaClasspath(f, filepath.Join(tmpdir, "javac-output")),
+		file,
+	)
+	javac := exec.Command("javac", args...)
+	return RunCmd(f, tmpdir, javac)
+}
+
+// javaSourceRoot returns the root of the source tree of the Java file at
+// path, whose contents are src: the directory its package declaration is
+// relative to. It is the directory of path if the package can't be found.
+func javaSourceRoot(path string, src []byte) string {
+	dir := filepath.Dir(path)
+	m := javaPackageRegexp.FindSubmatch(src)
+	if m == nil {
+		return dir
+	}
+	pkgDir := filepath.FromSlash(strings.Replace(string(m[1]), ".", "/", -1))
+	if root := strings.TrimSuffix(dir, string(filepath.Separator)+pkgDir); root != dir {
+		return root
+	}
+	return dir
+}
+
+// javaMajorVersion returns the major version of a Java or javac version,
+// e.g. 7 for 1.7, 8 for "javac 1.8.0_252" and 17 for "javac 17.0.2".
+func javaMajorVersion(version string) (int, error) {
+	v := strings.TrimPrefix(strings.TrimSpace(version), "javac ")
+	v = strings.TrimPrefix(v, "1.")
+	if i := strings.IndexAny(v, "._-+ "); i >= 0 {
+		v = v[:i]
+	}
+	major, err := strconv.Atoi(v)
+	if err != nil || major <= 0 {
+		return 0, fmt.Errorf("invalid Java version %q", version)
+	}
+	return major, nil
+}
+
+// javacTargetRange returns the oldest and newest Java versions the javac of
+// JDK major can compile for. Each JDK can target its own version, and JDK 9,
+// 12 and 20 dropped support for Java 5, 6 and 7 respectively.
+func javacTargetRange(major int) (int, int) {
+	switch {
+	case major >= 20:
+		return 8, major
+	case major >= 12:
+		return 7, major
+	case major >= 9:
+		return 6, major
+	}
+	return 1, major
+}
+
+// checkJavacTarget returns an error if the javac in $PATH cannot compile
+// for the Java version of f, with suggestions on how to fix it. Newer JDKs
+// regularly drop old targets, which javac reports unhelpfully.
+func checkJavacTarget(f *Flags) error {
+	target, err := javaMajorVersion(javaTarget(f))
+	if err != nil {
+		return err
+	}
+	if !f.ShouldRun() {
+		return nil
+	}
+	version, err := JavacVersion(f)
+	if err != nil {
+		return err
+	}
+	major, err := javaMajorVersion(version)
+	if err != nil {
+		return fmt.Errorf("could not determine the JDK version from javac -version: %v", err)
+	}
+	f.tracef("javac: %s, JDK %d", version, major)
+
+	min, max := javacTargetRange(major)
+	if target < min {
+		return fmt.Errorf("%s (JDK %d) cannot compile for Java %s, the oldest version it supports is %d. Set the Java version to %d or later, use javac --release %d, or use a JDK older than %d", version, major, javaTarget(f), min, min, min, major)
+	}
+	if target > max {
+		return fmt.Errorf("%s (JDK %d) cannot compile for Java %s, the newest version it supports is %d. Set an older Java version or use JDK %d or later", version, major, javaTarget(f), max, target)
+	}
+	return nil
+}
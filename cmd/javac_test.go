@@ -0,0 +1,336 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJavaDependents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matcha-javac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"io/gomatcha/bridge/GoValue.java":    "class GoValue { Tracker t; }",
+		"io/gomatcha/bridge/Bridge.java":     "class Bridge { GoValue v; }",
+		"io/gomatcha/bridge/Tracker.java":    "class Tracker {}",
+		"io/gomatcha/bridge/Trackers.java":   "class Trackers {}",
+		"io/gomatcha/bridge/GoValue.class":   "",
+		"io/gomatcha/bridge/GoValue$1.class": "",
+		"io/gomatcha/bridge/GoValues.class":  "",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	names := []string{"io/gomatcha/bridge/GoValue.java", "io/gomatcha/bridge/Bridge.java", "io/gomatcha/bridge/Trackers.java"}
+	dependents, err := javaDependents(dir, names, []string{"Tracker"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Bridge depends on Tracker through GoValue.
+	if !reflect.DeepEqual(dependents, []string{"io/gomatcha/bridge/Bridge.java", "io/gomatcha/bridge/GoValue.java"}) {
+		t.Errorf("Unexpected dependents %v", dependents)
+	}
+
+	classes, err := javaClasses(dir, "io/gomatcha/bridge/GoValue.java")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(classes, []string{"io/gomatcha/bridge/GoValue$1.class", "io/gomatcha/bridge/GoValue.class"}) {
+		t.Errorf("Unexpected classes %v", classes)
+	}
+}
+
+func TestLockJavacCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matcha-javac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f := &Flags{}
+	path := filepath.Join(dir, "cache.lock")
+	unlock, err := lockJavacCache(f, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locked := make(chan bool)
+	go func() {
+		unlock, err := lockJavacCache(f, path)
+		if err != nil {
+			t.Error(err)
+		} else {
+			unlock()
+		}
+		locked <- true
+	}()
+	select {
+	case <-locked:
+		t.Fatal("Locked a cache that is already locked")
+	case <-time.After(300 * time.Millisecond):
+	}
+	unlock()
+	<-locked
+
+	// Waiting for a lock stops when the build times out.
+	unlock, err = lockJavacCache(f, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timeout := &Flags{Timeout: 200 * time.Millisecond}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout.Timeout)
+	timeout.ctx = ctx
+	if _, err := lockJavacCache(timeout, path); err == nil || err.Error() != "build exceeded 200ms" {
+		t.Errorf("lockJavacCache() = %v, expected timeout", err)
+	}
+	cancel()
+	unlock()
+
+	// A lock left by a killed build is taken over, however recent, but not
+	// one held by a running process or another host.
+	exited := exec.Command(os.Args[0], "-test.run=^$")
+	if err := exited.Run(); err != nil {
+		t.Fatal(err)
+	}
+	hostname, _ := os.Hostname()
+	for owner, alive := range map[string]bool{
+		fmt.Sprintf("%s %d\n", hostname, exited.Process.Pid):       false,
+		fmt.Sprintf("%s %d\n", hostname, os.Getpid()):              true,
+		fmt.Sprintf("%s-other %d\n", hostname, exited.Process.Pid): true,
+	} {
+		if javacLockOwnerAlive(hostname, owner) != alive {
+			t.Errorf("javacLockOwnerAlive(%q) = %v", owner, !alive)
+		}
+	}
+	if err := ioutil.WriteFile(path, []byte(fmt.Sprintf("%s %d\n", hostname, exited.Process.Pid)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if unlock, err := lockJavacCache(f, path); err != nil {
+		t.Error(err)
+	} else {
+		unlock()
+	}
+}
+
+func TestJavacTargetRange(t *testing.T) {
+	for _, i := range []struct {
+		version  string
+		major    int
+		min, max int
+	}{
+		{"javac 1.8.0_252", 8, 1, 8},
+		{"javac 11.0.7", 11, 6, 11},
+		{"javac 17", 17, 7, 17},
+		{"javac 21.0.1", 21, 8, 21},
+		{"1.7", 7, 1, 7},
+	} {
+		major, err := javaMajorVersion(i.version)
+		if err != nil || major != i.major {
+			t.Errorf("javaMajorVersion(%q) = %v, %v, expected %v", i.version, major, err, i.major)
+			continue
+		}
+		if min, max := javacTargetRange(major); min != i.min || max != i.max {
+			t.Errorf("javacTargetRange(%v) = %v, %v, expected %v, %v", major, min, max, i.min, i.max)
+		}
+	}
+	if _, err := javaMajorVersion("javac"); err == nil {
+		t.Error("Expected error for a missing version")
+	}
+	if err := checkJavacTarget(&Flags{BuildN: true, JavaVersion: "seven"}); err == nil {
+		t.Error("Expected error for an invalid Java version")
+	}
+}
+
+func TestKotlinTarget(t *testing.T) {
+	for _, i := range []struct {
+		version, expected string
+	}{
+		{"", "1.8"},
+		{"1.8", "1.8"},
+		{"8", "1.8"},
+		{"11", "11"},
+		{"1.7", ""},
+	} {
+		target, err := kotlinTarget(&Flags{JavaVersion: i.version})
+		if target != i.expected || (err == nil) != (i.expected != "") {
+			t.Errorf("kotlinTarget(%q) = %q, %v, expected %q", i.version, target, err, i.expected)
+		}
+	}
+	for jars, expected := range map[string]bool{
+		"":            false,
+		"/libs/a.jar": false,
+		"/libs/a.jar,/kotlinc/lib/kotlin-stdlib.jar": true,
+		"/m2/kotlin-stdlib-1.9.22.jar":               true,
+	} {
+		f := &Flags{}
+		if jars != "" {
+			f.MergeJars = strings.Split(jars, ",")
+		}
+		if mergesKotlinStdlib(f) != expected {
+			t.Errorf("mergesKotlinStdlib(%q) = %v", jars, !expected)
+		}
+	}
+}
+
+func TestCompileJavaFile(t *testing.T) {
+	buf := &bytes.Buffer{}
+	f := &Flags{Logger: log.New(buf, "", 0), BuildN: true, JavaVersion: "1.8"}
+	if err := CompileJavaFile(f, "/src/go/Seq.java", "$WORK"); err != nil {
+		t.Fatal(err)
+	}
+	expected := "javac -d $WORK/javac-file -source 1.8 -target 1.8 -bootclasspath $ANDROID_HOME/platforms/android-21/android.jar -sourcepath /src/go -classpath $WORK/javac-output /src/go/Seq.java"
+	if !strings.Contains(buf.String(), expected+"\n") {
+		t.Errorf("Expected %q in:\n%s", expected, buf)
+	}
+
+	// The Java sources are compiled against the jars merged into them.
+	buf.Reset()
+	f.MergeJars = []string{"/libs/a.jar", "/libs/b.jar"}
+	if err := CompileJavaFile(f, "/src/go/Seq.java", "$WORK"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := compileJava(f, "/src", "", "$WORK"); err != nil {
+		t.Fatal(err)
+	}
+	sep := string(os.PathListSeparator)
+	for _, i := range []string{
+		"-classpath $WORK/javac-output" + sep + "/libs/a.jar" + sep + "/libs/b.jar /src/go/Seq.java",
+		"-classpath /libs/a.jar" + sep + "/libs/b.jar",
+	} {
+		if !strings.Contains(buf.String(), i) {
+			t.Errorf("Expected %q in:\n%s", i, buf)
+		}
+	}
+
+	for _, i := range []struct {
+		path, src, expected string
+	}{
+		{"/src/go/Seq.java", "package go;\n", "/src"},
+		{"/src/go/example/Example.java", "// Code generated.\n\npackage go.example;\n", "/src"},
+		{"/src/Main.java", "class Main {}\n", "/src"},
+		{"/other/Example.java", "package go.example;\n", "/other"},
+	} {
+		path := filepath.FromSlash(i.path)
+		if root := javaSourceRoot(path, []byte(i.src)); root != filepath.FromSlash(i.expected) {
+			t.Errorf("javaSourceRoot(%q) = %q, expected %q", i.path, root, i.expected)
+		}
+	}
+
+	// A file using a class of another file in its source tree compiles.
+	if _, err := exec.LookPath("javac"); err != nil {
+		t.Skip("javac is not installed")
+	}
+	f = &Flags{Logger: log.New(ioutil.Discard, "", 0), JavaVersion: "1.8"}
+	if _, err := AndroidPlatformPath(f); err != nil {
+		t.Skip("no Android SDK platform:", err)
+	}
+	dir, err := ioutil.TempDir("", "matcha-javac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"go/Seq.java":             "package go;\n\npublic final class Seq {\n    public static int ref() { return 0; }\n}\n",
+		"go/example/Example.java": "package go.example;\n\npublic final class Example {\n    public static int ref() { return go.Seq.ref(); }\n}\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, "src", filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := CompileJavaFile(f, filepath.Join(dir, "src", "go", "example", "Example.java"), dir); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestJavaSourceTransform(t *testing.T) {
+	sdk, cleanup := fakeSDK(t, "platforms/android-21")
+	defer cleanup()
+	if err := ioutil.WriteFile(filepath.Join(sdk, "platforms", "android-21", "android.jar"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "matcha-javac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	files := map[string]string{
+		"go/Seq.java": "package go;\n\npublic final class Seq {}\n",
+		"go/notes":    "not Java\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := &recordingRunner{output: "javac 11.0.20"}
+	transformed := []string{}
+	f := &Flags{Logger: log.New(ioutil.Discard, "", 0), Runner: r, JavaSourceTransform: func(path string, src []byte) ([]byte, error) {
+		transformed = append(transformed, filepath.Base(path))
+		return append([]byte("// transformed\n"), src...), nil
+	}}
+	tmpdir := filepath.Join(dir, "work")
+	if _, err := compileJava(f, src, "", tmpdir); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(transformed, []string{"Seq.java"}) {
+		t.Errorf("Transformed %v, expected only the Java source", transformed)
+	}
+	for name, expected := range map[string]string{
+		"java-staging/go/Seq.java": "// transformed\n" + files["go/Seq.java"],
+		"java-staging/go/notes":    files["go/notes"],
+	} {
+		if data, err := ioutil.ReadFile(filepath.Join(tmpdir, filepath.FromSlash(name))); err != nil || string(data) != expected {
+			t.Errorf("Staged %s = %q, %v, expected %q", name, data, err, expected)
+		}
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(src, "go", "Seq.java")); err != nil || string(data) != files["go/Seq.java"] {
+		t.Errorf("The source was modified: %q, %v", data, err)
+	}
+	javac := r.args[len(r.args)-1]
+	if javac[0] != "javac" || javac[len(javac)-1] != filepath.Join("go", "Seq.java") {
+		t.Errorf("Unexpected javac command %v", javac)
+	}
+
+	// An error from the transform fails the build before javac runs.
+	r.args = nil
+	f.JavaSourceTransform = func(path string, src []byte) ([]byte, error) {
+		return nil, fmt.Errorf("bad source")
+	}
+	if _, err := compileJava(f, src, "", filepath.Join(dir, "work2")); err == nil || !strings.Contains(err.Error(), "bad source") {
+		t.Errorf("Expected the transform's error, got %v", err)
+	}
+	if len(r.args) != 0 {
+		t.Errorf("Ran %v after the transform failed", r.args)
+	}
+}
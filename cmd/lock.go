@@ -0,0 +1,197 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+)
+
+// LockFile is the name of the file written next to the built aars that
+// records the toolchain and module versions they were built with.
+const LockFile = "matcha.lock"
+
+// Lock records the versions of everything that goes into an aar, so that
+// an identical one can be rebuilt later, see VerifyLock.
+type Lock struct {
+	Matcha  string       `json:"matcha"`            // version of the matcha command
+	Go      string       `json:"go"`                // output of go version
+	NDK     string       `json:"ndk"`               // Pkg.Revision of the NDK
+	JDK     string       `json:"jdk"`               // output of javac -version
+	Modules []LockModule `json:"modules,omitempty"` // modules of the main module's build list, if any
+
+	// Env is the environment matcha sets for go build, for each ABI, with
+	// the NDK's path replaced by $NDK so that it is the same wherever the NDK
+	// is installed. It is only recorded by reproducible builds, and not
+	// checked by VerifyLock since it includes the host's toolchain directory.
+	Env map[string][]string `json:"env,omitempty"`
+}
+
+// LockModule is a module in a Lock.
+type LockModule struct {
+	Path    string `json:"path"`
+	Version string `json:"version"` // version, followed by => and the replacement if the module is replaced
+}
+
+// CurrentLock returns the versions of the tools that would be used to build,
+// and the modules required by the module in dir.
+func CurrentLock(f *Flags, dir string) (*Lock, error) {
+	lock := &Lock{Matcha: matchaVersion(), NDK: "$NDK_VERSION"}
+
+	goVersion, err := GoVersion(f)
+	if err != nil {
+		return nil, err
+	}
+	lock.Go = strings.TrimSpace(string(goVersion))
+
+	ndkPath, err := NDKPath(f)
+	if err != nil {
+		return nil, err
+	}
+	if f.ShouldRun() {
+		if lock.NDK, err = NDKRevision(f, ndkPath); err != nil {
+			return nil, err
+		}
+	}
+
+	if lock.JDK, err = JavacVersion(f); err != nil {
+		return nil, err
+	}
+
+	if lock.Modules, err = lockModules(f, dir); err != nil {
+		return nil, err
+	}
+	return lock, nil
+}
+
+// lockEnv returns the environment AndroidEnv sets for each of androidArchs,
+// keyed by ABI, with the NDK's path replaced by $NDK.
+func lockEnv(f *Flags, androidArchs []string) (map[string][]string, error) {
+	ndkPath, err := NDKPath(f)
+	if err != nil {
+		return nil, err
+	}
+	env := map[string][]string{}
+	for _, arch := range androidArchs {
+		archEnv, err := AndroidEnv(f, arch)
+		if err != nil {
+			return nil, err
+		}
+		for i, kv := range archEnv {
+			archEnv[i] = strings.Replace(kv, ndkPath, "$NDK", -1)
+		}
+		env[GetAndroidABI(arch)] = archEnv
+	}
+	return env, nil
+}
+
+// JavacVersion returns the version reported by javac -version, e.g.
+// "javac 1.8.0_252". Older javacs print it to stderr rather than stdout.
+func JavacVersion(f *Flags) (string, error) {
+	out, err := CombinedOutputCmd(f, []byte("javac $JAVAC_VERSION"), "", exec.Command("javac", "-version"))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// matchaVersion returns the module version the running matcha command was
+// built from, or (devel) if it was not built from a tagged module.
+func matchaVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "(devel)"
+}
+
+// lockModules returns the build list of the module containing dir, or nil if
+// dir is not in a module.
+func lockModules(f *Flags, dir string) ([]LockModule, error) {
+	if gomod := GoEnv(f, "GOMOD"); gomod == "" || gomod == os.DevNull {
+		return nil, nil
+	}
+
+	cmd := exec.Command("go", "list", "-m", "-f", "{{.Path}} {{.Version}}{{with .Replace}} => {{.Path}} {{.Version}}{{end}}", "all")
+	cmd.Dir = dir
+	out, err := OutputCmd(f, nil, "", cmd)
+	if err != nil {
+		return nil, err
+	}
+	modules := []LockModule{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		kv := strings.SplitN(line, " ", 2)
+		m := LockModule{Path: kv[0]}
+		if len(kv) == 2 {
+			m.Version = kv[1]
+		}
+		modules = append(modules, m)
+	}
+	return modules, nil
+}
+
+// WriteLock writes lock as JSON to the LockFile in dir.
+func WriteLock(f *Flags, dir string, lock *Lock) error {
+	data, err := json.MarshalIndent(lock, "", "\t")
+	if err != nil {
+		return err
+	}
+	return WriteFile(f, filepath.Join(dir, LockFile), bytes.NewReader(append(data, '\n')))
+}
+
+// VerifyLock returns an error listing every difference between the lock
+// file at path and current.
+func VerifyLock(f *Flags, path string, current *Lock) error {
+	data, err := ReadFile(f, path)
+	if err != nil {
+		return err
+	}
+	if !f.ShouldRun() {
+		return nil
+	}
+	lock := &Lock{}
+	if err := json.Unmarshal(data, lock); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	diffs := []string{}
+	diff := func(name, locked, found string) {
+		if locked != found {
+			diffs = append(diffs, fmt.Sprintf("\t%s: locked %q, found %q", name, locked, found))
+		}
+	}
+	diff("matcha", lock.Matcha, current.Matcha)
+	diff("go", lock.Go, current.Go)
+	diff("ndk", lock.NDK, current.NDK)
+	diff("jdk", lock.JDK, current.JDK)
+
+	found := map[string]string{}
+	for _, i := range current.Modules {
+		found[i.Path] = i.Version
+	}
+	for _, i := range lock.Modules {
+		version, ok := found[i.Path]
+		if !ok {
+			diffs = append(diffs, fmt.Sprintf("\tmodule %s: locked %q, not required", i.Path, i.Version))
+			continue
+		}
+		diff("module "+i.Path, i.Version, version)
+		delete(found, i.Path)
+	}
+	for _, i := range current.Modules {
+		if version, ok := found[i.Path]; ok {
+			diffs = append(diffs, fmt.Sprintf("\tmodule %s: not locked, found %q", i.Path, version))
+		}
+	}
+
+	if len(diffs) > 0 {
+		return fmt.Errorf("environment does not match %s:\n%s", path, strings.Join(diffs, "\n"))
+	}
+	return nil
+}
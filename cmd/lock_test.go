@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestVerifyLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matcha-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f := &Flags{Logger: log.New(ioutil.Discard, "", 0)}
+	lock := &Lock{
+		Matcha: "v0.3.0",
+		Go:     "go version go1.12.5 linux/amd64",
+		NDK:    "19.2.5345600",
+		JDK:    "javac 1.8.0_252",
+		Modules: []LockModule{
+			{"example.com/app", ""},
+			{"golang.org/x/text", "v0.3.2"},
+		},
+	}
+	if err := WriteLock(f, dir, lock); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, LockFile)
+	if err := VerifyLock(f, path, lock); err != nil {
+		t.Error(err)
+	}
+
+	current := *lock
+	current.NDK = "21.0.6113669"
+	current.Modules = []LockModule{
+		{"example.com/app", ""},
+		{"golang.org/x/text", "v0.3.3"},
+		{"golang.org/x/sys", "v0.0.1"},
+	}
+	err = VerifyLock(f, path, &current)
+	if err == nil {
+		t.Fatal("Expected error for a different environment")
+	}
+	for _, i := range []string{
+		`ndk: locked "19.2.5345600", found "21.0.6113669"`,
+		`module golang.org/x/text: locked "v0.3.2", found "v0.3.3"`,
+		`module golang.org/x/sys: not locked, found "v0.0.1"`,
+	} {
+		if !strings.Contains(err.Error(), i) {
+			t.Errorf("Error is missing %s:\n%v", i, err)
+		}
+	}
+}
+
+func TestJavacVersion(t *testing.T) {
+	// javac 8 and older print the version to stderr.
+	r := &recordingRunner{stderr: "javac 1.8.0_252\n"}
+	f := &Flags{Logger: log.New(ioutil.Discard, "", 0), Runner: r}
+	if v, err := JavacVersion(f); err != nil || v != "javac 1.8.0_252" {
+		t.Errorf("JavacVersion() = %q, %v", v, err)
+	}
+	r = &recordingRunner{output: "javac 17.0.2\n"}
+	f.Runner = r
+	if v, err := JavacVersion(f); err != nil || v != "javac 17.0.2" {
+		t.Errorf("JavacVersion() = %q, %v", v, err)
+	}
+	if !reflect.DeepEqual(r.args, [][]string{{"javac", "-version"}}) {
+		t.Errorf("Unexpected commands %v", r.args)
+	}
+}
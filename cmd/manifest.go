@@ -0,0 +1,261 @@
+package cmd
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"go/build"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// aarManifestSource returns the AndroidManifest.xml of the aar built from
+// pkgs, including the permissions and features of deps. It is checked with
+// lintManifest if f.LintManifest is set.
+func aarManifestSource(f *Flags, pkgs []*build.Package, deps []*aarDep) (string, error) {
+	minSDK, err := androidMinSDK(f)
+	if err != nil {
+		return "", err
+	}
+	features, err := formFactorFeatures(f.FormFactor)
+	if err != nil {
+		return "", err
+	}
+	permissions, err := permissionElements(f.Permissions)
+	if err != nil {
+		return "", err
+	}
+	depManifest, err := aarDepManifest(deps, append(features, permissions...))
+	if err != nil {
+		return "", err
+	}
+	rootAttrs, err := manifestRootAttrs(f.ManifestNamespaces)
+	if err != nil {
+		return "", err
+	}
+	const manifestFmt = `<manifest xmlns:android="http://schemas.android.com/apk/res/android" package=%q%s>
+%s%s</manifest>`
+	manifest := fmt.Sprintf(manifestFmt, "go."+bindName(pkgs)+".gojni", rootAttrs, usesSDKElement(minSDK, f.TargetSDK), depManifest)
+	if f.LintManifest {
+		if err := lintManifest([]byte(manifest)); err != nil {
+			return "", err
+		}
+	}
+	return manifest, nil
+}
+
+// usesSDKElement returns the manifest's uses-sdk element. targetSdkVersion is
+// left out if targetSDK is 0, so apps that use the aar decide it.
+func usesSDKElement(minSDK, targetSDK int) string {
+	if targetSDK == 0 {
+		return fmt.Sprintf(`<uses-sdk android:minSdkVersion="%d"/>`, minSDK)
+	}
+	return fmt.Sprintf(`<uses-sdk android:minSdkVersion="%d" android:targetSdkVersion="%d"/>`, minSDK, targetSDK)
+}
+
+// BuildManifestOnlyAAR writes an aar to w with the AndroidManifest.xml that
+// BuildAAR would generate for pkgs, an empty classes.jar and an empty R.txt.
+// Nothing is compiled, so it is quick to build when testing how the manifest
+// merges into an app.
+func BuildManifestOnlyAAR(f *Flags, pkgs []*build.Package, w io.Writer) error {
+	if err := f.Validate(); err != nil {
+		return err
+	}
+	deps, err := openAARDeps(f.FatAAR)
+	if err != nil {
+		return err
+	}
+	defer closeAARDeps(deps)
+
+	manifest, err := aarManifestSource(f, pkgs, deps)
+	if err != nil {
+		return err
+	}
+	aarw := zip.NewWriter(w)
+	if err := writeManifestOnlyEntries(f, aarw, manifest); err != nil {
+		return err
+	}
+	return aarw.Close()
+}
+
+// writeManifestOnlyEntries writes the entries of an aar without code to
+// aarw, manifest as its AndroidManifest.xml, a classes.jar with no classes
+// and an empty R.txt.
+func writeManifestOnlyEntries(f *Flags, aarw *zip.Writer, manifest string) error {
+	jarManifest, err := jarManifest(f.JarManifestAttrs)
+	if err != nil {
+		return err
+	}
+
+	mw, err := aarw.Create("AndroidManifest.xml")
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(mw, manifest); err != nil {
+		return err
+	}
+
+	jw, err := aarw.Create("classes.jar")
+	if err != nil {
+		return err
+	}
+	jarw := zip.NewWriter(jw)
+	jmw, err := jarw.Create("META-INF/MANIFEST.MF")
+	if err != nil {
+		return err
+	}
+	if _, err := jmw.Write(jarManifest); err != nil {
+		return err
+	}
+	if err := jarw.Close(); err != nil {
+		return err
+	}
+
+	_, err = aarw.Create("R.txt")
+	return err
+}
+
+// lintManifest parses an AndroidManifest.xml and checks that it has a valid
+// package name and that its minSdkVersion is no greater than its
+// targetSdkVersion.
+func lintManifest(data []byte) error {
+	m := struct {
+		XMLName xml.Name `xml:"manifest"`
+		Package string   `xml:"package,attr"`
+		UsesSDK *struct {
+			Min    string `xml:"http://schemas.android.com/apk/res/android minSdkVersion,attr"`
+			Target string `xml:"http://schemas.android.com/apk/res/android targetSdkVersion,attr"`
+		} `xml:"uses-sdk"`
+	}{}
+	if err := xml.Unmarshal(data, &m); err != nil {
+		return fmt.Errorf("AndroidManifest.xml is malformed: %v", err)
+	}
+	if !isValidAndroidPackage(m.Package) {
+		return fmt.Errorf("AndroidManifest.xml package %q is not a valid Android package name", m.Package)
+	}
+	if m.UsesSDK == nil {
+		return fmt.Errorf("AndroidManifest.xml is missing uses-sdk")
+	}
+
+	min, err := strconv.Atoi(m.UsesSDK.Min)
+	if err != nil {
+		return fmt.Errorf("AndroidManifest.xml minSdkVersion %q is not an API level", m.UsesSDK.Min)
+	}
+	if m.UsesSDK.Target != "" {
+		target, err := strconv.Atoi(m.UsesSDK.Target)
+		if err != nil {
+			return fmt.Errorf("AndroidManifest.xml targetSdkVersion %q is not an API level", m.UsesSDK.Target)
+		}
+		if min > target {
+			return fmt.Errorf("AndroidManifest.xml minSdkVersion %d is greater than targetSdkVersion %d", min, target)
+		}
+	}
+	return nil
+}
+
+// isValidAndroidPackage reports whether name has at least two dot separated
+// segments, each starting with a letter and containing only letters, digits
+// and underscores.
+func isValidAndroidPackage(name string) bool {
+	segments := strings.Split(name, ".")
+	if len(segments) < 2 {
+		return false
+	}
+	for _, i := range segments {
+		if i == "" {
+			return false
+		}
+		for j, c := range i {
+			isLetter := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+			isDigit := c >= '0' && c <= '9'
+			if !isLetter && (j == 0 || !isDigit && c != '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// permissionElements returns a uses-permission element for each of
+// permissions, which must be valid permission names such as
+// android.permission.INTERNET.
+func permissionElements(permissions []string) ([]string, error) {
+	elems := []string{}
+	for _, i := range permissions {
+		if !isValidAndroidPackage(i) {
+			return nil, fmt.Errorf("permission %q is not a valid permission name, e.g. android.permission.INTERNET", i)
+		}
+		elems = append(elems, fmt.Sprintf("<uses-permission android:name=%q/>", i))
+	}
+	return elems, nil
+}
+
+// manifestRootAttrs returns attrs, namespace declarations such as xmlns:tools
+// and attributes such as tools:overrideLibrary, formatted for the manifest
+// element in sorted order. The prefix of each attribute must be android,
+// xmlns or declared in attrs, and the attributes generated by BuildAAR can't
+// be overridden.
+func manifestRootAttrs(attrs map[string]string) (string, error) {
+	names := make([]string, 0, len(attrs))
+	for k := range attrs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	buf := &bytes.Buffer{}
+	for _, name := range names {
+		parts := strings.Split(name, ":")
+		valid := len(parts) <= 2
+		for _, i := range parts {
+			valid = valid && isXMLName(i)
+		}
+		if !valid {
+			return "", fmt.Errorf("manifest attribute %q is not a valid attribute name, e.g. xmlns:tools", name)
+		}
+		if name == "package" || name == "xmlns:android" {
+			return "", fmt.Errorf("manifest attribute %s is generated and cannot be set", name)
+		}
+		if prefix := parts[0]; len(parts) == 2 && prefix != "xmlns" && prefix != "android" {
+			if _, ok := attrs["xmlns:"+prefix]; !ok {
+				return "", fmt.Errorf("manifest attribute %s uses the undeclared namespace prefix %s, add xmlns:%s", name, prefix, prefix)
+			}
+		}
+		fmt.Fprintf(buf, " %s=\"", name)
+		xml.EscapeText(buf, []byte(attrs[name]))
+		buf.WriteString(`"`)
+	}
+	return buf.String(), nil
+}
+
+// isXMLName reports whether name is a valid XML name without a colon.
+func isXMLName(name string) bool {
+	for i, r := range name {
+		if !unicode.IsLetter(r) && r != '_' && (i == 0 || !unicode.IsDigit(r) && r != '-' && r != '.') {
+			return false
+		}
+	}
+	return name != ""
+}
+
+// formFactorFeatures returns the uses-feature elements required by libraries
+// targeting formFactor, one of phone, tv or wear. Phones need no features.
+// The features are merged into the manifests of the apps using the library,
+// so none are required, which would hide the apps from other devices.
+func formFactorFeatures(formFactor string) ([]string, error) {
+	switch formFactor {
+	case "", "phone":
+		return nil, nil
+	case "tv":
+		return []string{
+			`<uses-feature android:name="android.software.leanback" android:required="false"/>`,
+			`<uses-feature android:name="android.hardware.touchscreen" android:required="false"/>`,
+		}, nil
+	case "wear":
+		return []string{`<uses-feature android:name="android.hardware.type.watch" android:required="false"/>`}, nil
+	}
+	return nil, fmt.Errorf("invalid form factor %q, valid values are phone, tv and wear", formFactor)
+}
@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"archive/zip"
+	"bytes"
+	"go/build"
+	"strings"
+	"testing"
+)
+
+func TestLintManifest(t *testing.T) {
+	for _, i := range []struct {
+		manifest string
+		ok       bool
+	}{
+		{`<manifest xmlns:android="http://schemas.android.com/apk/res/android" package="go.example.gojni">
+<uses-sdk android:minSdkVersion="15"/></manifest>`, true},
+		{`<manifest xmlns:android="http://schemas.android.com/apk/res/android" package="go.example.gojni">
+<uses-sdk android:minSdkVersion="15" android:targetSdkVersion="26"/></manifest>`, true},
+		{`<manifest xmlns:android="http://schemas.android.com/apk/res/android" package="go.example.gojni">
+<uses-sdk android:minSdkVersion="21" android:targetSdkVersion="19"/></manifest>`, false},
+		{`<manifest xmlns:android="http://schemas.android.com/apk/res/android" package="go.example.gojni">
+<uses-sdk android:minSdkVersion="15"/>`, false},
+		{`<manifest xmlns:android="http://schemas.android.com/apk/res/android" package="go.1example.gojni">
+<uses-sdk android:minSdkVersion="15"/></manifest>`, false},
+		{`<manifest xmlns:android="http://schemas.android.com/apk/res/android" package="example">
+<uses-sdk android:minSdkVersion="15"/></manifest>`, false},
+		{`<manifest xmlns:android="http://schemas.android.com/apk/res/android" package="go.example.gojni"></manifest>`, false},
+	} {
+		if err := lintManifest([]byte(i.manifest)); (err == nil) != i.ok {
+			t.Errorf("lintManifest(%q) = %v", i.manifest, err)
+		}
+	}
+}
+
+func TestFormFactorFeatures(t *testing.T) {
+	for formFactor, count := range map[string]int{"": 0, "phone": 0, "tv": 2, "wear": 1} {
+		features, err := formFactorFeatures(formFactor)
+		if err != nil || len(features) != count {
+			t.Errorf("formFactorFeatures(%q) = %v, %v", formFactor, features, err)
+		}
+		for _, i := range features {
+			if !strings.Contains(i, `android:required="false"`) {
+				t.Errorf("formFactorFeatures(%q) requires %s", formFactor, i)
+			}
+		}
+	}
+	if _, err := formFactorFeatures("car"); err == nil {
+		t.Error("Expected error for unknown form factor")
+	}
+}
+
+func TestBuildManifestOnlyAAR(t *testing.T) {
+	buf := &bytes.Buffer{}
+	f := &Flags{MinSDK: 21, FormFactor: "tv", LintManifest: true, Permissions: []string{"android.permission.INTERNET"}}
+	if err := BuildManifestOnlyAAR(f, []*build.Package{{Name: "example"}}, buf); err != nil {
+		t.Fatal(err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.File) != 3 || r.File[0].Name != "AndroidManifest.xml" || r.File[1].Name != "classes.jar" || r.File[2].Name != "R.txt" {
+		t.Fatalf("Unexpected entries %v", r.File)
+	}
+	manifest, err := readZipFile(r.File[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `<manifest xmlns:android="http://schemas.android.com/apk/res/android" package="go.example.gojni">
+<uses-sdk android:minSdkVersion="21"/>
+<uses-feature android:name="android.hardware.touchscreen" android:required="false"/>
+<uses-feature android:name="android.software.leanback" android:required="false"/>
+<uses-permission android:name="android.permission.INTERNET"/></manifest>`
+	if string(manifest) != expected {
+		t.Errorf("Unexpected manifest:\n%s", manifest)
+	}
+
+	if usesSDK := usesSDKElement(21, 34); usesSDK != `<uses-sdk android:minSdkVersion="21" android:targetSdkVersion="34"/>` {
+		t.Errorf("usesSDKElement(21, 34) = %s", usesSDK)
+	}
+	f.TargetSDK = 34
+	if manifest, err := aarManifestSource(f, []*build.Package{{Name: "example"}}, nil); err != nil || !strings.Contains(manifest, ` android:targetSdkVersion="34"/>`) {
+		t.Errorf("aarManifestSource() with target SDK = %s, %v", manifest, err)
+	}
+
+	// The package is named after the bound package, not its dependencies.
+	pkgs := []*build.Package{
+		{Name: "fmt", ImportPath: "fmt", Goroot: true},
+		{Name: "bridge", ImportPath: "gomatcha.io/matcha/bridge"},
+		{Name: "example", ImportPath: "example.com/example", Imports: []string{"fmt", "gomatcha.io/matcha/bridge"}},
+	}
+	if manifest, err := aarManifestSource(f, pkgs, nil); err != nil || !strings.Contains(manifest, ` package="go.example.gojni"`) {
+		t.Errorf("aarManifestSource() with dependencies = %s, %v", manifest, err)
+	}
+
+	for _, i := range []string{"INTERNET", "android.permission.", "android..INTERNET", "com.example.1ST", `a.b"/>`} {
+		f.Permissions = []string{i}
+		if err := BuildManifestOnlyAAR(f, []*build.Package{{Name: "example"}}, &bytes.Buffer{}); err == nil {
+			t.Errorf("Expected error for permission %q", i)
+		}
+	}
+}
+
+func TestManifestNamespaces(t *testing.T) {
+	f := &Flags{MinSDK: 21, LintManifest: true, ManifestNamespaces: map[string]string{
+		"xmlns:tools":           "http://schemas.android.com/tools",
+		"tools:overrideLibrary": "com.example.a, com.example.b",
+		"android:versionName":   `1.0 "beta"`,
+	}}
+	manifest, err := aarManifestSource(f, []*build.Package{{Name: "example"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `<manifest xmlns:android="http://schemas.android.com/apk/res/android" package="go.example.gojni" android:versionName="1.0 &#34;beta&#34;" tools:overrideLibrary="com.example.a, com.example.b" xmlns:tools="http://schemas.android.com/tools">
+<uses-sdk android:minSdkVersion="21"/></manifest>`
+	if manifest != expected {
+		t.Errorf("Unexpected manifest:\n%s", manifest)
+	}
+
+	for _, i := range []map[string]string{
+		{"tools:node": "merge"},
+		{"package": "com.example"},
+		{"xmlns:android": "http://example.com"},
+		{"a:b:c": "d"},
+		{"1st": "x"},
+		{`a"`: "x"},
+	} {
+		if _, err := manifestRootAttrs(i); err == nil {
+			t.Errorf("Expected error for %v", i)
+		}
+	}
+}
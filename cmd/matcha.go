@@ -6,13 +6,19 @@ package cmd
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"go/build"
 	"log"
+	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const (
@@ -33,12 +39,315 @@ type Flags struct {
 	BuildO       string // output path
 	BuildBinary  bool
 	BuildTargets string // targets
+	BuildJavadoc bool   // write a javadoc jar next to the aar
+	OutputDir    string // directory for artifacts named after the module, variant and version
+	Version      string // version included in artifact names
+	ToolRetries  int    // times to retry commands that fail with transient errors
+
+	// Android
+	BuildVariant        string // debug or release
+	BuildAllVariants    bool   // build both debug and release aars
+	NativeDebugSymbols  bool   // write unstripped libraries to a native-debug-symbols.zip
+	AssetPrefix         string // directory prepended to asset names in the aar
+	AssetsDirName       string // slash separated directory of each package's assets, defaults to assets
+	CppStdlib           string // C++ standard library, c++_static or c++_shared
+	NDKVersion          string // expected NDK Pkg.Revision, e.g. 16.1.4479499
+	NDKSHA256           string // expected SHA-256 of the NDK's source.properties and toolchain binaries, see ndkSHA256
+	NDKRoot             string // NDK used instead of the one in $ANDROID_HOME, e.g. a patched toolchain
+	LintManifest        bool   // check the generated AndroidManifest.xml
+	CompressClassesJar  bool   // deflate classes.jar in the aar instead of storing it
+	StrictBinding       bool   // fail if a JNI function has no Java native method
+	FormFactor          string // phone, tv or wear, adds the form factor's uses-feature elements
+	NormalizeAssetPerms bool   // give every asset 0644 permissions instead of its file's
+	KotlincPath         string // kotlinc used for Kotlin sources, defaults to the one in $PATH
+	MaxAssetBytes       int64  // limit on the total size of assets, if positive
+	ConsumerRules       string // proguard rules file applied to apps using the aar, appended to its proguard.txt
+	PrebuiltLibs        bool   // BuildAAR uses the libgojni.so files already in jniLibs
+	BuildMode           string // c-shared, the default, or c-archive for static archives outside the aar
+	MinSDK              int    // minSdkVersion and native API level, defaults to 15 or the lowest of r19+ NDKs
+	TargetSDK           int    // targetSdkVersion of the aar and lowest platform compiled against, left out if unset
+	Incremental         bool   // only recompile changed Java sources, reusing classes from $GOPATH/pkg/matcha/javac
+	EmbedVersion        bool   // add a go.<pkg>.MatchaVersion class with Version and a check method
+	CheckSymbols        bool   // fail before linking if two packages export the same C symbol
+	TraceDiscovery      bool   // log every path probed while locating the SDK, NDK and javac
+	SplitNative         bool   // move the native libraries of each ABI to their own <name>-native-<abi>.aar
+	VerifyJar           bool   // load the compiled classes in a host JVM to catch missing classes and bad bytecode
+	Lock                bool   // write a matcha.lock of the tool, NDK, JDK and module versions next to the aars
+	VerifyLock          string // matcha.lock the tool, NDK, JDK and module versions must match
+	MinimalRes          bool   // write an empty res/values/values.xml instead of a bare res/ entry
+	Report              string // txt or html, writes a <name>-build-report file of sizes, versions and timings next to each aar
+	NoAssets            bool   // leave the packages' assets out of the aar without looking for them
+	JavaVersion         string // Java version the sources are compiled for, e.g. 1.8, defaults to 1.7, or 1.8 with Kotlin sources
+	SysrootOverlay      string // directory whose include and lib/<abi> are searched before the NDK's sysroot
+	AGPVersion          string // Android Gradle plugin version the aar targets, 7.0 and later get aar-metadata.properties
+	Parallel            int    // assets compressed at once when packaging, if more than 1
+	SDKCodename         string // codename of a preview SDK platform to build against, e.g. TiramisuPrivacySandbox
+	Hermetic            bool   // build from read-only copies of the packages in the work directory
+	PGOProfile          string // CPU profile passed to go build -pgo for profile-guided optimization, needs Go 1.21
+	EmitScript          string // path of a shell script, or batch file on windows, that reproduces the build without matcha
+	AssetManifest       string // JSON file mapping source files to asset names, added to the packages' assets
+	NoAssetWarnings     bool   // don't warn about assets that collide with the android framework's own
+	ArchiveComment      string // zip comment of the aar, defaults to the matcha version and build time
+	Reproducible        bool   // build with -trimpath, a pinned locale and time zone and no timestamps in the aar, recording the env in matcha.lock if Lock is set, implies NormalizeAssetPerms
+	RTxt                string // R.txt listing the library's resources, written to the aar instead of an empty one
+	Require16KB         bool   // link 64 bit libraries for 16KB pages, and fail instead of warning if they aren't aligned for them
+	TestHarness         bool   // also write a -test-harness.jar of the bindings with stubbed native methods, for JVM unit tests
+	WarnAssetExts       bool   // warn about assets with extensions outside AllowedAssetExts instead of failing
+	NativeKeepRules     bool   // keep only native methods and classes found by JNI in proguard.txt, instead of all of go.**
+	SignKey             string // PGP or minisign secret key writing a detached signature of each aar written, see SignAAR
+	NoVerifyELF         bool   // skip checking that each jni/<abi>/libgojni.so is built for its abi's machine
+
+	// NoRecompressExts lists the extensions of already compressed assets,
+	// which are stored in the aar without deflating them again. If nil, .gz,
+	// .png, .jpg, .mp3 and .ogg assets are stored.
+	NoRecompressExts []string
+
+	// AllowedAssetExts, if not nil, lists the only extensions assets may
+	// have, e.g. .png and .json, so that stray sources or build artifacts
+	// fail the build instead of shipping in the aar.
+	AllowedAssetExts []string
+
+	// MinSDKVariants builds one aar for each minSdkVersion, named by its
+	// level, instead of a single aar for MinSDK.
+	MinSDKVariants []int
+
+	// MinSDKPerABI raises the native API level of the ABIs it lists, e.g.
+	// arm64-v8a, above MinSDK. The aar's minSdkVersion stays MinSDK.
+	MinSDKPerABI map[string]int
+
+	// Permissions are added to the aar's manifest as uses-permission
+	// elements, e.g. android.permission.INTERNET.
+	Permissions []string
+
+	// ExtraAARFiles maps the names of files added to the aar, e.g. lint.jar,
+	// to the paths of their contents. The names must not be generated by
+	// the build.
+	ExtraAARFiles map[string]string
+
+	// ManifestNamespaces are added to the manifest element of the aar's
+	// AndroidManifest.xml, mapping namespace declarations and attributes to
+	// their values, e.g. xmlns:tools to http://schemas.android.com/tools
+	// and tools:overrideLibrary to the packages the manifest merger may
+	// ignore the min SDK of.
+	ManifestNamespaces map[string]string
+
+	// JarManifestAttrs are added to the main section of the classes.jar
+	// manifest, e.g. Implementation-Version.
+	JarManifestAttrs map[string]string
+
+	// BuildConfig, BuildConfigInt and BuildConfigBool are compiled into
+	// constants of a go.<pkg>.BuildConfig class in classes.jar.
+	BuildConfig     map[string]string
+	BuildConfigInt  map[string]int
+	BuildConfigBool map[string]bool
+
+	// PostBuild is a command and its arguments that is run after an aar is
+	// built successfully, with $MATCHA_ARTIFACT set to its path. BuildAAR
+	// runs it once the aar is written and signed, and Bind for each aar once
+	// they are all copied to their destination and the lock is written.
+	PostBuild []string
+
+	// ExportedSymbols are exported by libgojni.so in addition to the JNI
+	// entry points. If set, all other symbols are hidden.
+	ExportedSymbols []string
+
+	// VersionScript is a linker version script controlling the symbols
+	// exported by libgojni.so, used instead of ExportedSymbols. {abi} in the
+	// path is replaced by each arch's ABI, e.g. arm64-v8a, for per ABI
+	// scripts. The script must keep the JNI entry points, JNI_OnLoad and
+	// Java_*, global.
+	VersionScript string
+
+	// GoEnv sets environment variables, e.g. GOEXPERIMENT, for the go
+	// commands building the native libraries. It cannot override the
+	// variables that select the target and its C toolchain.
+	GoEnv map[string]string
+
+	// Sanitizers, address or undefined, are enabled for the cgo code of the
+	// native libraries, and their runtimes are added next to libgojni.so in
+	// the aar, with a wrap.sh that preloads the address sanitizer's runtime,
+	// see https://developer.android.com/ndk/guides/asan. Sanitized libraries
+	// are for debug builds only.
+	Sanitizers []string
+
+	// Timeout limits the time taken by the android build. If zero, there is
+	// no limit.
+	Timeout time.Duration
+
+	// TmpDirPerm are the permissions of the work directory and the javac
+	// output in it, 0700 if zero. Group or other permissions let later CI
+	// steps running as another user read the intermediate outputs.
+	TmpDirPerm os.FileMode
+
+	// FatAAR lists the paths of dependency aars that are merged into the
+	// built aar, including the permissions, features and application
+	// components of their manifests, see aarDepManifest.
+	FatAAR []string
+
+	// MergeJars lists the paths of jars whose classes are merged into the
+	// built classes.jar, so that consumers don't have to add them
+	// separately. The Java sources are compiled against them.
+	MergeJars []string
+
+	// JavaSourceTransform, if set, is applied to a copy of each Java source
+	// file before it is compiled.
+	JavaSourceTransform func(path string, src []byte) ([]byte, error)
+
+	// Runner runs external commands such as go and javac. If nil, commands
+	// are run on the local machine.
+	Runner Runner
+
+	ctx         context.Context
+	ndkVerified string // NDK path that passed verifyNDK
+	script      *buildScript
+}
+
+// shouldRecord reports whether commands and file operations are recorded in
+// the script written to f.EmitScript.
+func (f *Flags) shouldRecord() bool {
+	return f.script != nil && !f.disablePrint
 }
 
 func (f *Flags) ShouldPrint() bool {
 	return (f.BuildN || f.BuildX) && !f.disablePrint
 }
 
+// tmpDirPerm returns the permissions of work directories, f.TmpDirPerm or
+// 0700 if it is unset.
+func (f *Flags) tmpDirPerm() os.FileMode {
+	if f.TmpDirPerm == 0 {
+		return 0700
+	}
+	return f.TmpDirPerm
+}
+
+func (f *Flags) runner() Runner {
+	if f.Runner == nil {
+		return localRunner{}
+	}
+	return f.Runner
+}
+
+func (f *Flags) context() context.Context {
+	if f.ctx == nil {
+		return context.Background()
+	}
+	return f.ctx
+}
+
+// withTimeout returns a copy of f whose commands are cancelled once
+// f.Timeout has passed, or f itself if there is no timeout or a deadline is
+// already set. f is left unchanged, so it can be shared by concurrent
+// builds. The returned function must be called to release the deadline.
+func (f *Flags) withTimeout() (*Flags, func()) {
+	if f.Timeout <= 0 {
+		return f, func() {}
+	}
+	if _, ok := f.context().Deadline(); ok {
+		return f, func() {}
+	}
+	ctx, cancel := context.WithTimeout(f.context(), f.Timeout)
+	timed := *f
+	timed.ctx = ctx
+	return &timed, cancel
+}
+
+// timeoutErr returns an error if f.Timeout has passed.
+func (f *Flags) timeoutErr() error {
+	if f.context().Err() == context.DeadlineExceeded {
+		return fmt.Errorf("build exceeded %v", f.Timeout)
+	}
+	return nil
+}
+
+// Validate returns an error describing every combination of f's fields that
+// contradict each other, where one setting would silently be ignored or
+// override another. It is called at the start of each build.
+func (f *Flags) Validate() error {
+	problems := []string{}
+	conflict := func(cond bool, format string, args ...interface{}) {
+		if cond {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	if f.NoAssets {
+		conflict(f.AssetPrefix != "", "no assets cannot be combined with an asset prefix")
+		conflict(f.AssetsDirName != "", "no assets cannot be combined with an assets directory")
+		conflict(f.MaxAssetBytes > 0, "no assets cannot be combined with a limit on the size of assets")
+		conflict(f.NoRecompressExts != nil, "no assets cannot be combined with extensions of assets not to recompress")
+	}
+	conflict(f.BuildAllVariants && f.BuildVariant != "", "building all variants cannot be combined with the %s variant", f.BuildVariant)
+	conflict(f.MinSDK != 0 && len(f.MinSDKVariants) > 0, "min SDK %d cannot be combined with min SDK variants %v", f.MinSDK, f.MinSDKVariants)
+	if f.TargetSDK != 0 {
+		conflict(f.TargetSDK < f.MinSDK || f.TargetSDK < minAndroidAPI, "target SDK %d is below the min SDK", f.TargetSDK)
+		for _, i := range f.MinSDKVariants {
+			conflict(f.TargetSDK < i, "target SDK %d is below the min SDK variant %d", f.TargetSDK, i)
+		}
+	}
+	extraNames := []string{}
+	for name := range f.ExtraAARFiles {
+		extraNames = append(extraNames, name)
+	}
+	sort.Strings(extraNames)
+	for _, name := range extraNames {
+		conflict(!isCleanRelPath(name), "extra aar file %q is not a clean relative path", name)
+	}
+	unknownABIs := []string{}
+	for abi := range f.MinSDKPerABI {
+		if GetAndroidArch(abi) == "" {
+			unknownABIs = append(unknownABIs, abi)
+		}
+	}
+	sort.Strings(unknownABIs)
+	conflict(len(unknownABIs) > 0, "min SDKs per ABI list unknown ABIs %v, valid ABIs are %v", unknownABIs, SupportedABIs())
+	for _, abi := range SupportedABIs() {
+		if api, ok := f.MinSDKPerABI[abi]; ok {
+			conflict(api < f.MinSDK || api < minAndroidAPI, "min SDK %d for %s is below the min SDK of the aar", api, abi)
+			for _, i := range f.MinSDKVariants {
+				conflict(api < i, "min SDK %d for %s is below the min SDK variant %d", api, abi, i)
+			}
+		}
+	}
+	conflict(len(f.ExportedSymbols) > 0 && f.VersionScript != "", "exported symbols cannot be combined with a version script")
+	if f.BuildMode == "c-archive" {
+		conflict(len(f.ExportedSymbols) > 0, "exported symbols are only supported by c-shared builds")
+		conflict(f.VersionScript != "", "version scripts are only supported by c-shared builds")
+		conflict(f.NativeDebugSymbols, "native debug symbols are only supported by c-shared builds")
+		conflict(f.SplitNative, "splitting native libraries is only supported by c-shared builds")
+		conflict(len(f.Sanitizers) > 0, "sanitizers are only supported by c-shared builds")
+	}
+	conflict(len(f.Sanitizers) > 0 && (f.BuildVariant == "release" || f.BuildAllVariants), "sanitizers can only be used in debug builds")
+	conflict(f.EmbedVersion && f.Version == "", "embedding the version requires a version to be set")
+	conflict(f.Parallel < 0, "parallelism %d cannot be negative", f.Parallel)
+	conflict(f.Hermetic && f.OutputDir == "", "hermetic builds require an output directory outside the source tree")
+	conflict(f.TmpDirPerm&^os.ModePerm != 0, "work directory permissions %v must only have permission bits", f.TmpDirPerm)
+	conflict(f.TmpDirPerm != 0 && f.TmpDirPerm&0700 != 0700, "work directory permissions %v must let the owner read, write and search it", f.TmpDirPerm)
+	conflict(len(f.ArchiveComment) > 0xffff, "archive comments must be shorter than 64KB")
+	conflict(f.WarnAssetExts && f.AllowedAssetExts == nil, "warning about asset extensions requires allowed asset extensions")
+	conflict(f.EmitScript != "" && f.BuildN, "emitting a script requires running the build, it cannot be combined with -n")
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("invalid flags:\n\t%s", strings.Join(problems, "\n\t"))
+}
+
+// tracef logs a step of locating the SDK, NDK and tools to f.Logger if
+// f.TraceDiscovery is set and there is a logger.
+func (f *Flags) tracef(format string, args ...interface{}) {
+	if f.TraceDiscovery && f.Logger != nil {
+		f.Logger.Printf("discovery: "+format+"\n", args...)
+	}
+}
+
+// warnf logs a warning to f.Logger, if there is one.
+func (f *Flags) warnf(format string, args ...interface{}) {
+	if f.Logger != nil {
+		f.Logger.Printf("warning: "+format+"\n", args...)
+	}
+}
+
 func (f *Flags) ShouldRun() bool {
 	return !f.BuildN
 }
@@ -132,6 +441,22 @@ func GoVersion(f *Flags) ([]byte, error) {
 	return ver, nil
 }
 
+// goMinorVersion returns the minor version of a go version output, e.g. 21
+// for "go version go1.21.3 linux/amd64". ok is false for development
+// versions, which have no minor version.
+func goMinorVersion(ver []byte) (minor int, ok bool) {
+	fields := strings.Fields(string(ver))
+	if len(fields) < 3 || !strings.HasPrefix(fields[2], "go1.") {
+		return 0, false
+	}
+	v := strings.TrimPrefix(fields[2], "go1.")
+	if i := strings.IndexFunc(v, func(r rune) bool { return r < '0' || r > '9' }); i >= 0 {
+		v = v[:i]
+	}
+	minor, err := strconv.Atoi(v)
+	return minor, err == nil
+}
+
 func GoBuild(f *Flags, srcs []string, env []string, buildTags []string, matchaPkgPath, tmpdir string, args ...string) error {
 	pkgPath, err := PkgPath(f, matchaPkgPath, env)
 	if err != nil {
@@ -164,6 +489,9 @@ func GoBuild(f *Flags, srcs []string, env []string, buildTags []string, matchaPk
 	if f.BuildWork {
 		cmd.Args = append(cmd.Args, "-work")
 	}
+	if f.Reproducible {
+		cmd.Args = append(cmd.Args, "-trimpath")
+	}
 	cmd.Args = append(cmd.Args, args...)
 	cmd.Args = append(cmd.Args, srcs...)
 	cmd.Env = append([]string{}, env...)
@@ -194,6 +522,68 @@ func InstallPkg(f *Flags, matchaPkgPath, temp string, pkg string, env []string,
 	return RunCmd(f, temp, cmd)
 }
 
+// ResolvePackages returns the packages matched by patterns, import paths or
+// go patterns such as ./..., in the current directory, "." if there are none.
+// The patterns are expanded by go list, so they are resolved in the main
+// module in module mode, for android with the matcha build tag. Main
+// packages matched only by wildcard patterns are skipped, and it is an error
+// for a pattern without a wildcard to match one, or for the patterns to match
+// no packages.
+func ResolvePackages(patterns []string, f *Flags) ([]*build.Package, error) {
+	if len(patterns) == 0 {
+		patterns = []string{"."}
+	}
+	cmd := exec.Command("go", append([]string{"list", "-tags", "matcha", "-f", "{{.ImportPath}}\t{{.Dir}}\t{{join .Match \"\\t\"}}"}, patterns...)...)
+	cmd.Env = []string{"GOOS=android", "GOARCH=arm64", "CGO_ENABLED=1"}
+	fallback := &bytes.Buffer{}
+	for _, i := range patterns {
+		fmt.Fprintf(fallback, "%s\t%s\t%s\n", i, i, i)
+	}
+	out, err := OutputCmd(f, fallback.Bytes(), "", cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := build.Default
+	ctx.GOOS = "android"
+	ctx.GOARCH = "arm64"
+	ctx.CgoEnabled = true
+	ctx.BuildTags = append(ctx.BuildTags, "matcha")
+
+	pkgs := []*build.Package{}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Split(strings.TrimSpace(line), "\t")
+		if len(fields) < 2 {
+			continue
+		}
+		if !f.ShouldRun() {
+			pkgs = append(pkgs, &build.Package{ImportPath: fields[0], Dir: fields[1], Name: path.Base(fields[0])})
+			continue
+		}
+		pkg, err := ctx.ImportDir(fields[1], build.ImportComment)
+		if err != nil {
+			return nil, err
+		}
+		pkg.ImportPath = fields[0]
+		if pkg.Name == "main" {
+			wildcard := true
+			for _, i := range fields[2:] {
+				wildcard = wildcard && strings.Contains(i, "...")
+			}
+			if !wildcard {
+				return nil, fmt.Errorf("binding 'main' package (%s) is not supported", pkg.ImportPath)
+			}
+			f.tracef("%s: skipped, main package matched by %s", pkg.ImportPath, strings.Join(fields[2:], " "))
+			continue
+		}
+		pkgs = append(pkgs, pkg)
+	}
+	if len(pkgs) == 0 {
+		return nil, fmt.Errorf("no packages to bind match %s", strings.Join(patterns, " "))
+	}
+	return pkgs, nil
+}
+
 func ImportAll(f *Flags, ctx *build.Context, paths []string, srcDir string, mode build.ImportMode) ([]*build.Package, error) {
 	pkgs := map[string]*build.Package{}
 	for _, i := range paths {
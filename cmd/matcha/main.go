@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 	"gomatcha.io/matcha/cmd"
@@ -35,6 +37,65 @@ var (
 	// buildThreaded bool
 	// buildBinary  bool   // -binary
 	buildTargets string // --targets
+	buildJavadoc bool   // --javadoc
+
+	buildVariant     string        // --variant
+	buildAllVariants bool          // --all-variants
+	buildSymbols     bool          // --native-debug-symbols
+	buildNDKVersion  string        // --ndk-version
+	buildNDKSHA256   string        // --ndk-sha256
+	buildNDKRoot     string        // --ndk-root
+	buildFatAAR      []string      // --fat-aar
+	buildLint        bool          // --lint-manifest
+	buildOutputDir   string        // --output-dir
+	buildVersion     string        // --version
+	buildToolRetries int           // --tool-retries
+	buildStrict      bool          // --strict-binding
+	buildFormFactor  string        // --form-factor
+	buildTimeout     time.Duration // --timeout
+	buildPostBuild   string        // --post-build
+	buildKotlinc     string        // --kotlinc
+	buildMaxAssets   int64         // --max-asset-bytes
+	buildConsumer    string        // --consumer-rules
+	buildMinSDK      int           // --min-sdk
+	buildMinSDKs     []int         // --min-sdk-variants
+	buildTargetSDK   int           // --target-sdk
+	buildIncremental bool          // --incremental
+	buildEmbedVer    bool          // --embed-version
+	buildCheckSyms   bool          // --check-symbols
+	buildTrace       bool          // --trace-discovery
+	buildPermissions []string      // --permissions
+	buildSplitNative bool          // --split-native
+	buildSanitizers  []string      // --sanitize
+	buildVerifyJar   bool          // --verify-jar
+	buildLock        bool          // --lock
+	buildVerifyLock  string        // --verify-lock
+	buildMinimalRes  bool          // --minimal-res
+	buildVerScript   string        // --version-script
+	buildReport      string        // --report
+	buildNoAssets    bool          // --no-assets
+	buildJavaVersion string        // --java-version
+	buildOverlay     string        // --sysroot-overlay
+	buildAGPVersion  string        // --agp-version
+	buildParallel    int           // --parallel
+	buildCodename    string        // --sdk-codename
+	buildHermetic    bool          // --hermetic
+	buildPGO         string        // --pgo
+	buildScript      string        // --emit-script
+	buildAssetList   string        // --asset-manifest
+	buildTmpDirPerm  int           // --tmp-dir-perm
+	buildNoAssetWarn bool          // --no-asset-warnings
+	buildComment     string        // --archive-comment
+	buildReproduce   bool          // --reproducible
+	buildNoVerifyELF bool          // --no-verify-elf
+	buildMergeJars   []string      // --merge-jars
+	buildRTxt        string        // --r-txt
+	buildRequire16KB bool          // --require-16kb
+	buildTestHarness bool          // --test-harness
+	buildAssetExts   []string      // --allowed-asset-exts
+	buildWarnExts    bool          // --warn-asset-exts
+	buildNativeKeep  bool          // --native-keep-rules
+	buildSignKey     string        // --sign-key
 )
 
 func init() {
@@ -47,6 +108,7 @@ func init() {
 	flags.StringVar(&buildLdflags, "ldflags", "", "arguments to pass on each go tool link invocation.")
 	flags.StringVar(&buildTargets, "target", "", "space separated os/arch. Valid values are: android, ios, android/arm, android/arm64, android/386, android/amd64, ios/arm, ios/arm64, ios/386, ios/amd64.")
 
+	InitCmd.AddCommand(InitAndroidCmd)
 	RootCmd.AddCommand(InitCmd)
 }
 
@@ -72,6 +134,30 @@ var InitCmd = &cobra.Command{
 	},
 }
 
+var InitAndroidCmd = &cobra.Command{
+	Use:   "android [dir]",
+	Short: "Creates a minimal Android library project",
+	Long: `Init android creates a Go module with a package, its assets directory
+and a matcha.json in dir, or the current directory, so that matcha build
+works in it straight away.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(command *cobra.Command, args []string) {
+		flags := &cmd.Flags{
+			Logger: log.New(os.Stderr, "", 0),
+			BuildN: buildN,
+			BuildX: buildX,
+			BuildV: buildV,
+		}
+		dir := "."
+		if len(args) > 0 {
+			dir = args[0]
+		}
+		if err := cmd.InitAndroidProject(dir, flags); err != nil {
+			fmt.Println(err)
+		}
+	},
+}
+
 func init() {
 	flags := BuildCmd.Flags()
 	flags.BoolVarP(&buildN, "dry-run", "n", false, "print the commands but do not run them.")
@@ -81,6 +167,64 @@ func init() {
 	flags.StringVar(&buildGcflags, "gcflags", "", "arguments to pass on each go tool compile invocation.")
 	flags.StringVar(&buildLdflags, "ldflags", "", "arguments to pass on each go tool link invocation.")
 	flags.StringVar(&buildTargets, "target", "", "space separated os/arch. Valid values are: android, ios, android/arm, android/arm64, android/386, android/amd64, ios/arm, ios/arm64, ios/386, ios/amd64.")
+	flags.BoolVar(&buildJavadoc, "javadoc", false, "write a javadoc jar next to the Android library.")
+	flags.StringVar(&buildVariant, "variant", "", "Android build variant, debug or release. Release libraries are stripped.")
+	flags.BoolVar(&buildAllVariants, "all-variants", false, "build both debug and release Android libraries in one pass.")
+	flags.BoolVar(&buildSymbols, "native-debug-symbols", false, "write the unstripped Android libraries to a native-debug-symbols.zip.")
+	flags.StringVar(&buildNDKVersion, "ndk-version", "", "fail unless the NDK's source.properties has this Pkg.Revision.")
+	flags.StringVar(&buildNDKSHA256, "ndk-sha256", "", "fail unless the NDK's source.properties and toolchain binaries have this SHA-256.")
+	flags.StringVar(&buildNDKRoot, "ndk-root", "", "NDK directory to use instead of the one in $ANDROID_HOME.")
+	flags.StringVar(&buildOutputDir, "output-dir", "", "directory to write Android artifacts to, named <package>-<variant>-<version>.aar.")
+	flags.StringVar(&buildVersion, "version", "", "version used in the names of artifacts written to --output-dir.")
+	flags.IntVar(&buildToolRetries, "tool-retries", 0, "times to retry commands that fail because the machine ran out of memory or processes.")
+	flags.BoolVar(&buildStrict, "strict-binding", false, "fail if a JNI function exported by Go has no Java native method.")
+	flags.StringVar(&buildFormFactor, "form-factor", "", "Android form factor, phone, tv or wear. Adds the uses-feature elements it requires to the manifest.")
+	flags.DurationVar(&buildTimeout, "timeout", 0, "cancel the Android build if it takes longer than this, e.g. 10m.")
+	flags.StringVar(&buildPostBuild, "post-build", "", "space separated command to run after the Android library is built, with $MATCHA_ARTIFACT set to its path.")
+	flags.StringVar(&buildKotlinc, "kotlinc", "", "path of the Kotlin compiler used for .kt sources, defaults to kotlinc in $PATH.")
+	flags.Int64Var(&buildMaxAssets, "max-asset-bytes", 0, "fail if the Android library's assets total more than this many bytes.")
+	flags.StringVar(&buildConsumer, "consumer-rules", "", "proguard rules file added to the Android library's proguard.txt, which apps apply when shrinking.")
+	flags.BoolVar(&buildLint, "lint-manifest", false, "check the generated AndroidManifest.xml before packaging it.")
+	flags.IntVar(&buildMinSDK, "min-sdk", 0, "minSdkVersion of the Android library and API level its native code is built for, defaults to 15, or the lowest API level of the NDK from r19 on.")
+	flags.IntVar(&buildTargetSDK, "target-sdk", 0, "targetSdkVersion of the Android library's manifest and lowest SDK platform to compile against, left out if unset.")
+	flags.IntSliceVar(&buildMinSDKs, "min-sdk-variants", nil, "comma separated minSdkVersions to build one Android library for each, named by level.")
+	flags.BoolVar(&buildIncremental, "incremental", false, "only recompile the Java sources that changed since the last build, and the sources that use them.")
+	flags.BoolVar(&buildEmbedVer, "embed-version", false, "add a MatchaVersion class holding --version to the Android library, with a check method for apps to call at startup.")
+	flags.BoolVar(&buildCheckSyms, "check-symbols", false, "fail before linking if two bound packages export C functions with the same name.")
+	flags.BoolVar(&buildTrace, "trace-discovery", false, "log every path checked while locating the Android SDK, NDK and javac.")
+	flags.StringSliceVar(&buildPermissions, "permissions", nil, "comma separated permissions the Android library requires, e.g. android.permission.INTERNET.")
+	flags.BoolVar(&buildSplitNative, "split-native", false, "write an Android library without native code and one <name>-native-<abi>.aar per ABI with its libraries.")
+	flags.StringSliceVar(&buildSanitizers, "sanitize", nil, "comma separated sanitizers, address or undefined, to build the native code of a debug Android library with.")
+	flags.BoolVar(&buildVerifyJar, "verify-jar", false, "load the compiled Java classes in a JVM to check they link, without a device.")
+	flags.BoolVar(&buildLock, "lock", false, "write a matcha.lock of the Go, NDK, JDK, matcha and module versions next to the Android library.")
+	flags.StringVar(&buildVerifyLock, "verify-lock", "", "fail unless the Go, NDK, JDK, matcha and module versions match this matcha.lock.")
+	flags.BoolVar(&buildMinimalRes, "minimal-res", false, "add an empty values resource to the aar, for Gradle versions that reject an empty res/.")
+	flags.StringVar(&buildVerScript, "version-script", "", "linker version script for libgojni.so, {abi} in the path is replaced by each ABI.")
+	flags.StringVar(&buildReport, "report", "", "write a build report in this format, txt or html, next to each aar.")
+	flags.BoolVar(&buildNoAssets, "no-assets", false, "leave the packages' assets out of the aar.")
+	flags.StringVar(&buildJavaVersion, "java-version", "", "Java version the Java sources are compiled for, e.g. 1.8. Defaults to 1.7, or 1.8 with Kotlin sources.")
+	flags.StringVar(&buildOverlay, "sysroot-overlay", "", "directory with include and lib/<abi> subdirectories searched before the NDK's sysroot.")
+	flags.StringVar(&buildAGPVersion, "agp-version", "", "Android Gradle plugin version the aar is built for, e.g. 7.4.2. 7.0 and later read the aar's metadata.")
+	flags.IntVar(&buildParallel, "parallel", 1, "number of assets to compress at once when packaging the aar.")
+	flags.StringVar(&buildCodename, "sdk-codename", "", "codename of a preview Android SDK platform to build against instead of the latest numbered one.")
+	flags.BoolVar(&buildHermetic, "hermetic", false, "build from read-only copies of the packages in the work directory. Requires --output-dir.")
+	flags.StringVar(&buildPGO, "pgo", "", "CPU profile to build the native libraries with profile-guided optimization. Requires Go 1.21.")
+	flags.StringVar(&buildScript, "emit-script", "", "write a shell script, or a batch file on Windows, that reproduces the build without matcha.")
+	flags.StringVar(&buildAssetList, "asset-manifest", "", "JSON file mapping source files to asset names, added to the packages' assets.")
+	flags.IntVar(&buildTmpDirPerm, "tmp-dir-perm", 0, "octal permissions of the work directory, e.g. 0750 for CI steps running as another user. Defaults to 0700.")
+	flags.BoolVar(&buildNoAssetWarn, "no-asset-warnings", false, "don't warn about assets that collide with the Android framework's assets, such as webkit/.")
+	flags.StringVar(&buildComment, "archive-comment", "", "zip comment of the Android library. Defaults to the matcha version and the build time.")
+	flags.BoolVar(&buildReproduce, "reproducible", false, "build with -trimpath, LC_ALL=C and TZ=UTC, give every asset 0644 permissions and leave timestamps out of the Android library so identical inputs produce identical files. With --lock the environment is recorded in matcha.lock.")
+	flags.BoolVar(&buildNoVerifyELF, "no-verify-elf", false, "skip checking that each native library in the Android library is built for its ABI's machine.")
+	flags.StringVar(&buildRTxt, "r-txt", "", "R.txt listing the resources of the Android library, written to it instead of an empty R.txt.")
+	flags.BoolVar(&buildRequire16KB, "require-16kb", false, "link the 64 bit native libraries for devices with 16KB pages, and fail if they aren't aligned for them.")
+	flags.BoolVar(&buildTestHarness, "test-harness", false, "also write a -test-harness.jar of the Java bindings with their native methods stubbed, for JVM unit tests.")
+	flags.StringSliceVar(&buildAssetExts, "allowed-asset-exts", nil, "comma separated extensions that assets may have, e.g. .png,.json. Other assets fail the build.")
+	flags.BoolVar(&buildWarnExts, "warn-asset-exts", false, "warn about assets with extensions outside --allowed-asset-exts instead of failing.")
+	flags.BoolVar(&buildNativeKeep, "native-keep-rules", false, "keep only the native methods and the classes looked up by JNI in the consumer proguard rules, instead of all of go.**.")
+	flags.StringVar(&buildSignKey, "sign-key", "", "PGP or minisign secret key to write a detached .asc or .sig signature of the Android library with.")
+	flags.StringSliceVar(&buildMergeJars, "merge-jars", nil, "comma separated paths of jars to merge into the Android library's classes.jar.")
+	flags.StringSliceVar(&buildFatAAR, "fat-aar", nil, "comma separated paths of aars to merge into the Android library.")
 
 	RootCmd.AddCommand(BuildCmd)
 }
@@ -99,7 +243,74 @@ var BuildCmd = &cobra.Command{
 			BuildGcflags: buildGcflags,
 			BuildLdflags: buildLdflags,
 			BuildTargets: buildTargets,
+			BuildJavadoc: buildJavadoc,
 			Threaded:     true,
+
+			BuildVariant:       buildVariant,
+			BuildAllVariants:   buildAllVariants,
+			NativeDebugSymbols: buildSymbols,
+			NDKVersion:         buildNDKVersion,
+			NDKSHA256:          buildNDKSHA256,
+			NDKRoot:            buildNDKRoot,
+			FatAAR:             buildFatAAR,
+			MergeJars:          buildMergeJars,
+			LintManifest:       buildLint,
+			OutputDir:          buildOutputDir,
+			Version:            buildVersion,
+			ToolRetries:        buildToolRetries,
+			StrictBinding:      buildStrict,
+			FormFactor:         buildFormFactor,
+			Timeout:            buildTimeout,
+			PostBuild:          strings.Fields(buildPostBuild),
+			KotlincPath:        buildKotlinc,
+			MaxAssetBytes:      buildMaxAssets,
+			ConsumerRules:      buildConsumer,
+			MinSDK:             buildMinSDK,
+			TargetSDK:          buildTargetSDK,
+			MinSDKVariants:     buildMinSDKs,
+			Incremental:        buildIncremental,
+			EmbedVersion:       buildEmbedVer,
+			CheckSymbols:       buildCheckSyms,
+			TraceDiscovery:     buildTrace,
+			Permissions:        buildPermissions,
+			SplitNative:        buildSplitNative,
+			Sanitizers:         buildSanitizers,
+			VerifyJar:          buildVerifyJar,
+			Lock:               buildLock,
+			VerifyLock:         buildVerifyLock,
+			MinimalRes:         buildMinimalRes,
+			VersionScript:      buildVerScript,
+			Report:             buildReport,
+			NoAssets:           buildNoAssets,
+			JavaVersion:        buildJavaVersion,
+			SysrootOverlay:     buildOverlay,
+			AGPVersion:         buildAGPVersion,
+			Parallel:           buildParallel,
+			SDKCodename:        buildCodename,
+			Hermetic:           buildHermetic,
+			PGOProfile:         buildPGO,
+			EmitScript:         buildScript,
+			AssetManifest:      buildAssetList,
+			TmpDirPerm:         os.FileMode(buildTmpDirPerm),
+			NoAssetWarnings:    buildNoAssetWarn,
+			ArchiveComment:     buildComment,
+			Reproducible:       buildReproduce,
+			NoVerifyELF:        buildNoVerifyELF,
+			RTxt:               buildRTxt,
+			Require16KB:        buildRequire16KB,
+			TestHarness:        buildTestHarness,
+			AllowedAssetExts:   buildAssetExts,
+			WarnAssetExts:      buildWarnExts,
+			NativeKeepRules:    buildNativeKeep,
+			SignKey:            buildSignKey,
+		}
+		config, err := cmd.ReadProjectConfig(".")
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if config != nil {
+			args = config.Apply(flags, args)
 		}
 		if err := cmd.Build(flags, args); err != nil {
 			fmt.Println(err)
@@ -107,6 +318,124 @@ var BuildCmd = &cobra.Command{
 	},
 }
 
+func init() {
+	flags := VerifyCmd.Flags()
+	flags.BoolVarP(&buildN, "dry-run", "n", false, "print the commands but do not run them.")
+	flags.BoolVarP(&buildX, "trace", "x", false, "print the commands.")
+	flags.BoolVarP(&buildV, "verbose", "v", false, "print the logs verbosely.")
+	flags.BoolVar(&buildWork, "work", false, "print the name of the temporary work directory and do not delete it when exiting.")
+	flags.StringVar(&buildGcflags, "gcflags", "", "arguments to pass on each go tool compile invocation.")
+	flags.StringVar(&buildLdflags, "ldflags", "", "arguments to pass on each go tool link invocation.")
+	flags.IntVar(&buildMinSDK, "min-sdk", 0, "minSdkVersion of the Android library and API level its native code is built for, defaults to 15, or the lowest API level of the NDK from r19 on.")
+	flags.IntVar(&buildTargetSDK, "target-sdk", 0, "targetSdkVersion of the Android library's manifest and lowest SDK platform to compile against, left out if unset.")
+	flags.BoolVar(&buildTrace, "trace-discovery", false, "log every path checked while locating the Android SDK, NDK and javac.")
+
+	RootCmd.AddCommand(VerifyCmd)
+}
+
+var VerifyCmd = &cobra.Command{
+	Use:   "verify [package]",
+	Short: "Checks that the Android library loads in a sample app on a connected device",
+	Long: `Verify builds the Android library, packages it into a sample app that
+calls into Go and runs the app on the device or emulator connected with adb.
+The Android SDK build-tools and platform-tools must be installed.`,
+	Run: func(command *cobra.Command, args []string) {
+		flags := &cmd.Flags{
+			Logger:         log.New(os.Stderr, "", 0),
+			BuildN:         buildN,
+			BuildX:         buildX,
+			BuildV:         buildV,
+			BuildWork:      buildWork,
+			BuildGcflags:   buildGcflags,
+			BuildLdflags:   buildLdflags,
+			Threaded:       true,
+			MinSDK:         buildMinSDK,
+			TargetSDK:      buildTargetSDK,
+			TraceDiscovery: buildTrace,
+		}
+		if err := cmd.Verify(flags, args); err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Println("ok")
+	},
+}
+
+func init() {
+	AARCmd.AddCommand(AARDiffCmd)
+	AARCmd.AddCommand(AARABIsCmd)
+	AARCmd.AddCommand(AARGoldenCmd)
+	AARCmd.AddCommand(AARManifestCmd)
+	RootCmd.AddCommand(AARCmd)
+}
+
+var AARCmd = &cobra.Command{
+	Use:   "aar",
+	Short: "Inspect Android libraries built by Matcha",
+	Long:  ``,
+}
+
+var AARDiffCmd = &cobra.Command{
+	Use:   "diff <old.aar> <new.aar>",
+	Short: "Lists the entries that differ between two Android libraries",
+	Long:  ``,
+	Args:  cobra.ExactArgs(2),
+	Run: func(command *cobra.Command, args []string) {
+		diff, err := cmd.DiffAAR(args[0], args[1])
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Print(diff)
+	},
+}
+
+var AARABIsCmd = &cobra.Command{
+	Use:   "abis <file.aar>",
+	Short: "Lists the ABIs with native libraries in an Android library",
+	Long:  ``,
+	Args:  cobra.ExactArgs(1),
+	Run: func(command *cobra.Command, args []string) {
+		abis, err := cmd.AARABIs(args[0])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		for _, i := range abis {
+			fmt.Println(i)
+		}
+	},
+}
+
+var AARGoldenCmd = &cobra.Command{
+	Use:   "golden <file.aar> <golden.txt>",
+	Short: "Checks that an Android library has the entries listed in a golden file",
+	Long:  ``,
+	Args:  cobra.ExactArgs(2),
+	Run: func(command *cobra.Command, args []string) {
+		if err := cmd.VerifyAARAgainstGolden(args[0], args[1]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println("ok")
+	},
+}
+
+var AARManifestCmd = &cobra.Command{
+	Use:   "manifest <file.aar>",
+	Short: "Prints the AndroidManifest.xml of an Android library",
+	Long:  ``,
+	Args:  cobra.ExactArgs(1),
+	Run: func(command *cobra.Command, args []string) {
+		manifest, err := cmd.ReadAARManifest(args[0])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Print(manifest)
+	},
+}
+
 /*
 func init() {
 	flags := InstallCmd.Flags()
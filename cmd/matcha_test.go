@@ -0,0 +1,173 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	for _, i := range []*Flags{
+		{},
+		{BuildAllVariants: true, NoAssets: true},
+		{MinSDKVariants: []int{16, 21}, BuildMode: "c-archive"},
+		{Sanitizers: []string{"address"}, BuildVariant: "debug", EmbedVersion: true, Version: "1.0.0"},
+		{MinSDK: 21, MinSDKPerABI: map[string]int{"arm64-v8a": 24, "x86_64": 21}},
+		{MinSDK: 21, TargetSDK: 21},
+		{MinSDKVariants: []int{16, 21}, TargetSDK: 34},
+		{ExtraAARFiles: map[string]string{"lint.jar": "build/lint.jar", "META-INF/vendor.properties": "vendor.properties"}},
+	} {
+		if err := i.Validate(); err != nil {
+			t.Errorf("Validate(%+v) = %v", i, err)
+		}
+	}
+
+	for _, i := range []struct {
+		flags    *Flags
+		problems []string
+	}{
+		{&Flags{NoAssets: true, AssetPrefix: "web", MaxAssetBytes: 10}, []string{"asset prefix", "limit on the size of assets"}},
+		{&Flags{BuildAllVariants: true, BuildVariant: "release"}, []string{"release variant"}},
+		{&Flags{MinSDK: 21, MinSDKVariants: []int{16}}, []string{"min SDK 21"}},
+		{&Flags{MinSDK: 21, TargetSDK: 19}, []string{"target SDK 19 is below the min SDK"}},
+		{&Flags{MinSDKVariants: []int{16, 24}, TargetSDK: 21}, []string{"min SDK variant 24"}},
+		{&Flags{BuildMode: "c-archive", SplitNative: true, ExportedSymbols: []string{"a"}, VersionScript: "a.map"}, []string{
+			"exported symbols cannot be combined with a version script",
+			"exported symbols are only supported",
+			"version scripts are only supported",
+			"splitting native libraries",
+		}},
+		{&Flags{Sanitizers: []string{"address"}, BuildAllVariants: true}, []string{"sanitizers can only be used in debug builds"}},
+		{&Flags{EmbedVersion: true}, []string{"requires a version"}},
+		{&Flags{WarnAssetExts: true}, []string{"requires allowed asset extensions"}},
+		{&Flags{MinSDK: 21, MinSDKPerABI: map[string]int{"arm64": 24, "x86_64": 16}}, []string{"unknown ABIs [arm64]", "min SDK 16 for x86_64"}},
+		{&Flags{MinSDKVariants: []int{16, 24}, MinSDKPerABI: map[string]int{"arm64-v8a": 21}}, []string{"min SDK variant 24"}},
+		{&Flags{ExtraAARFiles: map[string]string{"/lint.jar": "a", "../lint.jar": "b", "a/./b": "c", ".": "e", "ok.txt": "d"}}, []string{`"/lint.jar"`, `"../lint.jar"`, `"a/./b"`, `"."`}},
+	} {
+		err := i.flags.Validate()
+		if err == nil {
+			t.Errorf("Validate(%+v) returned no error", i.flags)
+			continue
+		}
+		if n := strings.Count(err.Error(), "\n\t"); n != len(i.problems) {
+			t.Errorf("Expected %d problems, got %d:\n%v", len(i.problems), n, err)
+		}
+		for _, j := range i.problems {
+			if !strings.Contains(err.Error(), j) {
+				t.Errorf("Error is missing %q:\n%v", j, err)
+			}
+		}
+	}
+}
+
+func TestWarnf(t *testing.T) {
+	// Callers that only build may leave the logger unset.
+	(&Flags{}).warnf("%s is unset", "Logger")
+	(&Flags{TraceDiscovery: true}).tracef("%s is unset", "Logger")
+
+	buf := &strings.Builder{}
+	f := &Flags{Logger: log.New(buf, "", 0)}
+	f.warnf("%s is set", "Logger")
+	if buf.String() != "warning: Logger is set\n" {
+		t.Errorf("Unexpected warning %q", buf.String())
+	}
+}
+
+func TestGoMinorVersion(t *testing.T) {
+	for ver, want := range map[string]int{
+		"go version go1.21.3 linux/amd64":  21,
+		"go version go1.20 darwin/arm64":   20,
+		"go version go1.22rc1 linux/amd64": 22,
+		"go version devel go1.23-abc Thu":  -1,
+		"go version goX.X.X x/x":           -1,
+	} {
+		minor, ok := goMinorVersion([]byte(ver))
+		if want == -1 && ok || want != -1 && (!ok || minor != want) {
+			t.Errorf("goMinorVersion(%q) = %v, %v, expected %v", ver, minor, ok, want)
+		}
+	}
+
+	if _, err := pgoProfile(&Flags{PGOProfile: "does-not-exist.pgo"}); err == nil {
+		t.Error("Expected error for a missing PGO profile")
+	}
+}
+
+func TestResolvePackages(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go is not installed")
+	}
+	dir, err := ioutil.TempDir("", "matcha-resolve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"go.mod":           "module example.com/lib\n",
+		"lib.go":           "package lib\n",
+		"a/a.go":           "package a\n",
+		"b/b.go":           "// +build matcha\n\npackage b\n",
+		"cmd/tool/main.go": "package main\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	go111module := os.Getenv("GO111MODULE")
+	os.Setenv("GO111MODULE", "on")
+	defer os.Setenv("GO111MODULE", go111module)
+
+	f := &Flags{Logger: log.New(ioutil.Discard, "", 0)}
+	pkgs, err := ResolvePackages([]string{"./a", "./b", "example.com/lib"}, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := []string{}
+	for _, i := range pkgs {
+		paths = append(paths, i.ImportPath)
+	}
+	if expected := []string{"example.com/lib/a", "example.com/lib/b", "example.com/lib"}; !reflect.DeepEqual(paths, expected) {
+		t.Errorf("ResolvePackages() = %v, expected %v", paths, expected)
+	}
+
+	// The main package is skipped under a wildcard, but not when named.
+	pkgs, err = ResolvePackages([]string{"./..."}, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths = []string{}
+	for _, i := range pkgs {
+		paths = append(paths, i.ImportPath)
+	}
+	if expected := []string{"example.com/lib", "example.com/lib/a", "example.com/lib/b"}; !reflect.DeepEqual(paths, expected) {
+		t.Errorf("ResolvePackages(./...) = %v, expected %v", paths, expected)
+	}
+	if _, err := ResolvePackages([]string{"./...", "./cmd/tool"}, f); err == nil || !strings.Contains(err.Error(), "'main' package") {
+		t.Errorf("Expected error for a main package, got %v", err)
+	}
+	if _, err := ResolvePackages([]string{"./a/..."}, f); err != nil {
+		t.Error(err)
+	}
+	if _, err := ResolvePackages([]string{"example.com/lib/c/..."}, f); err == nil || !strings.Contains(err.Error(), "no packages") {
+		t.Errorf("Expected error for no matching packages, got %v", err)
+	}
+}
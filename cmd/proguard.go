@@ -0,0 +1,321 @@
+package cmd
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"go/build"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// nativeKeepRules returns the consumer proguard rules used instead of keeping
+// all of go.** when Flags.NativeKeepRules is set. They keep the bridge
+// classes in io.gomatcha.bridge, whose methods the bridge calls from C on
+// objects it is handed, the native methods of the classes in classesDir and
+// f.MergeJars, which the VM binds to libgojni.so by name, and the classes and
+// methods the C sources of pkgs and the bridge look up with FindClass and
+// GetMethodID, so everything else can be shrunk.
+func nativeKeepRules(f *Flags, classesDir string, pkgs []*build.Package) ([]byte, error) {
+	if !f.ShouldRun() {
+		return nil, nil
+	}
+	natives := map[string][]string{}
+	err := filepath.Walk(classesDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || filepath.Ext(path) != ".class" {
+			return err
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return addNativeMethods(natives, path, data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range f.MergeJars {
+		r, err := zip.OpenReader(i)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range r.File {
+			if !strings.HasSuffix(file.Name, ".class") {
+				continue
+			}
+			data, err := readZipFile(file)
+			if err == nil {
+				err = addNativeMethods(natives, i+"!"+file.Name, data)
+			}
+			if err != nil {
+				r.Close()
+				return nil, err
+			}
+		}
+		r.Close()
+	}
+
+	bridge, err := bridgePackage(pkgs)
+	if err != nil {
+		return nil, err
+	}
+	found, methods, err := jniReferences(append(append([]*build.Package{}, pkgs...), bridge...))
+	if err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteString("-keep class io.gomatcha.bridge.** { *; }\n")
+	classes := make([]string, 0, len(natives))
+	for k := range natives {
+		classes = append(classes, k)
+	}
+	sort.Strings(classes)
+	for _, class := range classes {
+		fmt.Fprintf(buf, "-keep class %s {\n", class)
+		for _, i := range natives[class] {
+			fmt.Fprintf(buf, "    native %s;\n", i)
+		}
+		buf.WriteString("}\n")
+	}
+	for _, class := range found {
+		fmt.Fprintf(buf, "-keep class %s { *; }\n", class)
+	}
+	if len(methods) > 0 {
+		buf.WriteString("-keepclassmembers class * {\n")
+		for _, i := range methods {
+			fmt.Fprintf(buf, "    %s;\n", i)
+		}
+		buf.WriteString("}\n")
+	}
+	return buf.Bytes(), nil
+}
+
+// bridgePackage returns gomatcha.io/matcha/bridge as built for android,
+// unless it is in pkgs already.
+func bridgePackage(pkgs []*build.Package) ([]*build.Package, error) {
+	const path = "gomatcha.io/matcha/bridge"
+	for _, i := range pkgs {
+		if i.ImportPath == path {
+			return nil, nil
+		}
+	}
+	ctx := build.Default
+	ctx.GOOS = "android"
+	ctx.GOARCH = "arm64"
+	ctx.CgoEnabled = true
+	ctx.BuildTags = append(ctx.BuildTags, "matcha")
+	pkg, err := ctx.Import(path, "", 0)
+	if err != nil {
+		return nil, err
+	}
+	return []*build.Package{pkg}, nil
+}
+
+// addNativeMethods adds the native methods of the class file data to
+// natives, keyed by the class name and formatted as proguard member
+// specifications, e.g. long matchaGoBool(boolean).
+func addNativeMethods(natives map[string][]string, path string, data []byte) error {
+	class, methods, err := classNativeMethods(data)
+	if err != nil {
+		return fmt.Errorf("reading %s: %v", path, err)
+	}
+	if len(methods) > 0 {
+		natives[class] = append(natives[class], methods...)
+	}
+	return nil
+}
+
+// classNativeMethods returns the name of the class in the class file data and
+// its native methods as proguard member specifications.
+func classNativeMethods(data []byte) (class string, methods []string, err error) {
+	r := &classReader{data: data}
+	if r.u4() != 0xcafebabe {
+		return "", nil, errors.New("not a class file")
+	}
+	r.u2() // minor_version
+	r.u2() // major_version
+
+	count := int(r.u2())
+	utf8 := make(map[int]string, count)
+	classes := map[int]int{}
+	for i := 1; i < count && r.err == nil; i++ {
+		switch tag := r.u1(); tag {
+		case 1: // Utf8
+			utf8[i] = string(r.bytes(int(r.u2())))
+		case 7: // Class
+			classes[i] = int(r.u2())
+		case 8, 16, 19, 20: // String, MethodType, Module, Package
+			r.u2()
+		case 15: // MethodHandle
+			r.bytes(3)
+		case 3, 4, 9, 10, 11, 12, 17, 18: // Integer, Float, refs, NameAndType, Dynamic, InvokeDynamic
+			r.u4()
+		case 5, 6: // Long and Double take two entries
+			r.bytes(8)
+			i++
+		default:
+			return "", nil, fmt.Errorf("unknown constant pool tag %d", tag)
+		}
+	}
+	r.u2() // access_flags
+	class = strings.Replace(utf8[classes[int(r.u2())]], "/", ".", -1)
+	r.u2()                   // super_class
+	r.bytes(int(r.u2()) * 2) // interfaces
+
+	skipMembers := func() {
+		for n := int(r.u2()); n > 0 && r.err == nil; n-- {
+			r.bytes(6)
+			r.skipAttributes()
+		}
+	}
+	skipMembers() // fields
+
+	const accNative = 0x0100
+	for n := int(r.u2()); n > 0 && r.err == nil; n-- {
+		access, name, desc := r.u2(), utf8[int(r.u2())], utf8[int(r.u2())]
+		r.skipAttributes()
+		if access&accNative == 0 {
+			continue
+		}
+		spec, err := proguardMethod(name, desc)
+		if err != nil {
+			return "", nil, err
+		}
+		methods = append(methods, spec)
+	}
+	if r.err != nil {
+		return "", nil, r.err
+	}
+	if class == "" {
+		return "", nil, errors.New("class file has no class name")
+	}
+	return class, methods, nil
+}
+
+// classReader reads the big endian values of a class file, recording an
+// error instead of panicking when the data is truncated.
+type classReader struct {
+	data []byte
+	err  error
+}
+
+func (r *classReader) bytes(n int) []byte {
+	if r.err != nil || n > len(r.data) {
+		r.err = errors.New("truncated class file")
+		return make([]byte, n)
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *classReader) u1() byte   { return r.bytes(1)[0] }
+func (r *classReader) u2() uint16 { return binary.BigEndian.Uint16(r.bytes(2)) }
+func (r *classReader) u4() uint32 { return binary.BigEndian.Uint32(r.bytes(4)) }
+
+func (r *classReader) skipAttributes() {
+	for n := int(r.u2()); n > 0 && r.err == nil; n-- {
+		r.u2()
+		r.bytes(int(r.u4()))
+	}
+}
+
+// proguardMethod formats the method name with the descriptor desc, e.g.
+// (JLjava/lang/String;)[J, as a proguard member specification, e.g.
+// long[] name(long,java.lang.String).
+func proguardMethod(name, desc string) (string, error) {
+	if !strings.HasPrefix(desc, "(") {
+		return "", fmt.Errorf("invalid method descriptor %q", desc)
+	}
+	rest := desc[1:]
+	params := []string{}
+	for !strings.HasPrefix(rest, ")") {
+		typ, next, err := proguardType(rest)
+		if err != nil {
+			return "", fmt.Errorf("invalid method descriptor %q", desc)
+		}
+		params = append(params, typ)
+		rest = next
+	}
+	ret, next, err := proguardType(rest[1:])
+	if err != nil || next != "" {
+		return "", fmt.Errorf("invalid method descriptor %q", desc)
+	}
+	return fmt.Sprintf("%s %s(%s)", ret, name, strings.Join(params, ",")), nil
+}
+
+// proguardType returns the java type of the field descriptor at the start of
+// desc and the rest of desc.
+func proguardType(desc string) (typ, rest string, err error) {
+	if desc == "" {
+		return "", "", errors.New("empty descriptor")
+	}
+	primitives := map[byte]string{'B': "byte", 'C': "char", 'D': "double", 'F': "float", 'I': "int", 'J': "long", 'S': "short", 'Z': "boolean", 'V': "void"}
+	switch c := desc[0]; {
+	case primitives[c] != "":
+		return primitives[c], desc[1:], nil
+	case c == '[':
+		elem, rest, err := proguardType(desc[1:])
+		return elem + "[]", rest, err
+	case c == 'L':
+		end := strings.IndexByte(desc, ';')
+		if end < 0 {
+			return "", "", errors.New("unterminated class descriptor")
+		}
+		return strings.Replace(desc[1:end], "/", ".", -1), desc[end+1:], nil
+	}
+	return "", "", fmt.Errorf("invalid descriptor %q", desc)
+}
+
+var (
+	findClassRe   = regexp.MustCompile(`FindClass\s*\([^"]*"([\w/$]+)"`)
+	getMethodIDRe = regexp.MustCompile(`Get(?:Static)?MethodID\s*\([^"]*"([\w<>$]+)"\s*,\s*"([^"]+)"`)
+)
+
+// jniReferences returns the sorted names of the classes that the C sources
+// and cgo files of pkgs look up by name with FindClass, and the methods they
+// look up with GetMethodID or GetStaticMethodID as proguard member
+// specifications. The class of a method is often that of an object passed in
+// from Java, so the methods are kept in whichever class declares them.
+func jniReferences(pkgs []*build.Package) (classes, methods []string, err error) {
+	seen := map[string]bool{}
+	for _, pkg := range pkgs {
+		files := append(append(append([]string{}, pkg.CFiles...), pkg.HFiles...), pkg.CgoFiles...)
+		for _, i := range files {
+			data, err := ioutil.ReadFile(filepath.Join(pkg.Dir, i))
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, m := range findClassRe.FindAllSubmatch(data, -1) {
+				class := strings.Replace(string(m[1]), "/", ".", -1)
+				if !seen["class "+class] {
+					seen["class "+class] = true
+					classes = append(classes, class)
+				}
+			}
+			for _, m := range getMethodIDRe.FindAllSubmatch(data, -1) {
+				spec, err := proguardMethod(string(m[1]), string(m[2]))
+				if err != nil {
+					return nil, nil, fmt.Errorf("%s: %v", filepath.Join(pkg.Dir, i), err)
+				}
+				if string(m[1]) == "<init>" {
+					spec = strings.TrimPrefix(spec, "void ")
+				}
+				if !seen[spec] {
+					seen[spec] = true
+					methods = append(methods, spec)
+				}
+			}
+		}
+	}
+	sort.Strings(classes)
+	sort.Strings(methods)
+	return classes, methods, nil
+}
@@ -0,0 +1,150 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"go/build"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testClassFile returns a class file for class with methods, each a name, a
+// descriptor and access flags.
+func testClassFile(class string, methods [][3]interface{}) []byte {
+	buf := &bytes.Buffer{}
+	w := func(v interface{}) { binary.Write(buf, binary.BigEndian, v) }
+	utf8 := func(s string) {
+		w(uint8(1))
+		w(uint16(len(s)))
+		buf.WriteString(s)
+	}
+
+	w(uint32(0xcafebabe))
+	w(uint16(0))
+	w(uint16(52))
+	w(uint16(7 + 2*len(methods))) // constant_pool_count
+	utf8(class)                   // 1
+	w(uint8(7))                   // 2: Class
+	w(uint16(1))
+	utf8("java/lang/Object") // 3
+	w(uint8(7))              // 4: Class
+	w(uint16(3))
+	w(uint8(5)) // 5 and 6: Long
+	w(uint64(1))
+	for _, i := range methods {
+		utf8(i[0].(string))
+		utf8(i[1].(string))
+	}
+	w(uint16(0x0021)) // access_flags
+	w(uint16(2))      // this_class
+	w(uint16(4))      // super_class
+	w(uint16(0))      // interfaces_count
+	w(uint16(0))      // fields_count
+	w(uint16(len(methods)))
+	for n, i := range methods {
+		w(uint16(i[2].(int)))
+		w(uint16(7 + 2*n))
+		w(uint16(8 + 2*n))
+		w(uint16(1)) // attributes_count
+		w(uint16(0))
+		w(uint32(2))
+		w(uint16(0))
+	}
+	w(uint16(0)) // attributes_count
+	return buf.Bytes()
+}
+
+func TestNativeKeepRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matcha-proguard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	classes := filepath.Join(dir, "classes")
+	files := map[string][]byte{
+		"io/gomatcha/bridge/GoValue.class": testClassFile("io/gomatcha/bridge/GoValue", [][3]interface{}{
+			{"matchaGoBool", "(Z)J", 0x010a},
+			{"matchaGoCall", "(JLjava/lang/String;[J)[J", 0x010a},
+			{"toLong", "()J", 0x0001},
+		}),
+		"go/example/BuildConfig.class": testClassFile("go/example/BuildConfig", [][3]interface{}{
+			{"<init>", "()V", 0x0001},
+		}),
+	}
+	for name, data := range files {
+		path := filepath.Join(classes, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pkgDir := filepath.Join(dir, "bridge")
+	if err := os.MkdirAll(pkgDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	src := "jclass d = (*env)->FindClass(env, \"java/util/Map$Entry\");\njmethodID m = (*env)->GetMethodID(env, d, \"getKey\", \"()Ljava/lang/Object;\");\n"
+	if err := ioutil.WriteFile(filepath.Join(pkgDir, "example.c"), []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f := &Flags{Logger: log.New(ioutil.Discard, "", 0)}
+	pkgs := []*build.Package{{Dir: pkgDir, CFiles: []string{"example.c"}}}
+	rules, err := nativeKeepRules(f, classes, pkgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `-keep class io.gomatcha.bridge.** { *; }
+-keep class io.gomatcha.bridge.GoValue {
+    native long matchaGoBool(boolean);
+    native long[] matchaGoCall(long,java.lang.String,long[]);
+}
+-keep class java.util.Map$Entry { *; }
+-keepclassmembers class * {
+`
+	if !strings.HasPrefix(string(rules), expected) {
+		t.Errorf("Unexpected rules:\n%s", rules)
+	}
+
+	// The bridge looks up the methods of the Tracker it is passed with
+	// GetMethodID, see bridge/java-foreign.c.
+	for _, i := range []string{
+		"    java.lang.Object getKey();\n",
+		"    long foreignNil();\n",
+		"    long foreignCall(long,java.lang.String,long[]);\n",
+		"    void untrack(long);\n",
+	} {
+		if !strings.Contains(string(rules), i) {
+			t.Errorf("Rules are missing %q:\n%s", i, rules)
+		}
+	}
+
+	if _, _, err := classNativeMethods(files["go/example/BuildConfig.class"][:40]); err == nil {
+		t.Error("Expected error for a truncated class file")
+	}
+}
+
+func TestProguardMethod(t *testing.T) {
+	for _, i := range []struct {
+		name, desc, expected string
+	}{
+		{"init", "()V", "void init()"},
+		{"bytes", "([BI)[[Ljava/lang/Object;", "java.lang.Object[][] bytes(byte[],int)"},
+		{"misc", "(CDFSZ)Z", "boolean misc(char,double,float,short,boolean)"},
+	} {
+		if spec, err := proguardMethod(i.name, i.desc); err != nil || spec != i.expected {
+			t.Errorf("proguardMethod(%q, %q) = %q, %v", i.name, i.desc, spec, err)
+		}
+	}
+	for _, i := range []string{"", "V", "(L", "(X)V", "()", "()VV"} {
+		if _, err := proguardMethod("m", i); err == nil {
+			t.Errorf("Expected error for descriptor %q", i)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// InitAndroidProject creates a minimal project in dir that BuildAAR can
+// build: a Go module with a package with a sample function, empty assets,
+// src/main/java and src/main/jniLibs directories, and a matcha.json binding
+// the package for android with a min SDK of projectMinSDK. The module
+// path is dir's path in $GOPATH/src, or example.com/ followed by its base
+// name outside of one, to be replaced by where the module is published. It
+// is an error for dir to already have a matcha.json.
+func InitAndroidProject(dir string, f *Flags) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	configPath := filepath.Join(dir, ProjectConfigFile)
+	if _, err := os.Stat(configPath); err == nil {
+		return fmt.Errorf("%s already exists", configPath)
+	}
+
+	importPath := projectImportPath(f, dir)
+	name := projectPackageName(filepath.Base(dir))
+	for _, i := range []string{"assets", "src/main/java", "src/main/jniLibs"} {
+		if err := Mkdir(f, filepath.Join(dir, filepath.FromSlash(i))); err != nil {
+			return err
+		}
+	}
+
+	gomod := fmt.Sprintf(projectGoModFmt, importPath)
+	if err := WriteFile(f, filepath.Join(dir, "go.mod"), strings.NewReader(gomod)); err != nil {
+		return err
+	}
+	src := fmt.Sprintf(projectSourceFmt, name, name)
+	if err := WriteFile(f, filepath.Join(dir, name+".go"), strings.NewReader(src)); err != nil {
+		return err
+	}
+
+	pkgJSON, err := json.Marshal(importPath)
+	if err != nil {
+		return err
+	}
+	config := fmt.Sprintf(projectConfigFmt, pkgJSON, projectMinSDK)
+	return WriteFile(f, configPath, strings.NewReader(config))
+}
+
+// projectMinSDK is the min SDK of new projects, the lowest API level that
+// every unified NDK, r19 and later, supports for all the default arches.
+const projectMinSDK = 21
+
+const projectConfigFmt = `{
+	"packages": [%s],
+	"targets": ["android"],
+	"minSdk": %d,
+	"variant": "debug"
+}
+`
+
+const projectGoModFmt = `module %s
+
+go 1.16
+`
+
+const projectSourceFmt = `// Package %s is bound into an android library by matcha build.
+package %s
+
+// Hello returns a greeting for name.
+func Hello(name string) string {
+	return "Hello, " + name
+}
+`
+
+// projectImportPath returns the import path of the package in dir, its path
+// relative to the src directory of a GOPATH entry or its base name under
+// example.com.
+func projectImportPath(f *Flags, dir string) string {
+	for _, i := range filepath.SplitList(GoEnv(f, "GOPATH")) {
+		rel, err := filepath.Rel(filepath.Join(i, "src"), dir)
+		if err == nil && rel != "." && !strings.HasPrefix(rel, "..") {
+			return filepath.ToSlash(rel)
+		}
+	}
+	return "example.com/" + filepath.Base(dir)
+}
+
+// projectPackageName returns a valid Go package name for a directory called
+// base, keeping only its lower case letters and digits.
+func projectPackageName(base string) string {
+	name := strings.Map(func(r rune) rune {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, base)
+	if name == "" || unicode.IsDigit(rune(name[0])) {
+		name = "app" + name
+	}
+	return name
+}
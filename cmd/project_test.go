@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"go/build"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestInitAndroidProject(t *testing.T) {
+	gopath, err := ioutil.TempDir("", "matcha-project")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(gopath)
+
+	oldGopath := os.Getenv("GOPATH")
+	os.Setenv("GOPATH", gopath)
+	defer os.Setenv("GOPATH", oldGopath)
+
+	dir := filepath.Join(gopath, "src", "example.com", "My-App")
+	f := &Flags{Logger: log.New(ioutil.Discard, "", 0)}
+	if err := InitAndroidProject(dir, f); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, i := range []string{"assets", "src/main/java", "src/main/jniLibs"} {
+		if fi, err := os.Stat(filepath.Join(dir, filepath.FromSlash(i))); err != nil || !fi.IsDir() {
+			t.Errorf("Missing %s directory: %v", i, err)
+		}
+	}
+	if gomod, err := ioutil.ReadFile(filepath.Join(dir, "go.mod")); err != nil || !strings.HasPrefix(string(gomod), "module example.com/My-App\n") {
+		t.Errorf("Unexpected go.mod %q, %v", gomod, err)
+	}
+	pkg, err := build.ImportDir(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkg.Name != "myapp" {
+		t.Errorf("Package name %v, expected myapp", pkg.Name)
+	}
+
+	config, err := ReadProjectConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config.Packages, []string{"example.com/My-App"}) || !reflect.DeepEqual(config.Targets, []string{"android"}) {
+		t.Errorf("Unexpected config %+v", config)
+	}
+	// The min SDK must build with the oldest API levels of current NDKs.
+	for _, revision := range []int{19, 25, 26} {
+		if config.MinSDK < minUnifiedNDKAPI(revision) {
+			t.Errorf("Min SDK %d is below the lowest API level of NDK r%d", config.MinSDK, revision)
+		}
+	}
+
+	if err := InitAndroidProject(dir, f); err == nil {
+		t.Error("Expected error for an existing project")
+	}
+
+	// Outside of GOPATH the module gets a placeholder domain.
+	if p := projectImportPath(f, filepath.Join(os.TempDir(), "My-App")); p != "example.com/My-App" {
+		t.Errorf("projectImportPath() outside of GOPATH = %v", p)
+	}
+}
+
+func TestProjectPackageName(t *testing.T) {
+	for base, want := range map[string]string{
+		"app":      "app",
+		"My-App":   "myapp",
+		"2048":     "app2048",
+		"--":       "app",
+		"héllo_v2": "hllov2",
+	} {
+		if got := projectPackageName(base); got != want {
+			t.Errorf("projectPackageName(%q) = %v, expected %v", base, got, want)
+		}
+	}
+}
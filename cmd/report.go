@@ -0,0 +1,142 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// ReportPath returns the path of the build report in format, txt or html,
+// written next to aarPath.
+func ReportPath(aarPath, format string) string {
+	return strings.TrimSuffix(aarPath, ".aar") + "-build-report." + format
+}
+
+// checkReportFormat returns an error if format is not a supported format of
+// build reports.
+func checkReportFormat(format string) error {
+	switch format {
+	case "txt", "html":
+		return nil
+	}
+	return fmt.Errorf("invalid report format %q, valid values are txt and html", format)
+}
+
+// reportData is the data of the report templates.
+type reportData struct {
+	*BuildResult
+	Lock *Lock
+	Libs []reportLib
+}
+
+// reportLib is the native library of an ABI in a report.
+type reportLib struct {
+	ABI          string
+	Size         int64
+	Registration string
+}
+
+func (d reportData) Total() time.Duration {
+	total := time.Duration(0)
+	for _, i := range d.Phases {
+		total += i.Duration
+	}
+	return total
+}
+
+const textReport = `Matcha build report
+
+AAR:      {{.AARPath}}
+Size:     {{.Size}} bytes
+ABIs:     {{join .ABIs ", "}}
+Assets:   {{.Assets}} files, {{.AssetBytes}} bytes
+
+Native libraries:
+{{- range .Libs}}
+  {{printf "%-12s" .ABI}} {{.Size}} bytes, {{.Registration}} JNI registration
+{{- end}}
+{{with .Lock}}
+Versions:
+  matcha  {{.Matcha}}
+  go      {{.Go}}
+  ndk     {{.NDK}}
+  jdk     {{.JDK}}
+{{end}}
+Phases:
+{{- range .Phases}}
+  {{printf "%-8s" .Name}} {{.Duration}}
+{{- end}}
+  total    {{.Total}}
+`
+
+const htmlReport = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Matcha build report</title></head>
+<body>
+<h1>Matcha build report</h1>
+<table>
+<tr><th>AAR</th><td>{{.AARPath}}</td></tr>
+<tr><th>Size</th><td>{{.Size}} bytes</td></tr>
+<tr><th>ABIs</th><td>{{join .ABIs ", "}}</td></tr>
+<tr><th>Assets</th><td>{{.Assets}} files, {{.AssetBytes}} bytes</td></tr>
+</table>
+<h2>Native libraries</h2>
+<table>
+<tr><th>ABI</th><th>Size</th><th>JNI registration</th></tr>
+{{- range .Libs}}
+<tr><td>{{.ABI}}</td><td>{{.Size}} bytes</td><td>{{.Registration}}</td></tr>
+{{- end}}
+</table>
+{{- with .Lock}}
+<h2>Versions</h2>
+<table>
+<tr><th>matcha</th><td>{{.Matcha}}</td></tr>
+<tr><th>go</th><td>{{.Go}}</td></tr>
+<tr><th>ndk</th><td>{{.NDK}}</td></tr>
+<tr><th>jdk</th><td>{{.JDK}}</td></tr>
+</table>
+{{- end}}
+<h2>Phases</h2>
+<table>
+{{- range .Phases}}
+<tr><th>{{.Name}}</th><td>{{.Duration}}</td></tr>
+{{- end}}
+<tr><th>total</th><td>{{.Total}}</td></tr>
+</table>
+</body>
+</html>
+`
+
+// writeBuildReport writes a report of result in format, txt or html, to w.
+// The versions in lock are included if it is not nil.
+func writeBuildReport(w io.Writer, format string, result *BuildResult, lock *Lock) error {
+	data := reportData{BuildResult: result, Lock: lock}
+	for _, abi := range result.ABIs {
+		data.Libs = append(data.Libs, reportLib{ABI: abi, Size: result.LibSizes[abi], Registration: result.JNIRegistration[abi]})
+	}
+
+	funcs := map[string]interface{}{"join": strings.Join}
+	switch format {
+	case "txt":
+		return template.Must(template.New("report").Funcs(funcs).Parse(textReport)).Execute(w, data)
+	case "html":
+		return htmltemplate.Must(htmltemplate.New("report").Funcs(funcs).Parse(htmlReport)).Execute(w, data)
+	}
+	return checkReportFormat(format)
+}
+
+// WriteBuildReport writes a report of result in format, txt or html, to
+// path. The report summarizes the arches and assets in the aar, the sizes of
+// its native libraries, the versions of the tools in lock and how long each
+// phase of the build took.
+func WriteBuildReport(f *Flags, path, format string, result *BuildResult, lock *Lock) error {
+	buf := &bytes.Buffer{}
+	if err := writeBuildReport(buf, format, result, lock); err != nil {
+		return err
+	}
+	return WriteFile(f, path, buf)
+}
@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildReport(t *testing.T) {
+	result := &BuildResult{
+		AARPath:         "out/example.aar",
+		ABIs:            []string{"armeabi-v7a", "arm64-v8a"},
+		JNIRegistration: map[string]string{"armeabi-v7a": "static", "arm64-v8a": "static"},
+		LibSizes:        map[string]int64{"armeabi-v7a": 3000, "arm64-v8a": 4000},
+		Assets:          2,
+		AssetBytes:      300,
+		Size:            5000,
+		Phases:          []BuildPhase{{"native", 2 * time.Second}, {"java", time.Second}, {"package", 500 * time.Millisecond}},
+	}
+	lock := &Lock{Matcha: "(devel)", Go: "go version go1.12.5 linux/amd64", NDK: "19.2.5345600", JDK: "javac 1.8.0_252"}
+
+	buf := &bytes.Buffer{}
+	if err := writeBuildReport(buf, "txt", result, lock); err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []string{
+		"ABIs:     armeabi-v7a, arm64-v8a\n",
+		"Assets:   2 files, 300 bytes\n",
+		"  arm64-v8a    4000 bytes, static JNI registration\n",
+		"  ndk     19.2.5345600\n",
+		"  native   2s\n",
+		"  total    3.5s\n",
+	} {
+		if !strings.Contains(buf.String(), i) {
+			t.Errorf("Report is missing %q:\n%s", i, buf.String())
+		}
+	}
+
+	buf.Reset()
+	result.AARPath = "out/<example>.aar"
+	if err := writeBuildReport(buf, "html", result, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "out/&lt;example&gt;.aar") || strings.Contains(buf.String(), "Versions") {
+		t.Errorf("Unexpected html report:\n%s", buf.String())
+	}
+
+	if err := writeBuildReport(buf, "pdf", result, lock); err == nil {
+		t.Error("Expected error for an unsupported format")
+	}
+	if path := ReportPath("out/example.aar", "txt"); path != "out/example-build-report.txt" {
+		t.Errorf("ReportPath() = %v", path)
+	}
+}
@@ -0,0 +1,234 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// buildScript records the commands and file operations of a build as a
+// standalone shell script, or a batch file when windows is set, see
+// Flags.EmitScript.
+type buildScript struct {
+	windows bool
+	buf     bytes.Buffer
+}
+
+func newBuildScript(goos string) *buildScript {
+	return &buildScript{windows: goos == "windows"}
+}
+
+// heredocEnd ends the contents of files written by shell scripts.
+const heredocEnd = "MATCHA_EOF"
+
+// quote quotes arg for the script's shell.
+func (s *buildScript) quote(arg string) string {
+	if s.windows {
+		if arg != "" && !strings.ContainsAny(arg, " \t&|<>^()%!\"") {
+			return arg
+		}
+		return `"` + strings.Replace(arg, `"`, `""`, -1) + `"`
+	}
+	if arg != "" && strings.Trim(arg, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_=+/.,:@") == "" {
+		return arg
+	}
+	return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+}
+
+func (s *buildScript) join(args []string) string {
+	quoted := make([]string, 0, len(args))
+	for _, i := range args {
+		quoted = append(quoted, s.quote(i))
+	}
+	return strings.Join(quoted, " ")
+}
+
+// line adds a command to the script, stopping the batch file if it fails.
+// Shell scripts stop on failure with set -e.
+func (s *buildScript) line(format string, args ...interface{}) {
+	fmt.Fprintf(&s.buf, format+"\n", args...)
+	if s.windows {
+		s.buf.WriteString("if errorlevel 1 exit /b 1\n")
+	}
+}
+
+// command adds cmd, run in cmd.Dir with cmd.Env added to the environment.
+func (s *buildScript) command(cmd *exec.Cmd) {
+	if s.windows {
+		s.buf.WriteString("setlocal\n")
+		for _, i := range cmd.Env {
+			fmt.Fprintf(&s.buf, "set %s\n", s.quote(i))
+		}
+		if cmd.Dir != "" {
+			s.line("pushd %s", s.quote(cmd.Dir))
+		}
+		s.line("%s", s.join(cmd.Args))
+		if cmd.Dir != "" {
+			s.buf.WriteString("popd\n")
+		}
+		s.buf.WriteString("endlocal\n")
+		return
+	}
+
+	str := ""
+	for _, i := range cmd.Env {
+		kv := strings.SplitN(i, "=", 2)
+		if len(kv) == 2 {
+			str += kv[0] + "=" + s.quote(kv[1]) + " "
+		}
+	}
+	str += s.join(cmd.Args)
+	if cmd.Dir != "" {
+		str = fmt.Sprintf("(cd %s && %s)", s.quote(cmd.Dir), str)
+	}
+	s.line("%s", str)
+}
+
+func (s *buildScript) mkdir(dir string) {
+	if s.windows {
+		s.line(`if not exist %s mkdir %s`, s.quote(dir), s.quote(dir))
+		return
+	}
+	s.line("mkdir -p %s", s.quote(dir))
+}
+
+func (s *buildScript) copy(dst, src string) {
+	s.mkdir(filepath.Dir(dst))
+	if s.windows {
+		s.line("copy /y %s %s >nul", s.quote(src), s.quote(dst))
+		return
+	}
+	s.line("cp %s %s", s.quote(src), s.quote(dst))
+}
+
+func (s *buildScript) remove(path string) {
+	if s.windows {
+		s.line(`if exist %s\* (rmdir /s /q %s) else if exist %s del /f /q %s`, s.quote(path), s.quote(path), s.quote(path), s.quote(path))
+		return
+	}
+	s.line("rm -r -f %s", s.quote(path))
+}
+
+// write adds the creation of the file at path with data. Text is written
+// with a here-document in shell scripts, anything else is base64 encoded.
+func (s *buildScript) write(path string, data []byte) {
+	s.mkdir(filepath.Dir(path))
+	text := utf8.Valid(data) && bytes.IndexByte(data, 0) < 0 && !bytes.Contains(data, []byte(heredocEnd))
+	if !s.windows && text && (len(data) == 0 || data[len(data)-1] == '\n') {
+		fmt.Fprintf(&s.buf, "cat > %s <<'%s'\n%s%s\n", s.quote(path), heredocEnd, data, heredocEnd)
+		return
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(data)
+	lines := []string{}
+	for len(encoded) > 76 {
+		lines = append(lines, encoded[:76])
+		encoded = encoded[76:]
+	}
+	lines = append(lines, encoded)
+
+	if s.windows {
+		b64 := s.quote(path + ".b64")
+		s.buf.WriteString("(\n")
+		for _, i := range lines {
+			fmt.Fprintf(&s.buf, "echo %s\n", i)
+		}
+		fmt.Fprintf(&s.buf, ") > %s\n", b64)
+		s.line("certutil -f -decode %s %s >nul", b64, s.quote(path))
+		s.buf.WriteString("del " + b64 + "\n")
+		return
+	}
+	fmt.Fprintf(&s.buf, "base64 --decode > %s <<'%s'\n%s\n%s\n", s.quote(path), heredocEnd, strings.Join(lines, "\n"), heredocEnd)
+}
+
+// zip adds the creation of the zip file dst from the contents of dir.
+func (s *buildScript) zip(dst, dir string) {
+	if s.windows {
+		tmp := dst + ".zip"
+		s.line(`powershell -NoProfile -Command "Compress-Archive -Force -Path '%s\*' -DestinationPath '%s'"`, dir, tmp)
+		s.line("move /y %s %s >nul", s.quote(tmp), s.quote(dst))
+		return
+	}
+	s.line("rm -f %s", s.quote(dst))
+	s.line("(cd %s && zip -q -X -r %s .)", s.quote(dir), s.quote(dst))
+}
+
+// Bytes returns the script.
+func (s *buildScript) Bytes() []byte {
+	header := "#!/bin/sh\n# Generated by matcha, reproduces a build without it.\nset -e\n\n"
+	if s.windows {
+		header = "@echo off\nrem Generated by matcha, reproduces a build without it.\n\n"
+	}
+	return append([]byte(header), s.buf.Bytes()...)
+}
+
+// copyDir adds copying the contents of src into dst.
+func (s *buildScript) copyDir(dst, src string) {
+	s.mkdir(dst)
+	if s.windows {
+		s.line("xcopy /e /i /y /q %s %s >nul", s.quote(src), s.quote(dst))
+		return
+	}
+	s.line("cp -R %s %s", s.quote(src+"/."), s.quote(dst))
+}
+
+// scriptAAR records the entries of an aar as BuildAAR writes them, so that
+// a buildScript can assemble the same entries with zip.
+type scriptAAR struct {
+	names   []string
+	sources map[string]string        // entries copied from files
+	data    map[string]*bytes.Buffer // entries generated by the build
+}
+
+func newScriptAAR() *scriptAAR {
+	return &scriptAAR{sources: map[string]string{}, data: map[string]*bytes.Buffer{}}
+}
+
+// add records the entry name, and returns w writing its contents to the
+// record too. It returns w unchanged if a is nil.
+func (a *scriptAAR) add(name string, w io.Writer) io.Writer {
+	if a == nil {
+		return w
+	}
+	a.names = append(a.names, name)
+	buf := &bytes.Buffer{}
+	a.data[name] = buf
+	return io.MultiWriter(w, buf)
+}
+
+// source records that the entry name is a copy of the file at path.
+func (a *scriptAAR) source(name, path string) {
+	if a != nil {
+		a.sources[name] = path
+	}
+}
+
+// aar adds the assembly of the entries of a into the aar at dst, staging
+// them in stageDir. classes.jar is built from classesDir and the jar's
+// manifest, or written as recorded if classesDir is empty.
+func (s *buildScript) aar(dst, stageDir string, a *scriptAAR, classesDir string, manifest []byte) {
+	s.remove(stageDir)
+	for _, name := range a.names {
+		path := filepath.Join(stageDir, filepath.FromSlash(name))
+		switch src, ok := a.sources[name]; {
+		case ok:
+			s.copy(path, src)
+		case strings.HasSuffix(name, "/"):
+			s.mkdir(path)
+		case name == "classes.jar" && classesDir != "":
+			jarDir := filepath.Join(filepath.Dir(stageDir), filepath.Base(stageDir)+"-classes")
+			s.remove(jarDir)
+			s.write(filepath.Join(jarDir, "META-INF", "MANIFEST.MF"), manifest)
+			s.copyDir(jarDir, classesDir)
+			s.zip(path, jarDir)
+		default:
+			s.write(path, a.data[name].Bytes())
+		}
+	}
+	s.zip(dst, stageDir)
+}
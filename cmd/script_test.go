@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBuildScriptQuote(t *testing.T) {
+	sh := newBuildScript("linux")
+	bat := newBuildScript("windows")
+	for arg, want := range map[string][2]string{
+		"-o=lib/libgojni.so": {"-o=lib/libgojni.so", "-o=lib/libgojni.so"},
+		"a b":                {"'a b'", `"a b"`},
+		"it's":               {`'it'\''s'`, "it's"},
+		"":                   {"''", `""`},
+	} {
+		if got := sh.quote(arg); got != want[0] {
+			t.Errorf("sh quote(%q) = %s, expected %s", arg, got, want[0])
+		}
+		if got := bat.quote(arg); got != want[1] {
+			t.Errorf("batch quote(%q) = %s, expected %s", arg, got, want[1])
+		}
+	}
+}
+
+func TestBuildScript(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found")
+	}
+	dir, err := ioutil.TempDir("", "matcha-script")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f := &Flags{Logger: log.New(ioutil.Discard, "", 0), script: newBuildScript("linux")}
+	out := filepath.Join(dir, "out dir")
+	if err := WriteFile(f, filepath.Join(out, "text.txt"), strings.NewReader("it's text\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(f, filepath.Join(out, "binary"), strings.NewReader("\x00\x01")); err != nil {
+		t.Fatal(err)
+	}
+	if err := CopyFile(f, filepath.Join(out, "copy", "text.txt"), filepath.Join(out, "text.txt")); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("sh", "-c", `echo "$GREETING" > greeting`)
+	cmd.Dir = out
+	cmd.Env = []string{"GREETING=hello world"}
+	if err := RunCmd(f, "", cmd); err != nil {
+		t.Fatal(err)
+	}
+
+	// Running the script recreates the outputs.
+	if err := os.RemoveAll(out); err != nil {
+		t.Fatal(err)
+	}
+	script := filepath.Join(dir, "build.sh")
+	if err := ioutil.WriteFile(script, f.script.Bytes(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command("sh", script).CombinedOutput(); err != nil {
+		t.Fatalf("%v\n%s\n%s", err, out, f.script.Bytes())
+	}
+	for name, want := range map[string]string{
+		"text.txt":      "it's text\n",
+		"binary":        "\x00\x01",
+		"copy/text.txt": "it's text\n",
+		"greeting":      "hello world\n",
+	} {
+		data, err := ioutil.ReadFile(filepath.Join(out, filepath.FromSlash(name)))
+		if err != nil {
+			t.Error(err)
+		} else if string(data) != want {
+			t.Errorf("%s = %q, expected %q", name, data, want)
+		}
+	}
+
+	if err := (&Flags{EmitScript: "build.sh", BuildN: true}).Validate(); err == nil {
+		t.Error("Expected error for emitting a script with -n")
+	}
+}
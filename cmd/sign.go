@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// signAARs signs the aar at dst, and its native aars for abis if
+// f.SplitNative is set, with SignAAR, returning the paths of the signatures.
+// BuildAAR calls it once the aar is written, and Bind once the aars are split
+// and copied to their destination, so the signatures are of the files that
+// are shipped.
+func signAARs(f *Flags, dst string, abis []string, tmpdir string) ([]string, error) {
+	paths := []string{dst}
+	if f.SplitNative {
+		for _, abi := range abis {
+			paths = append(paths, NativeAARPath(dst, abi))
+		}
+	}
+	sigs := []string{}
+	for _, i := range paths {
+		sig, err := SignAAR(f, i, tmpdir)
+		if err != nil {
+			return nil, fmt.Errorf("signing %s: %v", i, err)
+		}
+		sigs = append(sigs, sig)
+	}
+	return sigs, nil
+}
+
+// SignAAR writes a detached signature of the aar at aarPath with the secret
+// key at f.SignKey, returning the path of the signature. Minisign keys, which
+// start with an untrusted comment, are used by minisign to write aarPath.sig,
+// and other keys are imported into a keyring in tmpdir for gpg to write an
+// ASCII armored aarPath.asc. Both run through f.Runner without a terminal, so
+// the key must not need a password to be typed. Consumers verify the aar with
+//
+//	gpg --verify lib.aar.asc lib.aar
+//	minisign -V -p minisign.pub -m lib.aar -x lib.aar.sig
+func SignAAR(f *Flags, aarPath, tmpdir string) (string, error) {
+	key, err := ReadFile(f, f.SignKey)
+	if err != nil {
+		return "", err
+	}
+	if bytes.HasPrefix(key, []byte("untrusted comment:")) {
+		sig := aarPath + ".sig"
+		cmd := exec.Command("minisign", "-S", "-s", f.SignKey, "-m", aarPath, "-x", sig)
+		return sig, RunCmd(f, tmpdir, cmd)
+	}
+
+	// A keyring of its own leaves the user's keyring unchanged.
+	home := filepath.Join(tmpdir, "gnupg")
+	if err := Mkdir(f, home); err != nil {
+		return "", err
+	}
+	if f.ShouldRun() {
+		// gpg refuses to use a home directory others can read.
+		if err := os.Chmod(home, 0700); err != nil {
+			return "", err
+		}
+	}
+	if err := RunCmd(f, tmpdir, exec.Command("gpg", "--batch", "--homedir", home, "--import", f.SignKey)); err != nil {
+		return "", err
+	}
+	sig := aarPath + ".asc"
+	cmd := exec.Command("gpg", "--batch", "--homedir", home, "--yes", "--armor", "--detach-sign", "--output", sig, aarPath)
+	return sig, RunCmd(f, tmpdir, cmd)
+}
@@ -0,0 +1,407 @@
+package cmd
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// verifyPackage is the Android package of the sample app built by Verify.
+const verifyPackage = "io.gomatcha.verify"
+
+const verifyManifestFmt = `<manifest xmlns:android="http://schemas.android.com/apk/res/android" package="io.gomatcha.verify">
+<uses-sdk android:minSdkVersion="%d" android:targetSdkVersion="%d"/>
+<application android:label="Matcha Verify">
+<activity android:name=".VerifyActivity" android:exported="true">
+<intent-filter>
+<action android:name="android.intent.action.MAIN"/>
+<category android:name="android.intent.category.LAUNCHER"/>
+</intent-filter>
+</activity>
+</application>
+</manifest>
+`
+
+// verifyActivitySource loads libgojni.so through GoValue, calls one of its
+// native methods and logs the result.
+const verifyActivitySource = `// Code generated by matcha. DO NOT EDIT.
+
+package io.gomatcha.verify;
+
+import android.app.Activity;
+import android.os.Bundle;
+import android.util.Log;
+
+public class VerifyActivity extends Activity {
+    @Override
+    protected void onCreate(Bundle savedInstanceState) {
+        super.onCreate(savedInstanceState);
+        try {
+            io.gomatcha.bridge.GoValue.WithInt(1);
+            Log.i("MatchaVerify", "OK");
+        } catch (Throwable t) {
+            Log.e("MatchaVerify", "FAIL " + t);
+        }
+        finish();
+    }
+}
+`
+
+// verifyLogRegexp matches the result logged by VerifyActivity.
+var verifyLogRegexp = regexp.MustCompile(`MatchaVerify[^:]*: (OK|FAIL.*)`)
+
+// verifyTimeout is how long Verify waits for the sample app to log a result.
+const verifyTimeout = 30 * time.Second
+
+// Verify builds the Android library for args, packages it into a sample app
+// that loads libgojni.so and calls one of its functions, and runs the app on
+// the device or emulator connected with adb. It returns an error if the app
+// does not report success.
+func Verify(f *Flags, args []string) error {
+	if err := f.Validate(); err != nil {
+		return err
+	}
+	tempdir, err := NewTmpDir(f, "")
+	if err != nil {
+		return err
+	}
+	if !f.BuildWork {
+		defer RemoveAll(f, tempdir)
+	}
+
+	bf := *f
+	bf.BuildTargets = "android"
+	bf.BuildAllVariants = false
+	bf.MinSDKVariants = nil
+	bf.OutputDir = filepath.Join(tempdir, "aar")
+	if err := Build(&bf, args); err != nil {
+		return err
+	}
+
+	aarPath := filepath.Join(bf.OutputDir, "*.aar")
+	if f.ShouldRun() {
+		matches, err := filepath.Glob(aarPath)
+		if err != nil {
+			return err
+		}
+		if len(matches) != 1 {
+			return fmt.Errorf("expected one aar in %s, found %d", bf.OutputDir, len(matches))
+		}
+		aarPath = matches[0]
+	}
+
+	apkPath, err := buildVerifyAPK(f, aarPath, tempdir)
+	if err != nil {
+		return err
+	}
+	return runVerifyAPK(f, apkPath, tempdir)
+}
+
+// buildVerifyAPK builds and signs the sample app for the aar at aarPath, using
+// the tools from the latest SDK build-tools.
+func buildVerifyAPK(f *Flags, aarPath, tempdir string) (string, error) {
+	platform, err := AndroidPlatformPath(f)
+	if err != nil {
+		return "", err
+	}
+	androidJar := filepath.Join(platform, "android.jar")
+	targetSDK, _ := strconv.Atoi(strings.TrimPrefix(filepath.Base(platform), "android-"))
+	if f.TargetSDK != 0 {
+		targetSDK = f.TargetSDK
+	}
+	minSDK, err := androidMinSDK(f)
+	if err != nil {
+		return "", err
+	}
+	buildTools, err := AndroidBuildToolsPath(f)
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(tempdir, "verify")
+	manifestPath := filepath.Join(dir, "AndroidManifest.xml")
+	if err := WriteFile(f, manifestPath, strings.NewReader(fmt.Sprintf(verifyManifestFmt, minSDK, targetSDK))); err != nil {
+		return "", err
+	}
+	srcDir := filepath.Join(dir, "src")
+	if err := WriteFile(f, filepath.Join(srcDir, "io", "gomatcha", "verify", "VerifyActivity.java"), strings.NewReader(verifyActivitySource)); err != nil {
+		return "", err
+	}
+	if err := extractVerifyAAR(f, aarPath, dir); err != nil {
+		return "", err
+	}
+
+	// Compile the activity against the aar's classes and dex them together.
+	classesDir := filepath.Join(dir, "classes")
+	if err := Mkdir(f, classesDir); err != nil {
+		return "", err
+	}
+	args := append(javacArgs(f, classesDir, androidJar),
+		"-classpath", filepath.Join(dir, "classes.jar"),
+		filepath.Join("io", "gomatcha", "verify", "VerifyActivity.java"),
+	)
+	javac := exec.Command("javac", args...)
+	javac.Dir = srcDir
+	if err := RunCmd(f, tempdir, javac); err != nil {
+		return "", err
+	}
+	dexDir := filepath.Join(dir, "dex")
+	if err := Mkdir(f, dexDir); err != nil {
+		return "", err
+	}
+	d8 := exec.Command(filepath.Join(buildTools, "d8"),
+		"--min-api", strconv.Itoa(minSDK),
+		"--lib", androidJar,
+		"--output", dexDir,
+		filepath.Join(classesDir, "io", "gomatcha", "verify", "VerifyActivity.class"),
+		filepath.Join(dir, "classes.jar"),
+	)
+	if err := RunCmd(f, tempdir, d8); err != nil {
+		return "", err
+	}
+
+	// Link the manifest, add the dex and native libraries, then align and sign.
+	baseAPK := filepath.Join(dir, "base.apk")
+	aapt2 := exec.Command(filepath.Join(buildTools, "aapt2"), "link", "-o", baseAPK, "--manifest", manifestPath, "-I", androidJar)
+	if err := RunCmd(f, tempdir, aapt2); err != nil {
+		return "", err
+	}
+	unsignedAPK := filepath.Join(dir, "unsigned.apk")
+	if err := addAPKEntries(f, unsignedAPK, baseAPK, map[string]string{
+		"classes.dex": filepath.Join(dexDir, "classes.dex"),
+		"lib":         filepath.Join(dir, "lib"),
+	}); err != nil {
+		return "", err
+	}
+	alignedAPK := filepath.Join(dir, "aligned.apk")
+	if err := RunCmd(f, tempdir, exec.Command(filepath.Join(buildTools, "zipalign"), "-f", "-p", "4", unsignedAPK, alignedAPK)); err != nil {
+		return "", err
+	}
+	keystore := filepath.Join(dir, "debug.keystore")
+	keytool := exec.Command("keytool", "-genkeypair", "-noprompt",
+		"-keystore", keystore, "-storepass", "android",
+		"-alias", "androiddebugkey", "-keypass", "android",
+		"-keyalg", "RSA", "-validity", "1", "-dname", "CN=Matcha Verify",
+	)
+	if err := RunCmd(f, tempdir, keytool); err != nil {
+		return "", err
+	}
+	apkPath := filepath.Join(dir, "verify.apk")
+	apksigner := exec.Command(filepath.Join(buildTools, "apksigner"), "sign", "--ks", keystore, "--ks-pass", "pass:android", "--out", apkPath, alignedAPK)
+	if err := RunCmd(f, tempdir, apksigner); err != nil {
+		return "", err
+	}
+	return apkPath, nil
+}
+
+// extractVerifyAAR copies classes.jar and the native libraries of the aar at
+// aarPath into dir, with the libraries under lib/ as they are laid out in an
+// apk.
+func extractVerifyAAR(f *Flags, aarPath, dir string) error {
+	if f.ShouldPrint() {
+		f.Logger.Printf("unzip -d %s %s\n", dir, aarPath)
+	}
+	if !f.ShouldRun() {
+		return nil
+	}
+
+	r, err := zip.OpenReader(aarPath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	for _, file := range r.File {
+		var dst string
+		switch {
+		case file.Name == "classes.jar":
+			dst = filepath.Join(dir, "classes.jar")
+		case strings.HasPrefix(file.Name, "jni/") && strings.HasSuffix(file.Name, ".so"):
+			dst = filepath.Join(dir, "lib", filepath.FromSlash(strings.TrimPrefix(file.Name, "jni/")))
+		default:
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		data, err := readZipFile(file)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(dst, data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addAPKEntries writes a copy of the apk at src to dst with extra entries.
+// extra maps entry names to files, or to directories whose files are added
+// under the entry name.
+func addAPKEntries(f *Flags, dst, src string, extra map[string]string) error {
+	names := make([]string, 0, len(extra))
+	for name := range extra {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if f.ShouldPrint() {
+		f.Logger.Printf("cp %s %s\n", src, dst)
+		for _, name := range names {
+			f.Logger.Printf("zip %s %s=%s\n", dst, name, extra[name])
+		}
+	}
+	if !f.ShouldRun() {
+		return nil
+	}
+
+	r, err := zip.OpenReader(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	w := zip.NewWriter(out)
+	if err := copyZipFiles(w, r.File); err != nil {
+		return err
+	}
+
+	create := func(name string) (io.Writer, error) {
+		return w.Create(name)
+	}
+	for _, name := range names {
+		path := extra[name]
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			err = writeFileEntry(create, name, path)
+		} else {
+			err = filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+				if err != nil || info.IsDir() {
+					return err
+				}
+				return writeFileEntry(create, name+"/"+filepath.ToSlash(p[len(path)+1:]), p)
+			})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// runVerifyAPK installs the sample app with adb, launches it and waits for it
+// to log its result.
+func runVerifyAPK(f *Flags, apkPath, tempdir string) error {
+	sdk, err := AndroidSDKPath(f)
+	if err != nil {
+		return err
+	}
+	adb := filepath.Join(sdk, "platform-tools", "adb")
+	if !IsFile(f, adb) {
+		return errors.New("adb was not found in $ANDROID_HOME/platform-tools, install the SDK platform tools")
+	}
+
+	if err := RunCmd(f, tempdir, exec.Command(adb, "install", "-r", apkPath)); err != nil {
+		return fmt.Errorf("installing the sample app, is a device connected? %v", err)
+	}
+	defer RunCmd(f, tempdir, exec.Command(adb, "uninstall", verifyPackage))
+	if err := RunCmd(f, tempdir, exec.Command(adb, "logcat", "-c")); err != nil {
+		return err
+	}
+	if err := RunCmd(f, tempdir, exec.Command(adb, "shell", "am", "start", "-W", "-n", verifyPackage+"/.VerifyActivity")); err != nil {
+		return err
+	}
+
+	for start := time.Now(); time.Since(start) < verifyTimeout; time.Sleep(time.Second) {
+		out, err := OutputCmd(f, []byte("I/MatchaVerify: OK"), tempdir, exec.Command(adb, "logcat", "-d", "-s", "MatchaVerify"))
+		if err != nil {
+			return err
+		}
+		if m := verifyLogRegexp.FindSubmatch(out); m != nil {
+			if string(m[1]) != "OK" {
+				return fmt.Errorf("sample app failed to call into Go: %s", m[1])
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("sample app did not report a result within %v", verifyTimeout)
+}
+
+// AndroidBuildToolsPath returns the latest version of the build-tools
+// installed in the android SDK.
+func AndroidBuildToolsPath(f *Flags) (string, error) {
+	sdk, err := AndroidSDKPath(f)
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(sdk, "build-tools")
+	names, err := ReadDirNames(f, dir)
+	if err != nil {
+		return "", fmt.Errorf("no build-tools in the Android SDK, install them with the SDK manager: %v", err)
+	}
+	if !f.ShouldRun() {
+		names = []string{"$BUILD_TOOLS_VERSION"}
+	}
+
+	latest := ""
+	var latestVer []int
+	for _, i := range names {
+		ver := parseBuildToolsVersion(i)
+		if ver == nil && f.ShouldRun() {
+			f.tracef("%s: skipped, not a version", filepath.Join(dir, i))
+			continue
+		}
+		if latest == "" || versionLess(latestVer, ver) {
+			latest, latestVer = i, ver
+		}
+	}
+	if latest == "" {
+		return "", errors.New("no build-tools in the Android SDK, install them with the SDK manager")
+	}
+	f.tracef("build-tools: %s", filepath.Join(dir, latest))
+	return filepath.Join(dir, latest), nil
+}
+
+// parseBuildToolsVersion returns the numeric components of a build-tools
+// directory name, e.g. 30.0.3, or nil if it is not a version. Release
+// candidates such as 31.0.0-rc1 are ignored.
+func parseBuildToolsVersion(name string) []int {
+	ver := []int{}
+	for _, i := range strings.Split(name, ".") {
+		n, err := strconv.Atoi(i)
+		if err != nil {
+			return nil
+		}
+		ver = append(ver, n)
+	}
+	return ver
+}
+
+// versionLess reports whether version a is older than b.
+func versionLess(a, b []int) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return len(a) < len(b)
+}
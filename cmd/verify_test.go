@@ -0,0 +1,18 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"testing"
+)
+
+func TestAndroidBuildToolsPath(t *testing.T) {
+	sdk, cleanup := fakeSDK(t, "build-tools/28.0.3", "build-tools/30.0.3", "build-tools/30.0.10", "build-tools/31.0.0-rc1", "build-tools/9.0")
+	defer cleanup()
+
+	f := &Flags{Logger: log.New(ioutil.Discard, "", 0)}
+	if path, err := AndroidBuildToolsPath(f); err != nil || path != filepath.Join(sdk, "build-tools", "30.0.10") {
+		t.Errorf("AndroidBuildToolsPath() = %v, %v", path, err)
+	}
+}
@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// verifyJarSource loads and initializes every class in the directory given as
+// its argument, printing a FAIL line for each class that cannot be loaded,
+// linked or verified. Initializers that fail because libgojni.so cannot be
+// loaded are expected, as the native code is not available.
+const verifyJarSource = `// Code generated by matcha. DO NOT EDIT.
+
+import java.io.File;
+import java.util.ArrayList;
+import java.util.Arrays;
+import java.util.List;
+
+public class MatchaVerifyJar {
+    public static void main(String[] args) {
+        List<String> names = new ArrayList<String>();
+        collect(new File(args[0]), "", names);
+        ClassLoader loader = MatchaVerifyJar.class.getClassLoader();
+        int failed = 0;
+        for (String name : names) {
+            try {
+                Class<?> c = Class.forName(name, true, loader);
+                c.getDeclaredFields();
+                c.getDeclaredMethods();
+                c.getDeclaredConstructors();
+            } catch (ExceptionInInitializerError e) {
+                if (!(e.getCause() instanceof UnsatisfiedLinkError)) {
+                    System.out.println("FAIL " + name + ": " + e.getCause());
+                    failed++;
+                }
+            } catch (UnsatisfiedLinkError e) {
+            } catch (NoClassDefFoundError e) {
+                String msg = e.getMessage();
+                if (msg == null || !msg.startsWith("Could not initialize class")) {
+                    System.out.println("FAIL " + name + ": " + e);
+                    failed++;
+                }
+            } catch (Throwable e) {
+                System.out.println("FAIL " + name + ": " + e);
+                failed++;
+            }
+        }
+        System.out.println("checked " + names.size() + " classes, " + failed + " failed");
+        if (failed > 0) {
+            System.exit(1);
+        }
+    }
+
+    private static void collect(File dir, String pkg, List<String> names) {
+        File[] files = dir.listFiles();
+        if (files == null) {
+            return;
+        }
+        Arrays.sort(files);
+        for (File i : files) {
+            if (i.isDirectory()) {
+                collect(i, pkg + i.getName() + ".", names);
+            } else if (i.getName().endsWith(".class")) {
+                names.add(pkg + i.getName().substring(0, i.getName().length() - ".class".length()));
+            }
+        }
+    }
+}
+`
+
+// verifyJar loads the classes compiled into classesDir in a host JVM, with
+// the android.jar of the platform on the classpath, and returns an error
+// listing the classes that fail to load. This catches missing classes,
+// unsupported bytecode versions and linkage errors without a device, but
+// does not run any native code.
+func verifyJar(f *Flags, classesDir, tmpdir string) error {
+	bClspath, err := bootClasspath(f)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(tmpdir, "verify-jar")
+	if err := WriteFile(f, filepath.Join(dir, "MatchaVerifyJar.java"), strings.NewReader(verifyJarSource)); err != nil {
+		return err
+	}
+	javac := exec.Command("javac", "-d", dir, filepath.Join(dir, "MatchaVerifyJar.java"))
+	if err := RunCmd(f, tmpdir, javac); err != nil {
+		return err
+	}
+
+	classpath := strings.Join([]string{dir, classesDir, bClspath}, string(filepath.ListSeparator))
+	java := exec.Command("java", "-classpath", classpath, "MatchaVerifyJar", classesDir)
+	out, err := OutputCmd(f, nil, tmpdir, java)
+	if err != nil {
+		return err
+	}
+	if f.BuildV {
+		f.Logger.Printf("verify jar: %s", out)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifyJar(t *testing.T) {
+	for _, i := range []string{"java", "javac"} {
+		if _, err := exec.LookPath(i); err != nil {
+			t.Skipf("%s not found", i)
+		}
+	}
+	dir, err := ioutil.TempDir("", "matcha-verify-jar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	platform := filepath.Join(dir, "sdk", "platforms", "android-28")
+	writeTestAAR(t, mkdirTest(t, platform), "android.jar", map[string]string{"META-INF/MANIFEST.MF": "Manifest-Version: 1.0\n"})
+	androidHome := os.Getenv("ANDROID_HOME")
+	os.Setenv("ANDROID_HOME", filepath.Join(dir, "sdk"))
+	defer os.Setenv("ANDROID_HOME", androidHome)
+
+	src := mkdirTest(t, filepath.Join(dir, "src", "go"))
+	classes := mkdirTest(t, filepath.Join(dir, "classes"))
+	for name, content := range map[string]string{
+		"A.java": "package go; public class A { static { System.loadLibrary(\"gojni\"); } public B b; }",
+		"B.java": "package go; public class B {}",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(src, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	javac := exec.Command("javac", "-d", classes, filepath.Join(src, "A.java"), filepath.Join(src, "B.java"))
+	if out, err := javac.CombinedOutput(); err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+
+	f := &Flags{Logger: log.New(ioutil.Discard, "", 0)}
+	if err := verifyJar(f, classes, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// A refers to B, which is missing from the classes.
+	if err := os.Remove(filepath.Join(classes, "go", "B.class")); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyJar(f, classes, dir); err == nil {
+		t.Error("Expected error for a missing class")
+	}
+}
+
+// mkdirTest creates dir and returns it.
+func mkdirTest(t *testing.T, dir string) string {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}